@@ -0,0 +1,91 @@
+// Package audit records security relevant events, such as lockouts, in the
+// audit_events table.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Actions, kept in one place so queries over the log can rely on them.
+const (
+	ActionLoginLocked    = "login.locked"
+	ActionLoginIPBlocked = "login.ip_blocked"
+	ActionLockoutCleared = "login.lockout_cleared"
+
+	ActionMFAEnabled            = "mfa.enabled"
+	ActionMFADisabled           = "mfa.disabled"
+	ActionMFAReset              = "mfa.reset"
+	ActionRecoveryCodeUsed      = "mfa.recovery_code_used"
+	ActionRecoveryCodesReplaced = "mfa.recovery_codes_replaced"
+
+	ActionPasskeyAdded   = "passkey.added"
+	ActionPasskeyRemoved = "passkey.removed"
+	ActionPasskeyCloned  = "passkey.clone_warning"
+
+	ActionAccessTokenCreated = "access_token.created"
+	ActionAccessTokenRevoked = "access_token.revoked"
+
+	ActionOAuthConsentGranted = "oauth.consent_granted"
+	ActionOAuthTokenRevoked   = "oauth.token_revoked"
+)
+
+// Event is one entry of the audit log. ActorID is the user who caused the
+// event and is nil for events raised by sesamo itself; UserID is the account
+// the event is about. Both are plain ids so entries outlive the users.
+type Event struct {
+	ID        string         `db:"id"         json:"id"`
+	Action    string         `db:"action"     json:"action"`
+	ActorID   *string        `db:"actor_id"   json:"actor_id,omitempty"`
+	UserID    *string        `db:"user_id"    json:"user_id,omitempty"`
+	IP        *string        `db:"ip"         json:"ip,omitempty"`
+	Details   map[string]any `db:"-"          json:"details,omitempty"`
+	CreatedAt time.Time      `db:"created_at" json:"created_at"`
+}
+
+type Recorder interface {
+	Record(ctx context.Context, event Event) error
+}
+
+// Store is the Recorder writing to the database.
+type Store struct {
+	db *sqlx.DB
+}
+
+func NewStore(db *sqlx.DB) *Store {
+	return &Store{db: db}
+}
+
+func (store *Store) Record(ctx context.Context, event Event) error {
+	var details *string
+	if len(event.Details) > 0 {
+		raw, err := json.Marshal(event.Details)
+		if err != nil {
+			return fmt.Errorf("Record: %w", err)
+		}
+		encoded := string(raw)
+		details = &encoded
+	}
+
+	sqlQuery := `INSERT INTO audit_events (action, actor_id, user_id, ip, details)
+                          VALUES ($1, $2, $3, $4, COALESCE($5::jsonb, '{}'))`
+
+	_, err := store.db.ExecContext(
+		ctx,
+		sqlQuery,
+		event.Action,
+		event.ActorID,
+		event.UserID,
+		event.IP,
+		details,
+	)
+	if err != nil {
+		return fmt.Errorf("Record: %w", err)
+	}
+
+	return nil
+}
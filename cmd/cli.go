@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/diegodario88/sesamo/config"
+	"github.com/diegodario88/sesamo/db"
+	"github.com/diegodario88/sesamo/user"
+	"github.com/jmoiron/sqlx"
+)
+
+var errUsage = errors.New("usage")
+
+// command is a node of the sesamo command tree. Leaves have run set, groups
+// only dispatch to their subcommands.
+type command struct {
+	name        string
+	summary     string
+	run         func(ctx context.Context, cfg *config.Config, args []string) error
+	subcommands []*command
+}
+
+func (cmd *command) execute(
+	ctx context.Context,
+	cfg *config.Config,
+	path string,
+	args []string,
+) error {
+	if cmd.run != nil {
+		return cmd.run(ctx, cfg, args)
+	}
+
+	if len(args) == 0 || args[0] == "-h" || args[0] == "--help" || args[0] == "help" {
+		cmd.usage(os.Stderr, path)
+		return errUsage
+	}
+
+	for _, sub := range cmd.subcommands {
+		if sub.name == args[0] {
+			return sub.execute(ctx, cfg, path+" "+sub.name, args[1:])
+		}
+	}
+
+	cmd.usage(os.Stderr, path)
+	return fmt.Errorf("unknown command %q", path+" "+args[0])
+}
+
+func (cmd *command) usage(w io.Writer, path string) {
+	fmt.Fprintf(w, "Usage: %s <command> [flags]\n\n", path)
+	cmd.listSubcommands(w)
+}
+
+func (cmd *command) listSubcommands(w io.Writer) {
+	fmt.Fprintln(w, "Commands:")
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, sub := range cmd.subcommands {
+		fmt.Fprintf(tw, "  %s\t%s\n", sub.name, sub.summary)
+	}
+	tw.Flush()
+}
+
+// output renders command results either as JSON, for scripts, or as an
+// aligned table for people.
+type output struct {
+	format string
+	w      io.Writer
+}
+
+func newFlagSet(name string) (*flag.FlagSet, *output) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	out := &output{w: os.Stdout}
+	fs.StringVar(&out.format, "o", "text", "output format: text or json")
+
+	return fs, out
+}
+
+func (out *output) print(v any, header []string, rows [][]string) error {
+	switch out.format {
+	case "json":
+		encoder := json.NewEncoder(out.w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	case "text":
+		tw := tabwriter.NewWriter(out.w, 0, 4, 2, ' ', 0)
+		if len(header) > 0 {
+			fmt.Fprintln(tw, strings.Join(header, "\t"))
+		}
+		for _, row := range rows {
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown output format %q", out.format)
+	}
+}
+
+// app holds what the administrative commands need: a storage connection that
+// does not touch the schema and the services built on top of it.
+type app struct {
+	storage *sqlx.DB
+	users   user.UserService
+}
+
+func openApp(cfg *config.Config) (*app, error) {
+	storage, err := db.CreateStorageConn(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := user.NewUserService(storage, cfg)
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+
+	return &app{storage: storage, users: users}, nil
+}
+
+func (a *app) Close() error {
+	return a.storage.Close()
+}
+
+// findUser resolves a user from either its ULID or its email.
+func (a *app) findUser(ctx context.Context, id string, email string) (*user.UserEntity, error) {
+	switch {
+	case id != "":
+		return a.users.Repo.FindUserById(ctx, id)
+	case email != "":
+		return a.users.Repo.FindUserByEmail(ctx, email)
+	default:
+		return nil, fmt.Errorf("either -id or -email is required")
+	}
+}
+
+func requireFlags(fs *flag.FlagSet, names ...string) error {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var missing []string
+	for _, name := range names {
+		if !set[name] {
+			missing = append(missing, "-"+name)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("%s: missing required flags %s", fs.Name(), strings.Join(missing, ", "))
+	}
+
+	return nil
+}
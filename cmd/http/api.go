@@ -3,19 +3,25 @@ package api
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 
 	"github.com/diegodario88/sesamo/config"
+	"github.com/diegodario88/sesamo/health"
 	"github.com/diegodario88/sesamo/httphelper"
+	"github.com/diegodario88/sesamo/logging"
+	"github.com/diegodario88/sesamo/metrics"
 	"github.com/diegodario88/sesamo/user"
 	"github.com/gorilla/mux"
 	"github.com/jmoiron/sqlx"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
 )
 
 type APIServer struct {
 	port   int64
 	db     *sqlx.DB
+	cfg    *config.Config
+	checks *health.Registry
 	server *http.Server
 }
 
@@ -29,21 +35,43 @@ type Alive struct {
 	Info   Info
 }
 
-func NewServer(db *sqlx.DB) *APIServer {
+func NewServer(db *sqlx.DB, cfg *config.Config, checks *health.Registry) *APIServer {
 	return &APIServer{
-		port: config.Variables.Port,
-		db:   db,
+		port:   cfg.Port,
+		db:     db,
+		cfg:    cfg,
+		checks: checks,
 	}
 }
 
 func (api *APIServer) Run() error {
+	if err := metrics.RegisterStorage(api.db); err != nil {
+		return err
+	}
+
 	router := mux.NewRouter()
+	router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		httphelper.WriteProblem(w, httphelper.NotFound("no route matches this path"))
+	})
+	router.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		httphelper.WriteProblem(w, httphelper.NewProblem(
+			http.StatusMethodNotAllowed,
+			"method_not_allowed",
+			fmt.Sprintf("%s is not allowed on this path", r.Method),
+		))
+	})
+	router.Use(otelmux.Middleware(api.cfg.OtelServiceName, otelmux.WithFilter(isTraced)))
+	router.Use(metrics.HTTPMiddleware)
 	subrouter := router.PathPrefix("/api/v1").Subrouter()
 
-	user.NewHandler(user.NewUserService(api.db)).RegisterRoutes(subrouter)
+	userService, err := user.NewUserService(api.db, api.cfg)
+	if err != nil {
+		return err
+	}
+	user.NewHandler(userService).RegisterRoutes(subrouter)
 
 	liveness := func(w http.ResponseWriter, r *http.Request) {
-		log.Println("HTTP Server is alive!")
+		logging.FromContext(r.Context()).Debug("HTTP server is alive")
 		httphelper.WriteJSON(w, http.StatusOK, Alive{
 			Status: "ok",
 			Info:   Info{Service: "Sesamo", Condition: "up"},
@@ -51,26 +79,33 @@ func (api *APIServer) Run() error {
 	}
 
 	router.Handle("/live", http.HandlerFunc(liveness))
+	router.Handle("/ready", api.checks.ReadyHandler()).Methods("GET")
+	router.Handle("/health", api.checks.HealthHandler()).Methods("GET")
+	router.Handle("/metrics", metrics.Handler()).Methods("GET")
 
 	api.server = &http.Server{
 		Addr:    fmt.Sprintf(":%d", api.port),
-		Handler: router,
+		Handler: logging.HTTPHandler(router, slog.Default()),
 	}
 
-	log.Printf("API Server listening at http://localhost:%d", api.port)
+	slog.Info("API server listening", "addr", fmt.Sprintf("http://localhost:%d", api.port))
 
-	err := api.server.ListenAndServe()
-	if err != nil {
-		return err
-	}
+	return api.server.ListenAndServe()
+}
 
-	log.Printf("API Server listening at http://localhost:%d", api.port)
-	return nil
+// isTraced leaves probes and scrapes out of the traces.
+func isTraced(r *http.Request) bool {
+	switch r.URL.Path {
+	case "/live", "/ready", "/health", "/metrics":
+		return false
+	default:
+		return true
+	}
 }
 
 func (api *APIServer) Shutdown(ctx context.Context) error {
 	if api.server != nil {
-		log.Println("Calling gracefully http shutdown...")
+		slog.Info("Calling graceful HTTP shutdown")
 		return api.server.Shutdown(ctx)
 	}
 	return nil
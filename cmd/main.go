@@ -2,93 +2,64 @@ package main
 
 import (
 	"context"
-	"log"
-	"net/http"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
 	"os/signal"
-	"sync"
 	"syscall"
-	"time"
 
-	api "github.com/diegodario88/sesamo/cmd/http"
-	mq "github.com/diegodario88/sesamo/cmd/tcp"
-	"github.com/diegodario88/sesamo/db"
-	"github.com/diegodario88/sesamo/user"
+	"github.com/diegodario88/sesamo/config"
+	"github.com/diegodario88/sesamo/logging"
 )
 
 func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
-	storage, err := db.CreateStorageConn()
-	if err != nil {
-		log.Fatal(err)
+	root := &command{
+		name: "sesamo",
+		subcommands: []*command{
+			{name: "serve", summary: "run the HTTP API and the MQ listener", run: runServe},
+			migrateCommand(),
+			userCommand(),
+			roleCommand(),
+			orgCommand(),
+			mqCommand(),
+			tokenCommand(),
+			serviceAccountCommand(),
+			oauthClientCommand(),
+		},
 	}
 
-	var wg sync.WaitGroup
-
-	userConsumer := mq.WrapConsumer(user.NewConsumer(storage))
-	mqListener := mq.NewMqListener(storage).RegisterConsumer("create_user", userConsumer)
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		log.Println("Starting MQ listener...")
-		if err := mqListener.ListenForNotifications(ctx); err != nil && err != context.Canceled {
-			log.Printf("MQ listener error: %v", err)
-		} else if err == context.Canceled {
-			log.Println("MQ listener shut down successfully")
-		}
-	}()
-
-	httpServer := api.NewServer(storage)
+	globalFlags := flag.NewFlagSet(root.name, flag.ContinueOnError)
+	globalFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [config flags] <command> [flags]\n\n", root.name)
+		root.listSubcommands(os.Stderr)
+		fmt.Fprintln(os.Stderr, "\nConfig flags:")
+		globalFlags.PrintDefaults()
+	}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		if err := httpServer.Run(); err != nil && err != http.ErrServerClosed {
-			log.Printf("HTTP server error: %v", err)
+	cfg, err := config.Load(globalFlags, os.Args[1:])
+	if err == nil {
+		args := globalFlags.Args()
+		if len(args) == 0 {
+			args = []string{"serve"}
 		}
-		log.Println("HTTP server stopped")
-	}()
-
-	<-ctx.Done()
-	log.Println("Shutdown signal  received. Initiating graceful shutdown...")
 
-	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer shutdownCancel()
-
-	startTime := time.Now()
-	if err := httpServer.Shutdown(shutdownCtx); err != nil {
-		log.Printf("HTTP server shutdown error: %v", err)
-	} else {
-		log.Printf("HTTP server shutdown successful (took %v)", time.Since(startTime))
-	}
-
-	startTime = time.Now()
-	if err := mqListener.Shutdown(shutdownCtx, storage); err != nil {
-		log.Printf("MQ listener shutdown error: %v", err)
-	} else {
-		log.Printf("MQ listener shutdown successful (took %v)", time.Since(startTime))
+		slog.SetDefault(logging.New(os.Stderr, cfg))
+		err = root.execute(ctx, cfg, root.name, args)
 	}
 
-	waitCh := make(chan struct{})
-
-	go func() {
-		wg.Wait()
-		close(waitCh)
-	}()
-
-	select {
-	case <-waitCh:
-		log.Println("All services stopped successfully")
-	case <-time.After(15 * time.Second):
-		log.Println("Shutdown timed out, some services may not have stopped gracefully")
+	if err == nil {
+		return
 	}
 
-	log.Println("Closing storage ...")
-	if err := storage.Close(); err != nil {
-		log.Printf("Error closing database: %v", err)
+	if !errors.Is(err, errUsage) && !errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintf(os.Stderr, "sesamo: %v\n", err)
 	}
 
-	log.Println("Application shutdown completed")
+	stop()
+	os.Exit(1)
 }
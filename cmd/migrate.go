@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/diegodario88/sesamo/config"
+	"github.com/diegodario88/sesamo/db"
+	"github.com/pressly/goose/v3"
+)
+
+type migrationResult struct {
+	Version   int64  `json:"version"`
+	Name      string `json:"name"`
+	Direction string `json:"direction"`
+	Duration  string `json:"duration"`
+	Error     string `json:"error,omitempty"`
+}
+
+type migrationStatus struct {
+	Version   int64      `json:"version"`
+	Name      string     `json:"name"`
+	State     string     `json:"state"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+}
+
+func migrateCommand() *command {
+	return &command{
+		name:    "migrate",
+		summary: "apply, revert or inspect the embedded database migrations",
+		subcommands: []*command{
+			{name: "up", summary: "apply all pending migrations", run: runMigrateUp},
+			{name: "down", summary: "revert the most recent migration", run: runMigrateDown},
+			{name: "status", summary: "list migrations and whether they are applied", run: runMigrateStatus},
+		},
+	}
+}
+
+func withMigrator(
+	ctx context.Context,
+	cfg *config.Config,
+	fn func(provider *goose.Provider) error,
+) error {
+	storage, err := db.CreateStorageConn(cfg)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	provider, err := db.NewMigrator(storage)
+	if err != nil {
+		return err
+	}
+
+	return fn(provider)
+}
+
+func runMigrateUp(ctx context.Context, cfg *config.Config, args []string) error {
+	fs, out := newFlagSet("migrate up")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	return withMigrator(ctx, cfg, func(provider *goose.Provider) error {
+		results, err := provider.Up(ctx)
+		if printErr := printMigrationResults(out, results); printErr != nil {
+			return printErr
+		}
+
+		return err
+	})
+}
+
+func runMigrateDown(ctx context.Context, cfg *config.Config, args []string) error {
+	fs, out := newFlagSet("migrate down")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	return withMigrator(ctx, cfg, func(provider *goose.Provider) error {
+		result, err := provider.Down(ctx)
+		if errors.Is(err, goose.ErrNoNextVersion) {
+			return fmt.Errorf("no migration to revert")
+		}
+
+		var results []*goose.MigrationResult
+		if result != nil {
+			results = append(results, result)
+		}
+
+		if printErr := printMigrationResults(out, results); printErr != nil {
+			return printErr
+		}
+
+		return err
+	})
+}
+
+func runMigrateStatus(ctx context.Context, cfg *config.Config, args []string) error {
+	fs, out := newFlagSet("migrate status")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	return withMigrator(ctx, cfg, func(provider *goose.Provider) error {
+		statuses, err := provider.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		view := make([]migrationStatus, 0, len(statuses))
+		rows := make([][]string, 0, len(statuses))
+		for _, status := range statuses {
+			item := migrationStatus{
+				Version: status.Source.Version,
+				Name:    path.Base(status.Source.Path),
+				State:   string(status.State),
+			}
+
+			appliedAt := "-"
+			if !status.AppliedAt.IsZero() {
+				item.AppliedAt = &status.AppliedAt
+				appliedAt = status.AppliedAt.Format(time.RFC3339)
+			}
+
+			view = append(view, item)
+			rows = append(rows, []string{item.Name, item.State, appliedAt})
+		}
+
+		return out.print(view, []string{"MIGRATION", "STATE", "APPLIED AT"}, rows)
+	})
+}
+
+func printMigrationResults(out *output, results []*goose.MigrationResult) error {
+	view := make([]migrationResult, 0, len(results))
+	rows := make([][]string, 0, len(results))
+	for _, result := range results {
+		item := migrationResult{
+			Version:   result.Source.Version,
+			Name:      path.Base(result.Source.Path),
+			Direction: result.Direction,
+			Duration:  result.Duration.String(),
+		}
+		if result.Error != nil {
+			item.Error = result.Error.Error()
+		}
+
+		view = append(view, item)
+		rows = append(rows, []string{
+			strconv.FormatInt(item.Version, 10),
+			item.Name,
+			item.Direction,
+			item.Duration,
+		})
+	}
+
+	return out.print(view, []string{"VERSION", "MIGRATION", "DIRECTION", "DURATION"}, rows)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/diegodario88/sesamo/config"
+	"github.com/diegodario88/sesamo/user"
+)
+
+type createdOAuthClient struct {
+	*user.OAuthClient
+	ClientSecret string `json:"client_secret,omitempty"`
+}
+
+func oauthClientCommand() *command {
+	return &command{
+		name:    "oauth-client",
+		summary: "manage applications users sign in to through sesamo",
+		subcommands: []*command{
+			{name: "create", summary: "register an application", run: runOAuthClientCreate},
+			{name: "list", summary: "list registered applications", run: runOAuthClientList},
+			{name: "rotate-secret", summary: "replace the client secret", run: runOAuthClientRotate},
+			{name: "delete", summary: "delete an application", run: runOAuthClientDelete},
+		},
+	}
+}
+
+// runOAuthClientCreate prints the client secret of the new application, the
+// only time it is shown. Public applications have none.
+func runOAuthClientCreate(ctx context.Context, cfg *config.Config, args []string) error {
+	fs, out := newFlagSet("oauth-client create")
+	name := fs.String("name", "", "application name, shown on the consent screen")
+	redirectURIs := fs.String("redirect-uri", "", "comma separated redirect URIs")
+	public := fs.Bool("public", false, "the application cannot keep a secret, as SPAs and mobile apps")
+	firstParty := fs.Bool("first-party", false, "skip the consent screen and issue API access tokens")
+	introspect := fs.Bool("introspect", false, "allow the application to introspect tokens")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := requireFlags(fs, "name", "redirect-uri"); err != nil {
+		return err
+	}
+
+	a, err := openApp(cfg)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	client, secret, err := a.users.CreateOAuthClient(
+		ctx,
+		*name,
+		splitList(*redirectURIs),
+		*public,
+		*firstParty,
+		*introspect,
+	)
+	if err != nil {
+		return err
+	}
+
+	created := createdOAuthClient{OAuthClient: client, ClientSecret: secret}
+	return out.print(created, []string{"ID", "NAME", "CLIENT ID", "CLIENT SECRET"}, [][]string{
+		{client.ID, client.Name, client.ClientID, orDash(secret)},
+	})
+}
+
+func runOAuthClientList(ctx context.Context, cfg *config.Config, args []string) error {
+	fs, out := newFlagSet("oauth-client list")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	a, err := openApp(cfg)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	clients, err := a.users.Repo.FindOAuthClients(ctx)
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(clients))
+	for _, client := range clients {
+		kind := "confidential"
+		if client.Public() {
+			kind = "public"
+		}
+		party := "third-party"
+		if client.FirstParty {
+			party = "first-party"
+		}
+		rows = append(rows, []string{
+			client.ClientID,
+			client.Name,
+			kind,
+			party,
+			strings.Join(client.RedirectURIs, ","),
+		})
+	}
+
+	return out.print(clients, []string{"CLIENT ID", "NAME", "TYPE", "PARTY", "REDIRECT URIS"}, rows)
+}
+
+// runOAuthClientRotate also turns public applications into confidential
+// ones.
+func runOAuthClientRotate(ctx context.Context, cfg *config.Config, args []string) error {
+	fs, out := newFlagSet("oauth-client rotate-secret")
+	clientID := fs.String("client-id", "", "client ID of the application")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := requireFlags(fs, "client-id"); err != nil {
+		return err
+	}
+
+	a, err := openApp(cfg)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	secret, err := a.users.RotateOAuthClientSecret(ctx, *clientID)
+	if err != nil {
+		return err
+	}
+
+	result := map[string]string{"client_id": *clientID, "client_secret": secret}
+	return out.print(result, []string{"CLIENT ID", "CLIENT SECRET"}, [][]string{{*clientID, secret}})
+}
+
+func runOAuthClientDelete(ctx context.Context, cfg *config.Config, args []string) error {
+	fs, out := newFlagSet("oauth-client delete")
+	clientID := fs.String("client-id", "", "client ID of the application")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := requireFlags(fs, "client-id"); err != nil {
+		return err
+	}
+
+	a, err := openApp(cfg)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	if err := a.users.Repo.DeleteOAuthClient(ctx, *clientID); err != nil {
+		return err
+	}
+
+	result := map[string]string{"client_id": *clientID, "action": "delete"}
+	return out.print(result, []string{"CLIENT ID", "ACTION"}, [][]string{{*clientID, "delete"}})
+}
+
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
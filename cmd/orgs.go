@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/diegodario88/sesamo/config"
+	"github.com/diegodario88/sesamo/user"
+)
+
+// organizationImport is the shape of each entry of an import file: an
+// organization with its branches. Entries carrying an id update that
+// organization, branches are matched by CNPJ within it.
+type organizationImport struct {
+	user.OrganizationEntity
+	Branches []user.BranchEntity `json:"branches"`
+}
+
+func orgCommand() *command {
+	return &command{
+		name:    "org",
+		summary: "manage organizations",
+		subcommands: []*command{
+			{name: "create", summary: "create an organization", run: runOrgCreate},
+			{name: "import", summary: "create or update organizations and branches from a JSON file", run: runOrgImport},
+		},
+	}
+}
+
+func runOrgCreate(ctx context.Context, cfg *config.Config, args []string) error {
+	fs, out := newFlagSet("org create")
+	var org user.OrganizationEntity
+	fs.StringVar(&org.Name, "name", "", "organization name")
+	fs.StringVar(&org.Description, "description", "", "organization description")
+	fs.IntVar(&org.ExternalCompanyId, "external-company-id", 0, "company ID in the ERP")
+	fs.IntVar(&org.ExternalHeadOfficeId, "external-head-office-id", 0, "head office ID in the ERP")
+	fs.BoolVar(&org.RequireMFA, "require-mfa", false, "require MFA from every member")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := requireFlags(fs, "name"); err != nil {
+		return err
+	}
+
+	a, err := openApp(cfg)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	created, err := a.users.Repo.InsertOrganization(ctx, &org, nil)
+	if err != nil {
+		return err
+	}
+
+	return printOrganizations(out, created, []user.OrganizationEntity{*created})
+}
+
+func runOrgImport(ctx context.Context, cfg *config.Config, args []string) error {
+	fs, out := newFlagSet("org import")
+	file := fs.String("file", "", "path to a JSON array of organizations, - for stdin")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := requireFlags(fs, "file"); err != nil {
+		return err
+	}
+
+	input := os.Stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		input = f
+	}
+
+	var entries []organizationImport
+	if err := json.NewDecoder(input).Decode(&entries); err != nil {
+		return fmt.Errorf("parsing %s: %w", *file, err)
+	}
+
+	a, err := openApp(cfg)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	imported := make([]user.OrganizationEntity, 0, len(entries))
+	for i, entry := range entries {
+		org, err := a.users.Repo.InsertOrganization(ctx, &entry.OrganizationEntity, entry.Branches)
+		if err != nil {
+			return fmt.Errorf("entry %d (%s): %w", i, entry.Name, err)
+		}
+
+		imported = append(imported, *org)
+	}
+
+	return printOrganizations(out, imported, imported)
+}
+
+func printOrganizations(out *output, v any, orgs []user.OrganizationEntity) error {
+	rows := make([][]string, 0, len(orgs))
+	for _, org := range orgs {
+		rows = append(rows, []string{org.ID, org.Name, strconv.Itoa(org.ExternalCompanyId)})
+	}
+
+	return out.print(v, []string{"ID", "NAME", "EXTERNAL COMPANY"}, rows)
+}
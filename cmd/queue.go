@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	mq "github.com/diegodario88/sesamo/cmd/tcp"
+	"github.com/diegodario88/sesamo/config"
+	"github.com/jmoiron/sqlx"
+)
+
+type queueCount struct {
+	Queue    string `json:"queue"`
+	Action   string `json:"action"`
+	Messages int64  `json:"messages"`
+}
+
+// headerFlags collects repeated -header key=value flags.
+type headerFlags map[string]string
+
+func (h headerFlags) String() string {
+	pairs := make([]string, 0, len(h))
+	for key, value := range h {
+		pairs = append(pairs, key+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (h headerFlags) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("header must be key=value, got %q", value)
+	}
+	h[key] = val
+	return nil
+}
+
+func mqCommand() *command {
+	return &command{
+		name:    "mq",
+		summary: "inspect and operate the message queue",
+		subcommands: []*command{
+			{name: "publish", summary: "publish a message to an exchange", run: runMqPublish},
+			{name: "peek", summary: "list messages of a queue without consuming them", run: runMqPeek},
+			{name: "purge", summary: "delete the messages of a queue that are not in flight", run: runMqPurge},
+			{
+				name:    "dlq",
+				summary: "operate the messages that failed too many times",
+				subcommands: []*command{
+					{name: "replay", summary: "requeue the dead letters of a queue", run: runMqDlqReplay},
+				},
+			},
+		},
+	}
+}
+
+func runMqPublish(ctx context.Context, cfg *config.Config, args []string) error {
+	fs, out := newFlagSet("mq publish")
+	exchange := fs.String("exchange", "", "exchange name, e.g. users")
+	routingKey := fs.String("routing-key", "", "routing key, e.g. user.create")
+	body := fs.String("body", "", "JSON message body")
+	headers := headerFlags{}
+	fs.Var(headers, "header", "message header as key=value, repeatable")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := requireFlags(fs, "exchange", "routing-key", "body"); err != nil {
+		return err
+	}
+
+	if !json.Valid([]byte(*body)) {
+		return fmt.Errorf("mq publish: -body is not valid JSON")
+	}
+
+	a, err := openApp(cfg)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	err = mq.Publish(ctx, a.storage, *exchange, *routingKey, json.RawMessage(*body), headers)
+	if err != nil {
+		return err
+	}
+
+	published := map[string]any{
+		"exchange":    *exchange,
+		"routing_key": *routingKey,
+		"headers":     map[string]string(headers),
+	}
+
+	return out.print(published, []string{"EXCHANGE", "ROUTING KEY", "STATUS"}, [][]string{
+		{*exchange, *routingKey, "published"},
+	})
+}
+
+func runMqPeek(ctx context.Context, cfg *config.Config, args []string) error {
+	fs, out := newFlagSet("mq peek")
+	queue := fs.String("queue", "", "queue name, e.g. create_user")
+	limit := fs.Int("limit", 20, "maximum number of messages")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := requireFlags(fs, "queue"); err != nil {
+		return err
+	}
+
+	a, err := openApp(cfg)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	messages, err := mq.Peek(ctx, a.storage, *queue, *limit)
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(messages))
+	for _, message := range messages {
+		rows = append(rows, []string{
+			strconv.FormatInt(message.MessageID, 10),
+			message.RoutingKey,
+			message.State,
+			string(message.Body),
+		})
+	}
+
+	return out.print(messages, []string{"ID", "ROUTING KEY", "STATE", "BODY"}, rows)
+}
+
+func runMqPurge(ctx context.Context, cfg *config.Config, args []string) error {
+	return runQueueCount(ctx, cfg, args, "purge", mq.Purge)
+}
+
+func runMqDlqReplay(ctx context.Context, cfg *config.Config, args []string) error {
+	return runQueueCount(ctx, cfg, args, "dlq replay", mq.ReplayDeadLetters)
+}
+
+func runQueueCount(
+	ctx context.Context,
+	cfg *config.Config,
+	args []string,
+	action string,
+	fn func(context.Context, *sqlx.DB, string) (int64, error),
+) error {
+	fs, out := newFlagSet("mq " + action)
+	queue := fs.String("queue", "", "queue name, e.g. create_user")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := requireFlags(fs, "queue"); err != nil {
+		return err
+	}
+
+	a, err := openApp(cfg)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	count, err := fn(ctx, a.storage, *queue)
+	if err != nil {
+		return err
+	}
+
+	result := queueCount{Queue: *queue, Action: action, Messages: count}
+	return out.print(result, []string{"QUEUE", "ACTION", "MESSAGES"}, [][]string{
+		{result.Queue, result.Action, strconv.FormatInt(result.Messages, 10)},
+	})
+}
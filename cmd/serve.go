@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	api "github.com/diegodario88/sesamo/cmd/http"
+	mq "github.com/diegodario88/sesamo/cmd/tcp"
+	"github.com/diegodario88/sesamo/config"
+	"github.com/diegodario88/sesamo/db"
+	"github.com/diegodario88/sesamo/health"
+	"github.com/diegodario88/sesamo/tracing"
+	"github.com/diegodario88/sesamo/user"
+	"github.com/jmoiron/sqlx"
+	"github.com/pressly/goose/v3"
+)
+
+func runServe(ctx context.Context, cfg *config.Config, args []string) error {
+	fs, _ := newFlagSet("serve")
+	migrate := fs.Bool(
+		"migrate",
+		cfg.MigrateOnStart,
+		"apply pending migrations before serving (MIGRATE_ON_START)",
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	shutdownTracing, err := tracing.Setup(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	storage, err := db.CreateStorageConn(cfg)
+	if err != nil {
+		return err
+	}
+
+	migrator, err := db.NewMigrator(storage)
+	if err != nil {
+		storage.Close()
+		return err
+	}
+
+	if err := prepareSchema(ctx, storage, migrator, *migrate); err != nil {
+		storage.Close()
+		return err
+	}
+
+	var wg sync.WaitGroup
+
+	consumer, err := user.NewConsumer(storage, cfg)
+	if err != nil {
+		storage.Close()
+		return err
+	}
+
+	userConsumer := mq.WrapConsumer(consumer)
+	mqListener := mq.NewMqListener(storage, cfg).RegisterConsumer("create_user", userConsumer)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		slog.Info("Starting MQ listener")
+		if err := mqListener.ListenForNotifications(ctx); err != nil && err != context.Canceled {
+			slog.Error("MQ listener error", "error", err)
+		} else if err == context.Canceled {
+			slog.Info("MQ listener shut down successfully")
+		}
+	}()
+
+	checks := health.NewRegistry().
+		Register("database", true, health.Database(storage)).
+		Register("migrations", true, health.Migrations(storage, migrator)).
+		Register("mq_listener", true, mqListener.Health).
+		Register("signing_key", true, health.SigningKey(cfg))
+
+	httpServer := api.NewServer(storage, cfg, checks)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := httpServer.Run(); err != nil && err != http.ErrServerClosed {
+			slog.Error("HTTP server error", "error", err)
+		}
+		slog.Info("HTTP server stopped")
+	}()
+
+	<-ctx.Done()
+	slog.Info("Shutdown signal received, initiating graceful shutdown")
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer shutdownCancel()
+
+	startTime := time.Now()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		slog.Error("HTTP server shutdown error", "error", err)
+	} else {
+		slog.Info("HTTP server shutdown successful", "took", time.Since(startTime).String())
+	}
+
+	startTime = time.Now()
+	if err := mqListener.Shutdown(shutdownCtx, storage); err != nil {
+		slog.Error("MQ listener shutdown error", "error", err)
+	} else {
+		slog.Info("MQ listener shutdown successful", "took", time.Since(startTime).String())
+	}
+
+	waitCh := make(chan struct{})
+
+	go func() {
+		wg.Wait()
+		close(waitCh)
+	}()
+
+	select {
+	case <-waitCh:
+		slog.Info("All services stopped successfully")
+	case <-time.After(15 * time.Second):
+		slog.Warn("Shutdown timed out, some services may not have stopped gracefully")
+	}
+
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("Error flushing traces", "error", err)
+	}
+
+	slog.Info("Closing storage")
+	if err := storage.Close(); err != nil {
+		slog.Error("Error closing database", "error", err)
+	}
+
+	slog.Info("Application shutdown completed")
+	return nil
+}
+
+// prepareSchema optionally migrates the database with migrator and then
+// refuses to go on when the schema is older than the migrations embedded in
+// this binary.
+func prepareSchema(
+	ctx context.Context,
+	storage *sqlx.DB,
+	migrator *goose.Provider,
+	migrate bool,
+) error {
+	if migrate {
+		slog.Info("Applying pending migrations")
+		results, err := db.Migrate(ctx, migrator)
+		for _, result := range results {
+			slog.Info("Migration applied", "migration", result.String())
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := db.CheckSchema(ctx, storage, migrator); err != nil {
+		if errors.Is(err, db.ErrSchemaBehind) {
+			return fmt.Errorf("%w; run `sesamo migrate up` or serve with -migrate", err)
+		}
+		return err
+	}
+
+	return nil
+}
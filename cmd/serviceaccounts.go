@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/diegodario88/sesamo/config"
+	"github.com/diegodario88/sesamo/user"
+)
+
+type createdServiceAccount struct {
+	*user.ServiceAccount
+	ClientSecret string `json:"client_secret,omitempty"`
+}
+
+type serviceAccountChange struct {
+	ClientID string `json:"client_id"`
+	Role     string `json:"role,omitempty"`
+	BranchID string `json:"branch_id,omitempty"`
+	Action   string `json:"action"`
+}
+
+func serviceAccountCommand() *command {
+	return &command{
+		name:    "service-account",
+		summary: "manage service accounts of organizations",
+		subcommands: []*command{
+			{name: "create", summary: "create a service account", run: runServiceAccountCreate},
+			{name: "list", summary: "list service accounts of an organization", run: runServiceAccountList},
+			{name: "rotate-secret", summary: "replace the client secret", run: runServiceAccountRotate},
+			{name: "disable", summary: "refuse tokens to a service account", run: runServiceAccountDisable},
+			{name: "enable", summary: "enable a disabled service account", run: runServiceAccountEnable},
+			{name: "delete", summary: "delete a service account", run: runServiceAccountDelete},
+			{name: "assign", summary: "grant a role to a service account", run: runServiceAccountAssign},
+			{name: "revoke", summary: "remove a role from a service account", run: runServiceAccountRevoke},
+		},
+	}
+}
+
+// runServiceAccountCreate prints the client secret of the new service
+// account, the only time it is shown. With -public-key the account signs
+// client assertions instead and has no secret.
+func runServiceAccountCreate(ctx context.Context, cfg *config.Config, args []string) error {
+	fs, out := newFlagSet("service-account create")
+	orgID := fs.String("org", "", "ID of the organization that owns the service account")
+	name := fs.String("name", "", "service account name")
+	keyFile := fs.String("public-key", "", "PEM file with the public key for private_key_jwt")
+	introspect := fs.Bool("introspect", false, "allow the service account to introspect tokens")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := requireFlags(fs, "org", "name"); err != nil {
+		return err
+	}
+
+	var publicKey string
+	if *keyFile != "" {
+		pem, err := os.ReadFile(*keyFile)
+		if err != nil {
+			return err
+		}
+		publicKey = string(pem)
+	}
+
+	a, err := openApp(cfg)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	account, secret, err := a.users.CreateServiceAccount(
+		ctx,
+		*orgID,
+		*name,
+		publicKey,
+		*introspect,
+	)
+	if err != nil {
+		return err
+	}
+
+	created := createdServiceAccount{ServiceAccount: account, ClientSecret: secret}
+	return out.print(created, []string{"ID", "NAME", "CLIENT ID", "CLIENT SECRET"}, [][]string{
+		{account.ID, account.Name, account.ClientID, orDash(secret)},
+	})
+}
+
+func runServiceAccountList(ctx context.Context, cfg *config.Config, args []string) error {
+	fs, out := newFlagSet("service-account list")
+	orgID := fs.String("org", "", "organization ID")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := requireFlags(fs, "org"); err != nil {
+		return err
+	}
+
+	a, err := openApp(cfg)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	accounts, err := a.users.Repo.FindOrganizationServiceAccounts(ctx, *orgID)
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(accounts))
+	for _, account := range accounts {
+		auth := "client_secret"
+		if account.PublicKey != nil {
+			auth = "private_key_jwt"
+		}
+		status := "active"
+		if account.DisabledAt != nil {
+			status = "disabled"
+		}
+		rows = append(rows, []string{account.ID, account.Name, account.ClientID, auth, status})
+	}
+
+	return out.print(accounts, []string{"ID", "NAME", "CLIENT ID", "AUTH", "STATUS"}, rows)
+}
+
+// runServiceAccountRotate also moves accounts that used a public key over to
+// a client secret.
+func runServiceAccountRotate(ctx context.Context, cfg *config.Config, args []string) error {
+	fs, out := newFlagSet("service-account rotate-secret")
+	clientID := fs.String("client-id", "", "client ID of the service account")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := requireFlags(fs, "client-id"); err != nil {
+		return err
+	}
+
+	a, err := openApp(cfg)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	secret, err := a.users.RotateServiceAccountSecret(ctx, *clientID)
+	if err != nil {
+		return err
+	}
+
+	result := map[string]string{"client_id": *clientID, "client_secret": secret}
+	return out.print(result, []string{"CLIENT ID", "CLIENT SECRET"}, [][]string{{*clientID, secret}})
+}
+
+func runServiceAccountDisable(ctx context.Context, cfg *config.Config, args []string) error {
+	return runServiceAccountChange(ctx, cfg, args, "disable")
+}
+
+func runServiceAccountEnable(ctx context.Context, cfg *config.Config, args []string) error {
+	return runServiceAccountChange(ctx, cfg, args, "enable")
+}
+
+func runServiceAccountDelete(ctx context.Context, cfg *config.Config, args []string) error {
+	return runServiceAccountChange(ctx, cfg, args, "delete")
+}
+
+func runServiceAccountAssign(ctx context.Context, cfg *config.Config, args []string) error {
+	return runServiceAccountChange(ctx, cfg, args, "assign")
+}
+
+func runServiceAccountRevoke(ctx context.Context, cfg *config.Config, args []string) error {
+	return runServiceAccountChange(ctx, cfg, args, "revoke")
+}
+
+// runServiceAccountChange backs the subcommands that change a service
+// account by client ID. Roles are scoped to the organization that owns the
+// account, or to one of its branches with -branch.
+func runServiceAccountChange(
+	ctx context.Context,
+	cfg *config.Config,
+	args []string,
+	action string,
+) error {
+	fs, out := newFlagSet("service-account " + action)
+	change := serviceAccountChange{Action: action}
+	fs.StringVar(&change.ClientID, "client-id", "", "client ID of the service account")
+	withRole := action == "assign" || action == "revoke"
+	if withRole {
+		fs.StringVar(&change.Role, "role", "", "role name, e.g. org_admin")
+		fs.StringVar(&change.BranchID, "branch", "", "branch ID for branch roles")
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	required := []string{"client-id"}
+	if withRole {
+		required = append(required, "role")
+	}
+	if err := requireFlags(fs, required...); err != nil {
+		return err
+	}
+
+	a, err := openApp(cfg)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	repo := a.users.Repo
+	switch action {
+	case "disable", "enable":
+		err = repo.SetServiceAccountDisabled(ctx, change.ClientID, action == "disable")
+	case "delete":
+		err = repo.DeleteServiceAccount(ctx, change.ClientID)
+	case "assign":
+		err = repo.AssignServiceAccountRole(ctx, change.ClientID, change.Role, change.BranchID)
+	case "revoke":
+		err = repo.RevokeServiceAccountRole(ctx, change.ClientID, change.Role, change.BranchID)
+	default:
+		err = fmt.Errorf("unknown action %q", action)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return out.print(change, []string{"CLIENT ID", "ROLE", "BRANCH", "ACTION"}, [][]string{
+		{change.ClientID, orDash(change.Role), orDash(change.BranchID), action},
+	})
+}
@@ -0,0 +1,184 @@
+package mq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/diegodario88/sesamo/tracing"
+	"github.com/jmoiron/sqlx"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type QueuedMessage struct {
+	MessageID   int64             `json:"message_id"`
+	RoutingKey  string            `json:"routing_key"`
+	Body        json.RawMessage   `json:"body"`
+	Headers     map[string]string `json:"headers"`
+	PublishTime time.Time         `json:"publish_time"`
+	State       string            `json:"state"`
+}
+
+// Publish hands a message to mq.publish, which routes it to every queue bound
+// to the exchange with a matching routing key pattern. The caller's trace
+// context travels in the traceparent header so consumers continue the trace.
+func Publish(
+	ctx context.Context,
+	storage *sqlx.DB,
+	exchange string,
+	routingKey string,
+	body json.RawMessage,
+	headers map[string]string,
+) error {
+	ctx, span := tracing.Tracer().Start(
+		ctx,
+		exchange+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "pg_mq"),
+			attribute.String("messaging.destination.name", exchange),
+			attribute.String("messaging.rabbitmq.destination.routing_key", routingKey),
+		),
+	)
+	defer span.End()
+
+	carrier := make(map[string]string, len(headers)+1)
+	for key, value := range headers {
+		carrier[key] = value
+	}
+	tracing.Inject(ctx, carrier)
+	headers = carrier
+
+	keys := make([]string, 0, len(headers))
+	values := make([]string, 0, len(headers))
+	for key, value := range headers {
+		keys = append(keys, key)
+		values = append(values, value)
+	}
+
+	_, err := storage.ExecContext(
+		ctx,
+		"CALL mq.publish($1, $2, $3::json, hstore($4::text[], $5::text[]))",
+		exchange,
+		routingKey,
+		string(body),
+		keys,
+		values,
+	)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "publish failed")
+		return fmt.Errorf("Publish: %w", err)
+	}
+
+	return nil
+}
+
+// Peek lists the oldest messages of a queue without delivering them.
+func Peek(
+	ctx context.Context,
+	storage *sqlx.DB,
+	queue string,
+	limit int,
+) ([]QueuedMessage, error) {
+	query := `
+		SELECT
+			m.message_id,
+			m.routing_key,
+			m.body::text,
+			hstore_to_json(m.headers)::text,
+			m.publish_time,
+			CASE
+				WHEN d.delivery_id IS NOT NULL THEN 'delivered'
+				ELSE 'waiting'
+			END
+		FROM mq.message m
+		JOIN mq.queue q ON q.queue_id = m.queue_id
+		LEFT JOIN mq.delivery d ON d.message_id = m.message_id
+		WHERE q.queue_name = $1
+		ORDER BY m.message_id
+		LIMIT $2
+	`
+
+	rows, err := storage.QueryContext(ctx, query, queue, limit)
+	if err != nil {
+		return nil, fmt.Errorf("Peek: %w", err)
+	}
+	defer rows.Close()
+
+	messages := []QueuedMessage{}
+	for rows.Next() {
+		var message QueuedMessage
+		var body, headers string
+
+		err := rows.Scan(
+			&message.MessageID,
+			&message.RoutingKey,
+			&body,
+			&headers,
+			&message.PublishTime,
+			&message.State,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("Peek: %w", err)
+		}
+
+		if err := json.Unmarshal([]byte(headers), &message.Headers); err != nil {
+			return nil, fmt.Errorf("Peek: headers of message %d: %w", message.MessageID, err)
+		}
+
+		message.Body = json.RawMessage(body)
+		messages = append(messages, message)
+	}
+
+	return messages, rows.Err()
+}
+
+// Purge removes every message of a queue that is not currently delivered to
+// a channel; in-flight messages are left for their consumer to ACK or NACK.
+func Purge(ctx context.Context, storage *sqlx.DB, queue string) (int64, error) {
+	query := `
+		DELETE FROM mq.message m
+		USING mq.queue q
+		WHERE q.queue_id = m.queue_id
+			AND q.queue_name = $1
+			AND NOT EXISTS (
+				SELECT 1 FROM mq.delivery d WHERE d.message_id = m.message_id
+			)
+	`
+
+	result, err := storage.ExecContext(ctx, query, queue)
+	if err != nil {
+		return 0, fmt.Errorf("Purge: %w", err)
+	}
+
+	return result.RowsAffected()
+}
+
+// ReplayDeadLetters moves the dead letters of a queue back into it, as new
+// messages with their attempts reset, in the order they were first published.
+func ReplayDeadLetters(ctx context.Context, storage *sqlx.DB, queue string) (int64, error) {
+	query := `
+		WITH replayed AS (
+			DELETE FROM mq.dead_letter d
+			USING mq.queue q
+			WHERE q.queue_id = d.queue_id
+				AND q.queue_name = $1
+			RETURNING d.*
+		)
+		INSERT INTO mq.message (exchange_id, routing_key, body, headers, publish_time, queue_id)
+		SELECT exchange_id, routing_key, body, headers, publish_time, queue_id
+		FROM replayed
+		ORDER BY message_id
+	`
+
+	result, err := storage.ExecContext(ctx, query, queue)
+	if err != nil {
+		return 0, fmt.Errorf("ReplayDeadLetters: %w", err)
+	}
+
+	return result.RowsAffected()
+}
@@ -3,15 +3,23 @@ package mq
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"sync/atomic"
 	"time"
 
 	"github.com/diegodario88/sesamo/config"
+	"github.com/diegodario88/sesamo/health"
+	"github.com/diegodario88/sesamo/logging"
+	"github.com/diegodario88/sesamo/metrics"
+	"github.com/diegodario88/sesamo/tracing"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jmoiron/sqlx"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Message[T any] struct {
@@ -22,12 +30,14 @@ type Message[T any] struct {
 	RawPayload []byte                 `json:"-"`
 }
 
+// MessageConsumer handles the messages of one queue. The context carries a
+// logger already correlated with the queue, channel and delivery.
 type MessageConsumer[T any] interface {
-	Process(message *Message[T]) (int, error)
+	Process(ctx context.Context, message *Message[T]) (int, error)
 }
 
 type ConsumerWrapper interface {
-	ProcessNotification(notification *pgconn.Notification) (int, error)
+	ProcessNotification(ctx context.Context, notification *pgconn.Notification) (int, error)
 }
 
 type ConsumerWrapperImpl[T any] struct {
@@ -35,13 +45,48 @@ type ConsumerWrapperImpl[T any] struct {
 }
 
 func (cw ConsumerWrapperImpl[T]) ProcessNotification(
+	ctx context.Context,
 	notification *pgconn.Notification,
 ) (int, error) {
 	msg, err := parseNotification[T](notification)
 	if err != nil {
 		return 0, err
 	}
-	return cw.consumer.Process(msg)
+
+	ctx = tracing.Extract(ctx, stringHeaders(msg.Headers))
+	ctx, span := tracing.Tracer().Start(
+		ctx,
+		msg.RoutingKey+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "pg_mq"),
+			attribute.String("messaging.rabbitmq.destination.routing_key", msg.RoutingKey),
+			attribute.Int("messaging.message.id", msg.DeliveryID),
+		),
+	)
+	defer span.End()
+
+	ctx = logging.With(ctx, "delivery_id", msg.DeliveryID, "routing_key", msg.RoutingKey)
+	deliveryID, err := cw.consumer.Process(ctx, msg)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "processing failed")
+	}
+
+	return deliveryID, err
+}
+
+// stringHeaders keeps the string values of an hstore decoded from JSON,
+// which is what trace propagation reads.
+func stringHeaders(headers map[string]interface{}) map[string]string {
+	result := make(map[string]string, len(headers))
+	for key, value := range headers {
+		if s, ok := value.(string); ok {
+			result[key] = s
+		}
+	}
+
+	return result
 }
 
 func WrapConsumer[T any](consumer MessageConsumer[T]) ConsumerWrapper {
@@ -53,12 +98,17 @@ type MqListener struct {
 	consumers        map[string]ConsumerWrapper
 	channelToQueue   map[string]string
 	cancelFunc       context.CancelFunc
-	storage          *sqlx.DB // Referência ao storage principal para operações de ACK/NACK
+	storage          *sqlx.DB // main storage, used for ACK/NACK outside the LISTEN connection
+
+	// state read by Health while the listener runs
+	connected        atomic.Bool
+	openChannels     atomic.Int64
+	lastNotification atomic.Int64 // unix nanoseconds
 }
 
-func NewMqListener(storage *sqlx.DB) *MqListener {
+func NewMqListener(storage *sqlx.DB, cfg *config.Config) *MqListener {
 	return &MqListener{
-		connectionString: config.Variables.DatabaseUrl,
+		connectionString: cfg.DatabaseUrl,
 		consumers:        make(map[string]ConsumerWrapper),
 		channelToQueue:   make(map[string]string),
 		storage:          storage,
@@ -79,8 +129,11 @@ func (mq *MqListener) ListenForNotifications(ctx context.Context) error {
 		return err
 	}
 
+	mq.connected.Store(true)
 	defer func() {
-		log.Println("MQ listener main loop exited")
+		mq.connected.Store(false)
+		mq.openChannels.Store(0)
+		slog.Info("MQ listener main loop exited")
 	}()
 
 	if len(mq.consumers) == 0 {
@@ -97,15 +150,12 @@ func (mq *MqListener) ListenForNotifications(ctx context.Context) error {
 		}
 
 		mq.channelToQueue[channelId] = queue
+		mq.openChannels.Add(1)
 
-		log.Printf(
-			"Listening for notifications on queue: %s via channel ID: %s\n",
-			queue,
-			channelId,
-		)
+		slog.Info("Listening for notifications", "queue", queue, "channel_id", channelId)
 	}
 
-	log.Println("PostgreSQL notification listener started")
+	slog.Info("PostgreSQL notification listener started")
 
 	var currentDeliveryID int
 	var processingMessage atomic.Bool
@@ -113,12 +163,13 @@ func (mq *MqListener) ListenForNotifications(ctx context.Context) error {
 	for {
 		select {
 		case <-innerCtx.Done():
-			log.Println("MQ listener shutdown signal received")
+			slog.Info("MQ listener shutdown signal received")
 
 			if processingMessage.Load() && currentDeliveryID > 0 {
-				log.Printf("Sending NACK for in-progress message ID: %d", currentDeliveryID)
-				if err := mq.disacknowledgeMessage(currentDeliveryID, "5 minutes"); err != nil {
-					log.Printf("Error during shutdown NACK: %v", err)
+				nackCtx := logging.With(ctx, "delivery_id", currentDeliveryID)
+				logging.FromContext(nackCtx).Info("Sending NACK for in-progress message")
+				if err := mq.disacknowledgeMessage(nackCtx, currentDeliveryID, "5 minutes"); err != nil {
+					logging.FromContext(nackCtx).Error("Error during shutdown NACK", "error", err)
 				}
 			}
 
@@ -129,28 +180,40 @@ func (mq *MqListener) ListenForNotifications(ctx context.Context) error {
 				return err
 			}
 
-			log.Printf("Received notification on channel %s\n", notification.Channel)
+			mq.lastNotification.Store(time.Now().UnixNano())
+			queue := mq.channelToQueue[notification.Channel]
+			messageCtx := logging.With(ctx, "queue", queue, "channel_id", notification.Channel)
+			logger := logging.FromContext(messageCtx)
+
+			logger.Debug("Received notification")
 
-			consumer, exists := mq.consumers[mq.channelToQueue[notification.Channel]]
+			consumer, exists := mq.consumers[queue]
 			if !exists {
-				log.Printf(
-					"No consumer registered for channel %s, skipping\n",
-					notification.Channel,
-				)
+				logger.Warn("No consumer registered for channel, skipping")
 				continue
 			}
 
 			processingMessage.Store(true)
-			deliveryId, err := consumer.ProcessNotification(notification)
+			startTime := time.Now()
+			deliveryId, err := consumer.ProcessNotification(messageCtx, notification)
 			currentDeliveryID = deliveryId
+			metrics.MQProcessingDuration.WithLabelValues(queue).Observe(time.Since(startTime).Seconds())
+
+			if deliveryId > 0 {
+				messageCtx = logging.With(messageCtx, "delivery_id", deliveryId)
+				logger = logging.FromContext(messageCtx)
+			}
 
 			if err != nil {
-				log.Printf("Error processing message on %s: %v\n", notification.Channel, err)
+				logger.Error("Error processing message", "error", err)
+				metrics.MQMessages.WithLabelValues(queue, metrics.MessageFailed).Inc()
 
 				if deliveryId > 0 {
-					log.Printf("Sending NACK for failed processing message ID: %d", deliveryId)
-					if err := mq.disacknowledgeMessage(currentDeliveryID, "5 minutes"); err != nil {
-						log.Printf("Error during shutdown NACK: %v", err)
+					logger.Info("Sending NACK for failed message")
+					if err := mq.disacknowledgeMessage(messageCtx, currentDeliveryID, "5 minutes"); err != nil {
+						logger.Error("Error sending NACK", "error", err)
+					} else {
+						metrics.MQMessages.WithLabelValues(queue, metrics.MessageNacked).Inc()
 					}
 				}
 
@@ -158,11 +221,17 @@ func (mq *MqListener) ListenForNotifications(ctx context.Context) error {
 				continue
 			}
 
-			if err := mq.acknowledgeMessage(currentDeliveryID); err != nil {
-				log.Printf("Error acknowledging message: %v\n", err)
-				if nackErr := mq.disacknowledgeMessage(currentDeliveryID, "1 minute"); nackErr != nil {
-					log.Printf("Error sending NACK after failed ACK: %v", nackErr)
+			metrics.MQMessages.WithLabelValues(queue, metrics.MessageProcessed).Inc()
+
+			if err := mq.acknowledgeMessage(messageCtx, currentDeliveryID); err != nil {
+				logger.Error("Error acknowledging message", "error", err)
+				if nackErr := mq.disacknowledgeMessage(messageCtx, currentDeliveryID, "1 minute"); nackErr != nil {
+					logger.Error("Error sending NACK after failed ACK", "error", nackErr)
+				} else {
+					metrics.MQMessages.WithLabelValues(queue, metrics.MessageNacked).Inc()
 				}
+			} else {
+				metrics.MQMessages.WithLabelValues(queue, metrics.MessageAcked).Inc()
 			}
 
 			processingMessage.Store(false)
@@ -170,18 +239,45 @@ func (mq *MqListener) ListenForNotifications(ctx context.Context) error {
 	}
 }
 
+// Health reports whether the LISTEN connection is up with every consumer's
+// channel open. The time since the last notification is informational only:
+// a quiet queue is not a failure.
+func (mq *MqListener) Health(ctx context.Context) health.Component {
+	details := map[string]any{
+		"connected":     mq.connected.Load(),
+		"channels_open": mq.openChannels.Load(),
+		"consumers":     len(mq.consumers),
+	}
+
+	if last := mq.lastNotification.Load(); last > 0 {
+		lastTime := time.Unix(0, last)
+		details["last_notification_at"] = lastTime.UTC()
+		details["seconds_since_last_notification"] = int64(time.Since(lastTime).Seconds())
+	}
+
+	if !mq.connected.Load() {
+		return health.Down(errors.New("listener is not connected"), details)
+	}
+
+	if mq.openChannels.Load() < int64(len(mq.consumers)) {
+		return health.Down(errors.New("not every consumer has an open channel"), details)
+	}
+
+	return health.Up(details)
+}
+
 func (mq *MqListener) Shutdown(ctx context.Context, conn *sqlx.DB) error {
 	if mq.cancelFunc == nil {
-		log.Println("MqListener is not running or is already canceled")
+		slog.Info("MqListener is not running or is already canceled")
 
 		return nil
 	}
 
-	log.Println("Gracefully shutting down MQ listener...")
+	slog.Info("Gracefully shutting down MQ listener")
 	mq.cancelFunc()
 	time.Sleep(100 * time.Millisecond)
 
-	log.Println("Closing channels...")
+	slog.Info("Closing channels")
 	cleanupCtx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
@@ -189,17 +285,17 @@ func (mq *MqListener) Shutdown(ctx context.Context, conn *sqlx.DB) error {
 		q := fmt.Sprintf("CALL mq.close_channel(%s);", c)
 		_, err := conn.ExecContext(cleanupCtx, q)
 		if err != nil {
-			log.Printf("Error closing channel: %v\n", err)
+			slog.Error("Error closing channel", "channel_id", c, "error", err)
 		}
 
 		_, err = conn.ExecContext(cleanupCtx, "CALL mq.close_dead_channels();")
 		if err != nil {
-			log.Printf("Error closing dead channels: %v\n", err)
+			slog.Error("Error closing dead channels", "error", err)
 		}
 	}
 
 	mq.channelToQueue = make(map[string]string)
-	log.Println("MQ listener cleanup process completed")
+	slog.Info("MQ listener cleanup process completed")
 	return nil
 }
 
@@ -229,22 +325,26 @@ func parseNotification[T any](notification *pgconn.Notification) (*Message[T], e
 	}, nil
 }
 
-func (mq *MqListener) acknowledgeMessage(deliveryID int) error {
+func (mq *MqListener) acknowledgeMessage(ctx context.Context, deliveryID int) error {
 	_, err := mq.storage.Exec(fmt.Sprintf("CALL mq.ack(%d)", deliveryID))
 	if err != nil {
 		return fmt.Errorf("error sending ACK message: %w", err)
 	}
 
-	log.Println("Message ACK successfully")
+	logging.FromContext(ctx).Info("Message ACK successfully")
 	return nil
 }
 
-func (mq *MqListener) disacknowledgeMessage(deliveryID int, retryAfter string) error {
+func (mq *MqListener) disacknowledgeMessage(
+	ctx context.Context,
+	deliveryID int,
+	retryAfter string,
+) error {
 	_, err := mq.storage.Exec("CALL mq.nack($1,retry_after=>$2)", deliveryID, retryAfter)
 	if err != nil {
 		return fmt.Errorf("error sending NACK message:: %w", err)
 	}
 
-	log.Println("Message NACK successfully")
+	logging.FromContext(ctx).Info("Message NACK successfully", "retry_after", retryAfter)
 	return nil
 }
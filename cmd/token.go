@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+
+	"github.com/diegodario88/sesamo/config"
+)
+
+type mintedToken struct {
+	UserID string `json:"user_id"`
+	Email  string `json:"email"`
+	Token  string `json:"token"`
+}
+
+func tokenCommand() *command {
+	return &command{
+		name:    "token",
+		summary: "issue tokens for debugging",
+		subcommands: []*command{
+			{name: "mint", summary: "sign an access token for a user without a password", run: runTokenMint},
+		},
+	}
+}
+
+func runTokenMint(ctx context.Context, cfg *config.Config, args []string) error {
+	fs, out := newFlagSet("token mint")
+	id := fs.String("id", "", "user ID")
+	email := fs.String("email", "", "user email")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	a, err := openApp(cfg)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	found, err := a.findUser(ctx, *id, *email)
+	if err != nil {
+		return err
+	}
+
+	token, err := a.users.GenerateUserToken(ctx, found)
+	if err != nil {
+		return err
+	}
+
+	minted := mintedToken{UserID: found.ID, Email: found.Email, Token: token}
+	return out.print(minted, []string{"USER", "EMAIL", "TOKEN"}, [][]string{
+		{minted.UserID, minted.Email, minted.Token},
+	})
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/diegodario88/sesamo/config"
+	"github.com/diegodario88/sesamo/httphelper"
+	"github.com/diegodario88/sesamo/user"
+)
+
+func userCommand() *command {
+	return &command{
+		name:    "user",
+		summary: "manage users",
+		subcommands: []*command{
+			{name: "create", summary: "create a user with a password", run: runUserCreate},
+			{name: "list", summary: "list all users", run: runUserList},
+			{name: "disable", summary: "disable a user so it can no longer log in", run: runUserDisable},
+			{name: "enable", summary: "reactivate a disabled or locked user", run: runUserEnable},
+			{name: "set-password", summary: "replace the password of a user", run: runUserSetPassword},
+		},
+	}
+}
+
+func runUserCreate(ctx context.Context, cfg *config.Config, args []string) error {
+	fs, out := newFlagSet("user create")
+	var payload user.RegisterUserPayload
+	fs.StringVar(&payload.FirstName, "first-name", "", "first name")
+	fs.StringVar(&payload.LastName, "last-name", "", "last name")
+	fs.StringVar(&payload.Email, "email", "", "email address")
+	password := fs.String("password", "", "password")
+	passwordStdin := fs.Bool("password-stdin", false, "read the password from stdin")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var err error
+	if payload.Password, err = readPassword(*password, *passwordStdin); err != nil {
+		return err
+	}
+
+	if err := httphelper.Validate.Struct(payload); err != nil {
+		return fmt.Errorf("invalid user: %w", err)
+	}
+
+	a, err := openApp(cfg)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	created, err := a.users.CreateUser(ctx, payload)
+	if err != nil {
+		return err
+	}
+
+	return printUsers(out, created, []user.UserEntity{*created})
+}
+
+func runUserList(ctx context.Context, cfg *config.Config, args []string) error {
+	fs, out := newFlagSet("user list")
+	var query user.UserQuery
+	fs.StringVar(&query.Email, "email", "", "only the user with this email")
+	fs.StringVar(&query.NamePrefix, "name", "", "first or last name prefix")
+	fs.StringVar(&query.Search, "search", "", "substring of the email or full name")
+	fs.StringVar(&query.Role, "role", "", "only users holding this role")
+	fs.StringVar(
+		&query.Status,
+		"status",
+		"",
+		strings.Join(user.AccountStatuses, ", "),
+	)
+	fs.StringVar(
+		&query.Sort,
+		"sort",
+		"",
+		"id, email, firstName, lastName or created_at; prefix - to reverse",
+	)
+	limit := fs.Int("limit", 0, "stop after this many users (default all)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	a, err := openApp(cfg)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	users := []user.UserEntity{}
+	query.Limit = user.MaxPageSize
+	for {
+		page, err := a.users.Repo.FindAllUsers(ctx, query)
+		if err != nil {
+			return err
+		}
+
+		users = append(users, page.Items...)
+		if page.Next == "" || (*limit > 0 && len(users) >= *limit) {
+			break
+		}
+		query.Cursor = page.Next
+	}
+
+	if *limit > 0 && len(users) > *limit {
+		users = users[:*limit]
+	}
+
+	return printUsers(out, users, users)
+}
+
+func runUserDisable(ctx context.Context, cfg *config.Config, args []string) error {
+	return runUserSetStatus(ctx, cfg, args, "disable", user.StatusDisabled)
+}
+
+func runUserEnable(ctx context.Context, cfg *config.Config, args []string) error {
+	return runUserSetStatus(ctx, cfg, args, "enable", user.StatusActive)
+}
+
+// runUserSetStatus moves a user to status; leaving the active status revokes
+// the user's tokens.
+func runUserSetStatus(
+	ctx context.Context,
+	cfg *config.Config,
+	args []string,
+	action string,
+	status string,
+) error {
+	fs, out := newFlagSet("user " + action)
+	id := fs.String("id", "", "user ID")
+	email := fs.String("email", "", "user email")
+	reason := fs.String("reason", "", "why the status changes, kept with the user")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	a, err := openApp(cfg)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	found, err := a.findUser(ctx, *id, *email)
+	if err != nil {
+		return err
+	}
+
+	var statusReason *string
+	if *reason != "" {
+		statusReason = reason
+	}
+
+	updated, err := a.users.Repo.SetUserStatus(ctx, found.ID, status, statusReason)
+	if err != nil {
+		return err
+	}
+
+	return printUsers(out, updated, []user.UserEntity{*updated})
+}
+
+func runUserSetPassword(ctx context.Context, cfg *config.Config, args []string) error {
+	fs, out := newFlagSet("user set-password")
+	id := fs.String("id", "", "user ID")
+	email := fs.String("email", "", "user email")
+	password := fs.String("password", "", "new password")
+	passwordStdin := fs.Bool("password-stdin", false, "read the password from stdin")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	newPassword, err := readPassword(*password, *passwordStdin)
+	if err != nil {
+		return err
+	}
+
+	a, err := openApp(cfg)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	found, err := a.findUser(ctx, *id, *email)
+	if err != nil {
+		return err
+	}
+
+	if err := a.users.SetPassword(ctx, found, newPassword); err != nil {
+		return err
+	}
+
+	return printUsers(out, found, []user.UserEntity{*found})
+}
+
+func printUsers(out *output, v any, users []user.UserEntity) error {
+	rows := make([][]string, 0, len(users))
+	for _, u := range users {
+		rows = append(rows, []string{u.ID, u.Email, u.FirstName + " " + u.LastName, u.Status})
+	}
+
+	return out.print(v, []string{"ID", "EMAIL", "NAME", "STATUS"}, rows)
+}
+
+func readPassword(password string, fromStdin bool) (string, error) {
+	if !fromStdin {
+		if password == "" {
+			return "", fmt.Errorf("either -password or -password-stdin is required")
+		}
+		return password, nil
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("reading password from stdin: %w", err)
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
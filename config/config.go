@@ -0,0 +1,76 @@
+package config
+
+import "time"
+
+// Config is the runtime configuration of sesamo. Every field is bound to an
+// environment variable through its env tag; see Load for where values come
+// from and in which order.
+type Config struct {
+	DatabaseUrl string `env:"DATABASE_URL"     required:"true" secret:"true" validate:"url"             usage:"PostgreSQL connection string"`
+	Port        int64  `env:"HTTP_SERVER_PORT" default:"3000"                validate:"min=1,max=65535" usage:"HTTP listen port"             flag:"port"`
+
+	JwtSecret              string `env:"JWT_SECRET"                required:"true" secret:"true" validate:"min=16" usage:"HMAC key used to sign access tokens"`
+	JwtExpirationInSeconds int64  `env:"JWT_EXPIRATION_IN_SECONDS" default:"3600"                validate:"min=60" usage:"access token lifetime in seconds"`
+
+	MicrosoftTenantId     string `env:"MICROSOFT_TENANT_ID"                   usage:"Entra ID tenant for Microsoft sign-in"`
+	MicrosoftClientId     string `env:"MICROSOFT_CLIENT_ID"                   usage:"client ID of sesamo in Entra ID; Microsoft sign-in is off when empty"`
+	MicrosoftClientSecret string `env:"MICROSOFT_CLIENT_SECRET" secret:"true" usage:"client secret of sesamo in Entra ID"`
+
+	MigrateOnStart bool `env:"MIGRATE_ON_START" default:"false" usage:"apply pending migrations when serving"`
+
+	LogLevel  string `env:"LOG_LEVEL"  default:"info" validate:"oneof=debug info warn error" usage:"minimum log level: debug, info, warn or error"`
+	LogFormat string `env:"LOG_FORMAT" default:"json" validate:"oneof=json text"             usage:"log encoding: json or text"`
+
+	OtelExporterEndpoint string `env:"OTEL_EXPORTER_OTLP_ENDPOINT" validate:"omitempty,url" usage:"OTLP/HTTP collector URL; tracing is a no-op when empty"`
+	OtelServiceName      string `env:"OTEL_SERVICE_NAME"           default:"sesamo"        usage:"service name reported on traces"`
+
+	AppUrl    string `env:"APP_URL"    default:"http://localhost:3000"        validate:"url" usage:"base URL of the web app that handles links sent by email"`
+	IssuerUrl string `env:"ISSUER_URL" default:"http://localhost:3000/api/v1" validate:"url" usage:"public base URL of the sesamo API: the OpenID issuer, and the audience of client assertions"`
+
+	MailSender   string `env:"MAIL_SENDER"   default:"smtp"                  validate:"oneof=smtp log" usage:"how email is delivered: smtp or log"`
+	MailFrom     string `env:"MAIL_FROM"     default:"no-reply@sesamo.local" validate:"email"          usage:"sender address of outgoing email"`
+	SmtpAddr     string `env:"SMTP_ADDR"     default:"localhost:1025"        validate:"hostname_port"  usage:"SMTP server host:port"`
+	SmtpUsername string `env:"SMTP_USERNAME"                                                           usage:"SMTP username; authentication is skipped when empty"`
+	SmtpPassword string `env:"SMTP_PASSWORD" secret:"true"                                             usage:"SMTP password"`
+
+	EmailVerification string        `env:"EMAIL_VERIFICATION" default:"required" validate:"oneof=required reduced off" usage:"self-registered accounts must verify their email before signing in (required), get a token without roles until they do (reduced), or skip verification (off)"`
+	EmailTokenTTL     time.Duration `env:"EMAIL_TOKEN_TTL"    default:"24h"      validate:"min=1m"                     usage:"lifetime of links sent by email"`
+	PasswordResetTTL  time.Duration `env:"PASSWORD_RESET_TTL" default:"30m"      validate:"min=1m"                     usage:"lifetime of password reset links"`
+
+	PasswordMinLength    int    `env:"PASSWORD_MIN_LENGTH"    default:"10"  validate:"min=1"       usage:"minimum password length in characters"`
+	PasswordMaxLength    int    `env:"PASSWORD_MAX_LENGTH"    default:"128" validate:"min=16"      usage:"maximum password length in characters"`
+	PasswordMinClasses   int    `env:"PASSWORD_MIN_CLASSES"   default:"3"   validate:"min=0,max=4" usage:"how many of lowercase, uppercase, digits and symbols a password must mix"`
+	PasswordBreachedList string `env:"PASSWORD_BREACHED_LIST"                                      usage:"SHA-1 breached password list: a file of digests or a directory of k-anonymity range files"`
+
+	PasswordHashMemory      int `env:"PASSWORD_HASH_MEMORY"      default:"65536" validate:"min=8192"      usage:"argon2id memory cost in KiB; hashes with other costs are upgraded on sign-in"`
+	PasswordHashIterations  int `env:"PASSWORD_HASH_ITERATIONS"  default:"3"     validate:"min=1,max=100" usage:"argon2id time cost"`
+	PasswordHashParallelism int `env:"PASSWORD_HASH_PARALLELISM" default:"2"     validate:"min=1,max=255" usage:"argon2id parallelism"`
+
+	PasswordHashConcurrency int `env:"PASSWORD_HASH_CONCURRENCY" default:"4" validate:"min=1" usage:"how many requests may hash passwords at once; excess requests get a 429"`
+
+	LoginAccountDelayAfter int           `env:"LOGIN_ACCOUNT_DELAY_AFTER" default:"3"     validate:"min=1"  usage:"failed logins of an account before each further attempt is delayed, doubling from one second"`
+	LoginAccountLockAfter  int           `env:"LOGIN_ACCOUNT_LOCK_AFTER"  default:"10"    validate:"min=1"  usage:"failed logins of an account that lock it for LOGIN_LOCKOUT_DURATION"`
+	LoginIPDelayAfter      int           `env:"LOGIN_IP_DELAY_AFTER"      default:"20"    validate:"min=1"  usage:"failed logins from a client IP before each further attempt is delayed"`
+	LoginIPLockAfter       int           `env:"LOGIN_IP_LOCK_AFTER"       default:"100"   validate:"min=1"  usage:"failed logins from a client IP that block it for LOGIN_LOCKOUT_DURATION"`
+	LoginMaxDelay          time.Duration `env:"LOGIN_MAX_DELAY"           default:"1m"    validate:"min=1s" usage:"longest delay between failed logins before the lockout"`
+	LoginLockoutDuration   time.Duration `env:"LOGIN_LOCKOUT_DURATION"    default:"15m"   validate:"min=1m" usage:"how long lockouts last and failed logins are remembered"`
+	TrustProxyHeaders      bool          `env:"TRUST_PROXY_HEADERS"       default:"false"                   usage:"take the client IP from X-Forwarded-For, as set by a reverse proxy in front of sesamo"`
+
+	EnumerationProtection bool `env:"ENUMERATION_PROTECTION" default:"false" usage:"answer register like forgot-password, the same whether or not the email is taken, and tell the owner of a taken email by mail instead"`
+
+	ReauthWindow time.Duration `env:"REAUTH_WINDOW" default:"5m" validate:"min=1m" usage:"how recent a sign-in must be for sensitive changes without the current password"`
+
+	MfaIssuer       string        `env:"MFA_ISSUER"        default:"Sesamo"                   usage:"issuer shown by authenticator apps next to TOTP codes"`
+	MfaChallengeTTL time.Duration `env:"MFA_CHALLENGE_TTL" default:"5m"     validate:"min=1m" usage:"how long after the password step the second login step may be completed"`
+
+	WebauthnRPID    string        `env:"WEBAUTHN_RP_ID"                                    usage:"domain passkeys are bound to; the host of APP_URL when empty"`
+	WebauthnOrigins []string      `env:"WEBAUTHN_ORIGINS"              validate:"dive,url" usage:"comma separated origins allowed to use passkeys; the origin of APP_URL when empty"`
+	WebauthnTimeout time.Duration `env:"WEBAUTHN_TIMEOUT" default:"5m" validate:"min=30s"  usage:"how long a passkey registration or login may take"`
+
+	AccessTokenMaxTTL time.Duration `env:"ACCESS_TOKEN_MAX_TTL" default:"8760h" validate:"min=1h" usage:"longest lifetime a personal access token may be created with"`
+
+	SessionTTL         time.Duration `env:"SESSION_TTL"           default:"12h" validate:"min=5m" usage:"lifetime of the browser session that signs users in to OAuth clients without asking again"`
+	OidcSigningKeyFile string        `env:"OIDC_SIGNING_KEY_FILE"                                 usage:"PEM file with the RSA private key signing ID tokens; a key generated at start, and lost on restart, when empty"`
+
+	ForwardAuthCacheTTL time.Duration `env:"FORWARD_AUTH_CACHE_TTL" default:"10s" validate:"max=5m" usage:"how long /auth/verify remembers an allowed request, which may outlive the revocation of its credentials as long; 0 disables the cache"`
+}
@@ -0,0 +1,267 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/joho/godotenv"
+)
+
+const envFileVariable = "SESAMO_ENV_FILE"
+const defaultEnvFile = ".env"
+
+// variable describes one Config field as read from its struct tags.
+type variable struct {
+	index    int
+	env      string
+	flag     string
+	def      string
+	usage    string
+	required bool
+	secret   bool
+}
+
+// Load builds a Config. Each variable is resolved from, in increasing order of
+// precedence: its default tag, the env file, the process environment, the file
+// named by <VAR>_FILE (Docker and Kubernetes secrets) and the command-line
+// flag. The env file is -env-file, $SESAMO_ENV_FILE or ./.env when present.
+//
+// Config flags are registered on fs and parsed from args, so the remaining
+// arguments are left in fs.Args(). Every missing or invalid value is reported
+// in the returned error, not just the first one.
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+	variables := describe()
+
+	envFile := fs.String(
+		"env-file",
+		os.Getenv(envFileVariable),
+		"optional dotenv file with configuration ($"+envFileVariable+")",
+	)
+
+	flagValues := map[string]string{}
+	for _, v := range variables {
+		env := v.env
+		usage := fmt.Sprintf("%s ($%s)", v.usage, v.env)
+		if v.def != "" {
+			usage += fmt.Sprintf(" (default %s)", v.def)
+		}
+
+		fs.Func(v.flag, usage, func(value string) error {
+			flagValues[env] = value
+			return nil
+		})
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	fileValues, err := readEnvFile(*envFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	target := reflect.ValueOf(cfg).Elem()
+
+	var errs []error
+	failed := map[string]bool{}
+	for _, v := range variables {
+		raw, found, err := resolve(v, flagValues, fileValues)
+		if err != nil {
+			errs = append(errs, err)
+			failed[v.env] = true
+			continue
+		}
+
+		if !found || raw == "" {
+			if v.required {
+				errs = append(errs, fmt.Errorf("%s: is required", v.env))
+				failed[v.env] = true
+				continue
+			}
+			raw = v.def
+		}
+
+		if raw == "" {
+			continue
+		}
+
+		if err := assign(target.Field(v.index), raw); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", v.env, err))
+			failed[v.env] = true
+		}
+	}
+
+	errs = append(errs, validate(cfg, variables, failed)...)
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+
+	return cfg, nil
+}
+
+func describe() []variable {
+	configType := reflect.TypeOf(Config{})
+	variables := make([]variable, 0, configType.NumField())
+
+	for i := range configType.NumField() {
+		field := configType.Field(i)
+		env := field.Tag.Get("env")
+		if env == "" {
+			continue
+		}
+
+		flagName := field.Tag.Get("flag")
+		if flagName == "" {
+			flagName = strings.ReplaceAll(strings.ToLower(env), "_", "-")
+		}
+
+		variables = append(variables, variable{
+			index:    i,
+			env:      env,
+			flag:     flagName,
+			def:      field.Tag.Get("default"),
+			usage:    field.Tag.Get("usage"),
+			required: field.Tag.Get("required") == "true",
+			secret:   field.Tag.Get("secret") == "true",
+		})
+	}
+
+	return variables
+}
+
+func readEnvFile(path string) (map[string]string, error) {
+	if path == "" {
+		if _, err := os.Stat(defaultEnvFile); err != nil {
+			return map[string]string{}, nil
+		}
+		path = defaultEnvFile
+	}
+
+	values, err := godotenv.Read(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading env file: %w", err)
+	}
+
+	return values, nil
+}
+
+func resolve(
+	v variable,
+	flagValues map[string]string,
+	fileValues map[string]string,
+) (string, bool, error) {
+	if value, ok := flagValues[v.env]; ok {
+		return value, true, nil
+	}
+
+	if path := os.Getenv(v.env + "_FILE"); path != "" {
+		if _, ok := os.LookupEnv(v.env); ok {
+			return "", false, fmt.Errorf("%s: both %s and %s_FILE are set", v.env, v.env, v.env)
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return "", false, fmt.Errorf("%s_FILE: %w", v.env, err)
+		}
+
+		return strings.TrimRight(string(content), "\r\n"), true, nil
+	}
+
+	if value, ok := os.LookupEnv(v.env); ok {
+		return value, true, nil
+	}
+
+	value, ok := fileValues[v.env]
+	return value, ok, nil
+}
+
+func assign(field reflect.Value, raw string) error {
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		duration, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", raw)
+		}
+		field.SetInt(int64(duration))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Bool:
+		value, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", raw)
+		}
+		field.SetBool(value)
+	case reflect.Int, reflect.Int64:
+		value, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", raw)
+		}
+		field.SetInt(value)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+
+	return nil
+}
+
+// validate applies the validate tags, skipping variables that already failed
+// to resolve or parse so each one is reported once.
+func validate(cfg *Config, variables []variable, failed map[string]bool) []error {
+	err := validator.New().Struct(cfg)
+
+	var validationErrors validator.ValidationErrors
+	if !errors.As(err, &validationErrors) {
+		if err != nil {
+			return []error{err}
+		}
+		return nil
+	}
+
+	byField := map[string]variable{}
+	configType := reflect.TypeOf(Config{})
+	for _, v := range variables {
+		byField[configType.Field(v.index).Name] = v
+	}
+
+	var errs []error
+	for _, fe := range validationErrors {
+		v := byField[fe.StructField()]
+		if failed[v.env] {
+			continue
+		}
+
+		rule := fe.Tag()
+		if fe.Param() != "" {
+			rule += "=" + fe.Param()
+		}
+
+		if v.secret {
+			errs = append(errs, fmt.Errorf("%s: does not satisfy %s", v.env, rule))
+		} else {
+			errs = append(errs, fmt.Errorf("%s: %v does not satisfy %s", v.env, fe.Value(), rule))
+		}
+	}
+
+	return errs
+}
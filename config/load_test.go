@@ -0,0 +1,80 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type LoadTestSuite struct {
+	suite.Suite
+}
+
+func TestLoadTestSuite(t *testing.T) {
+	suite.Run(t, new(LoadTestSuite))
+}
+
+func (suite *LoadTestSuite) SetupTest() {
+	for _, v := range describe() {
+		suite.T().Setenv(v.env, "")
+		os.Unsetenv(v.env)
+	}
+	suite.T().Setenv(envFileVariable, "")
+}
+
+func (suite *LoadTestSuite) load(args ...string) (*Config, error) {
+	return Load(flag.NewFlagSet("test", flag.ContinueOnError), args)
+}
+
+func (suite *LoadTestSuite) TestDefaultsAndPrecedence() {
+	envFile := filepath.Join(suite.T().TempDir(), "sesamo.env")
+	suite.NoError(os.WriteFile(envFile, []byte("HTTP_SERVER_PORT=4000\nJWT_EXPIRATION_IN_SECONDS=120\n"), 0o600))
+
+	suite.T().Setenv("DATABASE_URL", "postgres://sesamo@localhost/sesamo")
+	suite.T().Setenv("JWT_SECRET", "0123456789abcdef")
+	suite.T().Setenv("JWT_EXPIRATION_IN_SECONDS", "900")
+
+	cfg, err := suite.load("-env-file", envFile, "-port", "5000")
+	suite.Require().NoError(err)
+
+	suite.Equal(int64(5000), cfg.Port)
+	suite.Equal(int64(900), cfg.JwtExpirationInSeconds)
+	suite.False(cfg.MigrateOnStart)
+	suite.Empty(cfg.MicrosoftTenantId)
+}
+
+func (suite *LoadTestSuite) TestSecretFromFile() {
+	secretFile := filepath.Join(suite.T().TempDir(), "jwt_secret")
+	suite.NoError(os.WriteFile(secretFile, []byte("fedcba9876543210\n"), 0o600))
+
+	suite.T().Setenv("DATABASE_URL", "postgres://sesamo@localhost/sesamo")
+	suite.T().Setenv("JWT_SECRET_FILE", secretFile)
+
+	cfg, err := suite.load()
+	suite.Require().NoError(err)
+	suite.Equal("fedcba9876543210", cfg.JwtSecret)
+}
+
+func (suite *LoadTestSuite) TestReportsEveryInvalidValue() {
+	suite.T().Setenv("HTTP_SERVER_PORT", "http")
+	suite.T().Setenv("JWT_SECRET", "short")
+	suite.T().Setenv("JWT_EXPIRATION_IN_SECONDS", "10")
+	suite.T().Setenv("MIGRATE_ON_START", "maybe")
+
+	_, err := suite.load()
+	suite.Require().Error(err)
+
+	for _, expected := range []string{
+		"DATABASE_URL: is required",
+		`HTTP_SERVER_PORT: invalid integer "http"`,
+		"JWT_SECRET: does not satisfy min=16",
+		"JWT_EXPIRATION_IN_SECONDS: 10 does not satisfy min=60",
+		`MIGRATE_ON_START: invalid boolean "maybe"`,
+	} {
+		suite.Contains(err.Error(), expected)
+	}
+	suite.NotContains(err.Error(), "short")
+}
@@ -2,21 +2,28 @@ package db
 
 import (
 	"context"
+	"database/sql/driver"
 	"embed"
+	"fmt"
 	"time"
 
+	"github.com/XSAM/otelsql"
 	"github.com/diegodario88/sesamo/config"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/stdlib"
 	"github.com/jmoiron/sqlx"
-	"github.com/pressly/goose/v3"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 //go:embed migrations/*.sql
 var Migrations embed.FS
 
-func CreateStorageConn() (*sqlx.DB, error) {
-	DB, err := setup(config.Variables.DatabaseUrl)
+// CreateStorageConn connects to the database. It never changes the schema:
+// migrations are applied by `sesamo migrate up` or, when opted in, by Migrate
+// at startup.
+func CreateStorageConn(cfg *config.Config) (*sqlx.DB, error) {
+	DB, err := setup(cfg.DatabaseUrl)
 	if err != nil {
 		return nil, err
 	}
@@ -29,7 +36,11 @@ func CreateStorageConn() (*sqlx.DB, error) {
 }
 
 func setup(uri string) (*sqlx.DB, error) {
-	connConfig, _ := pgx.ParseConfig(uri)
+	connConfig, err := pgx.ParseConfig(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid database url: %w", err)
+	}
+
 	afterConnect := stdlib.OptionAfterConnect(func(ctx context.Context, conn *pgx.Conn) error {
 		_, err := conn.Exec(ctx, `
     SET SESSION "some.key" = 'somekey';
@@ -41,16 +52,29 @@ func setup(uri string) (*sqlx.DB, error) {
 		return nil
 	})
 
-	pgxdb := stdlib.OpenDB(*connConfig, afterConnect)
-	goose.SetBaseFS(Migrations)
-
-	if err := goose.SetDialect("postgres"); err != nil {
-		panic(err)
-	}
-
-	if err := goose.Up(pgxdb, "migrations"); err != nil {
-		panic(err)
-	}
+	connector := stdlib.GetConnector(*connConfig, afterConnect)
+	pgxdb := otelsql.OpenDB(
+		connector,
+		otelsql.WithAttributes(semconv.DBSystemPostgreSQL),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{
+			OmitConnResetSession: true,
+			OmitConnPrepare:      true,
+			OmitRows:             true,
+			SpanFilter:           hasParentSpan,
+		}),
+	)
 
 	return sqlx.NewDb(pgxdb, "pgx"), nil
 }
+
+// hasParentSpan keeps SQL spans to statements issued on behalf of a traced
+// request or message, instead of starting a root trace for every pool
+// connect, ACK or metrics scrape.
+func hasParentSpan(
+	ctx context.Context,
+	method otelsql.Method,
+	query string,
+	args []driver.NamedValue,
+) bool {
+	return trace.SpanContextFromContext(ctx).IsValid()
+}
@@ -0,0 +1,118 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pressly/goose/v3"
+	"github.com/pressly/goose/v3/lock"
+)
+
+var ErrSchemaBehind = errors.New("database schema is behind the embedded migrations")
+
+// NewMigrator returns a goose provider over the embedded migrations, so
+// callers get structured results instead of goose's log output. Operations
+// that change the schema hold a Postgres advisory lock, which serializes
+// replicas that migrate at the same time.
+func NewMigrator(storage *sqlx.DB) (*goose.Provider, error) {
+	migrations, err := fs.Sub(Migrations, "migrations")
+	if err != nil {
+		return nil, fmt.Errorf("NewMigrator: %w", err)
+	}
+
+	locker, err := lock.NewPostgresSessionLocker()
+	if err != nil {
+		return nil, fmt.Errorf("NewMigrator: %w", err)
+	}
+
+	provider, err := goose.NewProvider(
+		goose.DialectPostgres,
+		storage.DB,
+		migrations,
+		goose.WithSessionLocker(locker),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("NewMigrator: %w", err)
+	}
+
+	return provider, nil
+}
+
+// Migrate applies every pending migration of provider.
+func Migrate(ctx context.Context, provider *goose.Provider) ([]*goose.MigrationResult, error) {
+	results, err := provider.Up(ctx)
+	if err != nil {
+		return results, fmt.Errorf("Migrate: %w", err)
+	}
+
+	return results, nil
+}
+
+// appliedVersionsQuery lists the applied migration versions. goose records
+// every apply and rollback as a row, so the newest row of a version decides
+// whether it is applied; version 0 marks the table's creation.
+const appliedVersionsQuery = `SELECT version_id FROM (
+    SELECT DISTINCT ON (version_id) version_id, is_applied
+    FROM goose_db_version
+    ORDER BY version_id, id DESC
+) latest
+WHERE is_applied AND version_id > 0`
+
+// PendingMigrations returns the versions of the migrations of provider that
+// storage has not applied yet. Unlike provider.Status it only reads the
+// version table, so it neither waits for the migration lock nor creates the
+// table, and works for database users without DDL privileges.
+func PendingMigrations(
+	ctx context.Context,
+	storage *sqlx.DB,
+	provider *goose.Provider,
+) ([]int64, error) {
+	var exists bool
+	err := storage.GetContext(ctx, &exists, `SELECT to_regclass('goose_db_version') IS NOT NULL`)
+	if err != nil {
+		return nil, fmt.Errorf("PendingMigrations: %w", err)
+	}
+
+	var applied []int64
+	if exists {
+		if err := storage.SelectContext(ctx, &applied, appliedVersionsQuery); err != nil {
+			return nil, fmt.Errorf("PendingMigrations: %w", err)
+		}
+	}
+
+	return PendingVersions(provider.ListSources(), applied), nil
+}
+
+// CheckSchema reports ErrSchemaBehind when any embedded migration has not
+// been applied. It compares every version rather than the newest one, so a
+// migration merged below the database version is caught too. Like
+// PendingMigrations, it only reads the version table.
+func CheckSchema(ctx context.Context, storage *sqlx.DB, provider *goose.Provider) error {
+	pending, err := PendingMigrations(ctx, storage, provider)
+	if err != nil {
+		return fmt.Errorf("CheckSchema: %w", err)
+	}
+
+	if len(pending) > 0 {
+		return fmt.Errorf("%w: versions %v are pending", ErrSchemaBehind, pending)
+	}
+
+	return nil
+}
+
+// PendingVersions lists the versions of sources missing from applied, in the
+// order goose would apply them.
+func PendingVersions(sources []*goose.Source, applied []int64) []int64 {
+	var pending []int64
+	for _, source := range sources {
+		if !slices.Contains(applied, source.Version) {
+			pending = append(pending, source.Version)
+		}
+	}
+
+	return pending
+}
@@ -0,0 +1,37 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/pressly/goose/v3"
+	"github.com/stretchr/testify/suite"
+)
+
+type MigrateTestSuite struct {
+	suite.Suite
+}
+
+func TestMigrateTestSuite(t *testing.T) {
+	suite.Run(t, new(MigrateTestSuite))
+}
+
+func migrationSources(versions ...int64) []*goose.Source {
+	sources := make([]*goose.Source, 0, len(versions))
+	for _, version := range versions {
+		sources = append(sources, &goose.Source{Type: goose.TypeSQL, Version: version})
+	}
+
+	return sources
+}
+
+func (suite *MigrateTestSuite) TestPendingVersionsFindsGaps() {
+	suite.Equal([]int64{2}, PendingVersions(migrationSources(1, 2, 3), []int64{1, 3}))
+}
+
+func (suite *MigrateTestSuite) TestPendingVersionsIsEmptyWhenUpToDate() {
+	suite.Empty(PendingVersions(migrationSources(1, 2), []int64{1, 2}))
+}
+
+func (suite *MigrateTestSuite) TestPendingVersionsWithoutVersionTable() {
+	suite.Equal([]int64{1, 2}, PendingVersions(migrationSources(1, 2), nil))
+}
@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS status text NOT NULL DEFAULT 'active'
+        CHECK (status IN ('active', 'disabled', 'locked', 'pending_verification')),
+    ADD COLUMN IF NOT EXISTS status_reason text,
+    ADD COLUMN IF NOT EXISTS status_changed_at timestamp(0),
+    ADD COLUMN IF NOT EXISTS tokens_valid_after timestamp;
+
+CREATE INDEX IF NOT EXISTS users_status_idx ON users (status);
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS users_status_idx;
+
+ALTER TABLE users
+    DROP COLUMN IF EXISTS status,
+    DROP COLUMN IF EXISTS status_reason,
+    DROP COLUMN IF EXISTS status_changed_at,
+    DROP COLUMN IF EXISTS tokens_valid_after;
+
+-- +goose StatementEnd
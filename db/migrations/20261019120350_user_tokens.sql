@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS user_tokens (
+    id ulid NOT NULL DEFAULT gen_monotonic_ulid () PRIMARY KEY,
+    user_id ulid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    purpose text NOT NULL,
+    token_hash text NOT NULL UNIQUE,
+    data text,
+    expires_at timestamp(0) NOT NULL,
+    used_at timestamp(0),
+    created_at timestamp(0) NOT NULL DEFAULT (now() at time zone 'utc')
+);
+
+CREATE INDEX IF NOT EXISTS user_tokens_user_purpose_idx ON user_tokens (user_id, purpose);
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS user_tokens;
+
+-- +goose StatementEnd
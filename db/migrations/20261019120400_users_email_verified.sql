@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS email_verified_at timestamp(0);
+
+-- Accounts created before verification existed are trusted as they are.
+UPDATE
+    users
+SET
+    email_verified_at = created_at
+WHERE
+    email_verified_at IS NULL;
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE users
+    DROP COLUMN IF EXISTS email_verified_at;
+
+-- +goose StatementEnd
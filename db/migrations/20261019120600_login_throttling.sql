@@ -0,0 +1,30 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS failed_logins integer NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS last_failed_login_at timestamp(0);
+
+CREATE TABLE IF NOT EXISTS audit_events (
+    id ulid NOT NULL DEFAULT gen_monotonic_ulid () PRIMARY KEY,
+    action text NOT NULL,
+    actor_id ulid,
+    user_id ulid,
+    ip text,
+    details jsonb NOT NULL DEFAULT '{}',
+    created_at timestamp(0) NOT NULL DEFAULT (now() at time zone 'utc')
+);
+
+CREATE INDEX IF NOT EXISTS audit_events_user_idx ON audit_events (user_id, created_at);
+
+CREATE INDEX IF NOT EXISTS audit_events_action_idx ON audit_events (action, created_at);
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS audit_events;
+
+ALTER TABLE users
+    DROP COLUMN IF EXISTS failed_logins,
+    DROP COLUMN IF EXISTS last_failed_login_at;
+
+-- +goose StatementEnd
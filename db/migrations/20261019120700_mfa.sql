@@ -0,0 +1,41 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS totp_secret text,
+    ADD COLUMN IF NOT EXISTS totp_enabled_at timestamp(0),
+    ADD COLUMN IF NOT EXISTS totp_last_step bigint;
+
+CREATE TABLE IF NOT EXISTS user_recovery_codes (
+    id ulid NOT NULL DEFAULT gen_monotonic_ulid () PRIMARY KEY,
+    user_id ulid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    code_hash text NOT NULL,
+    used_at timestamp(0),
+    created_at timestamp(0) NOT NULL DEFAULT (now() at time zone 'utc'),
+    UNIQUE (user_id, code_hash)
+);
+
+ALTER TABLE roles
+    ADD COLUMN IF NOT EXISTS require_mfa boolean NOT NULL DEFAULT FALSE;
+
+ALTER TABLE organizations
+    ADD COLUMN IF NOT EXISTS require_mfa boolean NOT NULL DEFAULT FALSE;
+
+UPDATE roles SET require_mfa = TRUE WHERE name = 'super_admin';
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE organizations
+    DROP COLUMN IF EXISTS require_mfa;
+
+ALTER TABLE roles
+    DROP COLUMN IF EXISTS require_mfa;
+
+DROP TABLE IF EXISTS user_recovery_codes;
+
+ALTER TABLE users
+    DROP COLUMN IF EXISTS totp_secret,
+    DROP COLUMN IF EXISTS totp_enabled_at,
+    DROP COLUMN IF EXISTS totp_last_step;
+
+-- +goose StatementEnd
@@ -0,0 +1,39 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS webauthn_credentials (
+    id ulid NOT NULL DEFAULT gen_monotonic_ulid () PRIMARY KEY,
+    user_id ulid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    name text NOT NULL,
+    credential_id bytea NOT NULL UNIQUE,
+    public_key bytea NOT NULL,
+    attestation_type text NOT NULL DEFAULT '',
+    transports text NOT NULL DEFAULT '',
+    aaguid bytea,
+    flags smallint NOT NULL DEFAULT 0,
+    sign_count bigint NOT NULL DEFAULT 0,
+    last_used_at timestamp(0),
+    created_at timestamp(0) NOT NULL DEFAULT (now() at time zone 'utc')
+);
+
+CREATE INDEX IF NOT EXISTS webauthn_credentials_user_idx ON webauthn_credentials (user_id);
+
+CREATE TABLE IF NOT EXISTS webauthn_sessions (
+    id ulid NOT NULL DEFAULT gen_monotonic_ulid () PRIMARY KEY,
+    user_id ulid REFERENCES users (id) ON DELETE CASCADE,
+    purpose text NOT NULL,
+    token_hash text NOT NULL UNIQUE,
+    data text NOT NULL,
+    expires_at timestamp(0) NOT NULL,
+    created_at timestamp(0) NOT NULL DEFAULT (now() at time zone 'utc')
+);
+
+CREATE INDEX IF NOT EXISTS webauthn_sessions_expires_idx ON webauthn_sessions (expires_at);
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS webauthn_sessions;
+
+DROP TABLE IF EXISTS webauthn_credentials;
+
+-- +goose StatementEnd
@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS personal_access_tokens (
+    id ulid NOT NULL DEFAULT gen_monotonic_ulid () PRIMARY KEY,
+    user_id ulid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    name text NOT NULL,
+    token_hash text NOT NULL UNIQUE,
+    scopes text[] NOT NULL,
+    organization_id ulid REFERENCES organizations (id) ON DELETE CASCADE,
+    expires_at timestamp(0) NOT NULL,
+    last_used_at timestamp(0),
+    last_used_ip text,
+    created_at timestamp NOT NULL DEFAULT (now() at time zone 'utc')
+);
+
+CREATE INDEX IF NOT EXISTS personal_access_tokens_user_idx ON personal_access_tokens (user_id);
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS personal_access_tokens;
+
+-- +goose StatementEnd
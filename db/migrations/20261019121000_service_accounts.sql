@@ -0,0 +1,73 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS service_accounts (
+    id ulid NOT NULL DEFAULT gen_monotonic_ulid () PRIMARY KEY,
+    organization_id ulid NOT NULL REFERENCES organizations (id) ON DELETE CASCADE,
+    name text NOT NULL,
+    client_id text NOT NULL UNIQUE,
+    secret_hash text,
+    public_key text,
+    disabled_at timestamp(0),
+    tokens_valid_after timestamp,
+    created_at timestamp(0) NOT NULL DEFAULT (now() at time zone 'utc'),
+    updated_at timestamp(0) NOT NULL DEFAULT (now() at time zone 'utc'),
+    UNIQUE (id, organization_id),
+    CONSTRAINT has_credential CHECK (secret_hash IS NOT NULL OR public_key IS NOT NULL)
+);
+
+-- Roles of service accounts, shaped like user_roles. A service account only
+-- holds organization and branch roles of the organization that owns it.
+CREATE TABLE IF NOT EXISTS service_account_roles (
+    service_account_id ulid NOT NULL,
+    role_id ulid NOT NULL REFERENCES roles (id) ON DELETE CASCADE,
+    organization_id ulid NOT NULL,
+    branch_id ulid REFERENCES branches (id) ON DELETE CASCADE,
+    branch_id_key ulid GENERATED ALWAYS AS (COALESCE(branch_id, '00000000000000000000000000'::ulid)) STORED,
+    created_at timestamp(0) NOT NULL DEFAULT (now() at time zone 'utc'),
+    PRIMARY KEY (service_account_id, role_id, branch_id_key),
+    FOREIGN KEY (service_account_id, organization_id) REFERENCES service_accounts (id, organization_id) ON DELETE CASCADE,
+    CONSTRAINT scope_consistency CHECK (scope_matches_assignment (role_id, organization_id, branch_id))
+);
+
+-- Client assertions already redeemed, kept until they expire so none is
+-- accepted twice.
+CREATE TABLE IF NOT EXISTS client_assertions (
+    client_id text NOT NULL,
+    jti text NOT NULL,
+    expires_at timestamp(0) NOT NULL,
+    PRIMARY KEY (client_id, jti)
+);
+
+CREATE INDEX IF NOT EXISTS client_assertions_expires_idx ON client_assertions (expires_at);
+
+-- Role assignments of every principal, people and machines alike, for the
+-- permission checks.
+CREATE OR REPLACE VIEW principal_roles AS
+SELECT
+    user_id AS principal_id,
+    role_id,
+    organization_id,
+    branch_id
+FROM
+    user_roles
+UNION ALL
+SELECT
+    service_account_id,
+    role_id,
+    organization_id,
+    branch_id
+FROM
+    service_account_roles;
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP VIEW IF EXISTS principal_roles;
+
+DROP TABLE IF EXISTS client_assertions;
+
+DROP TABLE IF EXISTS service_account_roles;
+
+DROP TABLE IF EXISTS service_accounts;
+
+-- +goose StatementEnd
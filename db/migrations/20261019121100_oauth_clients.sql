@@ -0,0 +1,34 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Applications that sign users in through sesamo. Public clients, such as
+-- single-page and mobile apps, have no secret and rely on PKCE alone.
+CREATE TABLE IF NOT EXISTS oauth_clients (
+    id ulid NOT NULL DEFAULT gen_monotonic_ulid () PRIMARY KEY,
+    client_id text NOT NULL UNIQUE,
+    name text NOT NULL,
+    secret_hash text,
+    redirect_uris text[] NOT NULL,
+    first_party boolean NOT NULL DEFAULT false,
+    created_at timestamp(0) NOT NULL DEFAULT (now() at time zone 'utc'),
+    updated_at timestamp(0) NOT NULL DEFAULT (now() at time zone 'utc')
+);
+
+-- Scopes users allowed each client to ask for, so the consent screen is only
+-- shown again when a client asks for more.
+CREATE TABLE IF NOT EXISTS oauth_consents (
+    user_id ulid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    client_id text NOT NULL REFERENCES oauth_clients (client_id) ON DELETE CASCADE,
+    scopes text[] NOT NULL,
+    created_at timestamp(0) NOT NULL DEFAULT (now() at time zone 'utc'),
+    updated_at timestamp(0) NOT NULL DEFAULT (now() at time zone 'utc'),
+    PRIMARY KEY (user_id, client_id)
+);
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS oauth_consents;
+
+DROP TABLE IF EXISTS oauth_clients;
+
+-- +goose StatementEnd
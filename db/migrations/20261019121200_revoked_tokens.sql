@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Access tokens revoked before they expire. Tokens are JWTs sesamo does not
+-- store, so they are refused by hash until expires_at, when they would be
+-- refused anyway.
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+    token_hash text NOT NULL PRIMARY KEY,
+    expires_at timestamp(0) NOT NULL,
+    created_at timestamp(0) NOT NULL DEFAULT (now() at time zone 'utc')
+);
+
+CREATE INDEX IF NOT EXISTS revoked_tokens_expires_idx ON revoked_tokens (expires_at);
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS revoked_tokens;
+
+-- +goose StatementEnd
@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Clients allowed to call the introspection endpoint, which describes the
+-- tokens of any user, as RFC 7662 section 4 asks.
+ALTER TABLE oauth_clients
+    ADD COLUMN IF NOT EXISTS can_introspect boolean NOT NULL DEFAULT false;
+
+ALTER TABLE service_accounts
+    ADD COLUMN IF NOT EXISTS can_introspect boolean NOT NULL DEFAULT false;
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE service_accounts
+    DROP COLUMN IF EXISTS can_introspect;
+
+ALTER TABLE oauth_clients
+    DROP COLUMN IF EXISTS can_introspect;
+
+-- +goose StatementEnd
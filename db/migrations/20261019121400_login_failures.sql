@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Failed logins are counted per email, registered or not, so that locking out
+-- an address does not tell whether it has an account. email_hash is the
+-- SHA-256 of the normalized address.
+CREATE TABLE IF NOT EXISTS login_failures (
+    email_hash text NOT NULL PRIMARY KEY,
+    failures integer NOT NULL,
+    last_failed_at timestamp NOT NULL
+);
+
+ALTER TABLE users
+    DROP COLUMN IF EXISTS failed_logins,
+    DROP COLUMN IF EXISTS last_failed_login_at;
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS failed_logins integer NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS last_failed_login_at timestamp(0);
+
+DROP TABLE IF EXISTS login_failures;
+
+-- +goose StatementEnd
@@ -0,0 +1,118 @@
+-- +goose Up
+-- +goose StatementBegin
+-- A message NACKed max_attempts times is moved to mq.dead_letter instead of
+-- being retried forever; `sesamo mq dlq replay` publishes it to its queue
+-- again.
+ALTER TABLE mq.queue
+    ADD COLUMN IF NOT EXISTS max_attempts int NOT NULL DEFAULT 5;
+
+ALTER TABLE mq.message
+    ADD COLUMN IF NOT EXISTS attempts int NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS mq.dead_letter (
+    message_id bigint PRIMARY KEY,
+    exchange_id int NOT NULL REFERENCES mq.exchange (exchange_id) ON DELETE CASCADE,
+    routing_key text NOT NULL,
+    body json NOT NULL,
+    headers hstore NOT NULL DEFAULT '',
+    publish_time timestamptz NOT NULL,
+    queue_id bigint NOT NULL REFERENCES mq.queue (queue_id) ON DELETE CASCADE,
+    attempts int NOT NULL,
+    dead_time timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX ON mq.dead_letter (queue_id);
+
+CREATE OR REPLACE PROCEDURE mq.nack (delivery_id bigint, retry_after interval DEFAULT '0s' ::interval)
+LANGUAGE plpgsql
+AS $$
+DECLARE
+    delivery RECORD;
+    message RECORD;
+BEGIN
+    SELECT
+        * INTO delivery
+    FROM
+        mq.delivery d
+    WHERE
+        d.delivery_id = nack.delivery_id;
+    IF delivery IS NULL THEN
+        RAISE WARNING 'No such delivery';
+        RETURN;
+    END IF;
+    DELETE FROM mq.delivery d
+    WHERE d.delivery_id = nack.delivery_id;
+    UPDATE
+        mq.message m
+    SET
+        attempts = m.attempts + 1
+    WHERE
+        m.message_id = delivery.message_id
+    RETURNING
+        m.* INTO message;
+    IF FOUND AND message.attempts >= (
+        SELECT
+            q.max_attempts
+        FROM
+            mq.queue q
+        WHERE
+            q.queue_id = delivery.queue_id) THEN
+        INSERT INTO mq.dead_letter (message_id, exchange_id, routing_key, body, headers, publish_time, queue_id, attempts)
+            VALUES (message.message_id, message.exchange_id, message.routing_key, message.body, message.headers, message.publish_time, message.queue_id, message.attempts);
+        DELETE FROM mq.message m
+        WHERE m.message_id = message.message_id;
+        RAISE NOTICE 'Dead-lettered message % after % attempts', message.message_id, message.attempts;
+    ELSE
+        INSERT INTO mq.message_waiting (message_id, queue_id, not_until_time)
+            VALUES (delivery.message_id, delivery.queue_id, now() + nack.retry_after)
+        ON CONFLICT
+            DO NOTHING;
+    END IF;
+    INSERT INTO mq.channel_waiting (channel_id, slot, queue_id)
+        VALUES (delivery.channel_id, delivery.slot, delivery.queue_id)
+    ON CONFLICT
+        DO NOTHING;
+END;
+$$;
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+CREATE OR REPLACE PROCEDURE mq.nack (delivery_id bigint, retry_after interval DEFAULT '0s' ::interval)
+LANGUAGE plpgsql
+AS $$
+DECLARE
+    delivery RECORD;
+BEGIN
+    SELECT
+        * INTO delivery
+    FROM
+        mq.delivery d
+    WHERE
+        d.delivery_id = nack.delivery_id;
+    IF delivery IS NULL THEN
+        RAISE WARNING 'No such delivery';
+        RETURN;
+    END IF;
+    DELETE FROM mq.delivery d
+    WHERE d.delivery_id = nack.delivery_id;
+    INSERT INTO mq.message_waiting (message_id, queue_id, not_until_time)
+        VALUES (delivery.message_id, delivery.queue_id, now() + nack.retry_after)
+    ON CONFLICT
+        DO NOTHING;
+    INSERT INTO mq.channel_waiting (channel_id, slot, queue_id)
+        VALUES (delivery.channel_id, delivery.slot, delivery.queue_id)
+    ON CONFLICT
+        DO NOTHING;
+END;
+$$;
+
+DROP TABLE IF EXISTS mq.dead_letter;
+
+ALTER TABLE mq.message
+    DROP COLUMN IF EXISTS attempts;
+
+ALTER TABLE mq.queue
+    DROP COLUMN IF EXISTS max_attempts;
+
+-- +goose StatementEnd
@@ -0,0 +1,71 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/diegodario88/sesamo/config"
+	"github.com/diegodario88/sesamo/db"
+	"github.com/jmoiron/sqlx"
+	"github.com/pressly/goose/v3"
+)
+
+// Database pings the pool and reports its usage. A saturated pool, where
+// every connection is busy and callers are queueing, is degraded rather than
+// down: requests are slow but still served.
+func Database(storage *sqlx.DB) Check {
+	return func(ctx context.Context) Component {
+		stats := storage.Stats()
+		details := map[string]any{
+			"open_connections": stats.OpenConnections,
+			"in_use":           stats.InUse,
+			"idle":             stats.Idle,
+			"max_open":         stats.MaxOpenConnections,
+			"wait_count":       stats.WaitCount,
+		}
+
+		if err := storage.PingContext(ctx); err != nil {
+			return Down(fmt.Errorf("ping failed: %w", err), details)
+		}
+
+		if stats.MaxOpenConnections > 0 && stats.InUse >= stats.MaxOpenConnections {
+			return Component{
+				Status:  StatusDegraded,
+				Error:   "connection pool saturated",
+				Details: details,
+			}
+		}
+
+		return Up(details)
+	}
+}
+
+// Migrations fails when an embedded migration has not been applied, which
+// happens when a newer binary was rolled out before `migrate up`. Every probe
+// shares provider, and only reads the version table of storage.
+func Migrations(storage *sqlx.DB, provider *goose.Provider) Check {
+	return func(ctx context.Context) Component {
+		pending, err := db.PendingMigrations(ctx, storage, provider)
+		if err != nil {
+			return Down(err, nil)
+		}
+
+		if len(pending) > 0 {
+			return Down(db.ErrSchemaBehind, map[string]any{"pending": pending})
+		}
+
+		return Up(nil)
+	}
+}
+
+// SigningKey verifies that a key is available to sign access tokens.
+func SigningKey(cfg *config.Config) Check {
+	return func(ctx context.Context) Component {
+		if cfg.JwtSecret == "" {
+			return Down(errors.New("no signing key configured"), nil)
+		}
+
+		return Up(map[string]any{"algorithm": "HS256"})
+	}
+}
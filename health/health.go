@@ -0,0 +1,163 @@
+package health
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/diegodario88/sesamo/httphelper"
+	"github.com/diegodario88/sesamo/logging"
+)
+
+type Status string
+
+const (
+	StatusUp       Status = "up"
+	StatusDegraded Status = "degraded"
+	StatusDown     Status = "down"
+)
+
+// checkTimeout bounds every check so a hung dependency turns into a "down"
+// component instead of a hung probe.
+const checkTimeout = 2 * time.Second
+
+// Component is the outcome of one check.
+type Component struct {
+	Status   Status         `json:"status"`
+	Critical bool           `json:"critical"`
+	Error    string         `json:"error,omitempty"`
+	Details  map[string]any `json:"details,omitempty"`
+}
+
+type Report struct {
+	Status     Status               `json:"status"`
+	Components map[string]Component `json:"components"`
+}
+
+// publicReport is what the endpoints answer. They are unauthenticated, so
+// only the status of each check is shown; why a check failed is logged.
+type publicReport struct {
+	Status     Status                     `json:"status"`
+	Components map[string]publicComponent `json:"components"`
+}
+
+type publicComponent struct {
+	Status Status `json:"status"`
+}
+
+// Check inspects one dependency. It should honour ctx's deadline.
+type Check func(ctx context.Context) Component
+
+type registeredCheck struct {
+	name     string
+	critical bool
+	check    Check
+}
+
+// Registry holds the checks behind /ready and /health.
+type Registry struct {
+	checks []registeredCheck
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register adds a check. A critical check that is down makes the whole report
+// down, and the endpoints answer 503; anything else only degrades it.
+func (registry *Registry) Register(name string, critical bool, check Check) *Registry {
+	registry.checks = append(registry.checks, registeredCheck{name, critical, check})
+	return registry
+}
+
+// Run executes the checks concurrently. With criticalOnly set, non-critical
+// checks are skipped, which keeps readiness probes cheap.
+func (registry *Registry) Run(ctx context.Context, criticalOnly bool) Report {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	report := Report{Status: StatusUp, Components: map[string]Component{}}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, registered := range registry.checks {
+		if criticalOnly && !registered.critical {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			component := registered.check(ctx)
+			component.Critical = registered.critical
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			report.Components[registered.name] = component
+		}()
+	}
+	wg.Wait()
+
+	for _, component := range report.Components {
+		switch {
+		case component.Status == StatusDown && component.Critical:
+			report.Status = StatusDown
+		case component.Status != StatusUp && report.Status == StatusUp:
+			report.Status = StatusDegraded
+		}
+	}
+
+	return report
+}
+
+// ReadyHandler serves the critical checks, for load balancers and readiness
+// probes.
+func (registry *Registry) ReadyHandler() http.Handler {
+	return registry.handler(true)
+}
+
+// HealthHandler serves every check with its details.
+func (registry *Registry) HealthHandler() http.Handler {
+	return registry.handler(false)
+}
+
+func (registry *Registry) handler(criticalOnly bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := registry.Run(r.Context(), criticalOnly)
+
+		status := http.StatusOK
+		if report.Status == StatusDown {
+			status = http.StatusServiceUnavailable
+		}
+
+		public := publicReport{
+			Status:     report.Status,
+			Components: make(map[string]publicComponent, len(report.Components)),
+		}
+		for name, component := range report.Components {
+			public.Components[name] = publicComponent{Status: component.Status}
+			if component.Status != StatusUp {
+				logging.FromContext(r.Context()).Warn(
+					"Health check failed",
+					"check", name,
+					"status", component.Status,
+					"error", component.Error,
+					"details", component.Details,
+				)
+			}
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		httphelper.WriteJSON(w, status, public)
+	})
+}
+
+// Up and Down build components for checks.
+func Up(details map[string]any) Component {
+	return Component{Status: StatusUp, Details: details}
+}
+
+func Down(err error, details map[string]any) Component {
+	return Component{Status: StatusDown, Error: err.Error(), Details: details}
+}
@@ -0,0 +1,98 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type HealthTestSuite struct {
+	suite.Suite
+}
+
+func TestHealthTestSuite(t *testing.T) {
+	suite.Run(t, new(HealthTestSuite))
+}
+
+func up(ctx context.Context) Component {
+	return Up(nil)
+}
+
+func down(ctx context.Context) Component {
+	return Down(errors.New("unreachable"), nil)
+}
+
+func (suite *HealthTestSuite) serve(handler http.Handler) (int, Report) {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	var report Report
+	suite.Require().NoError(json.Unmarshal(recorder.Body.Bytes(), &report))
+	return recorder.Code, report
+}
+
+func (suite *HealthTestSuite) TestCriticalFailureIsUnavailable() {
+	registry := NewRegistry().
+		Register("database", true, down).
+		Register("signing_key", true, up)
+
+	code, report := suite.serve(registry.HealthHandler())
+
+	suite.Equal(http.StatusServiceUnavailable, code)
+	suite.Equal(StatusDown, report.Status)
+	suite.Equal(StatusDown, report.Components["database"].Status)
+	suite.Equal(StatusUp, report.Components["signing_key"].Status)
+}
+
+func (suite *HealthTestSuite) TestFailuresAreNotExplainedPublicly() {
+	registry := NewRegistry().Register("database", true, down)
+
+	recorder := httptest.NewRecorder()
+	registry.HealthHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	suite.JSONEq(
+		`{"status": "down", "components": {"database": {"status": "down"}}}`,
+		recorder.Body.String(),
+	)
+	suite.Equal("unreachable", registry.Run(context.Background(), false).Components["database"].Error)
+}
+
+func (suite *HealthTestSuite) TestNonCriticalFailureDegrades() {
+	registry := NewRegistry().
+		Register("database", true, up).
+		Register("cache", false, down)
+
+	code, report := suite.serve(registry.HealthHandler())
+
+	suite.Equal(http.StatusOK, code)
+	suite.Equal(StatusDegraded, report.Status)
+}
+
+func (suite *HealthTestSuite) TestReadySkipsNonCriticalChecks() {
+	registry := NewRegistry().
+		Register("database", true, up).
+		Register("cache", false, down)
+
+	code, report := suite.serve(registry.ReadyHandler())
+
+	suite.Equal(http.StatusOK, code)
+	suite.Equal(StatusUp, report.Status)
+	suite.NotContains(report.Components, "cache")
+}
+
+func (suite *HealthTestSuite) TestHungCheckTimesOut() {
+	registry := NewRegistry().Register("database", true, func(ctx context.Context) Component {
+		<-ctx.Done()
+		return Down(ctx.Err(), nil)
+	})
+
+	report := registry.Run(context.Background(), true)
+
+	suite.Equal(StatusDown, report.Status)
+	suite.Equal(context.DeadlineExceeded.Error(), report.Components["database"].Error)
+}
@@ -3,12 +3,21 @@ package httphelper
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"sort"
+	"strings"
 
 	"github.com/go-playground/validator/v10"
 )
 
-var Validate = validator.New(validator.WithRequiredStructEnabled())
+var Validate = newValidate()
+
+func newValidate() *validator.Validate {
+	validate := validator.New(validator.WithRequiredStructEnabled())
+	validate.RegisterTagNameFunc(jsonFieldName)
+	return validate
+}
 
 func WriteJSON(w http.ResponseWriter, status int, v any) error {
 	w.Header().Add("Content-Type", "application/json")
@@ -16,10 +25,6 @@ func WriteJSON(w http.ResponseWriter, status int, v any) error {
 	return json.NewEncoder(w).Encode(v)
 }
 
-func WriteError(w http.ResponseWriter, status int, err error) {
-	WriteJSON(w, status, map[string]string{"error": err.Error()})
-}
-
 func ParseJSON(r *http.Request, v any) error {
 	if r.Body == nil {
 		return fmt.Errorf("missing request body")
@@ -37,3 +42,44 @@ func ExtractTokenFromRequest(r *http.Request) string {
 
 	return ""
 }
+
+// ClientIP returns the IP address of the client. When trustProxy is set the
+// last X-Forwarded-For entry wins, which is the one added by the reverse
+// proxy in front of sesamo; earlier entries are up to the client.
+func ClientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		if last := strings.TrimSpace(forwarded[len(forwarded)-1]); last != "" {
+			return last
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// SetPageLinks sets an RFC 8288 Link header with the next and prev pages of
+// the current request, each reached by replacing the param query parameter.
+func SetPageLinks(w http.ResponseWriter, r *http.Request, param string, next string, prev string) {
+	var links []string
+	for rel, cursor := range map[string]string{"next": next, "prev": prev} {
+		if cursor == "" {
+			continue
+		}
+
+		target := *r.URL
+		query := target.Query()
+		query.Set(param, cursor)
+		target.RawQuery = query.Encode()
+		links = append(links, fmt.Sprintf(`<%s>; rel="%s"`, target.RequestURI(), rel))
+	}
+
+	if len(links) > 0 {
+		sort.Strings(links)
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+}
@@ -0,0 +1,29 @@
+package httphelper
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type RequestTestSuite struct {
+	suite.Suite
+}
+
+func TestRequestTestSuite(t *testing.T) {
+	suite.Run(t, new(RequestTestSuite))
+}
+
+func (suite *RequestTestSuite) TestClientIP() {
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.RemoteAddr = "10.0.0.2:51234"
+	request.Header.Set("X-Forwarded-For", "198.51.100.7, 203.0.113.9")
+
+	suite.Equal("10.0.0.2", ClientIP(request, false))
+	suite.Equal("203.0.113.9", ClientIP(request, true))
+
+	request.Header.Del("X-Forwarded-For")
+	suite.Equal("10.0.0.2", ClientIP(request, true))
+}
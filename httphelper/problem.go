@@ -0,0 +1,181 @@
+package httphelper
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diegodario88/sesamo/logging"
+	"github.com/go-playground/validator/v10"
+)
+
+const ProblemContentType = "application/problem+json"
+
+// problemTypePrefix namespaces the type URI of every problem; the code after
+// it is stable and safe for clients to switch on.
+const problemTypePrefix = "urn:sesamo:problem:"
+
+// Problem is an RFC 7807 error response.
+type Problem struct {
+	Type   string       `json:"type"`
+	Title  string       `json:"title"`
+	Status int          `json:"status"`
+	Code   string       `json:"code"`
+	Detail string       `json:"detail,omitempty"`
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError describes one rejected field of a request body. Field uses the
+// JSON name and Rule the validator tag, e.g. "min" with Param "8".
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Param   string `json:"param,omitempty"`
+	Message string `json:"message"`
+}
+
+func (problem *Problem) Error() string {
+	if problem.Detail == "" {
+		return problem.Code
+	}
+
+	return problem.Code + ": " + problem.Detail
+}
+
+func NewProblem(status int, code string, detail string) *Problem {
+	return &Problem{
+		Type:   problemTypePrefix + code,
+		Title:  http.StatusText(status),
+		Status: status,
+		Code:   code,
+		Detail: detail,
+	}
+}
+
+func BadRequest(detail string) *Problem {
+	return NewProblem(http.StatusBadRequest, "bad_request", detail)
+}
+
+func Unauthorized(detail string) *Problem {
+	return NewProblem(http.StatusUnauthorized, "unauthorized", detail)
+}
+
+func Forbidden(detail string) *Problem {
+	return NewProblem(http.StatusForbidden, "forbidden", detail)
+}
+
+func NotFound(detail string) *Problem {
+	return NewProblem(http.StatusNotFound, "not_found", detail)
+}
+
+func Conflict(detail string) *Problem {
+	return NewProblem(http.StatusConflict, "conflict", detail)
+}
+
+// Internal never carries the underlying error; log it with
+// WriteInternalError instead.
+func Internal() *Problem {
+	return NewProblem(
+		http.StatusInternalServerError,
+		"internal_error",
+		"an unexpected error occurred",
+	)
+}
+
+// ValidationFailed builds a 422 listing every field rejected by Validate.
+// Errors that are not validation errors become a 400.
+func ValidationFailed(err error) *Problem {
+	var validationErrors validator.ValidationErrors
+	if !errors.As(err, &validationErrors) {
+		return BadRequest("invalid payload")
+	}
+
+	fields := make([]FieldError, 0, len(validationErrors))
+	for _, fe := range validationErrors {
+		fields = append(fields, FieldError{
+			Field:   fe.Field(),
+			Rule:    fe.Tag(),
+			Param:   fe.Param(),
+			Message: fieldMessage(fe),
+		})
+	}
+
+	return InvalidFields(fields...)
+}
+
+// InvalidFields is the 422 of ValidationFailed, for fields rejected by checks
+// other than Validate.
+func InvalidFields(fields ...FieldError) *Problem {
+	problem := NewProblem(
+		http.StatusUnprocessableEntity,
+		"validation_failed",
+		"the request body has invalid fields",
+	)
+	problem.Errors = fields
+
+	return problem
+}
+
+func fieldMessage(fe validator.FieldError) string {
+	unit := ""
+	if fe.Kind() == reflect.String {
+		unit = " characters"
+	}
+
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "email":
+		return "must be a valid email address"
+	case "url":
+		return "must be a valid URL"
+	case "min":
+		return fmt.Sprintf("must be at least %s%s", fe.Param(), unit)
+	case "max":
+		return fmt.Sprintf("must be at most %s%s", fe.Param(), unit)
+	case "oneof":
+		return fmt.Sprintf("must be one of: %s", fe.Param())
+	default:
+		return fmt.Sprintf("does not satisfy %s", fe.Tag())
+	}
+}
+
+func WriteProblem(w http.ResponseWriter, problem *Problem) {
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// WriteTooManyRequests answers with a 429 whose Retry-After header asks the
+// client to wait retryAfter, rounded up to whole seconds.
+func WriteTooManyRequests(w http.ResponseWriter, detail string, retryAfter time.Duration) {
+	seconds := int64(math.Ceil(retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.FormatInt(max(seconds, 1), 10))
+	WriteProblem(w, NewProblem(http.StatusTooManyRequests, "too_many_requests", detail))
+}
+
+// WriteInternalError logs err with the request's logger and answers with a
+// generic 500.
+func WriteInternalError(w http.ResponseWriter, r *http.Request, err error) {
+	logging.FromContext(r.Context()).Error("Request failed", "error", err)
+	WriteProblem(w, Internal())
+}
+
+// jsonFieldName makes validation errors report the JSON name of a field.
+func jsonFieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "-" {
+		return ""
+	}
+	if name == "" {
+		return field.Name
+	}
+
+	return name
+}
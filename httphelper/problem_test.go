@@ -0,0 +1,73 @@
+package httphelper
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ProblemTestSuite struct {
+	suite.Suite
+}
+
+func TestProblemTestSuite(t *testing.T) {
+	suite.Run(t, new(ProblemTestSuite))
+}
+
+type signupPayload struct {
+	Email    string `json:"email"    validate:"required,email"`
+	Password string `json:"password" validate:"required,min=8"`
+}
+
+func (suite *ProblemTestSuite) TestValidationFailedListsFieldsByJSONName() {
+	err := Validate.Struct(signupPayload{Email: "not-an-email", Password: "short"})
+
+	problem := ValidationFailed(err)
+
+	suite.Equal(http.StatusUnprocessableEntity, problem.Status)
+	suite.Equal("validation_failed", problem.Code)
+	suite.Equal([]FieldError{
+		{Field: "email", Rule: "email", Message: "must be a valid email address"},
+		{Field: "password", Rule: "min", Param: "8", Message: "must be at least 8 characters"},
+	}, problem.Errors)
+}
+
+func (suite *ProblemTestSuite) TestWriteProblem() {
+	recorder := httptest.NewRecorder()
+
+	WriteProblem(recorder, NotFound("user not found"))
+
+	suite.Equal(http.StatusNotFound, recorder.Code)
+	suite.Equal(ProblemContentType, recorder.Header().Get("Content-Type"))
+
+	var body map[string]any
+	suite.Require().NoError(json.Unmarshal(recorder.Body.Bytes(), &body))
+	suite.Equal("urn:sesamo:problem:not_found", body["type"])
+	suite.Equal("Not Found", body["title"])
+	suite.Equal("user not found", body["detail"])
+}
+
+func (suite *ProblemTestSuite) TestWriteInternalErrorHidesCause() {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/users/1", nil)
+
+	WriteInternalError(recorder, request, errors.New("FindUserById: sql: connection refused"))
+
+	suite.Equal(http.StatusInternalServerError, recorder.Code)
+	suite.NotContains(recorder.Body.String(), "sql")
+}
+
+func (suite *ProblemTestSuite) TestWriteTooManyRequestsRoundsRetryAfterUp() {
+	recorder := httptest.NewRecorder()
+
+	WriteTooManyRequests(recorder, "slow down", 1500*time.Millisecond)
+
+	suite.Equal(http.StatusTooManyRequests, recorder.Code)
+	suite.Equal("2", recorder.Header().Get("Retry-After"))
+	suite.Contains(recorder.Body.String(), `"code":"too_many_requests"`)
+}
@@ -0,0 +1,136 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const RequestIDHeader = "X-Request-Id"
+
+type requestInfoKey struct{}
+
+// requestInfo is filled while a request travels through the router, so the
+// access log written on the way out knows the matched route and the caller.
+type requestInfo struct {
+	route  string
+	userID string
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+// HTTPHandler wraps router with request logging. Every request gets a request
+// ID, taken from X-Request-Id when the caller sends one, and a logger in its
+// context carrying that ID. One access log line is written per request with
+// method, route template, status, latency and, once authenticated, user ID.
+func HTTPHandler(router *mux.Router, logger *slog.Logger) http.Handler {
+	router.Use(captureRoute)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		requestID := r.Header.Get(RequestIDHeader)
+		if requestID == "" || len(requestID) > 128 {
+			requestID = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, requestID)
+
+		info := &requestInfo{}
+		requestLogger := logger.With("request_id", requestID)
+
+		ctx := context.WithValue(r.Context(), requestInfoKey{}, info)
+		ctx = WithContext(ctx, requestLogger)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		router.ServeHTTP(rec, r.WithContext(ctx))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		level := slog.LevelInfo
+		switch {
+		case rec.status >= 500:
+			level = slog.LevelError
+		case rec.status >= 400:
+			level = slog.LevelWarn
+		}
+
+		attrs := []any{
+			"method", r.Method,
+			"route", RouteTemplate(ctx),
+			"status", rec.status,
+			"latency_ms", float64(time.Since(start).Microseconds()) / 1000,
+			"bytes", rec.bytes,
+		}
+		if info.userID != "" {
+			attrs = append(attrs, "user_id", info.userID)
+		}
+
+		requestLogger.Log(r.Context(), level, "http request", attrs...)
+	})
+}
+
+// SetUserID records the authenticated user for the access log and adds it to
+// the logger of the returned context.
+func SetUserID(ctx context.Context, userID string) context.Context {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		info.userID = userID
+	}
+
+	return With(ctx, "user_id", userID)
+}
+
+// RouteTemplate returns the template of the route that matched the request,
+// or "unmatched" when none did.
+func RouteTemplate(ctx context.Context) string {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok && info.route != "" {
+		return info.route
+	}
+
+	return "unmatched"
+}
+
+func captureRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+			if route := mux.CurrentRoute(r); route != nil {
+				info.route, _ = route.GetPathTemplate()
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+
+	return hex.EncodeToString(b)
+}
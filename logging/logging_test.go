@@ -0,0 +1,81 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/diegodario88/sesamo/config"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/suite"
+)
+
+type LoggingTestSuite struct {
+	suite.Suite
+	buffer *bytes.Buffer
+	logger *slog.Logger
+}
+
+func TestLoggingTestSuite(t *testing.T) {
+	suite.Run(t, new(LoggingTestSuite))
+}
+
+func (suite *LoggingTestSuite) SetupTest() {
+	suite.buffer = &bytes.Buffer{}
+	suite.logger = New(suite.buffer, &config.Config{LogLevel: "debug", LogFormat: "json"})
+}
+
+func (suite *LoggingTestSuite) lastEntry() map[string]any {
+	lines := bytes.Split(bytes.TrimSpace(suite.buffer.Bytes()), []byte("\n"))
+	entry := map[string]any{}
+	suite.Require().NoError(json.Unmarshal(lines[len(lines)-1], &entry))
+	return entry
+}
+
+func (suite *LoggingTestSuite) TestRedactsSensitiveAttributes() {
+	suite.logger.Info("login", "password", "hunter2", "refresh_token", "abc", "email", "a@b.c")
+
+	entry := suite.lastEntry()
+	suite.Equal(redacted, entry["password"])
+	suite.Equal(redacted, entry["refresh_token"])
+	suite.Equal("a@b.c", entry["email"])
+}
+
+func (suite *LoggingTestSuite) TestHTTPHandlerCorrelatesRequest() {
+	router := mux.NewRouter()
+	router.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		ctx := SetUserID(r.Context(), "01JQEG0PHECS7VVSSMRWXGBTEA")
+		FromContext(ctx).Info("inside handler")
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	request := httptest.NewRequest(http.MethodGet, "/users/42", nil)
+	request.Header.Set(RequestIDHeader, "req-1")
+	recorder := httptest.NewRecorder()
+
+	HTTPHandler(router, suite.logger).ServeHTTP(recorder, request)
+
+	suite.Equal("req-1", recorder.Header().Get(RequestIDHeader))
+
+	entry := suite.lastEntry()
+	suite.Equal("http request", entry["msg"])
+	suite.Equal("req-1", entry["request_id"])
+	suite.Equal("/users/{id}", entry["route"])
+	suite.Equal(float64(http.StatusTeapot), entry["status"])
+	suite.Equal("01JQEG0PHECS7VVSSMRWXGBTEA", entry["user_id"])
+	suite.Contains(suite.buffer.String(), `"msg":"inside handler","request_id":"req-1"`)
+}
+
+func (suite *LoggingTestSuite) TestHTTPHandlerUnmatchedRoute() {
+	recorder := httptest.NewRecorder()
+	HTTPHandler(mux.NewRouter(), suite.logger).
+		ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/nope", nil))
+
+	entry := suite.lastEntry()
+	suite.Equal("unmatched", entry["route"])
+	suite.Equal(float64(http.StatusNotFound), entry["status"])
+	suite.NotEmpty(entry["request_id"])
+}
@@ -0,0 +1,105 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/diegodario88/sesamo/config"
+	"github.com/diegodario88/sesamo/logging"
+)
+
+// Message is a plain-text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender delivers email. Implementations must be safe for concurrent use.
+type Sender interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// NewSender returns the sender selected by MAIL_SENDER.
+func NewSender(cfg *config.Config) Sender {
+	if cfg.MailSender == "log" {
+		return LogSender{}
+	}
+
+	return &SMTPSender{
+		Addr:     cfg.SmtpAddr,
+		From:     cfg.MailFrom,
+		Username: cfg.SmtpUsername,
+		Password: cfg.SmtpPassword,
+	}
+}
+
+// SMTPSender delivers through an SMTP relay, upgrading to TLS when the server
+// offers STARTTLS. Any local mail catcher works for development.
+type SMTPSender struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+func (sender *SMTPSender) Send(ctx context.Context, msg Message) error {
+	host, _, err := net.SplitHostPort(sender.Addr)
+	if err != nil {
+		return fmt.Errorf("Send: %w", err)
+	}
+
+	var auth smtp.Auth
+	if sender.Username != "" {
+		auth = smtp.PlainAuth("", sender.Username, sender.Password, host)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(sender.Addr, auth, sender.From, []string{msg.To}, sender.format(msg))
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("Send: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("Send: %w", ctx.Err())
+	}
+}
+
+func (sender *SMTPSender) format(msg Message) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", sender.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+
+	return buf.Bytes()
+}
+
+// LogSender writes messages to the log instead of delivering them. Bodies
+// carry single-use links, so it is meant for development only.
+type LogSender struct{}
+
+func (LogSender) Send(ctx context.Context, msg Message) error {
+	logging.FromContext(ctx).Info(
+		"Email not delivered (MAIL_SENDER=log)",
+		"to", msg.To,
+		"subject", msg.Subject,
+		"body", msg.Body,
+	)
+	return nil
+}
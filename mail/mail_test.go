@@ -0,0 +1,98 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type MailTestSuite struct {
+	suite.Suite
+}
+
+func TestMailTestSuite(t *testing.T) {
+	suite.Run(t, new(MailTestSuite))
+}
+
+// fakeSMTP accepts one message and sends its DATA section on the channel.
+func (suite *MailTestSuite) fakeSMTP() (string, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	suite.Require().NoError(err)
+	suite.T().Cleanup(func() { listener.Close() })
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		reply("220 localhost ready")
+
+		var data strings.Builder
+		inData := false
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			if inData {
+				if line == ".\r\n" {
+					inData = false
+					received <- data.String()
+					reply("250 queued")
+					continue
+				}
+				data.WriteString(line)
+				continue
+			}
+
+			switch command := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+				reply("250 localhost")
+			case command == "DATA":
+				inData = true
+				reply("354 end with .")
+			case command == "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+
+	return listener.Addr().String(), received
+}
+
+func (suite *MailTestSuite) TestSMTPSenderDeliversMessage() {
+	addr, received := suite.fakeSMTP()
+	sender := &SMTPSender{Addr: addr, From: "no-reply@sesamo.local"}
+
+	err := sender.Send(context.Background(), Message{
+		To:      "ana@example.com",
+		Subject: "Confirm your email",
+		Body:    "Open this link:\nhttps://example.com/confirm",
+	})
+	suite.Require().NoError(err)
+
+	data := <-received
+	suite.Contains(data, "To: ana@example.com\r\n")
+	suite.Contains(data, "Subject: Confirm your email\r\n")
+	suite.Contains(data, "Open this link:\r\nhttps://example.com/confirm")
+}
+
+func (suite *MailTestSuite) TestSMTPSenderRejectsInvalidAddress() {
+	sender := &SMTPSender{Addr: "no-port", From: "no-reply@sesamo.local"}
+
+	err := sender.Send(context.Background(), Message{To: "ana@example.com"})
+	suite.Error(err)
+}
@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "sesamo"
+
+// Registry holds every sesamo metric plus the Go runtime and process
+// collectors. It is separate from the Prometheus default registry so tests
+// and libraries cannot leak metrics into /metrics.
+var Registry = prometheus.NewRegistry()
+
+var (
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "HTTP request latency by route template, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	LoginAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "auth",
+		Name:      "login_attempts_total",
+		Help:      "Login attempts by authentication method and outcome.",
+	}, []string{"method", "outcome"})
+
+	TokensIssued = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "auth",
+		Name:      "tokens_issued_total",
+		Help:      "Tokens signed by kind.",
+	}, []string{"kind"})
+
+	PermissionChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "rbac",
+		Name:      "permission_checks_total",
+		Help:      "RBAC permission checks by permission and result.",
+	}, []string{"permission", "result"})
+
+	MQMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "mq",
+		Name:      "messages_total",
+		Help:      "Messages handled by the MQ listener by queue and outcome.",
+	}, []string{"queue", "outcome"})
+
+	MQProcessingDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "mq",
+		Name:      "processing_duration_seconds",
+		Help:      "Time spent by consumers processing a message, by queue.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"queue"})
+)
+
+// Outcomes used as label values, kept in one place so dashboards can rely on them.
+const (
+	OutcomeSuccess            = "success"
+	OutcomeInvalidCredentials = "invalid_credentials"
+	OutcomeInvalidPayload     = "invalid_payload"
+	OutcomeDisabled           = "disabled"
+	OutcomeLocked             = "locked"
+	OutcomeUnverified         = "unverified"
+	OutcomeThrottled          = "throttled"
+	OutcomeMFARequired        = "mfa_required"
+	OutcomeError              = "error"
+
+	ResultAllowed = "allowed"
+	ResultDenied  = "denied"
+	ResultError   = "error"
+
+	MessageProcessed = "processed"
+	MessageFailed    = "failed"
+	MessageAcked     = "acked"
+	MessageNacked    = "nacked"
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequestDuration,
+		LoginAttempts,
+		TokensIssued,
+		PermissionChecks,
+		MQMessages,
+		MQProcessingDuration,
+	)
+}
+
+// Handler serves the registry in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
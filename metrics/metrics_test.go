@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/suite"
+)
+
+type MetricsTestSuite struct {
+	suite.Suite
+}
+
+func TestMetricsTestSuite(t *testing.T) {
+	suite.Run(t, new(MetricsTestSuite))
+}
+
+func (suite *MetricsTestSuite) TestHTTPMiddlewareLabelsByRouteTemplate() {
+	router := mux.NewRouter()
+	router.Use(HTTPMiddleware)
+	router.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	before := testutil.CollectAndCount(HTTPRequestDuration)
+	for _, id := range []string{"a", "b", "c"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/"+id, nil))
+	}
+
+	suite.Equal(before+1, testutil.CollectAndCount(HTTPRequestDuration))
+	suite.Equal(1, testutil.CollectAndCount(
+		HTTPRequestDuration.MustCurryWith(map[string]string{
+			"method": "GET", "route": "/users/{id}", "status": "404",
+		}),
+	))
+}
+
+func (suite *MetricsTestSuite) TestHandlerExposesRegistry() {
+	LoginAttempts.WithLabelValues("password", OutcomeSuccess).Inc()
+
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	suite.Equal(http.StatusOK, recorder.Code)
+	suite.Contains(recorder.Body.String(), "sesamo_auth_login_attempts_total")
+	suite.Contains(recorder.Body.String(), "go_goroutines")
+}
@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+var queueDepthDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "mq", "queue_depth"),
+	"Messages currently in each queue by state: waiting or delivered.",
+	[]string{"queue", "state"},
+	nil,
+)
+
+// queueDepthCollector reads queue depths from the mq schema on every scrape,
+// so the numbers are right even for messages published by other replicas.
+type queueDepthCollector struct {
+	storage *sqlx.DB
+}
+
+func (c queueDepthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueDepthDesc
+}
+
+func (c queueDepthCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	query := `
+		SELECT
+			q.queue_name,
+			(SELECT count(*) FROM mq.message_waiting mw WHERE mw.queue_id = q.queue_id),
+			(SELECT count(*) FROM mq.delivery d WHERE d.queue_id = q.queue_id)
+		FROM mq.queue q
+	`
+
+	rows, err := c.storage.QueryContext(ctx, query)
+	if err != nil {
+		slog.Warn("Collecting queue depth failed", "error", err)
+		ch <- prometheus.NewInvalidMetric(queueDepthDesc, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var queue string
+		var waiting, delivered float64
+		if err := rows.Scan(&queue, &waiting, &delivered); err != nil {
+			ch <- prometheus.NewInvalidMetric(queueDepthDesc, err)
+			return
+		}
+
+		ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, waiting, queue, "waiting")
+		ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, delivered, queue, "delivered")
+	}
+}
+
+// RegisterStorage adds connection pool statistics and queue depth gauges for
+// storage. Calling it again for the same process is a no-op.
+func RegisterStorage(storage *sqlx.DB) error {
+	for _, collector := range []prometheus.Collector{
+		collectors.NewDBStatsCollector(storage.DB, namespace),
+		queueDepthCollector{storage: storage},
+	} {
+		err := Registry.Register(collector)
+
+		var alreadyRegistered prometheus.AlreadyRegisteredError
+		if err != nil && !errors.As(err, &alreadyRegistered) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,159 @@
+package password
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	digestLength = sha1.Size
+	prefixLength = 5
+)
+
+type digest [digestLength]byte
+
+// Blocklist holds the SHA-1 digests of breached passwords, so it can be
+// checked without any network access and without keeping the passwords
+// themselves.
+type Blocklist struct {
+	digests []digest
+}
+
+var (
+	loadedMutex sync.Mutex
+	loaded      = map[string]*Blocklist{}
+)
+
+// LoadBlocklist reads a breached password list in one of the formats of the
+// Have I Been Pwned downloads:
+//
+//   - a file with one hex SHA-1 digest per line, optionally followed by
+//     ":count";
+//   - a directory of k-anonymity range files, each named after the first five
+//     hex digits of its digests and listing the remaining 35 per line.
+//
+// Lists are loaded once per path and shared.
+func LoadBlocklist(path string) (*Blocklist, error) {
+	loadedMutex.Lock()
+	defer loadedMutex.Unlock()
+
+	if blocklist, ok := loaded[path]; ok {
+		return blocklist, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("LoadBlocklist: %w", err)
+	}
+
+	blocklist := &Blocklist{}
+	if info.IsDir() {
+		err = blocklist.readRanges(path)
+	} else {
+		err = blocklist.readFile(path, "")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("LoadBlocklist: %w", err)
+	}
+
+	blocklist.sort()
+	loaded[path] = blocklist
+
+	return blocklist, nil
+}
+
+func (blocklist *Blocklist) readRanges(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		prefix := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+		if entry.IsDir() || len(prefix) != prefixLength {
+			continue
+		}
+
+		if err := blocklist.readFile(filepath.Join(dir, entry.Name()), prefix); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (blocklist *Blocklist) readFile(path string, prefix string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return blocklist.read(file, prefix)
+}
+
+// read parses one digest per line, each completed by prefix. Blank lines are
+// skipped.
+func (blocklist *Blocklist) read(reader io.Reader, prefix string) error {
+	scanner := bufio.NewScanner(reader)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if text == "" {
+			continue
+		}
+
+		var d digest
+		full := prefix + text
+		if len(full) != hex.EncodedLen(digestLength) {
+			return fmt.Errorf("line %d: invalid SHA-1 digest %q", line, text)
+		}
+		if _, err := hex.Decode(d[:], []byte(full)); err != nil {
+			return fmt.Errorf("line %d: invalid SHA-1 digest %q", line, text)
+		}
+		blocklist.digests = append(blocklist.digests, d)
+	}
+
+	return scanner.Err()
+}
+
+// NewBlocklist builds a list from hex SHA-1 digests, one per line.
+func NewBlocklist(reader io.Reader) (*Blocklist, error) {
+	blocklist := &Blocklist{}
+	if err := blocklist.read(reader, ""); err != nil {
+		return nil, fmt.Errorf("NewBlocklist: %w", err)
+	}
+
+	blocklist.sort()
+
+	return blocklist, nil
+}
+
+// sort orders the digests for binary search and drops duplicates.
+func (blocklist *Blocklist) sort() {
+	slices.SortFunc(blocklist.digests, compareDigests)
+	blocklist.digests = slices.Compact(blocklist.digests)
+}
+
+func (blocklist *Blocklist) Contains(password string) bool {
+	sum := digest(sha1.Sum([]byte(password)))
+	_, found := slices.BinarySearchFunc(blocklist.digests, sum, compareDigests)
+
+	return found
+}
+
+func compareDigests(a, b digest) int {
+	return bytes.Compare(a[:], b[:])
+}
+
+func (blocklist *Blocklist) Len() int {
+	return len(blocklist.digests)
+}
@@ -0,0 +1,154 @@
+package password
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/alexedwards/argon2id"
+	"github.com/diegodario88/sesamo/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	saltLength = 16
+	keyLength  = 32
+)
+
+// ErrUnknownHash is returned for stored hashes in a scheme sesamo cannot
+// verify.
+var ErrUnknownHash = errors.New("password hash scheme is not supported")
+
+// Params are the argon2id costs new hashes are created with. Memory is in
+// KiB.
+type Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+}
+
+// DefaultParams applies when no costs were configured. It matches the
+// defaults of the PASSWORD_HASH_* variables.
+var DefaultParams = Params{Memory: 64 * 1024, Iterations: 3, Parallelism: 2}
+
+// ParamsFromConfig returns the costs configured by the PASSWORD_HASH_*
+// variables.
+func ParamsFromConfig(cfg *config.Config) Params {
+	return Params{
+		Memory:      uint32(cfg.PasswordHashMemory),
+		Iterations:  uint32(cfg.PasswordHashIterations),
+		Parallelism: uint8(cfg.PasswordHashParallelism),
+	}
+}
+
+// Hash encodes password as an argon2id hash in the PHC string format.
+func Hash(password string, params Params) (string, error) {
+	encoded, err := argon2id.CreateHash(password, &argon2id.Params{
+		Memory:      params.Memory,
+		Iterations:  params.Iterations,
+		Parallelism: params.Parallelism,
+		SaltLength:  saltLength,
+		KeyLength:   keyLength,
+	})
+	if err != nil {
+		return "", fmt.Errorf("Hash: %w", err)
+	}
+
+	return encoded, nil
+}
+
+var (
+	dummiesMutex sync.Mutex
+	dummies      = map[Params]string{}
+)
+
+// DummyHash returns the hash of a random password, created once per params.
+// Verifying against it when an account has no hash costs as much as a real
+// verification, so response times do not reveal which accounts exist.
+func DummyHash(params Params) (string, error) {
+	dummiesMutex.Lock()
+	defer dummiesMutex.Unlock()
+
+	if encoded, ok := dummies[params]; ok {
+		return encoded, nil
+	}
+
+	random := make([]byte, saltLength)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("DummyHash: %w", err)
+	}
+
+	encoded, err := Hash(hex.EncodeToString(random), params)
+	if err != nil {
+		return "", fmt.Errorf("DummyHash: %w", err)
+	}
+	dummies[params] = encoded
+
+	return encoded, nil
+}
+
+// Verify reports whether password matches encoded, which is either an
+// argon2id hash or a bcrypt hash imported from the legacy system.
+func Verify(password string, encoded string) (bool, error) {
+	switch {
+	case isArgon2id(encoded):
+		match, err := argon2id.ComparePasswordAndHash(password, encoded)
+		if err != nil {
+			return false, fmt.Errorf("Verify: %w", err)
+		}
+		return match, nil
+	case isBcrypt(encoded):
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("Verify: %w", err)
+		}
+		return true, nil
+	default:
+		return false, ErrUnknownHash
+	}
+}
+
+// Known reports whether encoded is in a scheme Verify supports.
+func Known(encoded string) bool {
+	return isArgon2id(encoded) || isBcrypt(encoded)
+}
+
+// NeedsRehash reports whether encoded was not created by Hash with params:
+// bcrypt hashes and argon2id hashes with other costs or lengths. Callers
+// rehash once they have the plain password at hand, after a successful
+// Verify.
+func NeedsRehash(encoded string, params Params) bool {
+	if !isArgon2id(encoded) {
+		return true
+	}
+
+	current, salt, key, err := argon2id.DecodeHash(encoded)
+	if err != nil {
+		return true
+	}
+
+	return current.Memory != params.Memory ||
+		current.Iterations != params.Iterations ||
+		current.Parallelism != params.Parallelism ||
+		len(salt) != saltLength ||
+		len(key) != keyLength
+}
+
+func isArgon2id(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func isBcrypt(encoded string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		if strings.HasPrefix(encoded, prefix) {
+			return true
+		}
+	}
+	return false
+}
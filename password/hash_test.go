@@ -0,0 +1,77 @@
+package password
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type HashTestSuite struct {
+	suite.Suite
+}
+
+func TestHashTestSuite(t *testing.T) {
+	suite.Run(t, new(HashTestSuite))
+}
+
+var testParams = Params{Memory: 8 * 1024, Iterations: 1, Parallelism: 1}
+
+func (suite *HashTestSuite) TestHashAndVerify() {
+	encoded, err := Hash("Correct-Horse-42", testParams)
+	suite.Require().NoError(err)
+	suite.Contains(encoded, "$argon2id$v=19$m=8192,t=1,p=1$")
+
+	match, err := Verify("Correct-Horse-42", encoded)
+	suite.Require().NoError(err)
+	suite.True(match)
+
+	match, err = Verify("wrong", encoded)
+	suite.Require().NoError(err)
+	suite.False(match)
+}
+
+func (suite *HashTestSuite) TestVerifyBcrypt() {
+	encoded, err := bcrypt.GenerateFromPassword([]byte("Correct-Horse-42"), bcrypt.MinCost)
+	suite.Require().NoError(err)
+
+	match, err := Verify("Correct-Horse-42", string(encoded))
+	suite.Require().NoError(err)
+	suite.True(match)
+
+	match, err = Verify("wrong", string(encoded))
+	suite.Require().NoError(err)
+	suite.False(match)
+}
+
+func (suite *HashTestSuite) TestVerifyRejectsUnknownSchemes() {
+	_, err := Verify("secret", "$1$md5crypt$hash")
+	suite.ErrorIs(err, ErrUnknownHash)
+	suite.False(Known("plain text"))
+}
+
+func (suite *HashTestSuite) TestNeedsRehash() {
+	encoded, err := Hash("Correct-Horse-42", testParams)
+	suite.Require().NoError(err)
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("Correct-Horse-42"), bcrypt.MinCost)
+	suite.Require().NoError(err)
+
+	suite.False(NeedsRehash(encoded, testParams))
+	suite.True(NeedsRehash(encoded, Params{Memory: 16 * 1024, Iterations: 1, Parallelism: 1}))
+	suite.True(NeedsRehash(encoded, Params{Memory: 8 * 1024, Iterations: 2, Parallelism: 1}))
+	suite.True(NeedsRehash(string(bcryptHash), testParams))
+}
+
+func (suite *HashTestSuite) TestDummyHashIsCreatedOncePerParams() {
+	first, err := DummyHash(testParams)
+	suite.Require().NoError(err)
+	again, err := DummyHash(testParams)
+	suite.Require().NoError(err)
+
+	suite.Equal(first, again)
+	suite.False(NeedsRehash(first, testParams))
+
+	match, err := Verify("", first)
+	suite.Require().NoError(err)
+	suite.False(match)
+}
@@ -0,0 +1,154 @@
+package password
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/diegodario88/sesamo/config"
+)
+
+// minPersonalLength is the shortest name or email part a password is checked
+// against; shorter ones match too many passwords by chance.
+const minPersonalLength = 3
+
+// Violation is one rule a password breaks. Rule and Param mirror validator
+// tags so clients can handle both kinds of errors alike.
+type Violation struct {
+	Rule    string
+	Param   string
+	Message string
+}
+
+// Default applies when no policy was configured. It matches the defaults of
+// the PASSWORD_* variables, without a breached list.
+var Default = &Policy{MinLength: 10, MaxLength: 128, MinClasses: 3}
+
+// Policy decides which passwords are acceptable.
+type Policy struct {
+	MinLength  int
+	MaxLength  int
+	MinClasses int
+	// Breached rejects known leaked passwords; nil skips the check.
+	Breached *Blocklist
+}
+
+// NewPolicy builds the policy configured by the PASSWORD_* variables, loading
+// the breached password list when one is set.
+func NewPolicy(cfg *config.Config) (*Policy, error) {
+	policy := &Policy{
+		MinLength:  cfg.PasswordMinLength,
+		MaxLength:  cfg.PasswordMaxLength,
+		MinClasses: cfg.PasswordMinClasses,
+	}
+
+	if cfg.PasswordBreachedList != "" {
+		breached, err := LoadBlocklist(cfg.PasswordBreachedList)
+		if err != nil {
+			return nil, fmt.Errorf("NewPolicy: %w", err)
+		}
+		policy.Breached = breached
+	}
+
+	return policy, nil
+}
+
+// Check returns every rule password breaks, or nil. personal holds values
+// the password must not contain, such as the email and names of its owner;
+// for emails the part before the @ is checked as well.
+func (policy *Policy) Check(password string, personal ...string) []Violation {
+	var violations []Violation
+
+	length := utf8.RuneCountInString(password)
+	if length < policy.MinLength {
+		violations = append(violations, Violation{
+			Rule:    "min",
+			Param:   fmt.Sprint(policy.MinLength),
+			Message: fmt.Sprintf("must be at least %d characters", policy.MinLength),
+		})
+	}
+
+	if policy.MaxLength > 0 && length > policy.MaxLength {
+		violations = append(violations, Violation{
+			Rule:    "max",
+			Param:   fmt.Sprint(policy.MaxLength),
+			Message: fmt.Sprintf("must be at most %d characters", policy.MaxLength),
+		})
+	}
+
+	if classes(password) < policy.MinClasses {
+		violations = append(violations, Violation{
+			Rule:  "classes",
+			Param: fmt.Sprint(policy.MinClasses),
+			Message: fmt.Sprintf(
+				"must mix at least %d of: lowercase letters, uppercase letters, digits, symbols",
+				policy.MinClasses,
+			),
+		})
+	}
+
+	if containsPersonal(password, personal) {
+		violations = append(violations, Violation{
+			Rule:    "personal_info",
+			Message: "must not contain your name or email",
+		})
+	}
+
+	if policy.Breached != nil && policy.Breached.Contains(password) {
+		violations = append(violations, Violation{
+			Rule:    "breached",
+			Message: "appears in a list of leaked passwords; choose another one",
+		})
+	}
+
+	return violations
+}
+
+func classes(password string) int {
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+
+	count := 0
+	for _, present := range []bool{lower, upper, digit, symbol} {
+		if present {
+			count++
+		}
+	}
+
+	return count
+}
+
+func containsPersonal(password string, personal []string) bool {
+	folded := strings.ToLower(password)
+
+	for _, value := range personal {
+		candidates := []string{value}
+		if local, _, ok := strings.Cut(value, "@"); ok {
+			candidates = append(candidates, local)
+		}
+
+		for _, candidate := range candidates {
+			candidate = strings.ToLower(strings.TrimSpace(candidate))
+			if utf8.RuneCountInString(candidate) < minPersonalLength {
+				continue
+			}
+			if strings.Contains(folded, candidate) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
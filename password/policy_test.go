@@ -0,0 +1,107 @@
+package password
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type PolicyTestSuite struct {
+	suite.Suite
+}
+
+func TestPolicyTestSuite(t *testing.T) {
+	suite.Run(t, new(PolicyTestSuite))
+}
+
+func sha1Hex(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func rules(violations []Violation) []string {
+	names := make([]string, 0, len(violations))
+	for _, violation := range violations {
+		names = append(names, violation.Rule)
+	}
+	return names
+}
+
+func (suite *PolicyTestSuite) TestCheck() {
+	policy := &Policy{MinLength: 10, MaxLength: 20, MinClasses: 3}
+
+	suite.Empty(policy.Check("Correct-Horse-42"))
+	suite.Equal([]string{"min", "classes"}, rules(policy.Check("short")))
+	suite.Equal([]string{"max"}, rules(policy.Check("Correct-Horse-Battery-42")))
+	suite.Equal([]string{"classes"}, rules(policy.Check("alllowercase")))
+}
+
+func (suite *PolicyTestSuite) TestCheckRejectsPersonalInfo() {
+	policy := &Policy{MinLength: 1}
+
+	suite.Equal(
+		[]string{"personal_info"},
+		rules(policy.Check("my-Lima-2026", "ana.lima@example.com", "Ana", "Lima")),
+	)
+	suite.Equal(
+		[]string{"personal_info"},
+		rules(policy.Check("ANA.LIMA!", "ana.lima@example.com")),
+	)
+	suite.Empty(policy.Check("Calm-Sea-9", "al@example.com", "Al"), "short names are skipped")
+}
+
+func (suite *PolicyTestSuite) TestCheckRejectsBreachedPasswords() {
+	breached, err := NewBlocklist(strings.NewReader(sha1Hex("Password123!") + ":42\n"))
+	suite.Require().NoError(err)
+	policy := &Policy{MinLength: 1, Breached: breached}
+
+	suite.Equal([]string{"breached"}, rules(policy.Check("Password123!")))
+	suite.Empty(policy.Check("Correct-Horse-42"))
+}
+
+func (suite *PolicyTestSuite) TestLoadBlocklistFromFile() {
+	path := filepath.Join(suite.T().TempDir(), "pwned.txt")
+	content := sha1Hex("hunter2") + ":17\n\n" + strings.ToLower(sha1Hex("letmein")) + "\n"
+	suite.Require().NoError(os.WriteFile(path, []byte(content), 0o600))
+
+	blocklist, err := LoadBlocklist(path)
+	suite.Require().NoError(err)
+
+	suite.Equal(2, blocklist.Len())
+	suite.True(blocklist.Contains("hunter2"))
+	suite.True(blocklist.Contains("letmein"))
+	suite.False(blocklist.Contains("Correct-Horse-42"))
+
+	again, err := LoadBlocklist(path)
+	suite.Require().NoError(err)
+	suite.Same(blocklist, again)
+}
+
+func (suite *PolicyTestSuite) TestLoadBlocklistFromRanges() {
+	dir := suite.T().TempDir()
+	for _, password := range []string{"hunter2", "letmein"} {
+		digest := sha1Hex(password)
+		path := filepath.Join(dir, digest[:prefixLength]+".txt")
+		suite.Require().NoError(os.WriteFile(path, []byte(digest[prefixLength:]+":3\n"), 0o600))
+	}
+
+	blocklist, err := LoadBlocklist(dir)
+	suite.Require().NoError(err)
+
+	suite.Equal(2, blocklist.Len())
+	suite.True(blocklist.Contains("hunter2"))
+	suite.False(blocklist.Contains("Correct-Horse-42"))
+}
+
+func (suite *PolicyTestSuite) TestLoadBlocklistRejectsMalformedLines() {
+	path := filepath.Join(suite.T().TempDir(), "pwned.txt")
+	suite.Require().NoError(os.WriteFile(path, []byte("not a digest\n"), 0o600))
+
+	_, err := LoadBlocklist(path)
+	suite.Error(err)
+}
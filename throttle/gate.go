@@ -0,0 +1,39 @@
+package throttle
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/diegodario88/sesamo/httphelper"
+)
+
+// Gate bounds how many requests run an expensive handler at once, such as
+// the ones hashing passwords. Requests that find no free slot within wait are
+// rejected with a 429.
+type Gate struct {
+	slots chan struct{}
+	wait  time.Duration
+}
+
+func NewGate(size int, wait time.Duration) *Gate {
+	return &Gate{slots: make(chan struct{}, size), wait: wait}
+}
+
+func (gate *Gate) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timer := time.NewTimer(gate.wait)
+		defer timer.Stop()
+
+		select {
+		case gate.slots <- struct{}{}:
+		case <-timer.C:
+			httphelper.WriteTooManyRequests(w, "the server is busy, try again shortly", time.Second)
+			return
+		case <-r.Context().Done():
+			return
+		}
+		defer func() { <-gate.slots }()
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,74 @@
+package throttle
+
+import (
+	"time"
+
+	"github.com/diegodario88/sesamo/config"
+)
+
+// maxDoublings caps the exponent of the delay so it cannot overflow.
+const maxDoublings = 30
+
+// Policy decides how long a client must wait after repeated failures: nothing
+// until DelayAfter failures, then a delay doubling from one second up to
+// MaxDelay, and LockFor once LockAfter failures are reached. Failures older
+// than LockFor are forgotten.
+type Policy struct {
+	DelayAfter int
+	LockAfter  int
+	MaxDelay   time.Duration
+	LockFor    time.Duration
+}
+
+// AccountPolicy returns the policy for failed logins of one account.
+func AccountPolicy(cfg *config.Config) Policy {
+	return Policy{
+		DelayAfter: cfg.LoginAccountDelayAfter,
+		LockAfter:  cfg.LoginAccountLockAfter,
+		MaxDelay:   cfg.LoginMaxDelay,
+		LockFor:    cfg.LoginLockoutDuration,
+	}
+}
+
+// IPPolicy returns the policy for failed logins from one client IP.
+func IPPolicy(cfg *config.Config) Policy {
+	return Policy{
+		DelayAfter: cfg.LoginIPDelayAfter,
+		LockAfter:  cfg.LoginIPLockAfter,
+		MaxDelay:   cfg.LoginMaxDelay,
+		LockFor:    cfg.LoginLockoutDuration,
+	}
+}
+
+// Wait is how long after the last of failures the next attempt is allowed.
+func (policy Policy) Wait(failures int) time.Duration {
+	switch {
+	case policy.Locks(failures):
+		return policy.LockFor
+	case failures < policy.DelayAfter:
+		return 0
+	}
+
+	doublings := min(failures-policy.DelayAfter, maxDoublings)
+	return min(time.Second<<doublings, policy.MaxDelay)
+}
+
+// Locks reports whether failures reach the lockout.
+func (policy Policy) Locks(failures int) bool {
+	return policy.LockAfter > 0 && failures >= policy.LockAfter
+}
+
+// Expired reports whether a failure at lastFailure is forgotten by now.
+func (policy Policy) Expired(lastFailure time.Time, now time.Time) bool {
+	return !now.Before(lastFailure.Add(policy.LockFor))
+}
+
+// RetryAfter is how long from now the next attempt must wait, or zero when it
+// is allowed.
+func (policy Policy) RetryAfter(failures int, lastFailure time.Time, now time.Time) time.Duration {
+	if failures == 0 || policy.Expired(lastFailure, now) {
+		return 0
+	}
+
+	return max(lastFailure.Add(policy.Wait(failures)).Sub(now), 0)
+}
@@ -0,0 +1,90 @@
+package throttle
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ThrottleTestSuite struct {
+	suite.Suite
+	policy Policy
+}
+
+func TestThrottleTestSuite(t *testing.T) {
+	suite.Run(t, new(ThrottleTestSuite))
+}
+
+func (suite *ThrottleTestSuite) SetupTest() {
+	suite.policy = Policy{
+		DelayAfter: 3,
+		LockAfter:  6,
+		MaxDelay:   5 * time.Second,
+		LockFor:    15 * time.Minute,
+	}
+}
+
+func (suite *ThrottleTestSuite) TestWaitGrowsThenLocks() {
+	waits := []time.Duration{}
+	for failures := 0; failures <= 6; failures++ {
+		waits = append(waits, suite.policy.Wait(failures))
+	}
+
+	suite.Equal([]time.Duration{
+		0, 0, 0,
+		time.Second, 2 * time.Second, 4 * time.Second,
+		15 * time.Minute,
+	}, waits)
+	suite.Equal(5*time.Second, Policy{DelayAfter: 1, MaxDelay: 5 * time.Second}.Wait(100))
+}
+
+func (suite *ThrottleTestSuite) TestRetryAfter() {
+	now := time.Now()
+
+	suite.Zero(suite.policy.RetryAfter(2, now, now))
+	suite.Equal(time.Second, suite.policy.RetryAfter(3, now, now))
+	suite.Zero(suite.policy.RetryAfter(3, now.Add(-time.Second), now))
+	suite.Equal(10*time.Minute, suite.policy.RetryAfter(6, now.Add(-5*time.Minute), now))
+	suite.Zero(suite.policy.RetryAfter(6, now.Add(-15*time.Minute), now))
+}
+
+func (suite *ThrottleTestSuite) TestTrackerForgetsOldFailures() {
+	tracker := NewTracker(suite.policy)
+	now := time.Now()
+
+	for range 3 {
+		tracker.Fail("198.51.100.7", now)
+	}
+	suite.Equal(time.Second, tracker.RetryAfter("198.51.100.7", now))
+	suite.Zero(tracker.RetryAfter("203.0.113.9", now))
+
+	later := now.Add(suite.policy.LockFor)
+	suite.Equal(1, tracker.Fail("198.51.100.7", later))
+	suite.Len(tracker.entries, 1)
+
+	tracker.Reset("198.51.100.7")
+	suite.Zero(tracker.RetryAfter("198.51.100.7", later))
+}
+
+func (suite *ThrottleTestSuite) TestGateRejectsExcessRequests() {
+	release := make(chan struct{})
+	entered := make(chan struct{})
+	gate := NewGate(1, 10*time.Millisecond)
+	handler := gate.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+	}))
+
+	go handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", nil))
+	<-entered
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/", nil))
+	close(release)
+
+	suite.Equal(http.StatusTooManyRequests, recorder.Code)
+	suite.Equal("1", recorder.Header().Get("Retry-After"))
+}
@@ -0,0 +1,85 @@
+package throttle
+
+import (
+	"sync"
+	"time"
+)
+
+type entry struct {
+	failures    int
+	lastFailure time.Time
+}
+
+// Tracker counts failures per key, such as a client IP, in memory. Every
+// instance keeps its own counts.
+type Tracker struct {
+	policy Policy
+
+	mu      sync.Mutex
+	entries map[string]*entry
+	sweptAt time.Time
+}
+
+func NewTracker(policy Policy) *Tracker {
+	return &Tracker{policy: policy, entries: map[string]*entry{}}
+}
+
+func (tracker *Tracker) Policy() Policy {
+	return tracker.policy
+}
+
+// RetryAfter is how long from now key must wait before its next attempt.
+func (tracker *Tracker) RetryAfter(key string, now time.Time) time.Duration {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	current, ok := tracker.entries[key]
+	if !ok {
+		return 0
+	}
+
+	return tracker.policy.RetryAfter(current.failures, current.lastFailure, now)
+}
+
+// Fail records a failure of key and returns its count of failures that are
+// not yet forgotten.
+func (tracker *Tracker) Fail(key string, now time.Time) int {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	tracker.sweep(now)
+
+	current, ok := tracker.entries[key]
+	if !ok || tracker.policy.Expired(current.lastFailure, now) {
+		current = &entry{}
+		tracker.entries[key] = current
+	}
+
+	current.failures++
+	current.lastFailure = now
+
+	return current.failures
+}
+
+// Reset forgets the failures of key.
+func (tracker *Tracker) Reset(key string) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	delete(tracker.entries, key)
+}
+
+// sweep drops forgotten entries, at most once per LockFor, so keys that stop
+// failing do not stay in memory.
+func (tracker *Tracker) sweep(now time.Time) {
+	if !tracker.policy.Expired(tracker.sweptAt, now) {
+		return
+	}
+
+	for key, current := range tracker.entries {
+		if tracker.policy.Expired(current.lastFailure, now) {
+			delete(tracker.entries, key)
+		}
+	}
+	tracker.sweptAt = now
+}
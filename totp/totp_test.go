@@ -0,0 +1,65 @@
+package totp
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type TOTPTestSuite struct {
+	suite.Suite
+}
+
+func TestTOTPTestSuite(t *testing.T) {
+	suite.Run(t, new(TOTPTestSuite))
+}
+
+// rfcSecret is the SHA-1 key of the RFC 6238 test vectors.
+var rfcSecret = []byte("12345678901234567890")
+
+func (suite *TOTPTestSuite) TestCodeMatchesRFC6238Vectors() {
+	// The RFC lists eight digit codes; six digit codes are their last six.
+	vectors := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+
+	for unix, code := range vectors {
+		suite.Equal(code, Code(rfcSecret, Step(time.Unix(unix, 0))), unix)
+	}
+}
+
+func (suite *TOTPTestSuite) TestValidateAllowsSkewAndRefusesReuse() {
+	now := time.Unix(1111111111, 0)
+	previous := Code(rfcSecret, Step(now)-1)
+
+	step, ok := Validate(rfcSecret, previous, now, -1)
+	suite.True(ok)
+	suite.Equal(Step(now)-1, step)
+
+	_, ok = Validate(rfcSecret, previous, now, step)
+	suite.False(ok)
+
+	_, ok = Validate(rfcSecret, Code(rfcSecret, Step(now)-2), now, -1)
+	suite.False(ok)
+
+	_, ok = Validate(rfcSecret, "12345", now, -1)
+	suite.False(ok)
+}
+
+func (suite *TOTPTestSuite) TestURI() {
+	uri, err := url.Parse(URI("Sesamo", "ana@example.com", rfcSecret))
+	suite.Require().NoError(err)
+
+	suite.Equal("otpauth", uri.Scheme)
+	suite.Equal("totp", uri.Host)
+	suite.Equal("/Sesamo:ana@example.com", uri.Path)
+	suite.Equal("GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", uri.Query().Get("secret"))
+	suite.Equal("Sesamo", uri.Query().Get("issuer"))
+}
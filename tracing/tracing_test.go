@@ -0,0 +1,52 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/diegodario88/sesamo/config"
+	"github.com/stretchr/testify/suite"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type TracingTestSuite struct {
+	suite.Suite
+}
+
+func TestTracingTestSuite(t *testing.T) {
+	suite.Run(t, new(TracingTestSuite))
+}
+
+func (suite *TracingTestSuite) TestSetupWithoutEndpointIsNoop() {
+	shutdown, err := Setup(context.Background(), &config.Config{OtelServiceName: "sesamo"})
+	suite.Require().NoError(err)
+	suite.NoError(shutdown(context.Background()))
+
+	_, span := Tracer().Start(context.Background(), "noop")
+	defer span.End()
+
+	suite.False(span.SpanContext().IsValid())
+}
+
+func (suite *TracingTestSuite) TestHeadersCarryTraceContext() {
+	_, err := Setup(context.Background(), &config.Config{})
+	suite.Require().NoError(err)
+
+	provider := sdktrace.NewTracerProvider()
+	defer provider.Shutdown(context.Background())
+
+	ctx, span := provider.Tracer("test").Start(context.Background(), "publish")
+	defer span.End()
+
+	headers := map[string]string{"source": "test"}
+	Inject(ctx, headers)
+
+	suite.Contains(headers, "traceparent")
+	suite.Equal("test", headers["source"])
+
+	remote := trace.SpanContextFromContext(Extract(context.Background(), headers))
+	suite.True(remote.IsRemote())
+	suite.Equal(span.SpanContext().TraceID(), remote.TraceID())
+	suite.Equal(span.SpanContext().SpanID(), remote.SpanID())
+}
@@ -0,0 +1,354 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diegodario88/sesamo/audit"
+	"github.com/diegodario88/sesamo/httphelper"
+	"github.com/diegodario88/sesamo/logging"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Personal access tokens start with accessTokenPrefix, which tells them apart
+// from JWTs in the Authorization header and makes leaked ones easy to spot.
+const (
+	accessTokenPrefix  = "sesamo_pat_"
+	accessTokenPurpose = "access_token"
+)
+
+// PersonalAccessToken lets scripts and integrations act for a user without
+// their password. It grants the permissions in Scopes that the owner still
+// holds, only within OrganizationID when set. Only the SHA-256 of the secret
+// is stored.
+type PersonalAccessToken struct {
+	ID             string         `db:"id"              json:"id"`
+	UserID         string         `db:"user_id"         json:"-"`
+	Name           string         `db:"name"            json:"name"`
+	TokenHash      string         `db:"token_hash"      json:"-"`
+	Scopes         pq.StringArray `db:"scopes"          json:"scopes"`
+	OrganizationID *string        `db:"organization_id" json:"organization_id"`
+	ExpiresAt      time.Time      `db:"expires_at"      json:"expires_at"`
+	LastUsedAt     *time.Time     `db:"last_used_at"    json:"last_used_at"`
+	LastUsedIP     *string        `db:"last_used_ip"    json:"last_used_ip"`
+	CreatedAt      time.Time      `db:"created_at"      json:"created_at"`
+}
+
+type AccessTokenPayload struct {
+	Name           string   `json:"name"           validate:"required,max=64"`
+	Scopes         []string `json:"scopes"         validate:"required,min=1,dive,required"`
+	OrganizationID *string  `json:"organizationId"`
+	ExpiresInDays  int      `json:"expiresInDays"  validate:"required,min=1"`
+}
+
+// allows tells whether the token grants permission on a request made within
+// orgID, which is empty outside of organization routes.
+func (token *PersonalAccessToken) allows(permission string, orgID string) bool {
+	if token.OrganizationID != nil && *token.OrganizationID != orgID {
+		return false
+	}
+
+	return slices.Contains(token.Scopes, permission)
+}
+
+// CreateAccessToken issues a personal access token to the caller, who must
+// have signed in within REAUTH_WINDOW. The secret is only part of this
+// response.
+func (svc *UserService) CreateAccessToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKey).(string)
+
+	authTime, _ := ctx.Value(AuthTimeKey).(time.Time)
+	if time.Since(authTime) > svc.Config.ReauthWindow {
+		httphelper.WriteProblem(w, httphelper.NewProblem(
+			http.StatusForbidden,
+			"reauthentication_required",
+			"sign in again to create an access token",
+		))
+		return
+	}
+
+	if enrolling, _ := ctx.Value(MFAEnrollmentKey).(bool); enrolling {
+		httphelper.WriteProblem(w, httphelper.NewProblem(
+			http.StatusForbidden,
+			"mfa_enrollment_required",
+			"enroll in multi-factor authentication to create an access token",
+		))
+		return
+	}
+
+	var payload AccessTokenPayload
+	if err := httphelper.ParseJSON(r, &payload); err != nil {
+		httphelper.WriteProblem(w, httphelper.BadRequest(err.Error()))
+		return
+	}
+
+	if err := httphelper.Validate.Struct(payload); err != nil {
+		httphelper.WriteProblem(w, httphelper.ValidationFailed(err))
+		return
+	}
+
+	ttl := time.Duration(payload.ExpiresInDays) * 24 * time.Hour
+	if ttl > svc.Config.AccessTokenMaxTTL {
+		maxDays := int(svc.Config.AccessTokenMaxTTL / (24 * time.Hour))
+		httphelper.WriteProblem(w, httphelper.InvalidFields(httphelper.FieldError{
+			Field:   "expiresInDays",
+			Rule:    "max",
+			Param:   strconv.Itoa(maxDays),
+			Message: fmt.Sprintf("must be at most %d", maxDays),
+		}))
+		return
+	}
+
+	scopes, problem, err := svc.checkAccessTokenScopes(ctx, userID, payload)
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+	if problem != nil {
+		httphelper.WriteProblem(w, problem)
+		return
+	}
+
+	secret, _, err := newToken([]byte(svc.Config.JwtSecret), accessTokenPurpose)
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+	secret = accessTokenPrefix + secret
+
+	token, err := svc.Repo.InsertPersonalAccessToken(ctx, &PersonalAccessToken{
+		UserID:         userID,
+		Name:           payload.Name,
+		TokenHash:      hashToken(secret),
+		Scopes:         scopes,
+		OrganizationID: payload.OrganizationID,
+	}, ttl)
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	svc.record(ctx, audit.Event{
+		Action:  audit.ActionAccessTokenCreated,
+		ActorID: &userID,
+		UserID:  &userID,
+		Details: map[string]any{
+			"access_token_id": token.ID,
+			"name":            token.Name,
+			"scopes":          []string(token.Scopes),
+			"organization_id": token.OrganizationID,
+			"expires_at":      token.ExpiresAt,
+		},
+	})
+
+	httphelper.WriteJSON(w, http.StatusCreated, map[string]any{
+		"access_token": token,
+		"secret":       secret,
+	})
+}
+
+// checkAccessTokenScopes returns the distinct scopes of payload, or a problem
+// when the caller asks for a permission or an organization they do not have.
+func (svc *UserService) checkAccessTokenScopes(
+	ctx context.Context,
+	userID string,
+	payload AccessTokenPayload,
+) ([]string, *httphelper.Problem, error) {
+	scopes := []string{}
+	for _, scope := range payload.Scopes {
+		if slices.Contains(scopes, scope) {
+			continue
+		}
+
+		granted, err := svc.Repo.HasAccess(ctx, userID, scope)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !granted {
+			return nil, httphelper.InvalidFields(httphelper.FieldError{
+				Field:   "scopes",
+				Rule:    "granted",
+				Param:   scope,
+				Message: fmt.Sprintf("you do not have permission %s", scope),
+			}), nil
+		}
+
+		scopes = append(scopes, scope)
+	}
+
+	if payload.OrganizationID != nil {
+		orgs, err := svc.Repo.GetUserOrganizations(ctx, userID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !hasOrganization(orgs, *payload.OrganizationID) {
+			return nil, httphelper.InvalidFields(httphelper.FieldError{
+				Field:   "organizationId",
+				Rule:    "member",
+				Message: "is not one of your organizations",
+			}), nil
+		}
+	}
+
+	return scopes, nil, nil
+}
+
+// GetAccessTokens lists the personal access tokens of the caller, with when
+// and from where each was last used.
+func (svc *UserService) GetAccessTokens(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	tokens, err := svc.Repo.FindPersonalAccessTokens(ctx, ctx.Value(UserIDKey).(string))
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	httphelper.WriteJSON(w, http.StatusOK, tokens)
+}
+
+// RevokeAccessToken deletes a personal access token of the caller, which is
+// refused from then on.
+func (svc *UserService) RevokeAccessToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKey).(string)
+	tokenID := mux.Vars(r)["tokenId"]
+
+	if err := svc.Repo.DeletePersonalAccessToken(ctx, userID, tokenID); err != nil {
+		writeLookupError(w, r, err, "access token not found")
+		return
+	}
+
+	svc.record(ctx, audit.Event{
+		Action:  audit.ActionAccessTokenRevoked,
+		ActorID: &userID,
+		UserID:  &userID,
+		Details: map[string]any{"access_token_id": tokenID},
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authenticateAccessToken resolves the personal access token secret used from
+// ip into the request context AuthMiddleware hands on, recording its use.
+// Tokens of users who may not sign in, or created before the user's tokens
+// were revoked, are refused like JWTs.
+func (svc *UserService) authenticateAccessToken(
+	ctx context.Context,
+	ip string,
+	secret string,
+) (context.Context, error) {
+	if !svc.verifyAccessToken(secret) {
+		return ctx, ErrInvalidToken
+	}
+
+	token, err := svc.Repo.UsePersonalAccessToken(ctx, hashToken(secret), ip)
+	if err != nil {
+		return ctx, err
+	}
+
+	user, err := svc.accessTokenOwner(ctx, token)
+	if err != nil {
+		return ctx, err
+	}
+
+	// Tokens are held back like the reduced JWT of a user who has yet to
+	// enroll in the MFA their roles require.
+	enrolling := false
+	if user.Status != StatusPendingVerification {
+		if enrolling, err = svc.mfaEnrollmentRequired(ctx, user); err != nil {
+			return ctx, err
+		}
+	}
+
+	ctx = context.WithValue(ctx, UserIDKey, user.ID)
+	ctx = context.WithValue(ctx, UnverifiedKey, user.Status == StatusPendingVerification)
+	ctx = context.WithValue(ctx, AuthTimeKey, time.Time{})
+	ctx = context.WithValue(ctx, MFAEnrollmentKey, enrolling)
+	ctx = context.WithValue(ctx, AccessTokenKey, token)
+	return logging.SetUserID(ctx, user.ID), nil
+}
+
+// findAccessToken looks up the personal access token secret without recording
+// its use, for callers that only describe or delete it.
+func (svc *UserService) findAccessToken(
+	ctx context.Context,
+	secret string,
+) (*PersonalAccessToken, error) {
+	if !svc.verifyAccessToken(secret) {
+		return nil, ErrInvalidToken
+	}
+
+	return svc.Repo.FindPersonalAccessToken(ctx, hashToken(secret))
+}
+
+// verifyAccessToken checks that secret is a personal access token sesamo
+// signed, before anything is looked up.
+func (svc *UserService) verifyAccessToken(secret string) bool {
+	key := []byte(svc.Config.JwtSecret)
+	return verifyToken(key, accessTokenPurpose, strings.TrimPrefix(secret, accessTokenPrefix))
+}
+
+// accessTokenOwner returns the user token belongs to, refusing the token when
+// they may not sign in or it was created before their tokens were revoked.
+func (svc *UserService) accessTokenOwner(
+	ctx context.Context,
+	token *PersonalAccessToken,
+) (*UserEntity, error) {
+	user, err := svc.Repo.FindUserById(ctx, token.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, fmt.Errorf("accessTokenOwner: %w", err)
+	}
+
+	if err := svc.checkCanSignIn(user); err != nil {
+		return nil, err
+	}
+
+	if err := user.CheckTokenIssuedAt(token.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// rejectsToken tells the errors of a credential the caller must replace apart
+// from failures of sesamo itself.
+func rejectsToken(err error) bool {
+	return errors.Is(err, ErrInvalidToken) ||
+		errors.Is(err, ErrTokenRevoked) ||
+		errors.Is(err, ErrServiceAccountDisabled) ||
+		errors.Is(err, ErrUserNotFound) ||
+		accountInactive(err) != nil
+}
+
+// sessionOnly keeps personal access tokens and service accounts away from
+// handler, for endpoints that manage credentials or issue tokens and so need
+// a signed-in user.
+func (h *Handler) sessionOnly(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, isToken := r.Context().Value(AccessTokenKey).(*PersonalAccessToken)
+		_, isService := r.Context().Value(ServiceAccountKey).(*ServiceAccount)
+		if isToken || isService {
+			httphelper.WriteProblem(w, httphelper.NewProblem(
+				http.StatusForbidden,
+				"access_token_not_allowed",
+				"sign in to use this endpoint; access tokens cannot",
+			))
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
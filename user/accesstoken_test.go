@@ -0,0 +1,278 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diegodario88/sesamo/audit"
+	"github.com/diegodario88/sesamo/config"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+const (
+	memberOrgID = "01JQ0000000000000000000006"
+	otherOrgID  = "01JQ0000000000000000000007"
+)
+
+type AccessTokenTestSuite struct {
+	suite.Suite
+	repo    *MockUserRepository
+	audit   *recordingAudit
+	handler *Handler
+	user    *UserEntity
+}
+
+func TestAccessTokenTestSuite(t *testing.T) {
+	suite.Run(t, new(AccessTokenTestSuite))
+}
+
+func (suite *AccessTokenTestSuite) SetupTest() {
+	suite.repo = new(MockUserRepository)
+	suite.audit = &recordingAudit{}
+	suite.handler = NewHandler(UserService{
+		Repo: suite.repo,
+		Config: &config.Config{
+			JwtSecret:              "0123456789abcdef",
+			JwtExpirationInSeconds: 3600,
+			ReauthWindow:           5 * time.Minute,
+			AccessTokenMaxTTL:      90 * 24 * time.Hour,
+		},
+		Audit: suite.audit,
+	})
+	suite.user = &UserEntity{ID: targetID, Email: "ana@example.com", Status: StatusActive}
+}
+
+func (suite *AccessTokenTestSuite) create(body string) *httptest.ResponseRecorder {
+	ctx := context.WithValue(context.Background(), UserIDKey, suite.user.ID)
+	ctx = context.WithValue(ctx, AuthTimeKey, time.Now())
+	request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+
+	suite.handler.CreateAccessToken(recorder, request.WithContext(ctx))
+
+	return recorder
+}
+
+// issue returns the secret of a stored token granting scopes, which the
+// repository hands out when it is used.
+func (suite *AccessTokenTestSuite) issue(scopes []string, orgID *string) string {
+	secret, _, err := newToken([]byte(suite.handler.Config.JwtSecret), accessTokenPurpose)
+	suite.Require().NoError(err)
+	secret = accessTokenPrefix + secret
+
+	token := &PersonalAccessToken{
+		ID:             "01JQ0000000000000000000009",
+		UserID:         suite.user.ID,
+		Name:           "deploy",
+		Scopes:         scopes,
+		OrganizationID: orgID,
+		CreatedAt:      time.Now().Add(-time.Hour),
+	}
+	suite.repo.On("UsePersonalAccessToken", hashToken(secret), testIP).Return(token, nil).Once()
+	suite.repo.On("FindUserById", suite.user.ID).Return(suite.user, nil).Once()
+	suite.repo.On("RequiresMFA", suite.user.ID).Return(false, nil).Maybe()
+	return secret
+}
+
+// serve sends a request with secret through AuthMiddleware to route, which
+// answers 204 once every other middleware let it through.
+func (suite *AccessTokenTestSuite) serve(
+	secret string,
+	path string,
+	route func(router *mux.Router, ok http.Handler),
+) *httptest.ResponseRecorder {
+	router := mux.NewRouter()
+	router.Use(suite.handler.AuthMiddleware)
+	route(router, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	request := httptest.NewRequest(http.MethodGet, path, nil)
+	request.RemoteAddr = testIP + ":40000"
+	request.Header.Set("Authorization", "Bearer "+secret)
+	recorder := httptest.NewRecorder()
+
+	router.ServeHTTP(recorder, request)
+
+	return recorder
+}
+
+func (suite *AccessTokenTestSuite) TestSecretIsShownOnceAndStoredHashed() {
+	suite.repo.On("HasAccess", suite.user.ID, "users:read").Return(true, nil).Once()
+	suite.repo.
+		On("InsertPersonalAccessToken", mock.Anything, 30*24*time.Hour).
+		Return(&PersonalAccessToken{ID: "01JQ0000000000000000000009", Name: "deploy"}, nil).
+		Once()
+
+	recorder := suite.create(
+		`{"name":"deploy","scopes":["users:read","users:read"],"expiresInDays":30}`,
+	)
+
+	suite.Require().Equal(http.StatusCreated, recorder.Code, recorder.Body.String())
+	var body struct {
+		Secret string `json:"secret"`
+	}
+	suite.Require().NoError(json.Unmarshal(recorder.Body.Bytes(), &body))
+	suite.True(strings.HasPrefix(body.Secret, accessTokenPrefix))
+
+	stored := suite.repo.Calls[1].Arguments.Get(0).(*PersonalAccessToken)
+	suite.Equal(hashToken(body.Secret), stored.TokenHash)
+	suite.Equal([]string{"users:read"}, []string(stored.Scopes))
+	suite.Require().Len(suite.audit.events, 1)
+	suite.Equal(audit.ActionAccessTokenCreated, suite.audit.events[0].Action)
+}
+
+func (suite *AccessTokenTestSuite) TestScopesBeyondTheOwnerAreRefused() {
+	suite.repo.On("HasAccess", suite.user.ID, "users:delete").Return(false, nil).Once()
+
+	recorder := suite.create(`{"name":"deploy","scopes":["users:delete"],"expiresInDays":30}`)
+
+	suite.Equal(http.StatusUnprocessableEntity, recorder.Code)
+	suite.Contains(recorder.Body.String(), "users:delete")
+	suite.repo.AssertNotCalled(suite.T(), "InsertPersonalAccessToken", mock.Anything, mock.Anything)
+}
+
+func (suite *AccessTokenTestSuite) TestOtherOrganizationsAreRefused() {
+	suite.repo.On("HasAccess", suite.user.ID, "users:read").Return(true, nil).Once()
+	suite.repo.
+		On("GetUserOrganizations", suite.user.ID).
+		Return([]OrganizationEntity{{ID: memberOrgID}}, nil).
+		Once()
+
+	recorder := suite.create(
+		`{"name":"deploy","scopes":["users:read"],"organizationId":"` + otherOrgID +
+			`","expiresInDays":30}`,
+	)
+
+	suite.Equal(http.StatusUnprocessableEntity, recorder.Code)
+	suite.Contains(recorder.Body.String(), "organizationId")
+}
+
+func (suite *AccessTokenTestSuite) TestLifetimeIsCapped() {
+	recorder := suite.create(`{"name":"deploy","scopes":["users:read"],"expiresInDays":91}`)
+
+	suite.Equal(http.StatusUnprocessableEntity, recorder.Code)
+	suite.Contains(recorder.Body.String(), "must be at most 90")
+}
+
+func (suite *AccessTokenTestSuite) TestScopedPermissionIsGranted() {
+	secret := suite.issue([]string{"users:read"}, nil)
+	suite.repo.On("HasAccess", suite.user.ID, "users:read").Return(true, nil).Once()
+
+	recorder := suite.serve(secret, "/users", func(router *mux.Router, ok http.Handler) {
+		router.Handle("/users", RBACMiddleware(suite.handler, "users:read")(ok))
+	})
+
+	suite.Equal(http.StatusNoContent, recorder.Code)
+}
+
+func (suite *AccessTokenTestSuite) TestTokenOfUserYetToEnrollInMFAIsDenied() {
+	suite.repo.On("RequiresMFA", suite.user.ID).Return(true, nil).Once()
+	suite.repo.On("FindWebAuthnCredentials", suite.user.ID).Return([]WebAuthnCredential{}, nil).Once()
+	secret := suite.issue([]string{"users:read"}, nil)
+
+	recorder := suite.serve(secret, "/users", func(router *mux.Router, ok http.Handler) {
+		router.Handle("/users", RBACMiddleware(suite.handler, "users:read")(ok))
+	})
+
+	suite.Equal(http.StatusForbidden, recorder.Code)
+	suite.Contains(recorder.Body.String(), "mfa_enrollment_required")
+	suite.repo.AssertNotCalled(suite.T(), "HasAccess", mock.Anything, mock.Anything)
+}
+
+func (suite *AccessTokenTestSuite) TestPermissionOutsideTheScopesIsDenied() {
+	secret := suite.issue([]string{"users:read"}, nil)
+
+	recorder := suite.serve(secret, "/users/x", func(router *mux.Router, ok http.Handler) {
+		router.Handle("/users/x", RBACMiddleware(suite.handler, "users:delete")(ok))
+	})
+
+	suite.Equal(http.StatusForbidden, recorder.Code)
+	suite.repo.AssertNotCalled(suite.T(), "HasAccess", mock.Anything, mock.Anything)
+}
+
+func (suite *AccessTokenTestSuite) TestOrganizationTokenOnlyWorksInItsOrganization() {
+	org := memberOrgID
+	route := func(router *mux.Router, ok http.Handler) {
+		orgRouter := router.PathPrefix("/organizations/{orgId}").Subrouter()
+		orgRouter.Use(suite.handler.OrganizationAccessMiddleware)
+		orgRouter.Handle("/users", RBACMiddleware(suite.handler, "users:read")(ok))
+		router.Handle("/users", RBACMiddleware(suite.handler, "users:read")(ok))
+	}
+
+	secret := suite.issue([]string{"users:read"}, &org)
+	suite.repo.
+		On("GetUserOrganizations", suite.user.ID).
+		Return([]OrganizationEntity{{ID: memberOrgID}, {ID: otherOrgID}}, nil).
+		Once()
+	suite.repo.On("HasAccess", suite.user.ID, "users:read").Return(true, nil).Once()
+	suite.Equal(
+		http.StatusNoContent,
+		suite.serve(secret, "/organizations/"+memberOrgID+"/users", route).Code,
+	)
+
+	secret = suite.issue([]string{"users:read"}, &org)
+	suite.Equal(
+		http.StatusForbidden,
+		suite.serve(secret, "/organizations/"+otherOrgID+"/users", route).Code,
+	)
+
+	secret = suite.issue([]string{"users:read"}, &org)
+	suite.Equal(http.StatusForbidden, suite.serve(secret, "/users", route).Code)
+	suite.repo.AssertExpectations(suite.T())
+}
+
+func (suite *AccessTokenTestSuite) TestTokenCannotMintTokens() {
+	secret := suite.issue([]string{"users:read"}, nil)
+
+	recorder := suite.serve(secret, "/users/token/refresh", func(router *mux.Router, ok http.Handler) {
+		router.Handle("/users/token/refresh", suite.handler.sessionOnly(ok))
+	})
+
+	suite.Equal(http.StatusForbidden, recorder.Code)
+	suite.Contains(recorder.Body.String(), "access_token_not_allowed")
+}
+
+func (suite *AccessTokenTestSuite) TestExpiredOrRevokedTokenIsRejected() {
+	secret := suite.issue(nil, nil)
+	suite.repo.ExpectedCalls = nil
+	suite.repo.
+		On("UsePersonalAccessToken", hashToken(secret), testIP).
+		Return((*PersonalAccessToken)(nil), ErrInvalidToken).
+		Once()
+
+	recorder := suite.serve(secret, "/users/me", func(router *mux.Router, ok http.Handler) {
+		router.Handle("/users/me", ok)
+	})
+
+	suite.Equal(http.StatusUnauthorized, recorder.Code)
+}
+
+func (suite *AccessTokenTestSuite) TestForgedTokenIsRejectedWithoutALookup() {
+	recorder := suite.serve(
+		accessTokenPrefix+"forged.signature",
+		"/users/me",
+		func(router *mux.Router, ok http.Handler) { router.Handle("/users/me", ok) },
+	)
+
+	suite.Equal(http.StatusUnauthorized, recorder.Code)
+	suite.repo.AssertNotCalled(suite.T(), "UsePersonalAccessToken", mock.Anything, mock.Anything)
+}
+
+func (suite *AccessTokenTestSuite) TestTokenOfDisabledUserIsRejected() {
+	suite.user.Status = StatusDisabled
+	secret := suite.issue([]string{"users:read"}, nil)
+
+	recorder := suite.serve(secret, "/users/me", func(router *mux.Router, ok http.Handler) {
+		router.Handle("/users/me", ok)
+	})
+
+	suite.Equal(http.StatusUnauthorized, recorder.Code)
+}
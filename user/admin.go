@@ -0,0 +1,291 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/diegodario88/sesamo/httphelper"
+	"github.com/diegodario88/sesamo/logging"
+	"github.com/diegodario88/sesamo/mail"
+	"github.com/gorilla/mux"
+)
+
+// UpdateUserPayload changes the profile fields that are present.
+type UpdateUserPayload struct {
+	FirstName *string `json:"firstName" validate:"omitempty,min=1,max=100"`
+	LastName  *string `json:"lastName"  validate:"omitempty,min=1,max=100"`
+}
+
+type ChangeEmailPayload struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+// ChangeStatusPayload moves an account to another status. Any status other
+// than active revokes the tokens issued to the account.
+type ChangeStatusPayload struct {
+	Status string  `json:"status" validate:"required,oneof=active disabled locked pending_verification"`
+	Reason *string `json:"reason" validate:"omitempty,max=500"`
+}
+
+type ConfirmEmailPayload struct {
+	Token string `json:"token" validate:"required"`
+}
+
+// managedUser loads the {id} user of the route when the caller may act on it
+// with permission. Users outside the caller's scope answer 404, like missing
+// ones, so their existence is not disclosed.
+func (svc *UserService) managedUser(
+	w http.ResponseWriter,
+	r *http.Request,
+	permission string,
+) (*UserEntity, bool) {
+	manager := Manager{UserID: r.Context().Value(UserIDKey).(string), Permission: permission}
+
+	user, err := svc.Repo.FindManagedUser(r.Context(), manager, mux.Vars(r)["id"])
+	if err != nil {
+		writeLookupError(w, r, err, "user not found")
+		return nil, false
+	}
+
+	return user, true
+}
+
+func isSelf(r *http.Request, user *UserEntity) bool {
+	return r.Context().Value(UserIDKey).(string) == user.ID
+}
+
+func (svc *UserService) UpdateUser(w http.ResponseWriter, r *http.Request) {
+	var payload UpdateUserPayload
+	if err := httphelper.ParseJSON(r, &payload); err != nil {
+		httphelper.WriteProblem(w, httphelper.BadRequest(err.Error()))
+		return
+	}
+
+	if err := httphelper.Validate.Struct(payload); err != nil {
+		httphelper.WriteProblem(w, httphelper.ValidationFailed(err))
+		return
+	}
+
+	user, ok := svc.managedUser(w, r, "users:update")
+	if !ok {
+		return
+	}
+
+	updated, err := svc.Repo.UpdateUserProfile(
+		r.Context(),
+		user.ID,
+		payload.FirstName,
+		payload.LastName,
+	)
+	if err != nil {
+		writeLookupError(w, r, err, "user not found")
+		return
+	}
+
+	httphelper.WriteJSON(w, http.StatusOK, updated)
+}
+
+// ChangeUserEmail does not change the email right away: it mails a
+// confirmation link to the new address, and the change only happens once the
+// link is redeemed through ConfirmEmail.
+func (svc *UserService) ChangeUserEmail(w http.ResponseWriter, r *http.Request) {
+	var payload ChangeEmailPayload
+	if err := httphelper.ParseJSON(r, &payload); err != nil {
+		httphelper.WriteProblem(w, httphelper.BadRequest(err.Error()))
+		return
+	}
+
+	if err := httphelper.Validate.Struct(payload); err != nil {
+		httphelper.WriteProblem(w, httphelper.ValidationFailed(err))
+		return
+	}
+
+	user, ok := svc.managedUser(w, r, "users:update")
+	if !ok {
+		return
+	}
+
+	if strings.EqualFold(user.Email, payload.Email) {
+		httphelper.WriteProblem(w, httphelper.Conflict("the user already has this email"))
+		return
+	}
+
+	if _, err := svc.Repo.FindUserByEmail(r.Context(), payload.Email); err == nil {
+		writeUserExists(w, payload.Email)
+		return
+	}
+
+	if err := svc.RequestEmailChange(r.Context(), user, payload.Email); err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	httphelper.WriteJSON(w, http.StatusAccepted, map[string]string{"pending_email": payload.Email})
+}
+
+// RequestEmailChange mails a single-use link to email that, once redeemed,
+// makes it the email of user.
+func (svc *UserService) RequestEmailChange(
+	ctx context.Context,
+	user *UserEntity,
+	email string,
+) error {
+	secret, err := svc.issueToken(
+		ctx,
+		user.ID,
+		TokenPurposeEmailChange,
+		&email,
+		svc.Config.EmailTokenTTL,
+	)
+	if err != nil {
+		return fmt.Errorf("RequestEmailChange: %w", err)
+	}
+
+	err = svc.Mailer.Send(ctx, mail.Message{
+		To:      email,
+		Subject: "Confirm your new email address",
+		Body: fmt.Sprintf(
+			"Hello %s,\n\n"+
+				"Open the link below to make %s the email address of your account. "+
+				"It expires in %s.\n\n%s\n\n"+
+				"If you did not expect this message, you can ignore it.\n",
+			user.FirstName,
+			email,
+			svc.Config.EmailTokenTTL,
+			svc.link("confirm-email", secret),
+		),
+	})
+	if err != nil {
+		return fmt.Errorf("RequestEmailChange: %w", err)
+	}
+
+	return nil
+}
+
+// ConfirmEmail redeems an email change link. The token is the credential, so
+// the route is public.
+func (svc *UserService) ConfirmEmail(w http.ResponseWriter, r *http.Request) {
+	var payload ConfirmEmailPayload
+	if err := httphelper.ParseJSON(r, &payload); err != nil {
+		httphelper.WriteProblem(w, httphelper.BadRequest(err.Error()))
+		return
+	}
+
+	if err := httphelper.Validate.Struct(payload); err != nil {
+		httphelper.WriteProblem(w, httphelper.ValidationFailed(err))
+		return
+	}
+
+	token, err := svc.redeemToken(r.Context(), TokenPurposeEmailChange, payload.Token)
+	if errors.Is(err, ErrInvalidToken) {
+		writeInvalidToken(w)
+		return
+	}
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	if token.Data == nil {
+		httphelper.WriteInternalError(w, r, errors.New("email change token without an email"))
+		return
+	}
+
+	user, err := svc.Repo.UpdateUserEmail(r.Context(), token.UserID, *token.Data)
+	if errors.Is(err, ErrUserAlreadyExists) {
+		writeUserExists(w, *token.Data)
+		return
+	}
+	if err != nil {
+		writeLookupError(w, r, err, "user not found")
+		return
+	}
+
+	httphelper.WriteJSON(w, http.StatusOK, user)
+}
+
+func (svc *UserService) ChangeUserStatus(w http.ResponseWriter, r *http.Request) {
+	var payload ChangeStatusPayload
+	if err := httphelper.ParseJSON(r, &payload); err != nil {
+		httphelper.WriteProblem(w, httphelper.BadRequest(err.Error()))
+		return
+	}
+
+	if err := httphelper.Validate.Struct(payload); err != nil {
+		httphelper.WriteProblem(w, httphelper.ValidationFailed(err))
+		return
+	}
+
+	svc.changeStatus(w, r, payload.Status, payload.Reason)
+}
+
+func (svc *UserService) DisableUserByID(w http.ResponseWriter, r *http.Request) {
+	svc.changeStatus(w, r, StatusDisabled, nil)
+}
+
+func (svc *UserService) EnableUserByID(w http.ResponseWriter, r *http.Request) {
+	svc.changeStatus(w, r, StatusActive, nil)
+}
+
+// changeStatus moves the {id} user to status. Callers cannot deactivate
+// themselves, which would lock the last administrator out.
+func (svc *UserService) changeStatus(
+	w http.ResponseWriter,
+	r *http.Request,
+	status string,
+	reason *string,
+) {
+	user, ok := svc.managedUser(w, r, "users:update")
+	if !ok {
+		return
+	}
+
+	if status != StatusActive && isSelf(r, user) {
+		httphelper.WriteProblem(w, httphelper.Conflict("you cannot deactivate your own account"))
+		return
+	}
+
+	updated, err := svc.Repo.SetUserStatus(r.Context(), user.ID, status, reason)
+	if err != nil {
+		writeLookupError(w, r, err, "user not found")
+		return
+	}
+
+	logging.FromContext(r.Context()).Info(
+		"User status changed",
+		"target_user_id", user.ID,
+		"from", user.Status,
+		"to", status,
+	)
+	httphelper.WriteJSON(w, http.StatusOK, updated)
+}
+
+func (svc *UserService) DeleteUserByID(w http.ResponseWriter, r *http.Request) {
+	user, ok := svc.managedUser(w, r, "users:delete")
+	if !ok {
+		return
+	}
+
+	if isSelf(r, user) {
+		httphelper.WriteProblem(w, httphelper.Conflict("you cannot delete your own account"))
+		return
+	}
+
+	if err := svc.Repo.DeleteUser(r.Context(), user.ID); err != nil {
+		writeLookupError(w, r, err, "user not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeUserExists(w http.ResponseWriter, email string) {
+	httphelper.WriteProblem(w, httphelper.NewProblem(
+		http.StatusConflict,
+		"user_already_exists",
+		fmt.Sprintf("user with email %s already exists", email),
+	))
+}
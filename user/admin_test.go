@@ -0,0 +1,154 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diegodario88/sesamo/config"
+	"github.com/diegodario88/sesamo/mail"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+// recordingSender keeps the messages it is asked to send.
+type recordingSender struct {
+	sent []mail.Message
+}
+
+func (sender *recordingSender) Send(ctx context.Context, msg mail.Message) error {
+	sender.sent = append(sender.sent, msg)
+	return nil
+}
+
+const (
+	adminID  = "01JQ0000000000000000000001"
+	targetID = "01JQ0000000000000000000002"
+)
+
+type AdminTestSuite struct {
+	suite.Suite
+	repo   *MockUserRepository
+	mailer *recordingSender
+	svc    UserService
+}
+
+func TestAdminTestSuite(t *testing.T) {
+	suite.Run(t, new(AdminTestSuite))
+}
+
+func (suite *AdminTestSuite) SetupTest() {
+	suite.repo = new(MockUserRepository)
+	suite.mailer = &recordingSender{}
+	suite.svc = UserService{
+		Repo:   suite.repo,
+		Config: &config.Config{AppUrl: "https://app.example.com/", EmailTokenTTL: time.Hour},
+		Mailer: suite.mailer,
+	}
+}
+
+// request builds a request made by adminID against the {id} user.
+func (suite *AdminTestSuite) request(method string, id string, body string) *http.Request {
+	r := httptest.NewRequest(method, "/users/"+id, strings.NewReader(body))
+	r = r.WithContext(context.WithValue(r.Context(), UserIDKey, adminID))
+	return mux.SetURLVars(r, map[string]string{"id": id})
+}
+
+func (suite *AdminTestSuite) TestUserOutsideScopeIsNotFound() {
+	suite.repo.
+		On("FindManagedUser", Manager{UserID: adminID, Permission: "users:read"}, targetID).
+		Return((*UserEntity)(nil), fmt.Errorf("FindManagedUser: %w", sql.ErrNoRows))
+
+	recorder := httptest.NewRecorder()
+	suite.svc.GetUserByID(recorder, suite.request(http.MethodGet, targetID, ""))
+
+	suite.Equal(http.StatusNotFound, recorder.Code)
+	suite.repo.AssertExpectations(suite.T())
+}
+
+func (suite *AdminTestSuite) TestCannotDeleteOwnAccount() {
+	suite.repo.
+		On("FindManagedUser", Manager{UserID: adminID, Permission: "users:delete"}, adminID).
+		Return(&UserEntity{ID: adminID}, nil)
+
+	recorder := httptest.NewRecorder()
+	suite.svc.DeleteUserByID(recorder, suite.request(http.MethodDelete, adminID, ""))
+
+	suite.Equal(http.StatusConflict, recorder.Code)
+	suite.repo.AssertNotCalled(suite.T(), "DeleteUser", mock.Anything)
+}
+
+func (suite *AdminTestSuite) TestChangeEmailRequiresConfirmation() {
+	target := &UserEntity{ID: targetID, FirstName: "Ana", Email: "ana@example.com"}
+	suite.repo.
+		On("FindManagedUser", Manager{UserID: adminID, Permission: "users:update"}, targetID).
+		Return(target, nil)
+	suite.repo.
+		On("FindUserByEmail", "ana@new.example.com").
+		Return((*UserEntity)(nil), sql.ErrNoRows)
+
+	var stored *UserToken
+	suite.repo.
+		On("CreateUserToken", mock.AnythingOfType("*user.UserToken"), time.Hour).
+		Run(func(args mock.Arguments) { stored = args.Get(0).(*UserToken) }).
+		Return(nil)
+
+	recorder := httptest.NewRecorder()
+	suite.svc.ChangeUserEmail(recorder, suite.request(
+		http.MethodPut,
+		targetID,
+		`{"email":"ana@new.example.com"}`,
+	))
+
+	suite.Equal(http.StatusAccepted, recorder.Code)
+	suite.repo.AssertNotCalled(suite.T(), "UpdateUserEmail", mock.Anything, mock.Anything)
+	suite.Require().Len(suite.mailer.sent, 1)
+	suite.Equal("ana@new.example.com", suite.mailer.sent[0].To)
+
+	words := strings.Fields(suite.mailer.sent[0].Body)
+	var secret string
+	for _, word := range words {
+		if parsed, err := url.Parse(word); err == nil && parsed.Query().Has("token") {
+			suite.Equal("/confirm-email", parsed.Path)
+			secret = parsed.Query().Get("token")
+		}
+	}
+	suite.Require().NotEmpty(secret)
+	suite.Equal(stored.TokenHash, hashToken(secret))
+	suite.NotEqual(secret, stored.TokenHash)
+	suite.Equal(TokenPurposeEmailChange, stored.Purpose)
+
+	suite.repo.
+		On("ConsumeUserToken", TokenPurposeEmailChange, stored.TokenHash).
+		Return(&UserToken{UserID: targetID, Data: stored.Data}, nil)
+	suite.repo.
+		On("UpdateUserEmail", targetID, "ana@new.example.com").
+		Return(&UserEntity{ID: targetID, Email: "ana@new.example.com"}, nil)
+
+	recorder = httptest.NewRecorder()
+	body := strings.NewReader(`{"token":"` + secret + `"}`)
+	suite.svc.ConfirmEmail(recorder, httptest.NewRequest(http.MethodPost, "/", body))
+
+	suite.Equal(http.StatusOK, recorder.Code)
+	suite.repo.AssertExpectations(suite.T())
+}
+
+func (suite *AdminTestSuite) TestConfirmEmailRejectsUnknownToken() {
+	suite.repo.
+		On("ConsumeUserToken", TokenPurposeEmailChange, hashToken("bogus")).
+		Return((*UserToken)(nil), ErrInvalidToken)
+
+	recorder := httptest.NewRecorder()
+	body := strings.NewReader(`{"token":"bogus"}`)
+	suite.svc.ConfirmEmail(recorder, httptest.NewRequest(http.MethodPost, "/", body))
+
+	suite.Equal(http.StatusBadRequest, recorder.Code)
+	suite.Contains(recorder.Body.String(), `"code":"invalid_token"`)
+}
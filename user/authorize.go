@@ -0,0 +1,898 @@
+package user
+
+import (
+	"context"
+	"crypto/subtle"
+	"embed"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diegodario88/sesamo/audit"
+	"github.com/diegodario88/sesamo/httphelper"
+	"github.com/diegodario88/sesamo/logging"
+	"github.com/diegodario88/sesamo/metrics"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Purposes of the single-use tokens of the authorization code flow: the code
+// handed to clients, and the one handing a sign-in over from the web app to
+// the browser session.
+const (
+	TokenPurposeOAuthCode    = "oauth_code"
+	TokenPurposeOAuthSession = "oauth_session"
+)
+
+// Purposes of the signed values the authorization endpoint hands out, so
+// none redeems as another.
+const (
+	sessionPurpose      = "session"
+	oauthRequestPurpose = "oauth_request"
+	consentPurpose      = "oauth_consent"
+)
+
+const (
+	sessionCookieName = "sesamo_session"
+	loginCookieName   = "sesamo_login"
+
+	oauthRequestTTL = 15 * time.Minute
+	oauthCodeTTL    = time.Minute
+	oauthSessionTTL = time.Minute
+
+	// codeChallengeLength is the length of a base64url encoded SHA-256.
+	codeChallengeLength = 43
+)
+
+//go:embed templates/consent.html
+var templates embed.FS
+
+var consentTemplate = template.Must(template.ParseFS(templates, "templates/consent.html"))
+
+// scopeDescriptions tell users on the consent screen what a scope releases.
+var scopeDescriptions = map[string]string{
+	ScopeOpenID:  "Know who you are",
+	ScopeProfile: "See your name",
+	ScopeEmail:   "See your email address",
+}
+
+// authorizationRequest holds the checked parameters of a request to
+// Authorize. It travels signed, as oauth_request, through the login and
+// consent pages and back.
+type authorizationRequest struct {
+	ClientID      string `json:"client_id"`
+	RedirectURI   string `json:"redirect_uri"`
+	Scope         string `json:"scope"`
+	State         string `json:"state,omitempty"`
+	Nonce         string `json:"nonce,omitempty"`
+	CodeChallenge string `json:"code_challenge"`
+	Prompt        string `json:"prompt,omitempty"`
+	MaxAge        *int64 `json:"max_age,omitempty"`
+	// Binding is the hash of the login cookie of the browser sent to sign
+	// in, which alone may come back signed in.
+	Binding string `json:"binding,omitempty"`
+	Purpose string `json:"purpose"`
+	jwt.RegisteredClaims
+}
+
+func (request *authorizationRequest) prompts(value string) bool {
+	return slices.Contains(strings.Fields(request.Prompt), value)
+}
+
+// needsLogin is true when a session that began at authTime is too old for
+// request, through prompt=login or max_age.
+func (request *authorizationRequest) needsLogin(authTime time.Time) bool {
+	if (request.MaxAge != nil && *request.MaxAge == 0) || request.prompts("login") {
+		return request.IssuedAt == nil || authTime.Before(request.IssuedAt.Time)
+	}
+
+	if request.MaxAge != nil {
+		return time.Since(authTime) > time.Duration(*request.MaxAge)*time.Second
+	}
+
+	return false
+}
+
+// oauthSessionHandoff is what the web app hands over to the browser session
+// once the user signed in.
+type oauthSessionHandoff struct {
+	OAuthRequest string `json:"oauth_request"`
+	AuthTime     int64  `json:"auth_time"`
+}
+
+type OAuthSessionPayload struct {
+	OAuthRequest string `json:"oauth_request" validate:"required"`
+}
+
+// Authorize is the OAuth 2.0 authorization endpoint. It sends users to sign
+// in and to consent when needed, then back to the client with a code.
+func (svc *UserService) Authorize(w http.ResponseWriter, r *http.Request) {
+	request, client, err := svc.readAuthorizationRequest(r)
+	if err != nil {
+		svc.writeAuthorizeError(w, r, request, err)
+		return
+	}
+
+	svc.authorize(w, r, request, client)
+}
+
+func (svc *UserService) authorize(
+	w http.ResponseWriter,
+	r *http.Request,
+	request *authorizationRequest,
+	client *OAuthClient,
+) {
+	ctx := r.Context()
+
+	user, authTime, err := svc.readSession(r)
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	if user == nil || request.needsLogin(authTime) {
+		if request.prompts("none") {
+			svc.writeAuthorizeError(w, r, request, &OAuthError{
+				Code:        "login_required",
+				Description: "the user must sign in",
+			})
+			return
+		}
+		svc.redirectToLogin(w, r, request)
+		return
+	}
+
+	if !client.FirstParty {
+		granted, err := svc.Repo.FindOAuthConsent(ctx, user.ID, client.ClientID)
+		if err != nil {
+			httphelper.WriteInternalError(w, r, err)
+			return
+		}
+
+		if request.prompts("consent") || !coversScope(granted, request.Scope) {
+			if request.prompts("none") {
+				svc.writeAuthorizeError(w, r, request, &OAuthError{
+					Code:        "consent_required",
+					Description: "the user must consent",
+				})
+				return
+			}
+			svc.renderConsent(w, r, request, client, user)
+			return
+		}
+	}
+
+	svc.redirectWithCode(w, r, request, user, authTime)
+}
+
+// Consent takes the user's answer on the consent screen.
+func (svc *UserService) Consent(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if err := r.ParseForm(); err != nil {
+		httphelper.WriteProblem(w, httphelper.BadRequest(err.Error()))
+		return
+	}
+
+	signed := r.PostForm.Get("oauth_request")
+	request, err := svc.parseOAuthRequest(signed)
+	if err != nil {
+		httphelper.WriteProblem(w, httphelper.BadRequest(err.Error()))
+		return
+	}
+
+	client, err := svc.authorizeClient(ctx, request.ClientID, request.RedirectURI)
+	if err != nil {
+		svc.writeAuthorizeError(w, r, request, err)
+		return
+	}
+
+	session, err := r.Cookie(sessionCookieName)
+	if err != nil || subtle.ConstantTimeCompare(
+		[]byte(r.PostForm.Get("csrf")),
+		[]byte(svc.consentToken(session.Value, signed)),
+	) != 1 {
+		httphelper.WriteProblem(w, httphelper.Forbidden("consent form expired; sign in again"))
+		return
+	}
+
+	user, authTime, err := svc.readSession(r)
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+	if user == nil {
+		svc.authorize(w, r, request, client)
+		return
+	}
+
+	switch r.PostForm.Get("decision") {
+	case "allow":
+	case "deny":
+		svc.writeAuthorizeError(w, r, request, &OAuthError{
+			Code:        "access_denied",
+			Description: "the user denied the request",
+		})
+		return
+	default:
+		httphelper.WriteProblem(w, httphelper.BadRequest("decision must be allow or deny"))
+		return
+	}
+
+	scopes := strings.Fields(request.Scope)
+	if err := svc.Repo.SaveOAuthConsent(ctx, user.ID, client.ClientID, scopes); err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	ip := svc.clientIP(r)
+	svc.record(ctx, audit.Event{
+		Action:  audit.ActionOAuthConsentGranted,
+		ActorID: &user.ID,
+		UserID:  &user.ID,
+		IP:      &ip,
+		Details: map[string]any{"client_id": client.ClientID, "scopes": scopes},
+	})
+
+	svc.redirectWithCode(w, r, request, user, authTime)
+}
+
+// CreateOAuthSession hands a sign-in in the web app over to the browser,
+// for the authorization request that sent the user there. The web app
+// sends the browser to the returned URL, which starts the session.
+func (svc *UserService) CreateOAuthSession(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKey).(string)
+
+	if enrolling, _ := ctx.Value(MFAEnrollmentKey).(bool); enrolling {
+		httphelper.WriteProblem(w, httphelper.NewProblem(
+			http.StatusForbidden,
+			"mfa_enrollment_required",
+			"enroll in multi-factor authentication to sign in to applications",
+		))
+		return
+	}
+
+	var payload OAuthSessionPayload
+	if err := httphelper.ParseJSON(r, &payload); err != nil {
+		httphelper.WriteProblem(w, httphelper.BadRequest(err.Error()))
+		return
+	}
+
+	if err := httphelper.Validate.Struct(payload); err != nil {
+		httphelper.WriteProblem(w, httphelper.ValidationFailed(err))
+		return
+	}
+
+	if _, err := svc.parseOAuthRequest(payload.OAuthRequest); err != nil {
+		httphelper.WriteProblem(w, httphelper.BadRequest(err.Error()))
+		return
+	}
+
+	authTime, _ := ctx.Value(AuthTimeKey).(time.Time)
+	data, err := json.Marshal(oauthSessionHandoff{
+		OAuthRequest: payload.OAuthRequest,
+		AuthTime:     authTime.Unix(),
+	})
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	handoff := string(data)
+	code, err := svc.issueToken(ctx, userID, TokenPurposeOAuthSession, &handoff, oauthSessionTTL)
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	httphelper.WriteJSON(w, http.StatusOK, map[string]string{
+		"redirect_to": svc.issuer() + "/oauth/session?code=" + url.QueryEscape(code),
+	})
+}
+
+// StartOAuthSession redeems the code of CreateOAuthSession in the browser
+// that was sent to sign in, and resumes the authorization request.
+func (svc *UserService) StartOAuthSession(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	token, err := svc.redeemToken(ctx, TokenPurposeOAuthSession, r.URL.Query().Get("code"))
+	if errors.Is(err, ErrInvalidToken) {
+		writeInvalidToken(w)
+		return
+	}
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	var handoff oauthSessionHandoff
+	if token.Data == nil || json.Unmarshal([]byte(*token.Data), &handoff) != nil {
+		httphelper.WriteInternalError(w, r, fmt.Errorf("session code %s has no request", token.ID))
+		return
+	}
+
+	request, err := svc.parseOAuthRequest(handoff.OAuthRequest)
+	if err != nil {
+		httphelper.WriteProblem(w, httphelper.BadRequest(err.Error()))
+		return
+	}
+
+	user, err := svc.findTokenUser(ctx, token.UserID)
+	if errors.Is(err, ErrUserNotFound) {
+		writeInvalidToken(w)
+		return
+	}
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	svc.startSession(w, r, request, user, time.Unix(handoff.AuthTime, 0))
+}
+
+// MicrosoftLogin signs the user in with Microsoft for an authorization
+// request, for which the login page offers it.
+func (svc *UserService) MicrosoftLogin(w http.ResponseWriter, r *http.Request) {
+	if svc.Microsoft == nil {
+		httphelper.WriteProblem(w, httphelper.NotFound(ErrMicrosoftAuthDisabled.Error()))
+		return
+	}
+
+	// The request, bound to the browser by the login cookie, serves as state.
+	signed := r.URL.Query().Get("oauth_request")
+	if _, err := svc.parseOAuthRequest(signed); err != nil {
+		httphelper.WriteProblem(w, httphelper.BadRequest(err.Error()))
+		return
+	}
+
+	target, err := svc.Microsoft.AuthCodeURL(r.Context(), signed)
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// MicrosoftCallback is where Microsoft sends users back to. Multi-factor
+// authentication is then up to the policies of the Entra ID tenant.
+func (svc *UserService) MicrosoftCallback(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.FromContext(ctx)
+	query := r.URL.Query()
+
+	if svc.Microsoft == nil {
+		httphelper.WriteProblem(w, httphelper.NotFound(ErrMicrosoftAuthDisabled.Error()))
+		return
+	}
+
+	request, err := svc.parseOAuthRequest(query.Get("state"))
+	if err != nil {
+		httphelper.WriteProblem(w, httphelper.BadRequest(err.Error()))
+		return
+	}
+
+	if query.Get("error") != "" {
+		logger.Info("Microsoft sign-in failed", "error", query.Get("error"),
+			"description", query.Get("error_description"))
+		metrics.LoginAttempts.WithLabelValues("microsoft", metrics.OutcomeInvalidCredentials).Inc()
+		httphelper.WriteProblem(w, httphelper.Unauthorized(ErrMicrosoftAuthFailed.Error()))
+		return
+	}
+
+	info, err := svc.Microsoft.Exchange(ctx, query.Get("code"))
+	if err == nil && info.Email == "" {
+		err = errors.New("no email claim in ID token")
+	}
+	if err != nil {
+		logger.Warn("Microsoft sign-in failed", "error", err)
+		metrics.LoginAttempts.WithLabelValues("microsoft", metrics.OutcomeInvalidCredentials).Inc()
+		httphelper.WriteProblem(w, httphelper.Unauthorized(ErrMicrosoftAuthFailed.Error()))
+		return
+	}
+
+	user, err := svc.FindOrCreateFromMicrosoftAuth(ctx, info)
+	if problem := accountInactive(err); problem != nil {
+		metrics.LoginAttempts.WithLabelValues("microsoft", metrics.OutcomeDisabled).Inc()
+		httphelper.WriteProblem(w, problem)
+		return
+	}
+	if err != nil {
+		metrics.LoginAttempts.WithLabelValues("microsoft", metrics.OutcomeError).Inc()
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	metrics.LoginAttempts.WithLabelValues("microsoft", metrics.OutcomeSuccess).Inc()
+	svc.startSession(w, r, request, user, time.Now())
+}
+
+// Logout ends the browser session. Clients may name where to send the user
+// afterwards, among their redirect URIs; the web app is the default.
+func (svc *UserService) Logout(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	http.SetCookie(w, svc.cookie(sessionCookieName, "", -1))
+
+	target := strings.TrimRight(svc.Config.AppUrl, "/") + "/"
+	if uri := query.Get("post_logout_redirect_uri"); uri != "" {
+		client, err := svc.findOAuthClient(r.Context(), query.Get("client_id"))
+		if err != nil && !errors.Is(err, ErrInvalidClient) {
+			httphelper.WriteInternalError(w, r, err)
+			return
+		}
+
+		if client != nil && client.allowsRedirect(uri) {
+			target = uri
+			if state := query.Get("state"); state != "" {
+				target = withQuery(uri, url.Values{"state": {state}})
+			}
+		}
+	}
+
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// readAuthorizationRequest checks the parameters of r, or the signed request
+// it resumes. Until the client and redirect_uri are known good, errors are
+// *httphelper.Problem; after, they are *OAuthError to redirect with.
+func (svc *UserService) readAuthorizationRequest(
+	r *http.Request,
+) (*authorizationRequest, *OAuthClient, error) {
+	ctx := r.Context()
+	query := r.URL.Query()
+
+	if signed := query.Get("oauth_request"); signed != "" {
+		request, err := svc.parseOAuthRequest(signed)
+		if err != nil {
+			return nil, nil, httphelper.BadRequest(err.Error())
+		}
+
+		client, err := svc.authorizeClient(ctx, request.ClientID, request.RedirectURI)
+		return request, client, err
+	}
+
+	request := &authorizationRequest{
+		ClientID:         query.Get("client_id"),
+		RedirectURI:      query.Get("redirect_uri"),
+		State:            query.Get("state"),
+		Nonce:            query.Get("nonce"),
+		CodeChallenge:    query.Get("code_challenge"),
+		Prompt:           query.Get("prompt"),
+		RegisteredClaims: jwt.RegisteredClaims{IssuedAt: jwt.NewNumericDate(time.Now())},
+	}
+
+	client, err := svc.authorizeClient(ctx, request.ClientID, request.RedirectURI)
+	if err != nil {
+		return request, nil, err
+	}
+
+	if query.Get("response_type") != "code" {
+		return request, nil, &OAuthError{
+			Code:        "unsupported_response_type",
+			Description: "response_type must be code",
+		}
+	}
+
+	if request.Scope, err = parseScope(query.Get("scope")); err != nil {
+		return request, nil, err
+	}
+
+	if query.Get("code_challenge_method") != "S256" ||
+		len(request.CodeChallenge) != codeChallengeLength {
+		return request, nil, &OAuthError{
+			Code:        "invalid_request",
+			Description: "PKCE with code_challenge_method S256 is required",
+		}
+	}
+
+	prompts := strings.Fields(request.Prompt)
+	for _, prompt := range prompts {
+		if !slices.Contains([]string{"none", "login", "consent"}, prompt) ||
+			(prompt == "none" && len(prompts) > 1) {
+			return request, nil, &OAuthError{
+				Code:        "invalid_request",
+				Description: fmt.Sprintf("prompt %s is not supported", request.Prompt),
+			}
+		}
+	}
+
+	if maxAge := query.Get("max_age"); maxAge != "" {
+		seconds, err := strconv.ParseInt(maxAge, 10, 64)
+		if err != nil || seconds < 0 {
+			return request, nil, &OAuthError{
+				Code:        "invalid_request",
+				Description: "max_age must be a number of seconds",
+			}
+		}
+		request.MaxAge = &seconds
+	}
+
+	return request, client, nil
+}
+
+// authorizeClient finds the client of an authorization request, which may
+// only redirect to its own redirect URIs.
+func (svc *UserService) authorizeClient(
+	ctx context.Context,
+	clientID string,
+	redirectURI string,
+) (*OAuthClient, error) {
+	client, err := svc.findOAuthClient(ctx, clientID)
+	if errors.Is(err, ErrInvalidClient) {
+		return nil, httphelper.BadRequest("unknown client_id")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !client.allowsRedirect(redirectURI) {
+		return nil, httphelper.BadRequest("redirect_uri is not registered for the client")
+	}
+
+	return client, nil
+}
+
+// parseScope returns the supported scopes of scope, which must ask for an
+// ID token, sorted and without duplicates.
+func parseScope(scope string) (string, error) {
+	scopes := strings.Fields(scope)
+	if !slices.Contains(scopes, ScopeOpenID) {
+		return "", &OAuthError{Code: "invalid_scope", Description: "scope must include openid"}
+	}
+
+	for _, name := range scopes {
+		if !slices.Contains(supportedScopes, name) {
+			return "", &OAuthError{
+				Code:        "invalid_scope",
+				Description: fmt.Sprintf("scope %s is not supported", name),
+			}
+		}
+	}
+
+	slices.Sort(scopes)
+	return strings.Join(slices.Compact(scopes), " "), nil
+}
+
+func coversScope(granted []string, scope string) bool {
+	for _, name := range strings.Fields(scope) {
+		if !slices.Contains(granted, name) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// writeAuthorizeError answers a failed authorization request: with a
+// problem while the client cannot be trusted, and by redirecting the error
+// to the client once it can.
+func (svc *UserService) writeAuthorizeError(
+	w http.ResponseWriter,
+	r *http.Request,
+	request *authorizationRequest,
+	err error,
+) {
+	var problem *httphelper.Problem
+	var oauthErr *OAuthError
+	switch {
+	case errors.As(err, &problem):
+		httphelper.WriteProblem(w, problem)
+	case errors.As(err, &oauthErr):
+		svc.redirectToClient(w, r, request, url.Values{
+			"error":             {oauthErr.Code},
+			"error_description": {oauthErr.Description},
+		})
+	default:
+		httphelper.WriteInternalError(w, r, err)
+	}
+}
+
+// redirectWithCode sends the user back to the client with a code that
+// redeems at the token endpoint for what request asked.
+func (svc *UserService) redirectWithCode(
+	w http.ResponseWriter,
+	r *http.Request,
+	request *authorizationRequest,
+	user *UserEntity,
+	authTime time.Time,
+) {
+	data, err := json.Marshal(authorizationGrant{
+		ClientID:      request.ClientID,
+		RedirectURI:   request.RedirectURI,
+		Scope:         request.Scope,
+		Nonce:         request.Nonce,
+		CodeChallenge: request.CodeChallenge,
+		AuthTime:      authTime.Unix(),
+	})
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	grant := string(data)
+	code, err := svc.issueToken(r.Context(), user.ID, TokenPurposeOAuthCode, &grant, oauthCodeTTL)
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	svc.redirectToClient(w, r, request, url.Values{"code": {code}})
+}
+
+// redirectToClient answers request at its redirect URI, naming sesamo as
+// the issuer so clients of several providers tell them apart (RFC 9207).
+func (svc *UserService) redirectToClient(
+	w http.ResponseWriter,
+	r *http.Request,
+	request *authorizationRequest,
+	params url.Values,
+) {
+	params.Set("iss", svc.issuer())
+	if request.State != "" {
+		params.Set("state", request.State)
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, withQuery(request.RedirectURI, params), http.StatusFound)
+}
+
+// redirectToLogin sends the user to the login page of the web app. Only
+// this browser, which gets the login cookie, may come back signed in, so
+// nobody can sign a victim in to their own account.
+func (svc *UserService) redirectToLogin(
+	w http.ResponseWriter,
+	r *http.Request,
+	request *authorizationRequest,
+) {
+	raw, err := generateRandomBytes(tokenBytes)
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	binding := base64.RawURLEncoding.EncodeToString(raw)
+	request.Binding = hashToken(binding)
+	signed, err := svc.signOAuthRequest(request)
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	http.SetCookie(w, svc.cookie(loginCookieName, binding, oauthRequestTTL))
+	target := strings.TrimRight(svc.Config.AppUrl, "/") + "/login"
+	http.Redirect(w, r, withQuery(target, url.Values{"oauth_request": {signed}}), http.StatusFound)
+}
+
+// startSession signs user in to the browser that was sent to sign in for
+// request and resumes the request.
+func (svc *UserService) startSession(
+	w http.ResponseWriter,
+	r *http.Request,
+	request *authorizationRequest,
+	user *UserEntity,
+	authTime time.Time,
+) {
+	binding, err := r.Cookie(loginCookieName)
+	if err != nil || request.Binding == "" || subtle.ConstantTimeCompare(
+		[]byte(hashToken(binding.Value)),
+		[]byte(request.Binding),
+	) != 1 {
+		httphelper.WriteProblem(w, httphelper.Forbidden("sign-in was started in another browser"))
+		return
+	}
+
+	if err := svc.checkCanSignIn(user); err != nil {
+		if problem := accountInactive(err); problem != nil {
+			httphelper.WriteProblem(w, problem)
+			return
+		}
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	session, err := svc.generateSession(user, authTime)
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	signed, err := svc.signOAuthRequest(request)
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	http.SetCookie(w, svc.cookie(sessionCookieName, session, svc.Config.SessionTTL))
+	http.SetCookie(w, svc.cookie(loginCookieName, "", -1))
+	target := svc.issuer() + "/oauth/authorize"
+	http.Redirect(w, r, withQuery(target, url.Values{"oauth_request": {signed}}), http.StatusFound)
+}
+
+// renderConsent asks the user whether client may have the scopes request
+// asks for.
+func (svc *UserService) renderConsent(
+	w http.ResponseWriter,
+	r *http.Request,
+	request *authorizationRequest,
+	client *OAuthClient,
+	user *UserEntity,
+) {
+	signed, err := svc.signOAuthRequest(request)
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	// readSession found the cookie.
+	session, _ := r.Cookie(sessionCookieName)
+
+	scopes := []string{}
+	for _, name := range strings.Fields(request.Scope) {
+		scopes = append(scopes, scopeDescriptions[name])
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set(
+		"Content-Security-Policy",
+		"default-src 'none'; style-src 'unsafe-inline'; frame-ancestors 'none'",
+	)
+	w.Header().Set("X-Frame-Options", "DENY")
+
+	err = consentTemplate.Execute(w, map[string]any{
+		"Client":       client.Name,
+		"Email":        user.Email,
+		"Scopes":       scopes,
+		"Action":       svc.issuer() + "/oauth/authorize/consent",
+		"OAuthRequest": signed,
+		"CSRF":         svc.consentToken(session.Value, signed),
+	})
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Rendering the consent page failed", "error", err)
+	}
+}
+
+// consentToken ties a consent form to the session and the request it was
+// rendered for.
+func (svc *UserService) consentToken(session string, request string) string {
+	return signToken(
+		[]byte(svc.Config.JwtSecret),
+		consentPurpose,
+		hashToken(session)+"."+hashToken(request),
+	)
+}
+
+// readSession returns the user signed in to the browser and when they
+// signed in, or no user when there is no valid session.
+func (svc *UserService) readSession(r *http.Request) (*UserEntity, time.Time, error) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil, time.Time{}, nil
+	}
+
+	claims, err := svc.parseSignedClaims(cookie.Value, sessionPurpose)
+	if err != nil {
+		return nil, time.Time{}, nil
+	}
+
+	userID, _ := claims.GetSubject()
+	user, err := svc.findTokenUser(r.Context(), userID)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, time.Time{}, nil
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	issuedAt := tokenIssuedAt(claims)
+
+	// Sessions end with the user's tokens, as when they change their
+	// password.
+	if svc.checkCanSignIn(user) != nil || user.CheckTokenIssuedAt(issuedAt) != nil {
+		return nil, time.Time{}, nil
+	}
+
+	return user, authTime(claims, issuedAt), nil
+}
+
+// generateSession issues the session cookie of a browser user signed in to
+// at authTime.
+func (svc *UserService) generateSession(user *UserEntity, authTime time.Time) (string, error) {
+	now := user.tokenIssueTime()
+	claims := jwt.MapClaims{
+		"sub":       user.ID,
+		"purpose":   sessionPurpose,
+		"iat":       numericDate(now),
+		"auth_time": authTime.Unix(),
+		"exp":       now.Add(svc.Config.SessionTTL).Unix(),
+	}
+
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).
+		SignedString([]byte(svc.Config.JwtSecret))
+}
+
+func (svc *UserService) parseSignedClaims(tokenStr string, purpose string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(
+		tokenStr,
+		claims,
+		func(token *jwt.Token) (interface{}, error) {
+			return []byte(svc.Config.JwtSecret), nil
+		},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+	)
+	if err != nil || !token.Valid || claims["purpose"] != purpose {
+		return nil, ErrInvalidToken
+	}
+
+	return claims, nil
+}
+
+// signOAuthRequest signs request to resume it, within oauthRequestTTL, once
+// the user signed in or consented.
+func (svc *UserService) signOAuthRequest(request *authorizationRequest) (string, error) {
+	request.Purpose = oauthRequestPurpose
+	request.ExpiresAt = jwt.NewNumericDate(time.Now().Add(oauthRequestTTL))
+
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, request).
+		SignedString([]byte(svc.Config.JwtSecret))
+}
+
+func (svc *UserService) parseOAuthRequest(signed string) (*authorizationRequest, error) {
+	request := &authorizationRequest{}
+	token, err := jwt.ParseWithClaims(
+		signed,
+		request,
+		func(token *jwt.Token) (interface{}, error) {
+			return []byte(svc.Config.JwtSecret), nil
+		},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuedAt(),
+	)
+	if err != nil || !token.Valid || request.Purpose != oauthRequestPurpose {
+		return nil, errors.New("invalid or expired authorization request; sign in again")
+	}
+
+	return request, nil
+}
+
+func (svc *UserService) cookie(name string, value string, maxAge time.Duration) *http.Cookie {
+	seconds := int(maxAge.Seconds())
+	if maxAge < 0 {
+		seconds = -1
+	}
+
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   seconds,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(svc.Config.IssuerUrl, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// withQuery adds params to the query of uri, which was checked to parse.
+func withQuery(uri string, params url.Values) string {
+	target, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+
+	query := target.Query()
+	for name, values := range params {
+		query[name] = values
+	}
+	target.RawQuery = query.Encode()
+
+	return target.String()
+}
@@ -1,9 +1,11 @@
 package user
 
 import (
-	"log"
+	"context"
 
 	mq "github.com/diegodario88/sesamo/cmd/tcp"
+	"github.com/diegodario88/sesamo/config"
+	"github.com/diegodario88/sesamo/logging"
 	"github.com/jmoiron/sqlx"
 )
 
@@ -16,14 +18,17 @@ type NewUser struct {
 	LastName  string `json:"last_name"`
 }
 
-func NewConsumer(storage *sqlx.DB) *Consumer {
-	userService := NewUserService(storage)
-	return &Consumer{userService}
+func NewConsumer(storage *sqlx.DB, cfg *config.Config) (*Consumer, error) {
+	userService, err := NewUserService(storage, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Consumer{userService}, nil
 }
 
-func (consumer *Consumer) Process(message *mq.Message[NewUser]) (int, error) {
-	//TODO: Aqui a gente pode usar o service para de fato persistir o user
+func (consumer *Consumer) Process(ctx context.Context, message *mq.Message[NewUser]) (int, error) {
+	//TODO: use the service to actually persist the user
 
-	log.Println("Processing message for user %s", message.Body.LastName)
+	logging.FromContext(ctx).Info("Processing create user message")
 	return message.DeliveryID, nil
 }
@@ -0,0 +1,291 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/diegodario88/sesamo/httphelper"
+	"github.com/diegodario88/sesamo/logging"
+	"github.com/diegodario88/sesamo/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Headers Verify answers allowed requests with, for the proxy to hand on to
+// the application it protects.
+const (
+	forwardUserIDHeader = "X-Auth-User-Id"
+	forwardEmailHeader  = "X-Auth-Email"
+	forwardRolesHeader  = "X-Auth-Roles"
+)
+
+// ForwardDecision is who Verify let through: the user or service account
+// behind a request and their roles. Service accounts have no email.
+type ForwardDecision struct {
+	UserID string
+	Email  string
+	Roles  []string
+}
+
+func (decision *ForwardDecision) write(w http.ResponseWriter) {
+	w.Header().Set(forwardUserIDHeader, decision.UserID)
+	if decision.Email != "" {
+		w.Header().Set(forwardEmailHeader, decision.Email)
+	}
+	w.Header().Set(forwardRolesHeader, strings.Join(decision.Roles, ","))
+	w.WriteHeader(http.StatusOK)
+}
+
+type cachedDecision struct {
+	decision  *ForwardDecision
+	expiresAt time.Time
+}
+
+// DecisionCache remembers the requests Verify allowed for ttl, so a proxy
+// asking about every request of a page does not hit the database each time.
+// Refusals are not cached. Every instance keeps its own entries.
+type DecisionCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cachedDecision
+	sweptAt time.Time
+}
+
+func NewDecisionCache(ttl time.Duration) *DecisionCache {
+	return &DecisionCache{ttl: ttl, entries: map[string]cachedDecision{}}
+}
+
+// Get returns the decision cached for key, unless it expired by now.
+func (cache *DecisionCache) Get(key string, now time.Time) (*ForwardDecision, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cached, ok := cache.entries[key]
+	if !ok || !now.Before(cached.expiresAt) {
+		return nil, false
+	}
+
+	return cached.decision, true
+}
+
+func (cache *DecisionCache) Put(key string, decision *ForwardDecision, now time.Time) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.sweep(now)
+	cache.entries[key] = cachedDecision{decision: decision, expiresAt: now.Add(cache.ttl)}
+}
+
+// sweep drops expired entries, at most once per ttl, so credentials that
+// stop being used do not stay in memory.
+func (cache *DecisionCache) sweep(now time.Time) {
+	if now.Before(cache.sweptAt.Add(cache.ttl)) {
+		return
+	}
+
+	for key, cached := range cache.entries {
+		if !now.Before(cached.expiresAt) {
+			delete(cache.entries, key)
+		}
+	}
+	cache.sweptAt = now
+}
+
+// Verify is the forward auth endpoint of reverse proxies, such as nginx
+// auth_request and Traefik ForwardAuth, protecting applications that know
+// nothing of sesamo. It authenticates the bearer token of the proxied
+// request as AuthMiddleware does, or else the browser session, and answers
+// 200 with who the caller is, 401 or 403.
+//
+// The permission and organization the caller needs are taken from the
+// query, or else the X-Forwarded-Permission and X-Forwarded-Organization
+// headers, which the proxy must set or clear so clients cannot pick them.
+func (svc *UserService) Verify(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracing.Tracer().Start(r.Context(), "ForwardAuth")
+	defer span.End()
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	reject := func(problem *httphelper.Problem) {
+		span.SetStatus(codes.Error, problem.Detail)
+		httphelper.WriteProblem(w, problem)
+	}
+
+	permission := forwardedParam(r, "permission", "X-Forwarded-Permission")
+	orgID := forwardedParam(r, "organization", "X-Forwarded-Organization")
+	span.SetAttributes(
+		attribute.String("sesamo.permission", permission),
+		attribute.String("sesamo.organization", orgID),
+	)
+
+	credential, problem := forwardCredential(r)
+	if problem != nil {
+		reject(problem)
+		return
+	}
+
+	// Credentials are kept hashed, like everywhere else.
+	key := strings.Join([]string{hashToken(credential), permission, orgID}, "\x00")
+	if svc.ForwardAuthCache != nil {
+		if decision, ok := svc.ForwardAuthCache.Get(key, time.Now()); ok {
+			span.SetAttributes(attribute.Bool("sesamo.forward_auth.cached", true))
+			decision.write(w)
+			return
+		}
+	}
+
+	decision, problem, err := svc.verifyForward(ctx, r, permission, orgID)
+	if err != nil {
+		span.RecordError(err)
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+	if problem != nil {
+		reject(problem)
+		return
+	}
+
+	if svc.ForwardAuthCache != nil {
+		svc.ForwardAuthCache.Put(key, decision, time.Now())
+	}
+	decision.write(w)
+}
+
+// verifyForward authenticates the proxied request r and checks it against
+// permission and orgID, either of which may be empty.
+func (svc *UserService) verifyForward(
+	ctx context.Context,
+	r *http.Request,
+	permission string,
+	orgID string,
+) (*ForwardDecision, *httphelper.Problem, error) {
+	ctx, err := svc.authenticateForward(ctx, r)
+	switch {
+	case errors.Is(err, ErrInvalidToken):
+		return nil, httphelper.Unauthorized("Invalid or expired token"), nil
+	case err != nil && rejectsToken(err):
+		return nil, httphelper.Unauthorized(err.Error()), nil
+	case err != nil:
+		return nil, nil, err
+	}
+
+	if orgID != "" {
+		if !svc.canAccessOrganization(ctx, orgID) {
+			return nil, httphelper.Forbidden("no access to this organization"), nil
+		}
+		ctx = context.WithValue(ctx, OrganizationIDKey, orgID)
+	}
+
+	if permission != "" {
+		if problem, err := checkPermission(ctx, svc, permission); problem != nil || err != nil {
+			return nil, problem, err
+		}
+	}
+
+	decision, err := svc.forwardDecision(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return decision, nil, nil
+}
+
+// authenticateForward resolves the caller of the proxied request r into the
+// request context AuthMiddleware hands on. Browsers are authenticated by the
+// session they signed in to OAuth clients with.
+func (svc *UserService) authenticateForward(
+	ctx context.Context,
+	r *http.Request,
+) (context.Context, error) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return svc.authenticateToken(ctx, svc.clientIP(r), token)
+	}
+
+	user, authTime, err := svc.readSession(r)
+	if err != nil {
+		return ctx, err
+	}
+	if user == nil {
+		return ctx, ErrInvalidToken
+	}
+
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("enduser.id", user.ID))
+
+	// Sessions grant what an access token issued now would.
+	enrolling := false
+	roles := []string{}
+	if user.Status != StatusPendingVerification {
+		if enrolling, err = svc.mfaEnrollmentRequired(ctx, user); err != nil {
+			return ctx, err
+		}
+	}
+	if user.Status != StatusPendingVerification && !enrolling {
+		if roles, err = svc.Repo.GetRoles(ctx, user.ID); err != nil {
+			return ctx, err
+		}
+	}
+
+	ctx = context.WithValue(ctx, UserIDKey, user.ID)
+	ctx = context.WithValue(ctx, UnverifiedKey, user.Status == StatusPendingVerification)
+	ctx = context.WithValue(ctx, AuthTimeKey, authTime)
+	ctx = context.WithValue(ctx, MFAEnrollmentKey, enrolling)
+	ctx = context.WithValue(ctx, UserRolesKey, roles)
+	return logging.SetUserID(ctx, user.ID), nil
+}
+
+// forwardDecision describes the caller authenticated in ctx to the proxy.
+// Personal access tokens carry no roles, so those of their user are loaded.
+func (svc *UserService) forwardDecision(ctx context.Context) (*ForwardDecision, error) {
+	decision := &ForwardDecision{UserID: ctx.Value(UserIDKey).(string)}
+
+	roles, ok := ctx.Value(UserRolesKey).([]string)
+	if !ok {
+		var err error
+		if roles, err = svc.Repo.GetRoles(ctx, decision.UserID); err != nil {
+			return nil, err
+		}
+	}
+	decision.Roles = roles
+
+	if _, ok := ctx.Value(ServiceAccountKey).(*ServiceAccount); !ok {
+		user, err := svc.findTokenUser(ctx, decision.UserID)
+		if err != nil {
+			return nil, err
+		}
+		decision.Email = user.Email
+	}
+
+	return decision, nil
+}
+
+// forwardCredential returns the bearer token of the proxied request r, or
+// else its session cookie.
+func forwardCredential(r *http.Request) (string, *httphelper.Problem) {
+	if authHeader := r.Header.Get("Authorization"); authHeader != "" {
+		token, ok := strings.CutPrefix(authHeader, "Bearer ")
+		if !ok || token == "" || strings.Contains(token, " ") {
+			return "", httphelper.Unauthorized("Authorization header format must be Bearer {token}")
+		}
+		return token, nil
+	}
+
+	if cookie, err := r.Cookie(sessionCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value, nil
+	}
+
+	return "", httphelper.Unauthorized("bearer token or session cookie required")
+}
+
+func forwardedParam(r *http.Request, param string, header string) string {
+	if value := r.URL.Query().Get(param); value != "" {
+		return value
+	}
+
+	return r.Header.Get(header)
+}
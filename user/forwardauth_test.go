@@ -0,0 +1,224 @@
+package user
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/diegodario88/sesamo/config"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+type ForwardAuthTestSuite struct {
+	suite.Suite
+	repo    *MockUserRepository
+	handler *Handler
+	user    *UserEntity
+}
+
+func TestForwardAuthTestSuite(t *testing.T) {
+	suite.Run(t, new(ForwardAuthTestSuite))
+}
+
+func (suite *ForwardAuthTestSuite) SetupTest() {
+	suite.repo = new(MockUserRepository)
+	suite.repo.On("IsTokenRevoked", mock.Anything).Return(false, nil).Maybe()
+	suite.handler = NewHandler(UserService{
+		Repo: suite.repo,
+		Config: &config.Config{
+			JwtSecret:              "0123456789abcdef",
+			JwtExpirationInSeconds: 3600,
+			IssuerUrl:              testIssuer,
+			SessionTTL:             time.Hour,
+		},
+		ForwardAuthCache: NewDecisionCache(time.Minute),
+	})
+	suite.user = &UserEntity{ID: targetID, Email: "ana@example.com", Status: StatusActive}
+}
+
+// token issues an access token of the suite's user carrying roles.
+func (suite *ForwardAuthTestSuite) token(roles []string) string {
+	suite.repo.On("GetRoles", targetID).Return(roles, nil).Once()
+	suite.repo.On("RequiresMFA", targetID).Return(false, nil).Once()
+	token, err := suite.handler.GenerateUserToken(context.Background(), suite.user)
+	suite.Require().NoError(err)
+
+	suite.repo.On("FindUserById", targetID).Return(suite.user, nil)
+	return token
+}
+
+func (suite *ForwardAuthTestSuite) verify(
+	target string,
+	setup func(r *http.Request),
+) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodGet, target, nil)
+	if setup != nil {
+		setup(request)
+	}
+	recorder := httptest.NewRecorder()
+
+	suite.handler.Verify(recorder, request)
+
+	return recorder
+}
+
+func bearer(token string) func(r *http.Request) {
+	return func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+func (suite *ForwardAuthTestSuite) TestBearerTokenIsAllowed() {
+	token := suite.token([]string{"org_admin", "member"})
+
+	recorder := suite.verify("/auth/verify", bearer(token))
+
+	suite.Equal(http.StatusOK, recorder.Code)
+	suite.Equal(targetID, recorder.Header().Get("X-Auth-User-Id"))
+	suite.Equal("ana@example.com", recorder.Header().Get("X-Auth-Email"))
+	suite.Equal("org_admin,member", recorder.Header().Get("X-Auth-Roles"))
+	suite.Equal("no-store", recorder.Header().Get("Cache-Control"))
+}
+
+func (suite *ForwardAuthTestSuite) TestMissingCredentialsAreRejected() {
+	suite.Equal(http.StatusUnauthorized, suite.verify("/auth/verify", nil).Code)
+	suite.Equal(http.StatusUnauthorized, suite.verify("/auth/verify", func(r *http.Request) {
+		r.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+	}).Code)
+}
+
+func (suite *ForwardAuthTestSuite) TestDisabledUserIsRejected() {
+	token := suite.token([]string{"member"})
+	suite.repo.ExpectedCalls = nil
+	suite.repo.On("IsTokenRevoked", mock.Anything).Return(false, nil)
+	disabled := &UserEntity{ID: targetID, Status: StatusDisabled}
+	suite.repo.On("FindUserById", targetID).Return(disabled, nil).Once()
+
+	suite.Equal(http.StatusUnauthorized, suite.verify("/auth/verify", bearer(token)).Code)
+}
+
+func (suite *ForwardAuthTestSuite) TestPermissionFromQuery() {
+	token := suite.token([]string{"member"})
+	suite.repo.On("HasAccess", targetID, "users:read").Return(true, nil).Once()
+	suite.repo.On("HasAccess", targetID, "users:delete").Return(false, nil).Once()
+
+	allowed := suite.verify("/auth/verify?permission=users:read", bearer(token))
+	denied := suite.verify("/auth/verify?permission=users:delete", bearer(token))
+
+	suite.Equal(http.StatusOK, allowed.Code)
+	suite.Equal(http.StatusForbidden, denied.Code)
+	suite.Contains(denied.Body.String(), "permission_denied")
+}
+
+func (suite *ForwardAuthTestSuite) TestOrganizationFromForwardedHeader() {
+	token := suite.token([]string{"member"})
+	suite.repo.On("GetUserOrganizations", targetID).Return([]OrganizationEntity{
+		{ID: memberOrgID},
+	}, nil).Twice()
+	suite.repo.On("HasAccess", targetID, "branches:read").Return(true, nil).Once()
+
+	allowed := suite.verify("/auth/verify", func(r *http.Request) {
+		bearer(token)(r)
+		r.Header.Set("X-Forwarded-Permission", "branches:read")
+		r.Header.Set("X-Forwarded-Organization", memberOrgID)
+	})
+	denied := suite.verify("/auth/verify", func(r *http.Request) {
+		bearer(token)(r)
+		r.Header.Set("X-Forwarded-Organization", "01JQ0000000000000000000007")
+	})
+
+	suite.Equal(http.StatusOK, allowed.Code)
+	suite.Equal(http.StatusForbidden, denied.Code)
+}
+
+func (suite *ForwardAuthTestSuite) TestSessionCookieIsAllowed() {
+	session, err := suite.handler.generateSession(suite.user, time.Now())
+	suite.Require().NoError(err)
+	suite.repo.On("FindUserById", targetID).Return(suite.user, nil).Twice()
+	suite.repo.On("RequiresMFA", targetID).Return(false, nil).Once()
+	suite.repo.On("GetRoles", targetID).Return([]string{"member"}, nil).Once()
+
+	recorder := suite.verify("/auth/verify", func(r *http.Request) {
+		r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: session})
+	})
+
+	suite.Equal(http.StatusOK, recorder.Code)
+	suite.Equal(targetID, recorder.Header().Get("X-Auth-User-Id"))
+	suite.Equal("member", recorder.Header().Get("X-Auth-Roles"))
+}
+
+func (suite *ForwardAuthTestSuite) TestSessionOfUnverifiedUserGetsNoPermission() {
+	suite.handler.Config.EmailVerification = VerificationReduced
+	pending := &UserEntity{ID: targetID, Email: "ana@example.com", Status: StatusPendingVerification}
+	session, err := suite.handler.generateSession(pending, time.Now())
+	suite.Require().NoError(err)
+	suite.repo.On("FindUserById", targetID).Return(pending, nil).Once()
+
+	recorder := suite.verify("/auth/verify?permission=users:read", func(r *http.Request) {
+		r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: session})
+	})
+
+	suite.Equal(http.StatusForbidden, recorder.Code)
+	suite.Contains(recorder.Body.String(), "email_not_verified")
+	suite.repo.AssertNotCalled(suite.T(), "HasAccess", mock.Anything, mock.Anything)
+}
+
+func (suite *ForwardAuthTestSuite) TestSessionOfUserWhoMustEnrollInMFAGetsNoPermission() {
+	session, err := suite.handler.generateSession(suite.user, time.Now())
+	suite.Require().NoError(err)
+	suite.repo.On("FindUserById", targetID).Return(suite.user, nil).Once()
+	suite.repo.On("RequiresMFA", targetID).Return(true, nil).Once()
+	suite.repo.On("FindWebAuthnCredentials", targetID).Return([]WebAuthnCredential{}, nil).Once()
+
+	recorder := suite.verify("/auth/verify?permission=users:read", func(r *http.Request) {
+		r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: session})
+	})
+
+	suite.Equal(http.StatusForbidden, recorder.Code)
+	suite.Contains(recorder.Body.String(), "mfa_enrollment_required")
+}
+
+func (suite *ForwardAuthTestSuite) TestAllowedRequestsAreCached() {
+	token := suite.token([]string{"member"})
+	suite.repo.On("HasAccess", targetID, "users:read").Return(true, nil).Once()
+
+	first := suite.verify("/auth/verify?permission=users:read", bearer(token))
+	second := suite.verify("/auth/verify?permission=users:read", bearer(token))
+
+	suite.Equal(http.StatusOK, first.Code)
+	suite.Equal(http.StatusOK, second.Code)
+	suite.Equal(targetID, second.Header().Get("X-Auth-User-Id"))
+	suite.repo.AssertNumberOfCalls(suite.T(), "HasAccess", 1)
+	suite.repo.AssertNumberOfCalls(suite.T(), "FindUserById", 2)
+}
+
+func (suite *ForwardAuthTestSuite) TestRefusalsAreNotCached() {
+	token := suite.token([]string{"member"})
+	suite.repo.On("HasAccess", targetID, "users:read").Return(false, nil).Once()
+	suite.repo.On("HasAccess", targetID, "users:read").Return(true, nil).Once()
+
+	first := suite.verify("/auth/verify?permission=users:read", bearer(token))
+	second := suite.verify("/auth/verify?permission=users:read", bearer(token))
+
+	suite.Equal(http.StatusForbidden, first.Code)
+	suite.Equal(http.StatusOK, second.Code)
+}
+
+func (suite *ForwardAuthTestSuite) TestDecisionCacheExpires() {
+	cache := NewDecisionCache(time.Minute)
+	now := time.Now()
+	cache.Put("key", &ForwardDecision{UserID: targetID}, now)
+
+	decision, ok := cache.Get("key", now.Add(59*time.Second))
+	suite.True(ok)
+	suite.Equal(targetID, decision.UserID)
+
+	_, ok = cache.Get("key", now.Add(time.Minute))
+	suite.False(ok)
+
+	cache.Put("other", &ForwardDecision{UserID: targetID}, now.Add(time.Minute))
+	suite.Len(cache.entries, 1)
+}
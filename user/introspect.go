@@ -0,0 +1,336 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/diegodario88/sesamo/audit"
+	"github.com/diegodario88/sesamo/httphelper"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var ErrForeignToken = errors.New("token was issued to another client")
+
+// Introspection describes a token to the client that asked about it
+// (RFC 7662 2.2). Tokens that are not active are described by Active alone,
+// so callers learn nothing about why they were refused.
+type Introspection struct {
+	Active         bool     `json:"active"`
+	Subject        string   `json:"sub,omitempty"`
+	ClientID       string   `json:"client_id,omitempty"`
+	Username       string   `json:"username,omitempty"`
+	Scope          string   `json:"scope,omitempty"`
+	Roles          []string `json:"roles,omitempty"`
+	OrganizationID string   `json:"org_id,omitempty"`
+	TokenType      string   `json:"token_type,omitempty"`
+	ExpiresAt      int64    `json:"exp,omitempty"`
+	IssuedAt       int64    `json:"iat,omitempty"`
+	Issuer         string   `json:"iss,omitempty"`
+}
+
+// Introspect is the OAuth 2.0 token introspection endpoint (RFC 7662), for
+// resource servers checking the tokens they receive. Tokens are validated
+// as AuthMiddleware validates them, so revoked tokens and those of users who
+// may no longer sign in are reported inactive right away.
+func (svc *UserService) Introspect(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	if _, err := svc.authenticateCaller(r, true); err != nil {
+		svc.writeClientError(w, r, err)
+		return
+	}
+
+	tokenStr := r.PostForm.Get("token")
+	if tokenStr == "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "token is required")
+		return
+	}
+
+	result, err := svc.introspect(r.Context(), svc.clientIP(r), tokenStr)
+	if err != nil && rejectsToken(err) {
+		result, err = &Introspection{}, nil
+	}
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	httphelper.WriteJSON(w, http.StatusOK, result)
+}
+
+// Revoke is the OAuth 2.0 token revocation endpoint (RFC 7009). sesamo
+// issues no refresh tokens, so whatever the token_type_hint the token is an
+// access token: personal access tokens are deleted and JWTs refused until
+// they expire. Tokens that are already invalid are answered like revoked
+// ones, as RFC 7009 2.2 asks.
+func (svc *UserService) Revoke(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	clientID, err := svc.authenticateCaller(r, false)
+	if err != nil {
+		svc.writeClientError(w, r, err)
+		return
+	}
+
+	tokenStr := r.PostForm.Get("token")
+	if tokenStr == "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "token is required")
+		return
+	}
+
+	err = svc.revoke(r.Context(), svc.clientIP(r), clientID, tokenStr)
+	if errors.Is(err, ErrForeignToken) {
+		writeOAuthError(w, http.StatusBadRequest, "unauthorized_client", err.Error())
+		return
+	}
+	if err != nil && !rejectsToken(err) {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// authenticateCaller identifies the client calling the introspection or
+// revocation endpoint, a service account or an application, and returns
+// its client ID. Any client may revoke tokens, but only those registered
+// with can_introspect may introspect them (RFC 7662 4): introspection
+// describes the tokens of every user.
+func (svc *UserService) authenticateCaller(r *http.Request, introspecting bool) (string, error) {
+	credentials, err := readClientCredentials(r)
+	if err != nil {
+		return "", err
+	}
+
+	if strings.HasPrefix(credentials.ClientID, oauthClientPrefix) {
+		client, err := svc.authenticateOAuthClient(r)
+		if err != nil {
+			return "", err
+		}
+		if introspecting && (client.Public() || !client.CanIntrospect) {
+			return "", fmt.Errorf("%w: client may not introspect tokens", ErrInvalidClient)
+		}
+		return client.ClientID, nil
+	}
+
+	account, err := svc.authenticateClient(r)
+	if err != nil {
+		return "", err
+	}
+	if account.DisabledAt != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidClient, ErrServiceAccountDisabled)
+	}
+	if introspecting && !account.CanIntrospect {
+		return "", fmt.Errorf("%w: client may not introspect tokens", ErrInvalidClient)
+	}
+
+	return account.ClientID, nil
+}
+
+// introspect describes tokenStr, used from ip, once AuthMiddleware, or the
+// userinfo endpoint for the tokens of third-party clients, accepted it.
+func (svc *UserService) introspect(
+	ctx context.Context,
+	ip string,
+	tokenStr string,
+) (*Introspection, error) {
+	if strings.HasPrefix(tokenStr, accessTokenPrefix) {
+		return svc.introspectAccessToken(ctx, tokenStr)
+	}
+
+	claims, err := svc.parseAccessToken(tokenStr)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Introspection{Active: true, TokenType: "Bearer", Issuer: svc.issuer()}
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		result.ExpiresAt = exp.Unix()
+	}
+	if iat, err := claims.GetIssuedAt(); err == nil && iat != nil {
+		result.IssuedAt = iat.Unix()
+	}
+
+	if claims["purpose"] == userinfoPurpose {
+		user, scope, err := svc.userinfoSubject(ctx, ip, tokenStr)
+		if err != nil {
+			return nil, err
+		}
+
+		result.Subject = user.ID
+		result.ClientID, _ = claims["azp"].(string)
+		result.Scope = strings.Join(scope, " ")
+		return result, nil
+	}
+
+	authCtx, err := svc.authenticateToken(ctx, ip, tokenStr)
+	if err != nil {
+		return nil, err
+	}
+
+	result.Subject = authCtx.Value(UserIDKey).(string)
+	result.Roles, _ = authCtx.Value(UserRolesKey).([]string)
+	if account, ok := authCtx.Value(ServiceAccountKey).(*ServiceAccount); ok {
+		result.ClientID = account.ClientID
+		result.OrganizationID = account.OrganizationID
+	} else {
+		result.Username, _ = claims["email"].(string)
+	}
+
+	return result, nil
+}
+
+// introspectAccessToken describes a personal access token, which carries
+// the roles of its user at the time it is used. Describing a token is not a
+// use of it, so its last use is left as it was.
+func (svc *UserService) introspectAccessToken(
+	ctx context.Context,
+	secret string,
+) (*Introspection, error) {
+	token, err := svc.findAccessToken(ctx, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := svc.accessTokenOwner(ctx, token); err != nil {
+		return nil, err
+	}
+
+	roles, err := svc.Repo.GetRoles(ctx, token.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("introspectAccessToken: %w", err)
+	}
+
+	result := &Introspection{
+		Active:    true,
+		Subject:   token.UserID,
+		Scope:     strings.Join(token.Scopes, " "),
+		Roles:     roles,
+		TokenType: "Bearer",
+		ExpiresAt: token.ExpiresAt.Unix(),
+		IssuedAt:  token.CreatedAt.Unix(),
+		Issuer:    svc.issuer(),
+	}
+	if token.OrganizationID != nil {
+		result.OrganizationID = *token.OrganizationID
+	}
+
+	return result, nil
+}
+
+// revoke revokes tokenStr on behalf of clientID. Tokens issued to a client,
+// service account tokens and those of third-party applications, may only
+// be revoked by that client; anyone holding another token may revoke it.
+// Personal access tokens are deleted even when their user may not sign in,
+// so they stay revoked once the user is enabled again.
+func (svc *UserService) revoke(
+	ctx context.Context,
+	ip string,
+	clientID string,
+	tokenStr string,
+) error {
+	if strings.HasPrefix(tokenStr, accessTokenPrefix) {
+		token, err := svc.findAccessToken(ctx, tokenStr)
+		if err != nil {
+			return err
+		}
+
+		err = svc.Repo.DeletePersonalAccessToken(ctx, token.UserID, token.ID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("revoke: %w", err)
+		}
+
+		svc.record(ctx, audit.Event{
+			Action:  audit.ActionAccessTokenRevoked,
+			UserID:  &token.UserID,
+			IP:      &ip,
+			Details: map[string]any{"access_token_id": token.ID, "client_id": clientID},
+		})
+		return nil
+	}
+
+	claims, err := svc.parseAccessToken(tokenStr)
+	if err != nil {
+		return err
+	}
+
+	owner, _ := claims["azp"].(string)
+	if owner == "" {
+		owner, _ = claims["client_id"].(string)
+	}
+	if owner != "" && owner != clientID {
+		return ErrForeignToken
+	}
+
+	exp, err := claims.GetExpirationTime()
+	if err != nil || exp == nil {
+		return ErrInvalidToken
+	}
+
+	if err := svc.Repo.RevokeToken(ctx, hashToken(tokenStr), exp.Time); err != nil {
+		return err
+	}
+
+	subject, _ := claims["userID"].(string)
+	if subject == "" {
+		subject, _ = claims.GetSubject()
+	}
+	svc.record(ctx, audit.Event{
+		Action:  audit.ActionOAuthTokenRevoked,
+		UserID:  &subject,
+		IP:      &ip,
+		Details: map[string]any{"client_id": clientID},
+	})
+
+	return nil
+}
+
+// parseAccessToken verifies the signature and expiry of a JWT access token,
+// that of a user, a service account or a third-party client, and returns its
+// claims. Challenge and session tokens are refused.
+func (svc *UserService) parseAccessToken(tokenStr string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(
+		tokenStr,
+		claims,
+		func(token *jwt.Token) (interface{}, error) {
+			return []byte(svc.Config.JwtSecret), nil
+		},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+	)
+	if err != nil || !token.Valid {
+		return nil, ErrInvalidToken
+	}
+
+	if purpose, ok := claims["purpose"]; ok && purpose != userinfoPurpose {
+		return nil, ErrInvalidToken
+	}
+
+	return claims, nil
+}
+
+// checkNotRevoked fails with ErrTokenRevoked when tokenStr was revoked at
+// the revocation endpoint.
+func (svc *UserService) checkNotRevoked(ctx context.Context, tokenStr string) error {
+	revoked, err := svc.Repo.IsTokenRevoked(ctx, hashToken(tokenStr))
+	if err != nil {
+		return fmt.Errorf("checkNotRevoked: %w", err)
+	}
+	if revoked {
+		return ErrTokenRevoked
+	}
+
+	return nil
+}
@@ -0,0 +1,281 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diegodario88/sesamo/audit"
+	"github.com/diegodario88/sesamo/config"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+type IntrospectTestSuite struct {
+	suite.Suite
+	repo    *MockUserRepository
+	audit   *recordingAudit
+	handler *Handler
+	account *ServiceAccount
+	secret  string
+	user    *UserEntity
+}
+
+func TestIntrospectTestSuite(t *testing.T) {
+	suite.Run(t, new(IntrospectTestSuite))
+}
+
+func (suite *IntrospectTestSuite) SetupTest() {
+	suite.repo = new(MockUserRepository)
+	suite.audit = &recordingAudit{}
+	suite.handler = NewHandler(UserService{
+		Repo: suite.repo,
+		Config: &config.Config{
+			JwtSecret:              "0123456789abcdef",
+			JwtExpirationInSeconds: 3600,
+			IssuerUrl:              testIssuer,
+		},
+		Audit: suite.audit,
+	})
+
+	secret, hash, err := newClientSecret()
+	suite.Require().NoError(err)
+	suite.secret = secret
+	suite.account = &ServiceAccount{
+		ID:             serviceAccountID,
+		OrganizationID: memberOrgID,
+		Name:           "billing",
+		ClientID:       testClientID,
+		SecretHash:     &hash,
+		CanIntrospect:  true,
+	}
+	suite.user = &UserEntity{ID: targetID, Email: "ana@example.com", Status: StatusActive}
+}
+
+func (suite *IntrospectTestSuite) post(
+	endpoint http.HandlerFunc,
+	form url.Values,
+	setup func(r *http.Request),
+) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, "/oauth", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if setup != nil {
+		setup(request)
+	}
+	recorder := httptest.NewRecorder()
+
+	endpoint(recorder, request)
+
+	return recorder
+}
+
+// call posts form to endpoint as the service account of the suite.
+func (suite *IntrospectTestSuite) call(
+	endpoint http.HandlerFunc,
+	form url.Values,
+) *httptest.ResponseRecorder {
+	suite.repo.On("FindServiceAccountByClientID", testClientID).Return(suite.account, nil).Once()
+
+	return suite.post(endpoint, form, func(r *http.Request) {
+		r.SetBasicAuth(testClientID, suite.secret)
+	})
+}
+
+func (suite *IntrospectTestSuite) introspect(token string) Introspection {
+	recorder := suite.call(suite.handler.Introspect, url.Values{"token": {token}})
+	suite.Require().Equal(http.StatusOK, recorder.Code, recorder.Body.String())
+	suite.Equal("no-store", recorder.Header().Get("Cache-Control"))
+
+	var result Introspection
+	suite.Require().NoError(json.Unmarshal(recorder.Body.Bytes(), &result))
+	return result
+}
+
+// userToken issues an access token of the suite's user carrying roles.
+func (suite *IntrospectTestSuite) userToken(roles []string) string {
+	suite.repo.On("GetRoles", targetID).Return(roles, nil).Once()
+	suite.repo.On("RequiresMFA", targetID).Return(false, nil).Once()
+	token, err := suite.handler.GenerateUserToken(context.Background(), suite.user)
+	suite.Require().NoError(err)
+	return token
+}
+
+func (suite *IntrospectTestSuite) TestActiveUserToken() {
+	token := suite.userToken([]string{"org_admin"})
+	suite.repo.On("IsTokenRevoked", hashToken(token)).Return(false, nil).Once()
+	suite.repo.On("FindUserById", targetID).Return(suite.user, nil).Once()
+
+	result := suite.introspect(token)
+
+	suite.True(result.Active)
+	suite.Equal(targetID, result.Subject)
+	suite.Equal("ana@example.com", result.Username)
+	suite.Equal([]string{"org_admin"}, result.Roles)
+	suite.Equal("Bearer", result.TokenType)
+	suite.Equal(testIssuer, result.Issuer)
+	suite.InDelta(time.Now().Add(time.Hour).Unix(), result.ExpiresAt, 5)
+}
+
+func (suite *IntrospectTestSuite) TestTokenOfDisabledUserIsInactive() {
+	token := suite.userToken([]string{"org_admin"})
+	suite.repo.On("IsTokenRevoked", hashToken(token)).Return(false, nil).Once()
+	disabled := &UserEntity{ID: targetID, Status: StatusDisabled}
+	suite.repo.On("FindUserById", targetID).Return(disabled, nil).Once()
+
+	recorder := suite.call(suite.handler.Introspect, url.Values{"token": {token}})
+
+	suite.Equal(http.StatusOK, recorder.Code)
+	suite.JSONEq(`{"active": false}`, recorder.Body.String())
+}
+
+func (suite *IntrospectTestSuite) TestForgedTokenIsInactive() {
+	result := suite.introspect("not.a.token")
+
+	suite.Equal(Introspection{}, result)
+}
+
+func (suite *IntrospectTestSuite) TestPersonalAccessToken() {
+	secret, _, err := newToken([]byte(suite.handler.Config.JwtSecret), accessTokenPurpose)
+	suite.Require().NoError(err)
+	secret = accessTokenPrefix + secret
+	orgID := memberOrgID
+	token := &PersonalAccessToken{
+		ID:             "01JQ0000000000000000000009",
+		UserID:         targetID,
+		Scopes:         []string{"users:read"},
+		OrganizationID: &orgID,
+		ExpiresAt:      time.Now().Add(24 * time.Hour),
+		CreatedAt:      time.Now().Add(-time.Hour),
+	}
+	suite.repo.On("FindPersonalAccessToken", hashToken(secret)).Return(token, nil).Once()
+	suite.repo.On("FindUserById", targetID).Return(suite.user, nil).Once()
+	suite.repo.On("GetRoles", targetID).Return([]string{"member"}, nil).Once()
+
+	result := suite.introspect(secret)
+
+	suite.repo.AssertNotCalled(suite.T(), "UsePersonalAccessToken", mock.Anything, mock.Anything)
+
+	suite.True(result.Active)
+	suite.Equal(targetID, result.Subject)
+	suite.Equal("users:read", result.Scope)
+	suite.Equal([]string{"member"}, result.Roles)
+	suite.Equal(memberOrgID, result.OrganizationID)
+	suite.Equal(token.ExpiresAt.Unix(), result.ExpiresAt)
+}
+
+func (suite *IntrospectTestSuite) TestServiceAccountToken() {
+	suite.repo.On("GetRoles", serviceAccountID).Return([]string{"org_admin"}, nil).Once()
+	token, _, err := suite.handler.generateServiceAccountToken(context.Background(), suite.account)
+	suite.Require().NoError(err)
+	suite.repo.On("IsTokenRevoked", hashToken(token)).Return(false, nil).Once()
+	suite.repo.On("FindServiceAccountByClientID", testClientID).Return(suite.account, nil).Once()
+
+	result := suite.introspect(token)
+
+	suite.True(result.Active)
+	suite.Equal(serviceAccountID, result.Subject)
+	suite.Equal(testClientID, result.ClientID)
+	suite.Equal(memberOrgID, result.OrganizationID)
+	suite.Equal([]string{"org_admin"}, result.Roles)
+}
+
+func (suite *IntrospectTestSuite) TestCallerMustAuthenticate() {
+	recorder := suite.post(suite.handler.Introspect, url.Values{"token": {"not.a.token"}}, nil)
+
+	suite.Equal(http.StatusUnauthorized, recorder.Code)
+	suite.Contains(recorder.Body.String(), "invalid_client")
+}
+
+func (suite *IntrospectTestSuite) TestPublicClientCannotIntrospect() {
+	client := &OAuthClient{ClientID: appClientID, RedirectURIs: []string{appRedirect}}
+	suite.repo.On("FindOAuthClient", appClientID).Return(client, nil).Once()
+	form := url.Values{"token": {"not.a.token"}, "client_id": {appClientID}}
+
+	recorder := suite.post(suite.handler.Introspect, form, nil)
+
+	suite.Equal(http.StatusUnauthorized, recorder.Code)
+}
+
+func (suite *IntrospectTestSuite) TestCallerMustBeAllowedToIntrospect() {
+	suite.account.CanIntrospect = false
+
+	recorder := suite.call(suite.handler.Introspect, url.Values{"token": {"not.a.token"}})
+
+	suite.Equal(http.StatusUnauthorized, recorder.Code)
+	suite.Contains(recorder.Body.String(), "invalid_client")
+}
+
+func (suite *IntrospectTestSuite) TestRevokedTokenIsInactive() {
+	token := suite.userToken([]string{"org_admin"})
+	suite.repo.On("RevokeToken", hashToken(token), mock.Anything).Return(nil).Once()
+
+	recorder := suite.call(suite.handler.Revoke, url.Values{
+		"token":           {token},
+		"token_type_hint": {"refresh_token"},
+	})
+	suite.Require().Equal(http.StatusOK, recorder.Code, recorder.Body.String())
+	suite.Require().Len(suite.audit.events, 1)
+	suite.Equal(audit.ActionOAuthTokenRevoked, suite.audit.events[0].Action)
+	suite.Equal(targetID, *suite.audit.events[0].UserID)
+
+	suite.repo.On("IsTokenRevoked", hashToken(token)).Return(true, nil).Once()
+	suite.False(suite.introspect(token).Active)
+}
+
+func (suite *IntrospectTestSuite) TestRevokeDeletesPersonalAccessToken() {
+	secret, _, err := newToken([]byte(suite.handler.Config.JwtSecret), accessTokenPurpose)
+	suite.Require().NoError(err)
+	secret = accessTokenPrefix + secret
+	token := &PersonalAccessToken{ID: "01JQ0000000000000000000009", UserID: targetID}
+	suite.repo.On("FindPersonalAccessToken", hashToken(secret)).Return(token, nil).Once()
+	suite.repo.On("DeletePersonalAccessToken", targetID, token.ID).Return(nil).Once()
+
+	recorder := suite.call(suite.handler.Revoke, url.Values{"token": {secret}})
+
+	suite.Equal(http.StatusOK, recorder.Code)
+	suite.repo.AssertExpectations(suite.T())
+	suite.repo.AssertNotCalled(suite.T(), "UsePersonalAccessToken", mock.Anything, mock.Anything)
+	suite.Require().Len(suite.audit.events, 1)
+	suite.Equal(audit.ActionAccessTokenRevoked, suite.audit.events[0].Action)
+}
+
+func (suite *IntrospectTestSuite) TestRevokeDeletesTokenOfDisabledUser() {
+	secret, _, err := newToken([]byte(suite.handler.Config.JwtSecret), accessTokenPurpose)
+	suite.Require().NoError(err)
+	secret = accessTokenPrefix + secret
+	token := &PersonalAccessToken{ID: "01JQ0000000000000000000009", UserID: targetID}
+	disabled := &UserEntity{ID: targetID, Status: StatusDisabled}
+	suite.repo.On("FindUserById", targetID).Return(disabled, nil).Maybe()
+	suite.repo.On("FindPersonalAccessToken", hashToken(secret)).Return(token, nil).Once()
+	suite.repo.On("DeletePersonalAccessToken", targetID, token.ID).Return(nil).Once()
+
+	recorder := suite.call(suite.handler.Revoke, url.Values{"token": {secret}})
+
+	suite.Equal(http.StatusOK, recorder.Code)
+	suite.repo.AssertExpectations(suite.T())
+}
+
+func (suite *IntrospectTestSuite) TestRevokingAnInvalidTokenSucceeds() {
+	recorder := suite.call(suite.handler.Revoke, url.Values{"token": {"not.a.token"}})
+
+	suite.Equal(http.StatusOK, recorder.Code)
+	suite.repo.AssertNotCalled(suite.T(), "RevokeToken", mock.Anything, mock.Anything)
+}
+
+func (suite *IntrospectTestSuite) TestTokenOfAnotherClientIsNotRevoked() {
+	other := &ServiceAccount{ID: "01JQ000000000000000000000T", ClientID: "sa_other"}
+	suite.repo.On("GetRoles", other.ID).Return([]string{}, nil).Once()
+	token, _, err := suite.handler.generateServiceAccountToken(context.Background(), other)
+	suite.Require().NoError(err)
+
+	recorder := suite.call(suite.handler.Revoke, url.Values{"token": {token}})
+
+	suite.Equal(http.StatusBadRequest, recorder.Code)
+	suite.Contains(recorder.Body.String(), "unauthorized_client")
+	suite.repo.AssertNotCalled(suite.T(), "RevokeToken", mock.Anything, mock.Anything)
+}
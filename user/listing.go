@@ -0,0 +1,357 @@
+package user
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diegodario88/sesamo/httphelper"
+)
+
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 200
+)
+
+var ErrInvalidCursor = errors.New("invalid or expired cursor")
+var ErrInvalidSort = errors.New("invalid sort field")
+
+// UserFilter narrows a user listing. Zero values are ignored.
+type UserFilter struct {
+	Email         string
+	NamePrefix    string
+	Search        string
+	Role          string
+	Status        string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	ManagedBy     *Manager
+}
+
+// Manager restricts a listing to the users a caller may act on with
+// Permission; see managedByPredicate and changeableByPredicate.
+type Manager struct {
+	UserID     string
+	Permission string
+}
+
+// changesUsers reports whether Permission does more than read users, so
+// acting on a user could hand the manager that user's privileges.
+func (manager Manager) changesUsers() bool {
+	return manager.Permission != "users:read"
+}
+
+// managedByPredicate holds when the manager has the permission through a
+// global role, or through an organization or branch role whose organization or
+// branch u also belongs to. The manager may be a user or a service account, so
+// its roles come from principal_roles; u is always a user. Its placeholders
+// are the manager ID and the permission.
+const managedByPredicate = `EXISTS (
+	SELECT 1
+	FROM principal_roles mr
+	JOIN roles r ON mr.role_id = r.id
+	JOIN role_permissions rp ON r.id = rp.role_id
+	JOIN permissions p ON rp.permission_id = p.id
+	WHERE mr.principal_id = ? AND p.name = ? AND (
+		r.scope = 'global'
+		OR (r.scope = 'organization' AND EXISTS (
+			SELECT 1 FROM user_roles tr
+			WHERE tr.user_id = u.id AND tr.organization_id = mr.organization_id
+		))
+		OR (r.scope = 'branch' AND EXISTS (
+			SELECT 1 FROM user_roles tr
+			WHERE tr.user_id = u.id AND tr.branch_id = mr.branch_id
+		))
+	)
+)`
+
+// changeableByPredicate narrows managedByPredicate for permissions that
+// change users. Changing a user's email, password, MFA or status amounts to
+// taking the account over, so the manager's role must confine u: an
+// organization or branch role only reaches users whose every role lies in
+// that organization or branch, which leaves out global administrators. u must
+// also hold no permission the manager lacks. Its placeholders are the manager
+// ID, the permission and the manager ID again.
+const changeableByPredicate = `EXISTS (
+	SELECT 1
+	FROM principal_roles mr
+	JOIN roles r ON mr.role_id = r.id
+	JOIN role_permissions rp ON r.id = rp.role_id
+	JOIN permissions p ON rp.permission_id = p.id
+	WHERE mr.principal_id = ? AND p.name = ? AND (
+		r.scope = 'global'
+		OR (r.scope = 'organization' AND EXISTS (
+			SELECT 1 FROM user_roles tr
+			WHERE tr.user_id = u.id AND tr.organization_id = mr.organization_id
+		) AND NOT EXISTS (
+			SELECT 1 FROM user_roles tr
+			WHERE tr.user_id = u.id AND tr.organization_id IS DISTINCT FROM mr.organization_id
+		))
+		OR (r.scope = 'branch' AND EXISTS (
+			SELECT 1 FROM user_roles tr
+			WHERE tr.user_id = u.id AND tr.branch_id = mr.branch_id
+		) AND NOT EXISTS (
+			SELECT 1 FROM user_roles tr
+			WHERE tr.user_id = u.id AND tr.branch_id IS DISTINCT FROM mr.branch_id
+		))
+	)
+) AND NOT EXISTS (
+	SELECT 1
+	FROM user_roles tr
+	JOIN role_permissions trp ON tr.role_id = trp.role_id
+	WHERE tr.user_id = u.id AND trp.permission_id NOT IN (
+		SELECT mrp.permission_id
+		FROM principal_roles mr
+		JOIN role_permissions mrp ON mr.role_id = mrp.role_id
+		WHERE mr.principal_id = ?
+	)
+)`
+
+// UserQuery is one page request. Sort names a field of userSortFields,
+// prefixed with "-" for descending order; the ULID primary key breaks ties,
+// so pages are stable while users are inserted.
+type UserQuery struct {
+	UserFilter
+	Sort      string
+	Cursor    string
+	Limit     int
+	WithTotal bool
+}
+
+type UserPage struct {
+	Items []UserEntity `json:"items"`
+	Next  string       `json:"next,omitempty"`
+	Prev  string       `json:"prev,omitempty"`
+	Total *int         `json:"total,omitempty"`
+}
+
+type sortField struct {
+	column string
+	cast   string
+	value  func(user UserEntity) string
+}
+
+var userSortFields = map[string]sortField{
+	"id":        {"u.id", "::ulid", func(user UserEntity) string { return user.ID }},
+	"email":     {"u.email", "", func(user UserEntity) string { return user.Email }},
+	"firstName": {"u.first_name", "", func(user UserEntity) string { return user.FirstName }},
+	"lastName":  {"u.last_name", "", func(user UserEntity) string { return user.LastName }},
+	"created_at": {"u.created_at", "::timestamp", func(user UserEntity) string {
+		return user.CreatedAt.Format(cursorTimeLayout)
+	}},
+}
+
+const cursorTimeLayout = "2006-01-02 15:04:05.999999"
+
+func (query UserQuery) sortField() (sortField, bool, error) {
+	name, descending := strings.CutPrefix(query.Sort, "-")
+	if name == "" {
+		name = "id"
+	}
+
+	field, ok := userSortFields[name]
+	if !ok {
+		return sortField{}, false, fmt.Errorf("%w %q", ErrInvalidSort, name)
+	}
+
+	return field, descending, nil
+}
+
+func (query UserQuery) limit() int {
+	switch {
+	case query.Limit <= 0:
+		return DefaultPageSize
+	case query.Limit > MaxPageSize:
+		return MaxPageSize
+	default:
+		return query.Limit
+	}
+}
+
+// cursor points just past one row of a page. It records the sort it was
+// issued for, so a cursor reused with another sort is rejected instead of
+// silently skipping rows.
+type cursor struct {
+	Sort     string `json:"s"`
+	Value    string `json:"v"`
+	ID       string `json:"id"`
+	Backward bool   `json:"b,omitempty"`
+}
+
+func encodeCursor(c cursor) string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(encoded string, sort string) (*cursor, error) {
+	if encoded == "" {
+		return nil, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var c cursor
+	if err := json.Unmarshal(raw, &c); err != nil || c.ID == "" || c.Sort != sort {
+		return nil, ErrInvalidCursor
+	}
+
+	return &c, nil
+}
+
+// whereClause accumulates predicates written with ? placeholders; callers
+// rebind them for the driver.
+type whereClause struct {
+	predicates []string
+	args       []any
+}
+
+func (where *whereClause) add(predicate string, args ...any) {
+	where.predicates = append(where.predicates, predicate)
+	where.args = append(where.args, args...)
+}
+
+func (where *whereClause) String() string {
+	if len(where.predicates) == 0 {
+		return ""
+	}
+
+	return " WHERE " + strings.Join(where.predicates, " AND ")
+}
+
+func (filter UserFilter) apply(where *whereClause) {
+	if filter.Email != "" {
+		where.add("u.email = ?", filter.Email)
+	}
+
+	if filter.NamePrefix != "" {
+		prefix := escapeLike(filter.NamePrefix) + "%"
+		where.add(
+			"(u.first_name ILIKE ? OR u.last_name ILIKE ? OR u.first_name || ' ' || u.last_name ILIKE ?)",
+			prefix,
+			prefix,
+			prefix,
+		)
+	}
+
+	if filter.Search != "" {
+		pattern := "%" + escapeLike(filter.Search) + "%"
+		where.add(
+			"(u.email ILIKE ? OR u.first_name || ' ' || u.last_name ILIKE ?)",
+			pattern,
+			pattern,
+		)
+	}
+
+	if filter.Role != "" {
+		where.add(`EXISTS (
+			SELECT 1 FROM user_roles ur
+			JOIN roles r ON ur.role_id = r.id
+			WHERE ur.user_id = u.id AND r.name = ?
+		)`, filter.Role)
+	}
+
+	if filter.Status != "" {
+		where.add("u.status = ?", filter.Status)
+	}
+
+	if !filter.CreatedAfter.IsZero() {
+		where.add("u.created_at >= ?", filter.CreatedAfter.UTC())
+	}
+
+	if !filter.CreatedBefore.IsZero() {
+		where.add("u.created_at < ?", filter.CreatedBefore.UTC())
+	}
+
+	if manager := filter.ManagedBy; manager != nil && manager.changesUsers() {
+		where.add(changeableByPredicate, manager.UserID, manager.Permission, manager.UserID)
+	} else if manager != nil {
+		where.add(managedByPredicate, manager.UserID, manager.Permission)
+	}
+}
+
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value)
+}
+
+// ParseUserQuery reads a listing request from URL parameters: limit, cursor,
+// sort, email, name (prefix), q (substring search), role, status,
+// created_after, created_before (RFC 3339) and total=true.
+func ParseUserQuery(values url.Values) (UserQuery, error) {
+	query := UserQuery{
+		UserFilter: UserFilter{
+			Email:      values.Get("email"),
+			NamePrefix: values.Get("name"),
+			Search:     values.Get("q"),
+			Role:       values.Get("role"),
+			Status:     values.Get("status"),
+		},
+		Sort:   values.Get("sort"),
+		Cursor: values.Get("cursor"),
+	}
+
+	if raw := values.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > MaxPageSize {
+			return query, fmt.Errorf("limit must be between 1 and %d", MaxPageSize)
+		}
+		query.Limit = limit
+	}
+
+	if query.Status != "" && !slices.Contains(AccountStatuses, query.Status) {
+		return query, fmt.Errorf("status must be one of %s", strings.Join(AccountStatuses, ", "))
+	}
+
+	for name, target := range map[string]*time.Time{
+		"created_after":  &query.CreatedAfter,
+		"created_before": &query.CreatedBefore,
+	} {
+		if raw := values.Get(name); raw != "" {
+			parsed, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				return query, fmt.Errorf("%s must be an RFC 3339 timestamp", name)
+			}
+			*target = parsed
+		}
+	}
+
+	if raw := values.Get("total"); raw != "" {
+		withTotal, err := strconv.ParseBool(raw)
+		if err != nil {
+			return query, fmt.Errorf("total must be a boolean")
+		}
+		query.WithTotal = withTotal
+	}
+
+	if _, _, err := query.sortField(); err != nil {
+		return query, err
+	}
+
+	return query, nil
+}
+
+// writeUserPage answers a listing with the page and RFC 8288 Link headers
+// pointing at its neighbours.
+func writeUserPage(w http.ResponseWriter, r *http.Request, page *UserPage, err error) {
+	if errors.Is(err, ErrInvalidCursor) {
+		httphelper.WriteProblem(w, httphelper.BadRequest(ErrInvalidCursor.Error()))
+		return
+	}
+
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	httphelper.SetPageLinks(w, r, "cursor", page.Next, page.Prev)
+	httphelper.WriteJSON(w, http.StatusOK, page)
+}
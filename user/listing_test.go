@@ -0,0 +1,102 @@
+package user
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ListingTestSuite struct {
+	suite.Suite
+}
+
+func TestListingTestSuite(t *testing.T) {
+	suite.Run(t, new(ListingTestSuite))
+}
+
+func (suite *ListingTestSuite) TestParseUserQuery() {
+	values, err := url.ParseQuery(
+		"limit=20&sort=-created_at&name=ana&status=active&role=admin" +
+			"&created_after=2026-01-01T00:00:00Z&total=true",
+	)
+	suite.Require().NoError(err)
+
+	query, err := ParseUserQuery(values)
+
+	suite.Require().NoError(err)
+	suite.Equal(20, query.Limit)
+	suite.Equal("-created_at", query.Sort)
+	suite.Equal("ana", query.NamePrefix)
+	suite.Equal(StatusActive, query.Status)
+	suite.Equal("admin", query.Role)
+	suite.Equal(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), query.CreatedAfter)
+	suite.True(query.WithTotal)
+}
+
+func (suite *ListingTestSuite) TestParseUserQueryRejectsInvalidValues() {
+	invalid := []string{
+		"limit=0",
+		"limit=1000",
+		"sort=password_hash",
+		"status=gone",
+		"created_before=yesterday",
+	}
+
+	for _, raw := range invalid {
+		values, err := url.ParseQuery(raw)
+		suite.Require().NoError(err)
+
+		_, err = ParseUserQuery(values)
+		suite.Error(err, raw)
+	}
+}
+
+func (suite *ListingTestSuite) TestCursorIsBoundToItsSort() {
+	encoded := encodeCursor(cursor{
+		Sort:  "email",
+		Value: "a@b.c",
+		ID:    "01JQEG0PHECS7VVSSMRWXGBTEA",
+	})
+
+	decoded, err := decodeCursor(encoded, "email")
+	suite.Require().NoError(err)
+	suite.Equal("a@b.c", decoded.Value)
+
+	_, err = decodeCursor(encoded, "-email")
+	suite.ErrorIs(err, ErrInvalidCursor)
+
+	_, err = decodeCursor("not a cursor", "email")
+	suite.ErrorIs(err, ErrInvalidCursor)
+}
+
+func (suite *ListingTestSuite) TestWriteUserPageSetsLinkHeader() {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/api/v1/users?limit=2&cursor=old", nil)
+
+	page := &UserPage{Items: []UserEntity{}, Next: "n1", Prev: "p1"}
+	writeUserPage(recorder, request, page, nil)
+
+	suite.Equal(http.StatusOK, recorder.Code)
+	suite.Equal(
+		`</api/v1/users?cursor=n1&limit=2>; rel="next", </api/v1/users?cursor=p1&limit=2>; rel="prev"`,
+		recorder.Header().Get("Link"),
+	)
+}
+
+func (suite *ListingTestSuite) TestManagedByConfinesChangesToNarrowerUsers() {
+	reading := &whereClause{}
+	UserFilter{ManagedBy: &Manager{UserID: "m", Permission: "users:read"}}.apply(reading)
+
+	suite.Equal([]string{managedByPredicate}, reading.predicates)
+	suite.Equal([]any{"m", "users:read"}, reading.args)
+
+	updating := &whereClause{}
+	UserFilter{ManagedBy: &Manager{UserID: "m", Permission: "users:update"}}.apply(updating)
+
+	suite.Equal([]string{changeableByPredicate}, updating.predicates)
+	suite.Equal([]any{"m", "users:update", "m"}, updating.args)
+}
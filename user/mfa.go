@@ -0,0 +1,623 @@
+package user
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/diegodario88/sesamo/audit"
+	"github.com/diegodario88/sesamo/httphelper"
+	"github.com/diegodario88/sesamo/logging"
+	"github.com/diegodario88/sesamo/metrics"
+	"github.com/diegodario88/sesamo/totp"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// mfaChallengePurpose marks the short-lived token handed out by Login to
+// users with MFA enabled. It only redeems at /users/login/mfa.
+const mfaChallengePurpose = "mfa"
+
+const (
+	recoveryCodeCount = 10
+	recoveryCodeBytes = 5
+)
+
+var ErrInvalidMFACode = errors.New("invalid or already used MFA code")
+var ErrInvalidMFAChallenge = errors.New("invalid or expired MFA challenge")
+
+type MFACodePayload struct {
+	Code string `json:"code" validate:"required"`
+}
+
+// LoginMFAPayload completes a login with either a TOTP or recovery code, or
+// the answer of a passkey to the ceremony started at
+// /users/login/mfa/passkey/options.
+type LoginMFAPayload struct {
+	MFAToken   string          `json:"mfaToken"   validate:"required"`
+	Code       string          `json:"code"       validate:"required_without=Session"`
+	Session    string          `json:"session"    validate:"required_with=Credential"`
+	Credential json.RawMessage `json:"credential" validate:"required_with=Session"`
+}
+
+// EnrollTOTP starts TOTP enrollment of the caller. The secret is returned
+// both raw and as an otpauth URI to render as a QR code; it only takes effect
+// once ConfirmTOTP verifies a code from it. Restarting replaces the pending
+// secret.
+func (svc *UserService) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	user, err := svc.Repo.FindUserById(ctx, ctx.Value(UserIDKey).(string))
+	if err != nil {
+		writeLookupError(w, r, err, "user not found")
+		return
+	}
+
+	if user.TOTPEnabled() {
+		httphelper.WriteProblem(w, httphelper.Conflict("TOTP is already enabled"))
+		return
+	}
+
+	secret, err := totp.NewSecret()
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	sealed, err := svc.sealTOTPSecret(secret)
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	if err := svc.Repo.SetTOTPSecret(ctx, user.ID, sealed); err != nil {
+		writeLookupError(w, r, err, "user not found")
+		return
+	}
+
+	httphelper.WriteJSON(w, http.StatusOK, map[string]string{
+		"secret": totp.EncodeSecret(secret),
+		"uri":    totp.URI(svc.Config.MfaIssuer, user.Email, secret),
+	})
+}
+
+// ConfirmTOTP enables the pending TOTP secret of the caller once they prove
+// their authenticator app produces its codes. The response carries the
+// recovery codes, shown only this once, and a fresh token.
+func (svc *UserService) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	payload, ok := parseMFACode(w, r)
+	if !ok {
+		return
+	}
+
+	user, err := svc.Repo.FindUserById(ctx, ctx.Value(UserIDKey).(string))
+	if err != nil {
+		writeLookupError(w, r, err, "user not found")
+		return
+	}
+
+	if user.TOTPEnabled() {
+		httphelper.WriteProblem(w, httphelper.Conflict("TOTP is already enabled"))
+		return
+	}
+
+	if user.TOTPSecret == nil {
+		httphelper.WriteProblem(w, httphelper.NewProblem(
+			http.StatusConflict,
+			"mfa_not_enrolling",
+			"start TOTP enrollment first",
+		))
+		return
+	}
+
+	secret, err := svc.openTOTPSecret(*user.TOTPSecret)
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	step, ok := totp.Validate(secret, normalizeMFACode(payload.Code), time.Now(), -1)
+	if !ok {
+		writeInvalidMFACode(w)
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	if err := svc.Repo.EnableTOTP(ctx, user.ID, step, hashes); err != nil {
+		writeLookupError(w, r, err, "user not found")
+		return
+	}
+
+	svc.record(ctx, audit.Event{
+		Action:  audit.ActionMFAEnabled,
+		ActorID: &user.ID,
+		UserID:  &user.ID,
+	})
+
+	now := time.Now()
+	user.TOTPEnabledAt = &now
+
+	authTime, _ := ctx.Value(AuthTimeKey).(time.Time)
+	token, err := svc.generateToken(ctx, user, authTime)
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	httphelper.WriteJSON(w, http.StatusOK, map[string]any{
+		"recovery_codes": codes,
+		"token":          token,
+	})
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the caller, used or
+// not, after checking a current code.
+func (svc *UserService) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	user, ok := svc.mfaUser(w, r)
+	if !ok {
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	if err := svc.Repo.ReplaceRecoveryCodes(ctx, user.ID, hashes); err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	svc.record(ctx, audit.Event{
+		Action:  audit.ActionRecoveryCodesReplaced,
+		ActorID: &user.ID,
+		UserID:  &user.ID,
+	})
+
+	httphelper.WriteJSON(w, http.StatusOK, map[string]any{"recovery_codes": codes})
+}
+
+// DisableTOTP turns off TOTP for the caller after checking a current code.
+// Users whose roles or organizations require MFA cannot turn it off unless
+// they have a passkey.
+func (svc *UserService) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	user, ok := svc.mfaUser(w, r)
+	if !ok {
+		return
+	}
+
+	passkeys, err := svc.Repo.FindWebAuthnCredentials(ctx, user.ID)
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	if len(passkeys) == 0 && !svc.canDropMFA(w, r, user) {
+		return
+	}
+
+	if err := svc.Repo.DisableTOTP(ctx, user.ID); err != nil {
+		writeLookupError(w, r, err, "user not found")
+		return
+	}
+
+	svc.record(ctx, audit.Event{
+		Action:  audit.ActionMFADisabled,
+		ActorID: &user.ID,
+		UserID:  &user.ID,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ResetMFA turns off TOTP for a user who lost their authenticator and their
+// recovery codes. Their next sign in asks them to enroll again when their
+// roles require MFA.
+func (svc *UserService) ResetMFA(w http.ResponseWriter, r *http.Request) {
+	user, ok := svc.managedUser(w, r, "users:update")
+	if !ok {
+		return
+	}
+
+	if err := svc.Repo.DisableTOTP(r.Context(), user.ID); err != nil {
+		writeLookupError(w, r, err, "user not found")
+		return
+	}
+
+	actorID := r.Context().Value(UserIDKey).(string)
+	svc.record(r.Context(), audit.Event{
+		Action:  audit.ActionMFAReset,
+		ActorID: &actorID,
+		UserID:  &user.ID,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// LoginMFA completes a login of a user with MFA enabled, exchanging the
+// challenge token from Login and a TOTP or recovery code for an access
+// token. Wrong codes count as failed logins.
+func (svc *UserService) LoginMFA(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.FromContext(ctx)
+
+	var payload LoginMFAPayload
+	if err := httphelper.ParseJSON(r, &payload); err != nil {
+		metrics.LoginAttempts.WithLabelValues("mfa", metrics.OutcomeInvalidPayload).Inc()
+		httphelper.WriteProblem(w, httphelper.BadRequest(err.Error()))
+		return
+	}
+
+	if err := httphelper.Validate.Struct(payload); err != nil {
+		metrics.LoginAttempts.WithLabelValues("mfa", metrics.OutcomeInvalidPayload).Inc()
+		httphelper.WriteProblem(w, httphelper.ValidationFailed(err))
+		return
+	}
+
+	ip := svc.clientIP(r)
+	user, authTime, err := svc.authenticateMFA(ctx, payload, ip)
+	if err != nil {
+		logger.Info("MFA login failed", "reason", err, "ip", ip)
+		outcome := loginOutcome(err)
+		metrics.LoginAttempts.WithLabelValues("mfa", outcome).Inc()
+		var throttled *ThrottledError
+		switch {
+		case errors.As(err, &throttled):
+			httphelper.WriteTooManyRequests(
+				w,
+				"too many failed logins, try again later",
+				throttled.RetryAfter,
+			)
+		case errors.Is(err, ErrInvalidMFAChallenge):
+			writeInvalidMFAChallenge(w)
+		case errors.Is(err, ErrInvalidMFACode):
+			svc.failClientLogin(ctx, ip)
+			writeInvalidMFACode(w)
+		case errors.Is(err, ErrPasskeyFailed):
+			svc.failClientLogin(ctx, ip)
+			writePasskeyError(w, r, err)
+		case accountInactive(err) != nil:
+			httphelper.WriteProblem(w, accountInactive(err))
+		default:
+			httphelper.WriteInternalError(w, r, err)
+		}
+		return
+	}
+
+	token, err := svc.generateToken(ctx, user, authTime)
+	if err != nil {
+		metrics.LoginAttempts.WithLabelValues("mfa", metrics.OutcomeError).Inc()
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	metrics.LoginAttempts.WithLabelValues("mfa", metrics.OutcomeSuccess).Inc()
+	httphelper.WriteJSON(w, http.StatusOK, map[string]string{"token": token})
+}
+
+// authenticateMFA checks the second step of a login from ip and returns the
+// user along with when they entered their password.
+func (svc *UserService) authenticateMFA(
+	ctx context.Context,
+	payload LoginMFAPayload,
+	ip string,
+) (*UserEntity, time.Time, error) {
+	if err := svc.checkClientThrottle(ip); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	userID, issuedAt, authTime, err := svc.parseMFAChallenge(payload.MFAToken)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	user, err := svc.Repo.FindUserById(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, time.Time{}, ErrInvalidMFAChallenge
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	if err := user.CheckTokenIssuedAt(issuedAt); err != nil {
+		return nil, time.Time{}, ErrInvalidMFAChallenge
+	}
+
+	failures, err := svc.checkAccountThrottle(ctx, user.Email)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	if payload.Session != "" {
+		err = svc.checkPasskey(ctx, user, payload.Session, payload.Credential)
+	} else {
+		err = svc.checkMFACode(ctx, user, payload.Code)
+	}
+	if err != nil {
+		if errors.Is(err, ErrInvalidMFACode) || errors.Is(err, ErrPasskeyFailed) {
+			svc.failAccountLogin(ctx, user.Email, &user.ID, ip)
+		}
+		return nil, time.Time{}, err
+	}
+
+	if err := svc.checkCanSignIn(user); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	if failures > 0 {
+		svc.clearAccountLogins(ctx, user.Email)
+	}
+
+	return user, authTime, nil
+}
+
+// mfaUser loads the caller for an MFA change, answering for it when TOTP is
+// not enabled or the code in the request does not check out. Wrong codes
+// count as failed logins, so a stolen session cannot guess its way to
+// turning MFA off.
+func (svc *UserService) mfaUser(w http.ResponseWriter, r *http.Request) (*UserEntity, bool) {
+	ctx := r.Context()
+
+	payload, ok := parseMFACode(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	user, err := svc.Repo.FindUserById(ctx, ctx.Value(UserIDKey).(string))
+	if err != nil {
+		writeLookupError(w, r, err, "user not found")
+		return nil, false
+	}
+
+	if !user.TOTPEnabled() {
+		httphelper.WriteProblem(w, httphelper.NewProblem(
+			http.StatusConflict,
+			"mfa_not_enabled",
+			"TOTP is not enabled",
+		))
+		return nil, false
+	}
+
+	var throttled *ThrottledError
+	if _, err := svc.checkAccountThrottle(ctx, user.Email); errors.As(err, &throttled) {
+		httphelper.WriteTooManyRequests(w, "too many failed codes, try again later", throttled.RetryAfter)
+		return nil, false
+	}
+
+	if err := svc.checkMFACode(ctx, user, payload.Code); err != nil {
+		if errors.Is(err, ErrInvalidMFACode) {
+			svc.failAccountLogin(ctx, user.Email, &user.ID, svc.clientIP(r))
+			writeInvalidMFACode(w)
+			return nil, false
+		}
+		httphelper.WriteInternalError(w, r, err)
+		return nil, false
+	}
+
+	return user, true
+}
+
+// checkMFACode accepts a TOTP code of user, or one of their recovery codes.
+// Either is spent on success, so it cannot be replayed.
+func (svc *UserService) checkMFACode(ctx context.Context, user *UserEntity, code string) error {
+	if !user.TOTPEnabled() {
+		return ErrInvalidMFACode
+	}
+
+	code = normalizeMFACode(code)
+
+	if len(code) != totp.Digits {
+		if err := svc.Repo.UseRecoveryCode(ctx, user.ID, hashToken(code)); err != nil {
+			return err
+		}
+
+		svc.record(ctx, audit.Event{
+			Action: audit.ActionRecoveryCodeUsed,
+			UserID: &user.ID,
+		})
+		return nil
+	}
+
+	secret, err := svc.openTOTPSecret(*user.TOTPSecret)
+	if err != nil {
+		return err
+	}
+
+	after := int64(-1)
+	if user.TOTPLastStep != nil {
+		after = *user.TOTPLastStep
+	}
+
+	step, ok := totp.Validate(secret, code, time.Now(), after)
+	if !ok {
+		return ErrInvalidMFACode
+	}
+
+	return svc.Repo.AdvanceTOTPStep(ctx, user.ID, step)
+}
+
+// generateMFAChallenge issues the token proving user entered their password
+// at authTime, to be exchanged at /users/login/mfa within MFA_CHALLENGE_TTL.
+func (svc *UserService) generateMFAChallenge(user *UserEntity, authTime time.Time) (string, error) {
+	now := user.tokenIssueTime()
+	claims := jwt.MapClaims{
+		"sub":       user.ID,
+		"purpose":   mfaChallengePurpose,
+		"iat":       numericDate(now),
+		"auth_time": authTime.Unix(),
+		"exp":       now.Add(svc.Config.MfaChallengeTTL).Unix(),
+	}
+
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).
+		SignedString([]byte(svc.Config.JwtSecret))
+}
+
+// parseMFAChallenge returns the user a challenge token was issued to, when it
+// was issued and when the user entered their password.
+func (svc *UserService) parseMFAChallenge(
+	tokenStr string,
+) (string, time.Time, time.Time, error) {
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(
+		tokenStr,
+		claims,
+		func(token *jwt.Token) (interface{}, error) {
+			return []byte(svc.Config.JwtSecret), nil
+		},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+	)
+	if err != nil || !token.Valid || claims["purpose"] != mfaChallengePurpose {
+		return "", time.Time{}, time.Time{}, ErrInvalidMFAChallenge
+	}
+
+	userID, err := claims.GetSubject()
+	if err != nil || userID == "" {
+		return "", time.Time{}, time.Time{}, ErrInvalidMFAChallenge
+	}
+
+	issuedAt := tokenIssuedAt(claims)
+
+	return userID, issuedAt, authTime(claims, issuedAt), nil
+}
+
+// mfaKey derives the key sealing TOTP secrets at rest from JWT_SECRET.
+func (svc *UserService) mfaKey() []byte {
+	mac := hmac.New(sha256.New, []byte(svc.Config.JwtSecret))
+	mac.Write([]byte("totp"))
+	return mac.Sum(nil)
+}
+
+// sealTOTPSecret encrypts secret with AES-GCM, so a database leak alone does
+// not let anyone generate codes.
+func (svc *UserService) sealTOTPSecret(secret []byte) (string, error) {
+	gcm, err := newGCM(svc.mfaKey())
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, secret, nil)
+	return base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+func (svc *UserService) openTOTPSecret(sealed string) ([]byte, error) {
+	raw, err := base64.RawStdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("openTOTPSecret: %w", err)
+	}
+
+	gcm, err := newGCM(svc.mfaKey())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(raw) < gcm.NonceSize() {
+		return nil, errors.New("openTOTPSecret: sealed secret too short")
+	}
+
+	nonce, ciphertext := raw[:gcm.NonceSize()], raw[gcm.NonceSize():]
+	secret, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("openTOTPSecret: %w", err)
+	}
+
+	return secret, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// newRecoveryCodes returns recovery codes to show the user once, formatted
+// as xxxx-xxxx, and their hashes to store.
+func newRecoveryCodes() (codes []string, hashes []string, err error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+
+	for range recoveryCodeCount {
+		raw, err := generateRandomBytes(recoveryCodeBytes)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(encoding.EncodeToString(raw))
+		codes = append(codes, code[:4]+"-"+code[4:])
+		hashes = append(hashes, hashToken(code))
+	}
+
+	return codes, hashes, nil
+}
+
+// normalizeMFACode drops the separators people type or paste along with
+// codes, so "123 456" and "ABCD-EFGH" are accepted.
+func normalizeMFACode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(code))
+}
+
+func parseMFACode(w http.ResponseWriter, r *http.Request) (MFACodePayload, bool) {
+	var payload MFACodePayload
+	if err := httphelper.ParseJSON(r, &payload); err != nil {
+		httphelper.WriteProblem(w, httphelper.BadRequest(err.Error()))
+		return payload, false
+	}
+
+	if err := httphelper.Validate.Struct(payload); err != nil {
+		httphelper.WriteProblem(w, httphelper.ValidationFailed(err))
+		return payload, false
+	}
+
+	return payload, true
+}
+
+func writeInvalidMFAChallenge(w http.ResponseWriter) {
+	httphelper.WriteProblem(w, httphelper.NewProblem(
+		http.StatusUnauthorized,
+		"invalid_mfa_token",
+		ErrInvalidMFAChallenge.Error(),
+	))
+}
+
+func writeInvalidMFACode(w http.ResponseWriter) {
+	httphelper.WriteProblem(w, httphelper.NewProblem(
+		http.StatusUnauthorized,
+		"invalid_mfa_code",
+		ErrInvalidMFACode.Error(),
+	))
+}
@@ -0,0 +1,289 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diegodario88/sesamo/audit"
+	"github.com/diegodario88/sesamo/config"
+	"github.com/diegodario88/sesamo/password"
+	"github.com/diegodario88/sesamo/throttle"
+	"github.com/diegodario88/sesamo/totp"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+type MFATestSuite struct {
+	suite.Suite
+	repo   *MockUserRepository
+	audit  *recordingAudit
+	svc    UserService
+	secret []byte
+	user   *UserEntity
+}
+
+func TestMFATestSuite(t *testing.T) {
+	suite.Run(t, new(MFATestSuite))
+}
+
+func (suite *MFATestSuite) SetupTest() {
+	suite.repo = new(MockUserRepository)
+	suite.repo.On("IsTokenRevoked", mock.Anything).Return(false, nil).Maybe()
+	suite.repo.
+		On("FindLoginFailures", mock.Anything).
+		Return((*LoginFailures)(nil), sql.ErrNoRows).
+		Maybe()
+	suite.audit = &recordingAudit{}
+	suite.svc = UserService{
+		Repo: suite.repo,
+		Config: &config.Config{
+			JwtSecret:              "0123456789abcdef",
+			JwtExpirationInSeconds: 3600,
+			MfaIssuer:              "Sesamo",
+			MfaChallengeTTL:        5 * time.Minute,
+		},
+		Throttle: &LoginThrottle{
+			Account: throttle.Policy{DelayAfter: 3, LockAfter: 10, LockFor: 15 * time.Minute},
+			IPs:     throttle.NewTracker(throttle.Policy{LockAfter: 100, LockFor: time.Hour}),
+		},
+		Audit: suite.audit,
+	}
+
+	secret, err := totp.NewSecret()
+	suite.Require().NoError(err)
+	sealed, err := suite.svc.sealTOTPSecret(secret)
+	suite.Require().NoError(err)
+	hash, err := password.Hash("Correct-Horse-42", password.DefaultParams)
+	suite.Require().NoError(err)
+
+	enabledAt := time.Now().Add(-time.Hour)
+	suite.secret = secret
+	suite.user = &UserEntity{
+		ID:            targetID,
+		Email:         "ana@example.com",
+		Status:        StatusActive,
+		PasswordHash:  &hash,
+		TOTPSecret:    &sealed,
+		TOTPEnabledAt: &enabledAt,
+	}
+}
+
+func (suite *MFATestSuite) post(
+	ctx context.Context,
+	handler http.HandlerFunc,
+	body string,
+) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	request.RemoteAddr = testIP + ":40000"
+	recorder := httptest.NewRecorder()
+
+	handler(recorder, request.WithContext(ctx))
+
+	return recorder
+}
+
+// challenge signs in with the password and returns the MFA token handed out.
+func (suite *MFATestSuite) challenge() string {
+	suite.repo.On("FindUserByEmail", suite.user.Email).Return(suite.user, nil).Once()
+	suite.repo.
+		On("FindWebAuthnCredentials", suite.user.ID).
+		Return([]WebAuthnCredential{}, nil).
+		Once()
+
+	recorder := suite.post(
+		context.Background(),
+		suite.svc.Login,
+		`{"email":"ana@example.com","password":"Correct-Horse-42"}`,
+	)
+	suite.Require().Equal(http.StatusOK, recorder.Code)
+
+	var body struct {
+		MFARequired bool   `json:"mfa_required"`
+		MFAToken    string `json:"mfa_token"`
+		Token       string `json:"token"`
+	}
+	suite.Require().NoError(json.Unmarshal(recorder.Body.Bytes(), &body))
+	suite.True(body.MFARequired)
+	suite.Empty(body.Token)
+	return body.MFAToken
+}
+
+func (suite *MFATestSuite) loginMFA(mfaToken string, code string) *httptest.ResponseRecorder {
+	suite.repo.On("FindUserById", suite.user.ID).Return(suite.user, nil).Once()
+
+	return suite.post(
+		context.Background(),
+		suite.svc.LoginMFA,
+		`{"mfaToken":"`+mfaToken+`","code":"`+code+`"}`,
+	)
+}
+
+func (suite *MFATestSuite) TestLoginWithTOTPCode() {
+	step := totp.Step(time.Now())
+	suite.repo.On("AdvanceTOTPStep", suite.user.ID, step).Return(nil).Once()
+	suite.repo.On("GetRoles", suite.user.ID).Return([]string{"super_admin"}, nil)
+
+	recorder := suite.loginMFA(suite.challenge(), totp.Code(suite.secret, step))
+
+	suite.Equal(http.StatusOK, recorder.Code)
+	suite.Contains(recorder.Body.String(), `"token"`)
+	suite.repo.AssertExpectations(suite.T())
+}
+
+func (suite *MFATestSuite) TestLoginWithRecoveryCode() {
+	suite.repo.On("UseRecoveryCode", suite.user.ID, hashToken("abcdefgh")).Return(nil).Once()
+	suite.repo.On("GetRoles", suite.user.ID).Return([]string{}, nil)
+
+	recorder := suite.loginMFA(suite.challenge(), "ABCD-EFGH")
+
+	suite.Equal(http.StatusOK, recorder.Code)
+	suite.Require().Len(suite.audit.events, 1)
+	suite.Equal(audit.ActionRecoveryCodeUsed, suite.audit.events[0].Action)
+}
+
+func (suite *MFATestSuite) TestWrongCodeCountsAsFailedLogin() {
+	suite.repo.On("RecordFailedLogin", loginKey(suite.user.Email), 15*time.Minute).Return(1, nil).Once()
+	code := totp.Code(suite.secret, totp.Step(time.Now())+5)
+
+	recorder := suite.loginMFA(suite.challenge(), code)
+
+	suite.Equal(http.StatusUnauthorized, recorder.Code)
+	suite.Contains(recorder.Body.String(), "invalid_mfa_code")
+	suite.repo.AssertExpectations(suite.T())
+}
+
+func (suite *MFATestSuite) TestReplayedCodeIsRejected() {
+	step := totp.Step(time.Now())
+	suite.user.TOTPLastStep = &step
+	suite.repo.On("RecordFailedLogin", loginKey(suite.user.Email), 15*time.Minute).Return(1, nil).Once()
+
+	recorder := suite.loginMFA(suite.challenge(), totp.Code(suite.secret, step))
+
+	suite.Equal(http.StatusUnauthorized, recorder.Code)
+	suite.repo.AssertNotCalled(suite.T(), "AdvanceTOTPStep", mock.Anything, mock.Anything)
+}
+
+func (suite *MFATestSuite) TestAccessTokenIsNoChallenge() {
+	suite.repo.On("GetRoles", suite.user.ID).Return([]string{}, nil)
+	token, err := suite.svc.GenerateUserToken(context.Background(), suite.user)
+	suite.Require().NoError(err)
+
+	recorder := suite.post(
+		context.Background(),
+		suite.svc.LoginMFA,
+		`{"mfaToken":"`+token+`","code":"123456"}`,
+	)
+
+	suite.Equal(http.StatusUnauthorized, recorder.Code)
+	suite.Contains(recorder.Body.String(), "invalid_mfa_token")
+}
+
+func (suite *MFATestSuite) TestChallengeIsNoAccessToken() {
+	mfaToken := suite.challenge()
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	request := httptest.NewRequest(http.MethodGet, "/users/me", nil)
+	request.Header.Set("Authorization", "Bearer "+mfaToken)
+	recorder := httptest.NewRecorder()
+
+	NewHandler(suite.svc).AuthMiddleware(next).ServeHTTP(recorder, request)
+
+	suite.Equal(http.StatusUnauthorized, recorder.Code)
+}
+
+func (suite *MFATestSuite) TestConfirmTOTPEnablesIt() {
+	suite.user.TOTPEnabledAt = nil
+	step := totp.Step(time.Now())
+	suite.repo.On("FindUserById", suite.user.ID).Return(suite.user, nil).Once()
+	suite.repo.
+		On("EnableTOTP", suite.user.ID, step, mock.AnythingOfType("[]string")).
+		Return(nil).
+		Once()
+	suite.repo.On("GetRoles", suite.user.ID).Return([]string{}, nil)
+	ctx := context.WithValue(context.Background(), UserIDKey, suite.user.ID)
+
+	recorder := suite.post(
+		ctx,
+		suite.svc.ConfirmTOTP,
+		`{"code":"`+totp.Code(suite.secret, step)+`"}`,
+	)
+
+	suite.Require().Equal(http.StatusOK, recorder.Code)
+	var body struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+		Token         string   `json:"token"`
+	}
+	suite.Require().NoError(json.Unmarshal(recorder.Body.Bytes(), &body))
+	suite.Len(body.RecoveryCodes, recoveryCodeCount)
+	suite.NotEmpty(body.Token)
+	hashes := suite.repo.Calls[1].Arguments.Get(2).([]string)
+	suite.Equal(hashToken(normalizeMFACode(body.RecoveryCodes[0])), hashes[0])
+}
+
+func (suite *MFATestSuite) TestRequiredMFACannotBeDisabled() {
+	step := totp.Step(time.Now())
+	suite.repo.On("FindUserById", suite.user.ID).Return(suite.user, nil).Once()
+	suite.repo.On("AdvanceTOTPStep", suite.user.ID, step).Return(nil).Once()
+	suite.repo.
+		On("FindWebAuthnCredentials", suite.user.ID).
+		Return([]WebAuthnCredential{}, nil).
+		Once()
+	suite.repo.On("RequiresMFA", suite.user.ID).Return(true, nil).Once()
+	ctx := context.WithValue(context.Background(), UserIDKey, suite.user.ID)
+
+	recorder := suite.post(
+		ctx,
+		suite.svc.DisableTOTP,
+		`{"code":"`+totp.Code(suite.secret, step)+`"}`,
+	)
+
+	suite.Equal(http.StatusForbidden, recorder.Code)
+	suite.repo.AssertNotCalled(suite.T(), "DisableTOTP", mock.Anything)
+}
+
+func (suite *MFATestSuite) TestEnrollmentIsRequiredBeforeAnyPermission() {
+	suite.user.TOTPSecret = nil
+	suite.user.TOTPEnabledAt = nil
+	suite.repo.On("GetRoles", suite.user.ID).Return([]string{"super_admin"}, nil).Once()
+	suite.repo.On("RequiresMFA", suite.user.ID).Return(true, nil).Once()
+	suite.repo.
+		On("FindWebAuthnCredentials", suite.user.ID).
+		Return([]WebAuthnCredential{}, nil).
+		Once()
+	token, err := suite.svc.GenerateUserToken(context.Background(), suite.user)
+	suite.Require().NoError(err)
+
+	suite.repo.On("FindUserById", suite.user.ID).Return(suite.user, nil).Once()
+	handler := NewHandler(suite.svc)
+	protected := handler.AuthMiddleware(RBACMiddleware(handler, "users:read")(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}),
+	))
+	request := httptest.NewRequest(http.MethodGet, "/users", nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	recorder := httptest.NewRecorder()
+
+	protected.ServeHTTP(recorder, request)
+
+	suite.Equal(http.StatusForbidden, recorder.Code)
+	suite.Contains(recorder.Body.String(), "mfa_enrollment_required")
+	suite.repo.AssertNotCalled(suite.T(), "HasAccess", mock.Anything, mock.Anything)
+}
+
+func (suite *MFATestSuite) TestSealedSecretsOpenOnlyWithTheKey() {
+	opened, err := suite.svc.openTOTPSecret(*suite.user.TOTPSecret)
+	suite.Require().NoError(err)
+	suite.Equal(suite.secret, opened)
+
+	other := UserService{Config: &config.Config{JwtSecret: "fedcba9876543210"}}
+	_, err = other.openTOTPSecret(*suite.user.TOTPSecret)
+	suite.Error(err)
+}
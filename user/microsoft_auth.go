@@ -4,13 +4,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sync"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 	"golang.org/x/oauth2"
 )
 
 var (
-	ErrMicrosoftAuthFailed = errors.New("microsoft authentication failed")
+	ErrMicrosoftAuthFailed   = errors.New("microsoft authentication failed")
+	ErrMicrosoftAuthDisabled = errors.New("microsoft sign-in is not configured")
 )
 
 type MicrosoftAuthConfig struct {
@@ -26,14 +28,15 @@ type MicrosoftUserInfo struct {
 	FamilyName string `json:"family_name"`
 }
 
-func SetupMicrosoftAuth(msConfig MicrosoftAuthConfig) (*oauth2.Config, *oidc.Provider) {
-	ctx := context.Background()
-
+func SetupMicrosoftAuth(
+	ctx context.Context,
+	msConfig MicrosoftAuthConfig,
+) (*oauth2.Config, *oidc.Provider, error) {
 	// Microsoft endpoints for your tenant
 	providerURL := fmt.Sprintf("https://login.microsoftonline.com/%s/v2.0", msConfig.TenantID)
 	provider, err := oidc.NewProvider(ctx, providerURL)
 	if err != nil {
-		panic(fmt.Sprintf("Failed to create OIDC provider: %v", err))
+		return nil, nil, fmt.Errorf("failed to create OIDC provider: %w", err)
 	}
 
 	// Configure OAuth2
@@ -45,7 +48,7 @@ func SetupMicrosoftAuth(msConfig MicrosoftAuthConfig) (*oauth2.Config, *oidc.Pro
 		Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
 	}
 
-	return oauth2Config, provider
+	return oauth2Config, provider, nil
 }
 
 // ProcessMicrosoftCallback handles the OAuth2 callback and retrieves user information
@@ -82,3 +85,79 @@ func ProcessMicrosoftCallback(
 
 	return &claims, nil
 }
+
+// MicrosoftSignIn is the upstream identity provider users may sign in to
+// sesamo with.
+type MicrosoftSignIn interface {
+	AuthCodeURL(ctx context.Context, state string) (string, error)
+	Exchange(ctx context.Context, code string) (*MicrosoftUserInfo, error)
+}
+
+// MicrosoftFederation signs users in to sesamo through Microsoft. The tenant
+// metadata is only fetched on first use, and again after a failure, so
+// sesamo starts while Microsoft is unreachable.
+type MicrosoftFederation struct {
+	config MicrosoftAuthConfig
+
+	mu           sync.Mutex
+	oauth2Config *oauth2.Config
+	provider     *oidc.Provider
+}
+
+// NewMicrosoftFederation returns nil when Microsoft sign-in is not
+// configured.
+func NewMicrosoftFederation(msConfig MicrosoftAuthConfig) *MicrosoftFederation {
+	if msConfig.TenantID == "" || msConfig.ClientID == "" {
+		return nil
+	}
+
+	return &MicrosoftFederation{config: msConfig}
+}
+
+func (federation *MicrosoftFederation) setup(
+	ctx context.Context,
+) (*oauth2.Config, *oidc.Provider, error) {
+	if federation == nil {
+		return nil, nil, ErrMicrosoftAuthDisabled
+	}
+
+	federation.mu.Lock()
+	defer federation.mu.Unlock()
+
+	if federation.provider == nil {
+		oauth2Config, provider, err := SetupMicrosoftAuth(ctx, federation.config)
+		if err != nil {
+			return nil, nil, err
+		}
+		federation.oauth2Config, federation.provider = oauth2Config, provider
+	}
+
+	return federation.oauth2Config, federation.provider, nil
+}
+
+// AuthCodeURL is where to send the browser to sign in with Microsoft.
+func (federation *MicrosoftFederation) AuthCodeURL(
+	ctx context.Context,
+	state string,
+) (string, error) {
+	oauth2Config, _, err := federation.setup(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return oauth2Config.AuthCodeURL(state), nil
+}
+
+// Exchange redeems the code Microsoft redirected back with for the user's
+// claims.
+func (federation *MicrosoftFederation) Exchange(
+	ctx context.Context,
+	code string,
+) (*MicrosoftUserInfo, error) {
+	oauth2Config, provider, err := federation.setup(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return ProcessMicrosoftCallback(ctx, oauth2Config, provider, code)
+}
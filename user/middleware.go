@@ -2,125 +2,287 @@ package user
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
 	"strings"
+	"time"
 
-	"github.com/diegodario88/sesamo/config"
+	"github.com/diegodario88/sesamo/httphelper"
+	"github.com/diegodario88/sesamo/logging"
+	"github.com/diegodario88/sesamo/metrics"
+	"github.com/diegodario88/sesamo/tracing"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ContextKey string
 
 type Checker interface {
-	HasAccess(userID string, permission string) (bool, error)
+	HasAccess(ctx context.Context, userID string, permission string) (bool, error)
 }
 
 const (
 	UserIDKey    ContextKey = "userID"
 	UserRolesKey ContextKey = "userRoles"
+	// UnverifiedKey marks requests made with a reduced token, which no
+	// permission check grants.
+	UnverifiedKey ContextKey = "unverified"
+	// AuthTimeKey holds when the caller last signed in, as a time.Time.
+	AuthTimeKey ContextKey = "authTime"
+	// MFAEnrollmentKey marks requests made with a reduced token of a user
+	// who must enroll in MFA before any permission check grants.
+	MFAEnrollmentKey ContextKey = "mfaEnrollment"
+	// AccessTokenKey holds the *PersonalAccessToken of requests made with one.
+	AccessTokenKey ContextKey = "accessToken"
+	// OrganizationIDKey holds the organization of organization routes.
+	OrganizationIDKey ContextKey = "organizationID"
+	// ServiceAccountKey holds the *ServiceAccount of requests made with a
+	// token issued through the client credentials grant.
+	ServiceAccountKey ContextKey = "serviceAccount"
 )
 
-func AuthMiddleware(next http.Handler) http.Handler {
+func (h *Handler) AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracing.Tracer().Start(r.Context(), "AuthMiddleware")
+		defer span.End()
+
+		reject := func(message string) {
+			span.SetStatus(codes.Error, message)
+			httphelper.WriteProblem(w, httphelper.Unauthorized(message))
+		}
+
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
-			http.Error(w, "Authorization header required", http.StatusUnauthorized)
+			reject("Authorization header required")
 			return
 		}
 
 		headerParts := strings.Split(authHeader, " ")
 		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
-			http.Error(
-				w,
-				"Authorization header format must be Bearer {token}",
-				http.StatusUnauthorized,
-			)
+			reject("Authorization header format must be Bearer {token}")
 			return
 		}
 
-		tokenStr := headerParts[1]
-		claims := jwt.MapClaims{}
+		ctx, err := h.authenticateToken(ctx, h.clientIP(r), headerParts[1])
+		switch {
+		case errors.Is(err, ErrInvalidToken):
+			reject("Invalid or expired token")
+		case err != nil && rejectsToken(err):
+			reject(err.Error())
+		case err != nil:
+			span.RecordError(err)
+			httphelper.WriteInternalError(w, r, err)
+		default:
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}
+	})
+}
 
-		token, err := jwt.ParseWithClaims(
-			tokenStr,
-			claims,
-			func(token *jwt.Token) (interface{}, error) {
-				if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-					return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-				}
+// authenticateToken resolves the bearer token of a request from ip into the
+// request context AuthMiddleware hands on: a user's access token, a personal
+// access token or the token of a service account.
+func (svc *UserService) authenticateToken(
+	ctx context.Context,
+	ip string,
+	tokenStr string,
+) (context.Context, error) {
+	if strings.HasPrefix(tokenStr, accessTokenPrefix) {
+		return svc.authenticateAccessToken(ctx, ip, tokenStr)
+	}
 
-				return []byte(config.Variables.JwtSecret), nil
-			},
-		)
+	claims := jwt.MapClaims{}
 
-		if err != nil || !token.Valid {
-			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
-			return
-		}
+	token, err := jwt.ParseWithClaims(
+		tokenStr,
+		claims,
+		func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			}
 
-		userID, ok := claims["userID"].(string)
-		if !ok {
-			http.Error(w, "Invalid user ID in token", http.StatusUnauthorized)
-			return
-		}
+			return []byte(svc.Config.JwtSecret), nil
+		},
+	)
 
-		ctx := context.WithValue(r.Context(), UserIDKey, userID)
+	if err != nil || !token.Valid {
+		return ctx, ErrInvalidToken
+	}
 
-		if roles, ok := claims["roles"].([]interface{}); ok {
-			roleStrings := make([]string, len(roles))
-			for i, role := range roles {
-				roleStrings[i] = role.(string)
-			}
-			ctx = context.WithValue(ctx, UserRolesKey, roleStrings)
+	// Challenge tokens only redeem at the endpoint they were issued for.
+	if _, ok := claims["purpose"]; ok {
+		return ctx, ErrInvalidToken
+	}
+
+	if err := svc.checkNotRevoked(ctx, tokenStr); err != nil {
+		return ctx, err
+	}
+
+	if _, ok := claims["client_id"]; ok {
+		return svc.authenticateServiceAccount(ctx, claims)
+	}
+
+	userID, ok := claims["userID"].(string)
+	if !ok {
+		return ctx, ErrInvalidToken
+	}
+
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("enduser.id", userID))
+
+	user, err := svc.Repo.FindUserById(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ctx, ErrUserNotFound
+	}
+	if err != nil {
+		return ctx, err
+	}
+
+	if err := svc.checkCanSignIn(user); err != nil {
+		return ctx, err
+	}
+
+	issuedAt := tokenIssuedAt(claims)
+	if err := user.CheckTokenIssuedAt(issuedAt); err != nil {
+		return ctx, err
+	}
+
+	ctx = context.WithValue(ctx, UserIDKey, userID)
+	ctx = context.WithValue(ctx, UnverifiedKey, user.Status == StatusPendingVerification)
+	ctx = context.WithValue(ctx, AuthTimeKey, authTime(claims, issuedAt))
+	ctx = context.WithValue(
+		ctx,
+		MFAEnrollmentKey,
+		claims["mfa_enrollment_required"] == true && !user.TOTPEnabled(),
+	)
+	ctx = logging.SetUserID(ctx, userID)
+
+	if roles, ok := claims["roles"].([]interface{}); ok {
+		roleStrings := make([]string, len(roles))
+		for i, role := range roles {
+			roleStrings[i], _ = role.(string)
 		}
+		ctx = context.WithValue(ctx, UserRolesKey, roleStrings)
+	}
 
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+	return ctx, nil
 }
 
 func RBACMiddleware(svc Checker, permission string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			userID, ok := r.Context().Value(UserIDKey).(string)
-			if !ok {
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			ctx, span := tracing.Tracer().Start(
+				r.Context(),
+				"RBACMiddleware",
+				trace.WithAttributes(attribute.String("sesamo.permission", permission)),
+			)
+			defer span.End()
+
+			if _, ok := ctx.Value(UserIDKey).(string); !ok {
+				span.SetStatus(codes.Error, "missing user")
+				httphelper.WriteProblem(w, httphelper.Unauthorized("authentication required"))
 				return
 			}
 
-			hasAccess, err := svc.HasAccess(userID, permission)
+			problem, err := checkPermission(ctx, svc, permission)
 			if err != nil {
-				http.Error(w, "Server error checking permissions", http.StatusInternalServerError)
+				httphelper.WriteInternalError(w, r, err)
 				return
 			}
-
-			if !hasAccess {
-				http.Error(w, "Permission denied", http.StatusForbidden)
+			if problem != nil {
+				httphelper.WriteProblem(w, problem)
 				return
 			}
 
-			next.ServeHTTP(w, r)
+			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
 
+// checkPermission decides whether the caller authenticated in ctx holds
+// permission, returning the problem to answer when they do not.
+func checkPermission(
+	ctx context.Context,
+	svc Checker,
+	permission string,
+) (*httphelper.Problem, error) {
+	span := trace.SpanFromContext(ctx)
+	deny := func(problem *httphelper.Problem) (*httphelper.Problem, error) {
+		metrics.PermissionChecks.WithLabelValues(permission, metrics.ResultDenied).Inc()
+		span.SetAttributes(attribute.String("sesamo.permission.result", metrics.ResultDenied))
+		return problem, nil
+	}
+
+	if unverified, _ := ctx.Value(UnverifiedKey).(bool); unverified {
+		return deny(httphelper.NewProblem(
+			http.StatusForbidden,
+			"email_not_verified",
+			"verify your email address to use this endpoint",
+		))
+	}
+
+	if enrolling, _ := ctx.Value(MFAEnrollmentKey).(bool); enrolling {
+		return deny(httphelper.NewProblem(
+			http.StatusForbidden,
+			"mfa_enrollment_required",
+			"enroll in multi-factor authentication to use this endpoint",
+		))
+	}
+
+	hasAccess, err := svc.HasAccess(ctx, ctx.Value(UserIDKey).(string), permission)
+	if err != nil {
+		metrics.PermissionChecks.WithLabelValues(permission, metrics.ResultError).Inc()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "permission check failed")
+		return nil, err
+	}
+
+	if !hasAccess {
+		return deny(httphelper.NewProblem(
+			http.StatusForbidden,
+			"permission_denied",
+			fmt.Sprintf("missing permission %s", permission),
+		))
+	}
+
+	metrics.PermissionChecks.WithLabelValues(permission, metrics.ResultAllowed).Inc()
+	span.SetAttributes(attribute.String("sesamo.permission.result", metrics.ResultAllowed))
+
+	return nil, nil
+}
+
 func (h *Handler) OrganizationAccessMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		orgID := vars["orgId"]
-		userID := r.Context().Value(UserIDKey).(string)
+		ctx := r.Context()
 
-		orgs, err := h.Repo.GetUserOrganizations(userID)
-		if err != nil || !hasOrganization(orgs, orgID) {
-			http.Error(w, "Unauthorized access to organization", http.StatusForbidden)
+		if !h.canAccessOrganization(ctx, orgID) {
+			httphelper.WriteProblem(w, httphelper.Forbidden("no access to this organization"))
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, OrganizationIDKey, orgID)))
 	})
 }
 
+// canAccessOrganization is true when the caller authenticated in ctx is a
+// member of orgID, through a personal access token not limited to another
+// organization if they used one.
+func (svc *UserService) canAccessOrganization(ctx context.Context, orgID string) bool {
+	token, ok := ctx.Value(AccessTokenKey).(*PersonalAccessToken)
+	if ok && token.OrganizationID != nil && *token.OrganizationID != orgID {
+		return false
+	}
+
+	orgs, err := svc.Repo.GetUserOrganizations(ctx, ctx.Value(UserIDKey).(string))
+	return err == nil && hasOrganization(orgs, orgID)
+}
+
 func (h *Handler) BranchAccessMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
@@ -128,9 +290,9 @@ func (h *Handler) BranchAccessMiddleware(next http.Handler) http.Handler {
 		branchID := vars["branchId"]
 		userID := r.Context().Value(UserIDKey).(string)
 
-		branches, err := h.FindUserBranches(userID, orgID)
+		branches, err := h.FindUserBranches(r.Context(), userID, orgID)
 		if err != nil || !hasBranch(branches, branchID) {
-			http.Error(w, "Unauthorized access to branch", http.StatusForbidden)
+			httphelper.WriteProblem(w, httphelper.Forbidden("no access to this branch"))
 			return
 		}
 
@@ -138,6 +300,34 @@ func (h *Handler) BranchAccessMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// numericDate renders t for the iat claim. Unlike the other dates it keeps
+// microseconds, so a token issued just before a revocation is told apart from
+// one issued just after it.
+func numericDate(t time.Time) float64 {
+	return float64(t.UnixMicro()) / 1e6
+}
+
+// tokenIssuedAt reads the iat claim at the precision numericDate writes it.
+// Tokens lacking it read as issued at the zero time.
+func tokenIssuedAt(claims jwt.MapClaims) time.Time {
+	seconds, ok := claims["iat"].(float64)
+	if !ok {
+		return time.Time{}
+	}
+
+	return time.UnixMicro(int64(math.Round(seconds * 1e6)))
+}
+
+// authTime reads the auth_time claim, which tokens issued before it existed
+// lack; their issue time is the best estimate.
+func authTime(claims jwt.MapClaims, issuedAt time.Time) time.Time {
+	if seconds, ok := claims["auth_time"].(float64); ok {
+		return time.Unix(int64(seconds), 0)
+	}
+
+	return issuedAt
+}
+
 func hasOrganization(orgs []OrganizationEntity, orgID string) bool {
 	for _, org := range orgs {
 		if org.ID == orgID {
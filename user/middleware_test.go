@@ -0,0 +1,110 @@
+package user
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/diegodario88/sesamo/config"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+type MiddlewareTestSuite struct {
+	suite.Suite
+	repo    *MockUserRepository
+	handler *Handler
+}
+
+func TestMiddlewareTestSuite(t *testing.T) {
+	suite.Run(t, new(MiddlewareTestSuite))
+}
+
+func (suite *MiddlewareTestSuite) SetupTest() {
+	suite.repo = new(MockUserRepository)
+	suite.repo.On("IsTokenRevoked", mock.Anything).Return(false, nil).Maybe()
+	suite.handler = NewHandler(UserService{
+		Repo: suite.repo,
+		Config: &config.Config{
+			JwtSecret:              "0123456789abcdef",
+			JwtExpirationInSeconds: 3600,
+		},
+	})
+}
+
+// authenticate issues a token for user, then sends it through AuthMiddleware
+// with stored as the current state of the account.
+func (suite *MiddlewareTestSuite) authenticate(user *UserEntity, stored *UserEntity) int {
+	suite.repo.On("GetRoles", user.ID).Return([]string{}, nil).Once()
+	suite.repo.On("RequiresMFA", user.ID).Return(false, nil).Once()
+	token, err := suite.handler.GenerateUserToken(context.Background(), user)
+	suite.Require().NoError(err)
+
+	suite.repo.On("FindUserById", user.ID).Return(stored, nil).Once()
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	request := httptest.NewRequest(http.MethodGet, "/users/me", nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	recorder := httptest.NewRecorder()
+
+	suite.handler.AuthMiddleware(next).ServeHTTP(recorder, request)
+
+	return recorder.Code
+}
+
+func (suite *MiddlewareTestSuite) TestActiveUserPasses() {
+	user := &UserEntity{ID: targetID, Status: StatusActive}
+
+	suite.Equal(http.StatusNoContent, suite.authenticate(user, user))
+}
+
+func (suite *MiddlewareTestSuite) TestDisabledUserIsRejected() {
+	user := &UserEntity{ID: targetID, Status: StatusActive}
+	disabled := &UserEntity{ID: targetID, Status: StatusDisabled}
+
+	suite.Equal(http.StatusUnauthorized, suite.authenticate(user, disabled))
+}
+
+func (suite *MiddlewareTestSuite) TestRevokedTokenIsRejected() {
+	user := &UserEntity{ID: targetID, Status: StatusActive}
+	revokedAt := time.Now().Add(time.Minute)
+	revoked := &UserEntity{ID: targetID, Status: StatusActive, TokensValidAfter: &revokedAt}
+
+	suite.Equal(http.StatusUnauthorized, suite.authenticate(user, revoked))
+}
+
+func (suite *MiddlewareTestSuite) TestTokenIssuedJustAfterRevocationIsAccepted() {
+	user := &UserEntity{ID: targetID, Status: StatusActive}
+	revokedAt := time.Now()
+	revoked := &UserEntity{ID: targetID, Status: StatusActive, TokensValidAfter: &revokedAt}
+
+	suite.Equal(http.StatusNoContent, suite.authenticate(user, revoked))
+}
+
+func (suite *MiddlewareTestSuite) TestTokenIssuedJustBeforeRevocationIsRejected() {
+	user := &UserEntity{ID: targetID, Status: StatusActive}
+	revokedAt := time.Now().Add(time.Millisecond)
+	revoked := &UserEntity{ID: targetID, Status: StatusActive, TokensValidAfter: &revokedAt}
+
+	suite.Equal(http.StatusUnauthorized, suite.authenticate(user, revoked))
+}
+
+func (suite *MiddlewareTestSuite) TestTokenIssuedBeforePasswordChangeIsRejected() {
+	user := &UserEntity{ID: targetID, Status: StatusActive}
+	changedAt := time.Now().Add(time.Minute)
+	changed := &UserEntity{ID: targetID, Status: StatusActive, PasswordChangedAt: &changedAt}
+
+	suite.Equal(http.StatusUnauthorized, suite.authenticate(user, changed))
+}
+
+func (suite *MiddlewareTestSuite) TestTokenRevokedAtTheRevocationEndpointIsRejected() {
+	user := &UserEntity{ID: targetID, Status: StatusActive}
+	suite.repo.ExpectedCalls = nil
+	suite.repo.On("IsTokenRevoked", mock.Anything).Return(true, nil)
+
+	suite.Equal(http.StatusUnauthorized, suite.authenticate(user, user))
+}
@@ -0,0 +1,284 @@
+package user
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/diegodario88/sesamo/httphelper"
+	"github.com/diegodario88/sesamo/logging"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Clients authenticate with private_key_jwt by sending a JWT of this type,
+// which may be valid for at most clientAssertionMaxAge (RFC 7523).
+const (
+	clientAssertionType   = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	clientAssertionMaxAge = 5 * time.Minute
+)
+
+var ErrInvalidClient = errors.New("client authentication failed")
+
+// OAuthError is the error response of the OAuth endpoints (RFC 6749 5.2).
+type OAuthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (oauthErr *OAuthError) Error() string {
+	return oauthErr.Code + ": " + oauthErr.Description
+}
+
+// Token is the OAuth 2.0 token endpoint. It serves the client credentials
+// grant of service accounts and the authorization code grant of the
+// applications users sign in to.
+func (svc *UserService) Token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	switch grantType := r.PostForm.Get("grant_type"); grantType {
+	case "client_credentials":
+		svc.grantClientCredentials(w, r)
+	case "authorization_code":
+		svc.grantAuthorizationCode(w, r)
+	case "":
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "grant_type is required")
+	default:
+		writeOAuthError(
+			w,
+			http.StatusBadRequest,
+			"unsupported_grant_type",
+			fmt.Sprintf("grant type %s is not supported", grantType),
+		)
+	}
+}
+
+// grantClientCredentials issues service accounts an access token that
+// carries their roles.
+func (svc *UserService) grantClientCredentials(w http.ResponseWriter, r *http.Request) {
+	account, err := svc.authenticateClient(r)
+	if err != nil {
+		svc.writeClientError(w, r, err)
+		return
+	}
+
+	token, expiration, err := svc.generateServiceAccountToken(r.Context(), account)
+	if errors.Is(err, ErrServiceAccountDisabled) {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", err.Error())
+		return
+	}
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	httphelper.WriteJSON(w, http.StatusOK, map[string]any{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int(expiration.Seconds()),
+	})
+}
+
+// clientCredentials are what a client authenticates to the token endpoint
+// with: a secret, sent with HTTP Basic or in the form, a client assertion
+// signed with its private key, or nothing but its ID for public clients.
+type clientCredentials struct {
+	ClientID  string
+	Secret    string
+	Assertion string
+}
+
+// readClientCredentials reads the credentials of a client, which may use at
+// most one authentication method.
+func readClientCredentials(r *http.Request) (clientCredentials, error) {
+	basicID, basicSecret, hasBasic := r.BasicAuth()
+	credentials := clientCredentials{
+		ClientID:  r.PostForm.Get("client_id"),
+		Secret:    r.PostForm.Get("client_secret"),
+		Assertion: r.PostForm.Get("client_assertion"),
+	}
+
+	if credentials.Secret != "" && credentials.Assertion != "" {
+		return credentials, fmt.Errorf("%w: use one client authentication method", ErrInvalidClient)
+	}
+
+	if credentials.Assertion != "" &&
+		r.PostForm.Get("client_assertion_type") != clientAssertionType {
+		return credentials, fmt.Errorf("%w: unsupported client_assertion_type", ErrInvalidClient)
+	}
+
+	if hasBasic {
+		if credentials.Secret != "" || credentials.Assertion != "" {
+			return credentials, fmt.Errorf(
+				"%w: use one client authentication method",
+				ErrInvalidClient,
+			)
+		}
+
+		// RFC 6749 2.3.1 form-encodes the credentials before Basic encoding.
+		clientID, err := url.QueryUnescape(basicID)
+		if err != nil {
+			return credentials, ErrInvalidClient
+		}
+		secret, err := url.QueryUnescape(basicSecret)
+		if err != nil {
+			return credentials, ErrInvalidClient
+		}
+		if credentials.ClientID != "" && credentials.ClientID != clientID {
+			return credentials, ErrInvalidClient
+		}
+
+		credentials.ClientID, credentials.Secret = clientID, secret
+	}
+
+	return credentials, nil
+}
+
+// authenticateClient identifies the service account calling an OAuth
+// endpoint by its client secret or by a client assertion.
+func (svc *UserService) authenticateClient(r *http.Request) (*ServiceAccount, error) {
+	credentials, err := readClientCredentials(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case credentials.Assertion != "":
+		return svc.authenticateClientAssertion(
+			r.Context(),
+			credentials.ClientID,
+			credentials.Assertion,
+		)
+	case credentials.Secret != "":
+		return svc.authenticateClientSecret(r.Context(), credentials.ClientID, credentials.Secret)
+	default:
+		return nil, fmt.Errorf("%w: client credentials required", ErrInvalidClient)
+	}
+}
+
+func (svc *UserService) authenticateClientSecret(
+	ctx context.Context,
+	clientID string,
+	secret string,
+) (*ServiceAccount, error) {
+	account, err := svc.findClient(ctx, clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	if account.SecretHash == nil ||
+		subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(*account.SecretHash)) != 1 {
+		return nil, ErrInvalidClient
+	}
+
+	return account, nil
+}
+
+// authenticateClientAssertion verifies a private_key_jwt assertion: issued
+// and subject to the client, for this server, short-lived and never seen
+// before.
+func (svc *UserService) authenticateClientAssertion(
+	ctx context.Context,
+	clientID string,
+	assertion string,
+) (*ServiceAccount, error) {
+	unverified := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(assertion, unverified); err != nil {
+		return nil, ErrInvalidClient
+	}
+
+	subject, _ := unverified.GetSubject()
+	if subject == "" || (clientID != "" && clientID != subject) {
+		return nil, ErrInvalidClient
+	}
+
+	account, err := svc.findClient(ctx, subject)
+	if err != nil {
+		return nil, err
+	}
+
+	if account.PublicKey == nil {
+		return nil, ErrInvalidClient
+	}
+
+	key, err := parseClientPublicKey(*account.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("authenticateClientAssertion: %w", err)
+	}
+
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(
+		assertion,
+		claims,
+		func(token *jwt.Token) (interface{}, error) { return key, nil },
+		jwt.WithValidMethods(signingMethodsFor(key)),
+		jwt.WithIssuer(account.ClientID),
+		jwt.WithSubject(account.ClientID),
+		jwt.WithAudience(svc.Config.IssuerUrl, svc.Config.IssuerUrl+"/oauth/token"),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidClient, err)
+	}
+
+	expiresAt, _ := claims.GetExpirationTime()
+	if time.Until(expiresAt.Time) > clientAssertionMaxAge {
+		return nil, fmt.Errorf("%w: client assertion is valid for too long", ErrInvalidClient)
+	}
+
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return nil, fmt.Errorf("%w: client assertion has no jti", ErrInvalidClient)
+	}
+
+	if err := svc.Repo.UseClientAssertion(ctx, account.ClientID, jti, expiresAt.Time); err != nil {
+		return nil, err
+	}
+
+	return account, nil
+}
+
+func (svc *UserService) findClient(ctx context.Context, clientID string) (*ServiceAccount, error) {
+	if clientID == "" {
+		return nil, ErrInvalidClient
+	}
+
+	account, err := svc.Repo.FindServiceAccountByClientID(ctx, clientID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidClient
+	}
+	if err != nil {
+		return nil, fmt.Errorf("findClient: %w", err)
+	}
+
+	return account, nil
+}
+
+// writeClientError answers a failed client authentication, challenging
+// clients that tried HTTP Basic as RFC 6749 5.2 asks.
+func (svc *UserService) writeClientError(w http.ResponseWriter, r *http.Request, err error) {
+	if !errors.Is(err, ErrInvalidClient) {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	logging.FromContext(r.Context()).Info("Client authentication failed", "reason", err)
+	if strings.HasPrefix(r.Header.Get("Authorization"), "Basic ") {
+		w.Header().Set("WWW-Authenticate", `Basic realm="sesamo"`)
+	}
+	writeOAuthError(w, http.StatusUnauthorized, "invalid_client", ErrInvalidClient.Error())
+}
+
+func writeOAuthError(w http.ResponseWriter, status int, code string, description string) {
+	w.Header().Set("Cache-Control", "no-store")
+	httphelper.WriteJSON(w, status, OAuthError{Code: code, Description: description})
+}
@@ -0,0 +1,333 @@
+package user
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diegodario88/sesamo/config"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+const (
+	serviceAccountID = "01JQ000000000000000000000S"
+	testClientID     = "sa_test"
+	testIssuer       = "https://sesamo.example.com"
+)
+
+type OAuthTestSuite struct {
+	suite.Suite
+	repo    *MockUserRepository
+	handler *Handler
+	account *ServiceAccount
+	secret  string
+}
+
+func TestOAuthTestSuite(t *testing.T) {
+	suite.Run(t, new(OAuthTestSuite))
+}
+
+func (suite *OAuthTestSuite) SetupTest() {
+	suite.repo = new(MockUserRepository)
+	suite.repo.On("IsTokenRevoked", mock.Anything).Return(false, nil).Maybe()
+	suite.handler = NewHandler(UserService{
+		Repo: suite.repo,
+		Config: &config.Config{
+			JwtSecret:              "0123456789abcdef",
+			JwtExpirationInSeconds: 3600,
+			IssuerUrl:              testIssuer,
+		},
+		Audit: &recordingAudit{},
+	})
+
+	secret, hash, err := newClientSecret()
+	suite.Require().NoError(err)
+	suite.secret = secret
+	suite.account = &ServiceAccount{
+		ID:             serviceAccountID,
+		OrganizationID: memberOrgID,
+		Name:           "billing",
+		ClientID:       testClientID,
+		SecretHash:     &hash,
+	}
+}
+
+func (suite *OAuthTestSuite) token(
+	form url.Values,
+	setup func(r *http.Request),
+) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if setup != nil {
+		setup(request)
+	}
+	recorder := httptest.NewRecorder()
+
+	suite.handler.Token(recorder, request)
+
+	return recorder
+}
+
+// issue runs the client credentials grant with the client secret and returns
+// the access token.
+func (suite *OAuthTestSuite) issue() string {
+	suite.repo.On("FindServiceAccountByClientID", testClientID).Return(suite.account, nil).Once()
+	suite.repo.On("GetRoles", serviceAccountID).Return([]string{"org_admin"}, nil).Once()
+
+	recorder := suite.token(url.Values{"grant_type": {"client_credentials"}}, func(r *http.Request) {
+		r.SetBasicAuth(testClientID, suite.secret)
+	})
+	suite.Require().Equal(http.StatusOK, recorder.Code, recorder.Body.String())
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	suite.Require().NoError(json.Unmarshal(recorder.Body.Bytes(), &body))
+	suite.Equal("Bearer", body.TokenType)
+	suite.Equal(3600, body.ExpiresIn)
+	suite.Equal("no-store", recorder.Header().Get("Cache-Control"))
+	return body.AccessToken
+}
+
+// serve sends a request with token through AuthMiddleware to route, which
+// answers 204 once every other middleware let it through.
+func (suite *OAuthTestSuite) serve(
+	token string,
+	path string,
+	route func(router *mux.Router, ok http.Handler),
+) *httptest.ResponseRecorder {
+	router := mux.NewRouter()
+	router.Use(suite.handler.AuthMiddleware)
+	route(router, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	request := httptest.NewRequest(http.MethodGet, path, nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	recorder := httptest.NewRecorder()
+
+	router.ServeHTTP(recorder, request)
+
+	return recorder
+}
+
+// assertion returns the PEM public key of a new client key pair and a signer
+// of client assertions with the private key.
+func (suite *OAuthTestSuite) assertion() (string, func(claims jwt.MapClaims) string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	suite.Require().NoError(err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	suite.Require().NoError(err)
+	publicKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	return publicKey, func(claims jwt.MapClaims) string {
+		signed, err := jwt.NewWithClaims(jwt.SigningMethodES256, claims).SignedString(key)
+		suite.Require().NoError(err)
+		return signed
+	}
+}
+
+func (suite *OAuthTestSuite) assertionClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss": testClientID,
+		"sub": testClientID,
+		"aud": testIssuer + "/oauth/token",
+		"jti": "assertion-1",
+		"exp": time.Now().Add(time.Minute).Unix(),
+	}
+}
+
+func (suite *OAuthTestSuite) TestTokenCarriesTheRolesOfTheServiceAccount() {
+	token := suite.issue()
+
+	suite.repo.On("FindServiceAccountByClientID", testClientID).Return(suite.account, nil).Once()
+	suite.repo.On("HasAccess", serviceAccountID, "users:read").Return(true, nil).Once()
+
+	recorder := suite.serve(token, "/users", func(router *mux.Router, ok http.Handler) {
+		router.Handle("/users", RBACMiddleware(suite.handler, "users:read")(ok))
+	})
+
+	suite.Equal(http.StatusNoContent, recorder.Code)
+	suite.repo.AssertExpectations(suite.T())
+}
+
+func (suite *OAuthTestSuite) TestSecretInTheFormIsAccepted() {
+	suite.repo.On("FindServiceAccountByClientID", testClientID).Return(suite.account, nil).Once()
+	suite.repo.On("GetRoles", serviceAccountID).Return([]string{}, nil).Once()
+
+	recorder := suite.token(url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {testClientID},
+		"client_secret": {suite.secret},
+	}, nil)
+
+	suite.Equal(http.StatusOK, recorder.Code, recorder.Body.String())
+}
+
+func (suite *OAuthTestSuite) TestWrongSecretIsRejected() {
+	suite.repo.On("FindServiceAccountByClientID", testClientID).Return(suite.account, nil).Once()
+
+	recorder := suite.token(url.Values{"grant_type": {"client_credentials"}}, func(r *http.Request) {
+		r.SetBasicAuth(testClientID, clientSecretPrefix+"wrong")
+	})
+
+	suite.Equal(http.StatusUnauthorized, recorder.Code)
+	suite.Contains(recorder.Body.String(), `"error":"invalid_client"`)
+	suite.Equal(`Basic realm="sesamo"`, recorder.Header().Get("WWW-Authenticate"))
+	suite.repo.AssertNotCalled(suite.T(), "GetRoles", mock.Anything)
+}
+
+func (suite *OAuthTestSuite) TestUnsupportedGrantTypeIsRefused() {
+	recorder := suite.token(url.Values{"grant_type": {"password"}}, nil)
+
+	suite.Equal(http.StatusBadRequest, recorder.Code)
+	suite.Contains(recorder.Body.String(), `"error":"unsupported_grant_type"`)
+}
+
+func (suite *OAuthTestSuite) TestDisabledServiceAccountGetsNoToken() {
+	disabledAt := time.Now()
+	suite.account.DisabledAt = &disabledAt
+	suite.repo.On("FindServiceAccountByClientID", testClientID).Return(suite.account, nil).Once()
+
+	recorder := suite.token(url.Values{"grant_type": {"client_credentials"}}, func(r *http.Request) {
+		r.SetBasicAuth(testClientID, suite.secret)
+	})
+
+	suite.Equal(http.StatusUnauthorized, recorder.Code)
+	suite.Contains(recorder.Body.String(), "disabled")
+}
+
+func (suite *OAuthTestSuite) TestPrivateKeyJWTIsAccepted() {
+	publicKey, sign := suite.assertion()
+	suite.account.SecretHash = nil
+	suite.account.PublicKey = &publicKey
+	suite.repo.On("FindServiceAccountByClientID", testClientID).Return(suite.account, nil).Once()
+	suite.repo.
+		On("UseClientAssertion", testClientID, "assertion-1", mock.Anything).
+		Return(nil).
+		Once()
+	suite.repo.On("GetRoles", serviceAccountID).Return([]string{}, nil).Once()
+
+	recorder := suite.token(url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_assertion_type": {clientAssertionType},
+		"client_assertion":      {sign(suite.assertionClaims())},
+	}, nil)
+
+	suite.Equal(http.StatusOK, recorder.Code, recorder.Body.String())
+}
+
+func (suite *OAuthTestSuite) TestReplayedAssertionIsRejected() {
+	publicKey, sign := suite.assertion()
+	suite.account.PublicKey = &publicKey
+	suite.repo.On("FindServiceAccountByClientID", testClientID).Return(suite.account, nil).Once()
+	suite.repo.
+		On("UseClientAssertion", testClientID, "assertion-1", mock.Anything).
+		Return(ErrInvalidClient).
+		Once()
+
+	recorder := suite.token(url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_assertion_type": {clientAssertionType},
+		"client_assertion":      {sign(suite.assertionClaims())},
+	}, nil)
+
+	suite.Equal(http.StatusUnauthorized, recorder.Code)
+}
+
+func (suite *OAuthTestSuite) TestAssertionsThatDoNotFitAreRejected() {
+	publicKey, sign := suite.assertion()
+	_, signWithOtherKey := suite.assertion()
+	suite.account.PublicKey = &publicKey
+
+	cases := map[string]func(claims jwt.MapClaims) string{
+		"another audience": func(claims jwt.MapClaims) string {
+			claims["aud"] = "https://elsewhere.example.com"
+			return sign(claims)
+		},
+		"long lived": func(claims jwt.MapClaims) string {
+			claims["exp"] = time.Now().Add(time.Hour).Unix()
+			return sign(claims)
+		},
+		"no jti": func(claims jwt.MapClaims) string {
+			delete(claims, "jti")
+			return sign(claims)
+		},
+		"another key": signWithOtherKey,
+	}
+
+	for name, assertion := range cases {
+		suite.repo.
+			On("FindServiceAccountByClientID", testClientID).
+			Return(suite.account, nil).
+			Once()
+
+		recorder := suite.token(url.Values{
+			"grant_type":            {"client_credentials"},
+			"client_assertion_type": {clientAssertionType},
+			"client_assertion":      {assertion(suite.assertionClaims())},
+		}, nil)
+
+		suite.Equal(http.StatusUnauthorized, recorder.Code, name)
+	}
+	suite.repo.AssertNotCalled(
+		suite.T(),
+		"UseClientAssertion",
+		mock.Anything,
+		mock.Anything,
+		mock.Anything,
+	)
+}
+
+func (suite *OAuthTestSuite) TestTokenOfDisabledServiceAccountIsRejected() {
+	token := suite.issue()
+	disabledAt := time.Now()
+	disabled := *suite.account
+	disabled.DisabledAt = &disabledAt
+	suite.repo.On("FindServiceAccountByClientID", testClientID).Return(&disabled, nil).Once()
+
+	recorder := suite.serve(token, "/users", func(router *mux.Router, ok http.Handler) {
+		router.Handle("/users", ok)
+	})
+
+	suite.Equal(http.StatusUnauthorized, recorder.Code)
+}
+
+func (suite *OAuthTestSuite) TestTokenIssuedBeforeRotationIsRejected() {
+	token := suite.issue()
+	rotatedAt := time.Now().Add(time.Second)
+	rotated := *suite.account
+	rotated.TokensValidAfter = &rotatedAt
+	suite.repo.On("FindServiceAccountByClientID", testClientID).Return(&rotated, nil).Once()
+
+	recorder := suite.serve(token, "/users", func(router *mux.Router, ok http.Handler) {
+		router.Handle("/users", ok)
+	})
+
+	suite.Equal(http.StatusUnauthorized, recorder.Code)
+}
+
+func (suite *OAuthTestSuite) TestServiceAccountCannotUseSessionEndpoints() {
+	token := suite.issue()
+	suite.repo.On("FindServiceAccountByClientID", testClientID).Return(suite.account, nil).Once()
+
+	recorder := suite.serve(token, "/users/token/refresh", func(router *mux.Router, ok http.Handler) {
+		router.Handle("/users/token/refresh", suite.handler.sessionOnly(ok))
+	})
+
+	suite.Equal(http.StatusForbidden, recorder.Code)
+}
@@ -0,0 +1,310 @@
+package user
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/diegodario88/sesamo/httphelper"
+	"github.com/lib/pq"
+)
+
+// Client IDs of applications start with oauthClientPrefix, as those of
+// service accounts start with serviceAccountPrefix.
+const oauthClientPrefix = "app_"
+
+// PKCE code verifiers are 43 to 128 characters long (RFC 7636 4.1).
+const (
+	codeVerifierMinLength = 43
+	codeVerifierMaxLength = 128
+)
+
+var ErrInvalidRedirectURI = errors.New("redirect URIs must be absolute URLs without a fragment")
+
+// OAuthClient is an application users sign in to through sesamo. Public
+// clients, such as single-page and mobile apps, cannot keep a secret and
+// have none. First-party clients are trusted not to need the user's consent
+// and get access tokens of the sesamo API.
+type OAuthClient struct {
+	ID            string         `db:"id"             json:"id"`
+	ClientID      string         `db:"client_id"      json:"client_id"`
+	Name          string         `db:"name"           json:"name"`
+	SecretHash    *string        `db:"secret_hash"    json:"-"`
+	RedirectURIs  pq.StringArray `db:"redirect_uris"  json:"redirect_uris"`
+	FirstParty    bool           `db:"first_party"    json:"first_party"`
+	CanIntrospect bool           `db:"can_introspect" json:"can_introspect"`
+	CreatedAt     time.Time      `db:"created_at"     json:"created_at"`
+	UpdatedAt     time.Time      `db:"updated_at"     json:"updated_at"`
+}
+
+// Public is true for clients that authenticate with PKCE alone.
+func (client *OAuthClient) Public() bool {
+	return client.SecretHash == nil
+}
+
+// allowsRedirect is true when uri is registered for client. URIs are
+// compared exactly, as OAuth 2.0 Security BCP 4.1 asks.
+func (client *OAuthClient) allowsRedirect(uri string) bool {
+	return uri != "" && slices.Contains(client.RedirectURIs, uri)
+}
+
+// authorizationGrant is what a user authorized a client to do, stored with
+// the authorization code until the client redeems it.
+type authorizationGrant struct {
+	ClientID      string `json:"client_id"`
+	RedirectURI   string `json:"redirect_uri"`
+	Scope         string `json:"scope"`
+	Nonce         string `json:"nonce,omitempty"`
+	CodeChallenge string `json:"code_challenge"`
+	AuthTime      int64  `json:"auth_time"`
+}
+
+// CreateOAuthClient registers an application redirecting users back to
+// redirectURIs. Unless public, it authenticates with the returned secret,
+// which is not stored and cannot be shown again, and with canIntrospect it
+// may call the introspection endpoint.
+func (svc *UserService) CreateOAuthClient(
+	ctx context.Context,
+	name string,
+	redirectURIs []string,
+	public bool,
+	firstParty bool,
+	canIntrospect bool,
+) (*OAuthClient, string, error) {
+	if public && canIntrospect {
+		return nil, "", fmt.Errorf("%w: public clients cannot introspect tokens", ErrInvalidClient)
+	}
+	if len(redirectURIs) == 0 {
+		return nil, "", ErrInvalidRedirectURI
+	}
+	for _, uri := range redirectURIs {
+		if err := checkRedirectURI(uri); err != nil {
+			return nil, "", err
+		}
+	}
+
+	raw, err := generateRandomBytes(clientIDBytes)
+	if err != nil {
+		return nil, "", fmt.Errorf("CreateOAuthClient: %w", err)
+	}
+
+	client := &OAuthClient{
+		ClientID:      oauthClientPrefix + base64.RawURLEncoding.EncodeToString(raw),
+		Name:          name,
+		RedirectURIs:  redirectURIs,
+		FirstParty:    firstParty,
+		CanIntrospect: canIntrospect,
+	}
+
+	var secret string
+	if !public {
+		var hash string
+		secret, hash, err = newClientSecret()
+		if err != nil {
+			return nil, "", fmt.Errorf("CreateOAuthClient: %w", err)
+		}
+		client.SecretHash = &hash
+	}
+
+	created, err := svc.Repo.InsertOAuthClient(ctx, client)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return created, secret, nil
+}
+
+// RotateOAuthClientSecret replaces the secret of the client with clientID.
+func (svc *UserService) RotateOAuthClientSecret(
+	ctx context.Context,
+	clientID string,
+) (string, error) {
+	secret, hash, err := newClientSecret()
+	if err != nil {
+		return "", fmt.Errorf("RotateOAuthClientSecret: %w", err)
+	}
+
+	if err := svc.Repo.SetOAuthClientSecret(ctx, clientID, hash); err != nil {
+		return "", err
+	}
+
+	return secret, nil
+}
+
+func checkRedirectURI(uri string) error {
+	parsed, err := url.Parse(uri)
+	if err != nil || !parsed.IsAbs() || parsed.Fragment != "" || parsed.Opaque != "" {
+		return fmt.Errorf("%w: %s", ErrInvalidRedirectURI, uri)
+	}
+
+	return nil
+}
+
+// grantAuthorizationCode redeems the code a user's browser brought back from
+// Authorize for an ID token and an access token.
+func (svc *UserService) grantAuthorizationCode(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	client, err := svc.authenticateOAuthClient(r)
+	if err != nil {
+		svc.writeClientError(w, r, err)
+		return
+	}
+
+	code := r.PostForm.Get("code")
+	if code == "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "code is required")
+		return
+	}
+
+	token, err := svc.redeemToken(ctx, TokenPurposeOAuthCode, code)
+	if errors.Is(err, ErrInvalidToken) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", err.Error())
+		return
+	}
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	var grant authorizationGrant
+	if token.Data == nil || json.Unmarshal([]byte(*token.Data), &grant) != nil {
+		httphelper.WriteInternalError(w, r, fmt.Errorf("code %s has no grant", token.ID))
+		return
+	}
+
+	if grant.ClientID != client.ClientID || grant.RedirectURI != r.PostForm.Get("redirect_uri") {
+		writeOAuthError(
+			w,
+			http.StatusBadRequest,
+			"invalid_grant",
+			"code was issued to another client or redirect_uri",
+		)
+		return
+	}
+
+	if !verifyCodeChallenge(grant.CodeChallenge, r.PostForm.Get("code_verifier")) {
+		writeOAuthError(
+			w,
+			http.StatusBadRequest,
+			"invalid_grant",
+			"code_verifier does not match the code_challenge",
+		)
+		return
+	}
+
+	user, err := svc.findTokenUser(ctx, token.UserID)
+	if err == nil {
+		err = svc.checkCanSignIn(user)
+	}
+	if err != nil && rejectsToken(err) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", err.Error())
+		return
+	}
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	// First-party clients call the sesamo API on the user's behalf; others
+	// only learn who the user is.
+	var accessToken string
+	if client.FirstParty {
+		accessToken, err = svc.generateToken(ctx, user, time.Unix(grant.AuthTime, 0))
+	} else {
+		accessToken, err = svc.generateUserinfoToken(user, &grant)
+	}
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	idToken, err := svc.generateIDToken(user, &grant, accessToken)
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	httphelper.WriteJSON(w, http.StatusOK, map[string]any{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   svc.Config.JwtExpirationInSeconds,
+		"id_token":     idToken,
+		"scope":        grant.Scope,
+	})
+}
+
+// authenticateOAuthClient identifies the application calling the token
+// endpoint. Public clients send their client ID alone.
+func (svc *UserService) authenticateOAuthClient(r *http.Request) (*OAuthClient, error) {
+	credentials, err := readClientCredentials(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if credentials.Assertion != "" {
+		return nil, fmt.Errorf("%w: applications authenticate with a client secret", ErrInvalidClient)
+	}
+
+	client, err := svc.findOAuthClient(r.Context(), credentials.ClientID)
+	if err != nil {
+		return nil, err
+	}
+
+	if client.Public() {
+		if credentials.Secret != "" {
+			return nil, fmt.Errorf("%w: public clients have no secret", ErrInvalidClient)
+		}
+		return client, nil
+	}
+
+	if subtle.ConstantTimeCompare(
+		[]byte(hashToken(credentials.Secret)),
+		[]byte(*client.SecretHash),
+	) != 1 {
+		return nil, ErrInvalidClient
+	}
+
+	return client, nil
+}
+
+func (svc *UserService) findOAuthClient(
+	ctx context.Context,
+	clientID string,
+) (*OAuthClient, error) {
+	if clientID == "" {
+		return nil, ErrInvalidClient
+	}
+
+	client, err := svc.Repo.FindOAuthClient(ctx, clientID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidClient
+	}
+	if err != nil {
+		return nil, fmt.Errorf("findOAuthClient: %w", err)
+	}
+
+	return client, nil
+}
+
+// verifyCodeChallenge checks a PKCE code verifier against the S256 challenge
+// the authorization request carried.
+func verifyCodeChallenge(challenge string, verifier string) bool {
+	if len(verifier) < codeVerifierMinLength || len(verifier) > codeVerifierMaxLength {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
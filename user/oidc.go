@@ -0,0 +1,410 @@
+package user
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/diegodario88/sesamo/httphelper"
+	"github.com/diegodario88/sesamo/metrics"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Scopes OAuth clients may ask for. openid is required, profile and email
+// release the matching claims in the ID token and from userinfo.
+const (
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+)
+
+var supportedScopes = []string{ScopeOpenID, ScopeProfile, ScopeEmail}
+
+// userinfoPurpose marks the access tokens of third-party clients, which only
+// redeem at the userinfo endpoint.
+const userinfoPurpose = "userinfo"
+
+const signingKeyBits = 2048
+
+// SigningKey is the RSA key sesamo signs ID tokens with, published at the
+// JWKS endpoint so clients can verify them.
+type SigningKey struct {
+	once sync.Once
+	key  *rsa.PrivateKey
+	id   string
+	err  error
+}
+
+// NewSigningKey loads the key in OIDC_SIGNING_KEY_FILE. Without one, a key is
+// generated on first use; ID tokens it signed fail verification once sesamo
+// restarts, which only suits development.
+func NewSigningKey(path string) (*SigningKey, error) {
+	signingKey := &SigningKey{}
+	if path == "" {
+		return signingKey, nil
+	}
+
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("NewSigningKey: %w", err)
+	}
+
+	block, _ := pem.Decode(text)
+	if block == nil {
+		return nil, fmt.Errorf("NewSigningKey: %s holds no PEM block", path)
+	}
+
+	var key any
+	if key, err = x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("NewSigningKey: %w", err)
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("NewSigningKey: %s is not an RSA key", path)
+	}
+
+	signingKey.once.Do(func() { signingKey.set(rsaKey) })
+	return signingKey, nil
+}
+
+func (signingKey *SigningKey) load() (*rsa.PrivateKey, string, error) {
+	signingKey.once.Do(func() {
+		slog.Warn("OIDC_SIGNING_KEY_FILE is not set; signing ID tokens with a temporary key")
+		key, err := rsa.GenerateKey(rand.Reader, signingKeyBits)
+		if err != nil {
+			signingKey.err = err
+			return
+		}
+		signingKey.set(key)
+	})
+
+	return signingKey.key, signingKey.id, signingKey.err
+}
+
+// set stores key along with its RFC 7638 thumbprint, which serves as the key
+// ID.
+func (signingKey *SigningKey) set(key *rsa.PrivateKey) {
+	jwk := publicJWK(&key.PublicKey, "")
+	thumbprint, _ := json.Marshal(map[string]string{"e": jwk["e"], "kty": "RSA", "n": jwk["n"]})
+	sum := sha256.Sum256(thumbprint)
+
+	signingKey.key = key
+	signingKey.id = base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func publicJWK(key *rsa.PublicKey, id string) map[string]string {
+	jwk := map[string]string{
+		"kty": "RSA",
+		"use": "sig",
+		"alg": jwt.SigningMethodRS256.Alg(),
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+	if id != "" {
+		jwk["kid"] = id
+	}
+
+	return jwk
+}
+
+// ProviderMetadata is the OpenID Provider configuration document clients
+// discover sesamo's endpoints and capabilities from.
+type ProviderMetadata struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JwksURI                           string   `json:"jwks_uri"`
+	EndSessionEndpoint                string   `json:"end_session_endpoint"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	RevocationEndpoint                string   `json:"revocation_endpoint"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	ResponseModesSupported            []string `json:"response_modes_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	PromptValuesSupported             []string `json:"prompt_values_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+	AuthorizationResponseIssParameter bool     `json:"authorization_response_iss_parameter_supported"`
+}
+
+// OpenIDConfiguration serves /.well-known/openid-configuration.
+func (svc *UserService) OpenIDConfiguration(w http.ResponseWriter, r *http.Request) {
+	issuer := svc.issuer()
+
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	httphelper.WriteJSON(w, http.StatusOK, ProviderMetadata{
+		Issuer:                 issuer,
+		AuthorizationEndpoint:  issuer + "/oauth/authorize",
+		TokenEndpoint:          issuer + "/oauth/token",
+		UserinfoEndpoint:       issuer + "/oauth/userinfo",
+		JwksURI:                issuer + "/oauth/jwks",
+		EndSessionEndpoint:     issuer + "/oauth/logout",
+		IntrospectionEndpoint:  issuer + "/oauth/introspect",
+		RevocationEndpoint:     issuer + "/oauth/revoke",
+		ScopesSupported:        supportedScopes,
+		ResponseTypesSupported: []string{"code"},
+		ResponseModesSupported: []string{"query"},
+		GrantTypesSupported:    []string{"authorization_code", "client_credentials"},
+		SubjectTypesSupported:  []string{"public"},
+		IDTokenSigningAlgValuesSupported: []string{
+			jwt.SigningMethodRS256.Alg(),
+		},
+		TokenEndpointAuthMethodsSupported: []string{
+			"client_secret_basic",
+			"client_secret_post",
+			"private_key_jwt",
+			"none",
+		},
+		CodeChallengeMethodsSupported: []string{"S256"},
+		PromptValuesSupported:         []string{"none", "login", "consent"},
+		ClaimsSupported: []string{
+			"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "azp",
+			"name", "given_name", "family_name", "updated_at", "email", "email_verified",
+		},
+		AuthorizationResponseIssParameter: true,
+	})
+}
+
+// JWKS publishes the public key ID tokens are signed with.
+func (svc *UserService) JWKS(w http.ResponseWriter, r *http.Request) {
+	key, id, err := svc.SigningKey.load()
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	httphelper.WriteJSON(w, http.StatusOK, map[string]any{
+		"keys": []map[string]string{publicJWK(&key.PublicKey, id)},
+	})
+}
+
+// Userinfo returns the claims of the user an access token was issued to,
+// limited to the scopes granted to third-party clients.
+func (svc *UserService) Userinfo(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	tokenStr, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="sesamo"`)
+		httphelper.WriteProblem(w, httphelper.Unauthorized("Authorization header required"))
+		return
+	}
+
+	user, scope, err := svc.userinfoSubject(ctx, svc.clientIP(r), tokenStr)
+	if err != nil && rejectsToken(err) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="sesamo", error="invalid_token"`)
+		httphelper.WriteProblem(w, httphelper.Unauthorized("Invalid or expired token"))
+		return
+	}
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	httphelper.WriteJSON(w, http.StatusOK, userClaims(user, scope))
+}
+
+// userinfoSubject resolves the access token of a userinfo request into the
+// user it was issued to and the scopes it grants. Tokens of first-party
+// clients are ordinary access tokens, which grant every scope.
+func (svc *UserService) userinfoSubject(
+	ctx context.Context,
+	ip string,
+	tokenStr string,
+) (*UserEntity, []string, error) {
+	userID, scope, issuedAt, err := svc.parseUserinfoToken(tokenStr)
+	if errors.Is(err, ErrInvalidToken) {
+		// Not a userinfo token, so one AuthMiddleware accepts.
+		if ctx, err = svc.authenticateToken(ctx, ip, tokenStr); err != nil {
+			return nil, nil, err
+		}
+		if _, ok := ctx.Value(ServiceAccountKey).(*ServiceAccount); ok {
+			return nil, nil, ErrInvalidToken
+		}
+
+		user, err := svc.findTokenUser(ctx, ctx.Value(UserIDKey).(string))
+		return user, supportedScopes, err
+	}
+
+	if err := svc.checkNotRevoked(ctx, tokenStr); err != nil {
+		return nil, nil, err
+	}
+
+	user, err := svc.findTokenUser(ctx, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := svc.checkCanSignIn(user); err != nil {
+		return nil, nil, err
+	}
+	if err := user.CheckTokenIssuedAt(issuedAt); err != nil {
+		return nil, nil, err
+	}
+
+	return user, scope, nil
+}
+
+// findTokenUser loads the user a token was issued to, failing with
+// ErrUserNotFound when they were deleted since.
+func (svc *UserService) findTokenUser(ctx context.Context, userID string) (*UserEntity, error) {
+	user, err := svc.Repo.FindUserById(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("findTokenUser: %w", err)
+	}
+
+	return user, nil
+}
+
+// parseUserinfoToken returns the user, scopes and issue time of an access
+// token of a third-party client.
+func (svc *UserService) parseUserinfoToken(
+	tokenStr string,
+) (string, []string, time.Time, error) {
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(
+		tokenStr,
+		claims,
+		func(token *jwt.Token) (interface{}, error) {
+			return []byte(svc.Config.JwtSecret), nil
+		},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+	)
+	if err != nil || !token.Valid || claims["purpose"] != userinfoPurpose {
+		return "", nil, time.Time{}, ErrInvalidToken
+	}
+
+	userID, err := claims.GetSubject()
+	if err != nil || userID == "" {
+		return "", nil, time.Time{}, ErrInvalidToken
+	}
+
+	issuedAt := tokenIssuedAt(claims)
+
+	scope, _ := claims["scope"].(string)
+	return userID, strings.Fields(scope), issuedAt, nil
+}
+
+// userClaims returns the standard claims of user released by scope.
+func userClaims(user *UserEntity, scope []string) map[string]any {
+	claims := map[string]any{"sub": user.ID}
+
+	if slices.Contains(scope, ScopeProfile) {
+		claims["name"] = strings.TrimSpace(user.FirstName + " " + user.LastName)
+		claims["given_name"] = user.FirstName
+		claims["family_name"] = user.LastName
+		claims["updated_at"] = user.UpdatedAt.Unix()
+	}
+
+	if slices.Contains(scope, ScopeEmail) {
+		claims["email"] = user.Email
+		claims["email_verified"] = user.EmailVerifiedAt != nil
+	}
+
+	return claims
+}
+
+// generateIDToken signs the ID token of grant for client, bound to the
+// access token issued along with it through at_hash.
+func (svc *UserService) generateIDToken(
+	user *UserEntity,
+	grant *authorizationGrant,
+	accessToken string,
+) (string, error) {
+	key, id, err := svc.SigningKey.load()
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256([]byte(accessToken))
+	now := user.tokenIssueTime()
+	expiration := time.Second * time.Duration(svc.Config.JwtExpirationInSeconds)
+
+	claims := jwt.MapClaims{
+		"iss":       svc.issuer(),
+		"sub":       user.ID,
+		"aud":       grant.ClientID,
+		"azp":       grant.ClientID,
+		"iat":       numericDate(now),
+		"exp":       now.Add(expiration).Unix(),
+		"auth_time": grant.AuthTime,
+		"at_hash":   base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2]),
+	}
+	if grant.Nonce != "" {
+		claims["nonce"] = grant.Nonce
+	}
+	for name, value := range userClaims(user, strings.Fields(grant.Scope)) {
+		claims[name] = value
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = id
+	signed, err := token.SignedString(key)
+	if err != nil {
+		return "", err
+	}
+
+	metrics.TokensIssued.WithLabelValues("id").Inc()
+
+	return signed, nil
+}
+
+// generateUserinfoToken issues the access token of a third-party client,
+// which only redeems at the userinfo endpoint.
+func (svc *UserService) generateUserinfoToken(
+	user *UserEntity,
+	grant *authorizationGrant,
+) (string, error) {
+	now := user.tokenIssueTime()
+	expiration := time.Second * time.Duration(svc.Config.JwtExpirationInSeconds)
+	claims := jwt.MapClaims{
+		"sub":     user.ID,
+		"purpose": userinfoPurpose,
+		"azp":     grant.ClientID,
+		"scope":   grant.Scope,
+		"iat":     numericDate(now),
+		"exp":     now.Add(expiration).Unix(),
+	}
+
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).
+		SignedString([]byte(svc.Config.JwtSecret))
+	if err != nil {
+		return "", err
+	}
+
+	metrics.TokensIssued.WithLabelValues(userinfoPurpose).Inc()
+
+	return signed, nil
+}
+
+func (svc *UserService) issuer() string {
+	return strings.TrimRight(svc.Config.IssuerUrl, "/")
+}
@@ -0,0 +1,520 @@
+package user
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diegodario88/sesamo/audit"
+	"github.com/diegodario88/sesamo/config"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+const (
+	appClientID   = "app_test"
+	appRedirect   = "https://app.example.com/callback"
+	codeVerifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r7wW1gFWFOEjXk"
+	codeChallenge = "bwWFMyPfdG9qreDhH2lmftFx_dFeLDalzcT1gb_j68g"
+)
+
+var hiddenField = regexp.MustCompile(`name="(oauth_request|csrf)" value="([^"]+)"`)
+
+type OIDCTestSuite struct {
+	suite.Suite
+	repo    *MockUserRepository
+	audit   *recordingAudit
+	handler *Handler
+	user    *UserEntity
+	client  *OAuthClient
+	secret  string
+}
+
+func TestOIDCTestSuite(t *testing.T) {
+	suite.Run(t, new(OIDCTestSuite))
+}
+
+func (suite *OIDCTestSuite) SetupTest() {
+	suite.repo = new(MockUserRepository)
+	suite.repo.On("IsTokenRevoked", mock.Anything).Return(false, nil).Maybe()
+	suite.audit = &recordingAudit{}
+	suite.handler = NewHandler(UserService{
+		Repo: suite.repo,
+		Config: &config.Config{
+			JwtSecret:              "0123456789abcdef",
+			JwtExpirationInSeconds: 3600,
+			IssuerUrl:              testIssuer,
+			AppUrl:                 "https://sesamo.example.com",
+			SessionTTL:             12 * time.Hour,
+		},
+		Audit:      suite.audit,
+		SigningKey: &SigningKey{},
+	})
+
+	suite.user = &UserEntity{
+		ID:        targetID,
+		FirstName: "Ana",
+		LastName:  "Silva",
+		Email:     "ana@example.com",
+		Status:    StatusActive,
+	}
+
+	secret, hash, err := newClientSecret()
+	suite.Require().NoError(err)
+	suite.secret = secret
+	suite.client = &OAuthClient{
+		ClientID:     appClientID,
+		Name:         "Reports",
+		SecretHash:   &hash,
+		RedirectURIs: []string{appRedirect},
+	}
+	suite.repo.On("FindOAuthClient", appClientID).Return(suite.client, nil).Maybe()
+	suite.repo.On("FindUserById", targetID).Return(suite.user, nil).Maybe()
+}
+
+func (suite *OIDCTestSuite) params() url.Values {
+	return url.Values{
+		"client_id":             {appClientID},
+		"redirect_uri":          {appRedirect},
+		"response_type":         {"code"},
+		"scope":                 {"openid email"},
+		"state":                 {"xyz"},
+		"nonce":                 {"n-0S6"},
+		"code_challenge":        {codeChallenge},
+		"code_challenge_method": {"S256"},
+	}
+}
+
+// session returns the session cookie of the user, signed in at authTime.
+func (suite *OIDCTestSuite) session(authTime time.Time) *http.Cookie {
+	session, err := suite.handler.generateSession(suite.user, authTime)
+	suite.Require().NoError(err)
+	return &http.Cookie{Name: sessionCookieName, Value: session}
+}
+
+func (suite *OIDCTestSuite) authorize(
+	query url.Values,
+	cookies ...*http.Cookie,
+) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodGet, "/oauth/authorize?"+query.Encode(), nil)
+	for _, cookie := range cookies {
+		request.AddCookie(cookie)
+	}
+	recorder := httptest.NewRecorder()
+
+	suite.handler.Authorize(recorder, request)
+
+	return recorder
+}
+
+// expectCode stores the next authorization code, which then redeems once.
+func (suite *OIDCTestSuite) expectCode() {
+	var stored *UserToken
+	suite.repo.
+		On("CreateUserToken", mock.MatchedBy(func(token *UserToken) bool {
+			return token.Purpose == TokenPurposeOAuthCode
+		}), oauthCodeTTL).
+		Run(func(args mock.Arguments) {
+			stored = args.Get(0).(*UserToken)
+			suite.repo.
+				On("ConsumeUserToken", TokenPurposeOAuthCode, stored.TokenHash).
+				Return(&UserToken{UserID: stored.UserID, Data: stored.Data}, nil).Once()
+		}).
+		Return(nil).Once()
+}
+
+// redirected returns the query of the client redirect recorder answered.
+func (suite *OIDCTestSuite) redirected(recorder *httptest.ResponseRecorder) url.Values {
+	suite.Require().Equal(http.StatusFound, recorder.Code, recorder.Body.String())
+	location, err := url.Parse(recorder.Header().Get("Location"))
+	suite.Require().NoError(err)
+	suite.Equal(appRedirect, location.Scheme+"://"+location.Host+location.Path)
+
+	query := location.Query()
+	suite.Equal("xyz", query.Get("state"))
+	suite.Equal(testIssuer, query.Get("iss"))
+	return query
+}
+
+func (suite *OIDCTestSuite) exchange(code string, verifier string) *httptest.ResponseRecorder {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {appRedirect},
+		"code_verifier": {verifier},
+		"client_id":     {appClientID},
+	}
+	if !suite.client.Public() {
+		form.Set("client_secret", suite.secret)
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+
+	suite.handler.Token(recorder, request)
+
+	return recorder
+}
+
+// verifyIDToken checks the signature of an ID token against the key the JWKS
+// endpoint publishes and returns its claims.
+func (suite *OIDCTestSuite) verifyIDToken(idToken string) jwt.MapClaims {
+	recorder := httptest.NewRecorder()
+	suite.handler.JWKS(recorder, httptest.NewRequest(http.MethodGet, "/oauth/jwks", nil))
+	suite.Require().Equal(http.StatusOK, recorder.Code)
+
+	var jwks struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	suite.Require().NoError(json.Unmarshal(recorder.Body.Bytes(), &jwks))
+	suite.Require().Len(jwks.Keys, 1)
+	n, err := base64.RawURLEncoding.DecodeString(jwks.Keys[0]["n"])
+	suite.Require().NoError(err)
+	e, err := base64.RawURLEncoding.DecodeString(jwks.Keys[0]["e"])
+	suite.Require().NoError(err)
+	key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		suite.Equal(jwks.Keys[0]["kid"], token.Header["kid"])
+		return key, nil
+	}, jwt.WithValidMethods([]string{"RS256"}), jwt.WithIssuer(testIssuer),
+		jwt.WithAudience(appClientID))
+	suite.Require().NoError(err)
+	suite.Require().True(token.Valid)
+	return claims
+}
+
+func (suite *OIDCTestSuite) TestDiscovery() {
+	recorder := httptest.NewRecorder()
+	suite.handler.OpenIDConfiguration(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	suite.Equal(http.StatusOK, recorder.Code)
+	var metadata ProviderMetadata
+	suite.Require().NoError(json.Unmarshal(recorder.Body.Bytes(), &metadata))
+	suite.Equal(testIssuer, metadata.Issuer)
+	suite.Equal(testIssuer+"/oauth/authorize", metadata.AuthorizationEndpoint)
+	suite.Equal(testIssuer+"/oauth/token", metadata.TokenEndpoint)
+	suite.Equal(testIssuer+"/oauth/jwks", metadata.JwksURI)
+	suite.Equal([]string{"S256"}, metadata.CodeChallengeMethodsSupported)
+	suite.Contains(metadata.ScopesSupported, ScopeOpenID)
+}
+
+func (suite *OIDCTestSuite) TestAuthorizeRejectsUnregisteredRedirect() {
+	query := suite.params()
+	query.Set("redirect_uri", "https://evil.example.com/callback")
+
+	recorder := suite.authorize(query)
+
+	suite.Equal(http.StatusBadRequest, recorder.Code)
+	suite.Empty(recorder.Header().Get("Location"))
+}
+
+func (suite *OIDCTestSuite) TestAuthorizeRedirectsInvalidRequests() {
+	query := suite.params()
+	query.Del("code_challenge")
+	suite.Equal("invalid_request", suite.redirected(suite.authorize(query)).Get("error"))
+
+	query = suite.params()
+	query.Set("scope", "email")
+	suite.Equal("invalid_scope", suite.redirected(suite.authorize(query)).Get("error"))
+
+	query = suite.params()
+	query.Set("prompt", "none")
+	suite.Equal("login_required", suite.redirected(suite.authorize(query)).Get("error"))
+}
+
+func (suite *OIDCTestSuite) TestAuthorizeWithoutSessionSendsToLogin() {
+	recorder := suite.authorize(suite.params())
+
+	suite.Equal(http.StatusFound, recorder.Code)
+	location, err := url.Parse(recorder.Header().Get("Location"))
+	suite.Require().NoError(err)
+	suite.Equal("https://sesamo.example.com/login", location.Scheme+"://"+location.Host+location.Path)
+
+	request, err := suite.handler.parseOAuthRequest(location.Query().Get("oauth_request"))
+	suite.Require().NoError(err)
+	suite.Equal(appClientID, request.ClientID)
+	suite.Equal("email openid", request.Scope)
+
+	cookies := recorder.Result().Cookies()
+	suite.Require().Len(cookies, 1)
+	suite.Equal(loginCookieName, cookies[0].Name)
+	suite.True(cookies[0].HttpOnly)
+	suite.True(cookies[0].Secure)
+	suite.Equal(request.Binding, hashToken(cookies[0].Value))
+}
+
+func (suite *OIDCTestSuite) TestAuthorizeRequiresFreshLogin() {
+	query := suite.params()
+	query.Set("max_age", "60")
+
+	recorder := suite.authorize(query, suite.session(time.Now().Add(-time.Hour)))
+
+	suite.Equal(http.StatusFound, recorder.Code)
+	suite.Contains(recorder.Header().Get("Location"), "/login?oauth_request=")
+}
+
+func (suite *OIDCTestSuite) TestFirstPartyCodeFlow() {
+	suite.client.FirstParty = true
+	suite.repo.On("GetRoles", targetID).Return([]string{"org_admin"}, nil)
+	suite.repo.On("RequiresMFA", targetID).Return(false, nil)
+	suite.expectCode()
+	authTime := time.Now().Add(-time.Minute).Truncate(time.Second)
+
+	query := suite.redirected(suite.authorize(suite.params(), suite.session(authTime)))
+	suite.repo.AssertNotCalled(suite.T(), "FindOAuthConsent", mock.Anything, mock.Anything)
+
+	recorder := suite.exchange(query.Get("code"), codeVerifier)
+	suite.Require().Equal(http.StatusOK, recorder.Code, recorder.Body.String())
+	suite.Equal("no-store", recorder.Header().Get("Cache-Control"))
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+		Scope       string `json:"scope"`
+	}
+	suite.Require().NoError(json.Unmarshal(recorder.Body.Bytes(), &body))
+	suite.Equal("email openid", body.Scope)
+
+	claims := suite.verifyIDToken(body.IDToken)
+	suite.Equal(targetID, claims["sub"])
+	suite.Equal("n-0S6", claims["nonce"])
+	suite.Equal("ana@example.com", claims["email"])
+	suite.Nil(claims["name"])
+	suite.Equal(float64(authTime.Unix()), claims["auth_time"])
+	sum := sha256.Sum256([]byte(body.AccessToken))
+	suite.Equal(base64.RawURLEncoding.EncodeToString(sum[:16]), claims["at_hash"])
+
+	// The access token of a first-party client is one of the sesamo API.
+	ctx, err := suite.handler.authenticateToken(context.Background(), testIP, body.AccessToken)
+	suite.Require().NoError(err)
+	suite.Equal(targetID, ctx.Value(UserIDKey))
+	suite.Equal([]string{"org_admin"}, ctx.Value(UserRolesKey))
+
+	// Codes redeem once.
+	suite.repo.
+		On("ConsumeUserToken", TokenPurposeOAuthCode, mock.Anything).
+		Return((*UserToken)(nil), ErrInvalidToken).Once()
+	recorder = suite.exchange(query.Get("code"), codeVerifier)
+	suite.Equal(http.StatusBadRequest, recorder.Code)
+	suite.Contains(recorder.Body.String(), "invalid_grant")
+}
+
+func (suite *OIDCTestSuite) TestTokenRejectsWrongVerifier() {
+	suite.client.FirstParty = true
+	suite.expectCode()
+	query := suite.redirected(suite.authorize(suite.params(), suite.session(time.Now())))
+
+	recorder := suite.exchange(query.Get("code"), strings.Repeat("a", 43))
+
+	suite.Equal(http.StatusBadRequest, recorder.Code)
+	suite.Contains(recorder.Body.String(), "code_verifier does not match")
+}
+
+func (suite *OIDCTestSuite) TestThirdPartyConsentFlow() {
+	suite.client.SecretHash = nil
+	session := suite.session(time.Now())
+	suite.repo.On("FindOAuthConsent", targetID, appClientID).Return([]string{}, nil).Once()
+
+	recorder := suite.authorize(suite.params(), session)
+
+	suite.Require().Equal(http.StatusOK, recorder.Code)
+	suite.Equal("DENY", recorder.Header().Get("X-Frame-Options"))
+	suite.Contains(recorder.Header().Get("Content-Security-Policy"), "frame-ancestors 'none'")
+	suite.Contains(recorder.Body.String(), "Reports wants to access your account")
+	suite.Contains(recorder.Body.String(), "See your email address")
+
+	form := url.Values{"decision": {"allow"}}
+	for _, match := range hiddenField.FindAllStringSubmatch(recorder.Body.String(), -1) {
+		form.Set(match[1], match[2])
+	}
+	suite.Require().Len(form, 3)
+
+	suite.repo.On("SaveOAuthConsent", targetID, appClientID, []string{"email", "openid"}).
+		Return(nil).Once()
+	suite.expectCode()
+
+	request := httptest.NewRequest(
+		http.MethodPost,
+		"/oauth/authorize/consent",
+		strings.NewReader(form.Encode()),
+	)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.AddCookie(session)
+	recorder = httptest.NewRecorder()
+	suite.handler.Consent(recorder, request)
+
+	query := suite.redirected(recorder)
+	suite.Require().Len(suite.audit.events, 1)
+	suite.Equal(audit.ActionOAuthConsentGranted, suite.audit.events[0].Action)
+
+	// A public client redeems the code with its PKCE verifier alone.
+	recorder = suite.exchange(query.Get("code"), codeVerifier)
+	suite.Require().Equal(http.StatusOK, recorder.Code, recorder.Body.String())
+	var body struct {
+		AccessToken string `json:"access_token"`
+	}
+	suite.Require().NoError(json.Unmarshal(recorder.Body.Bytes(), &body))
+
+	// Its access token only redeems at userinfo, for the consented scopes.
+	_, err := suite.handler.authenticateToken(context.Background(), testIP, body.AccessToken)
+	suite.ErrorIs(err, ErrInvalidToken)
+
+	userinfo := httptest.NewRequest(http.MethodGet, "/oauth/userinfo", nil)
+	userinfo.Header.Set("Authorization", "Bearer "+body.AccessToken)
+	recorder = httptest.NewRecorder()
+	suite.handler.Userinfo(recorder, userinfo)
+
+	suite.Require().Equal(http.StatusOK, recorder.Code, recorder.Body.String())
+	var claims map[string]any
+	suite.Require().NoError(json.Unmarshal(recorder.Body.Bytes(), &claims))
+	suite.Equal(targetID, claims["sub"])
+	suite.Equal("ana@example.com", claims["email"])
+	suite.NotContains(claims, "name")
+}
+
+func (suite *OIDCTestSuite) TestGrantedConsentIsNotAskedAgain() {
+	suite.repo.On("FindOAuthConsent", targetID, appClientID).
+		Return([]string{"email", "openid", "profile"}, nil)
+	suite.expectCode()
+
+	suite.NotEmpty(suite.redirected(suite.authorize(suite.params(), suite.session(time.Now()))).
+		Get("code"))
+
+	query := suite.params()
+	query.Set("prompt", "none consent")
+	suite.Equal("invalid_request", suite.redirected(suite.authorize(query)).Get("error"))
+}
+
+func (suite *OIDCTestSuite) TestConsentRejectsForgedForm() {
+	request, _, err := suite.handler.readAuthorizationRequest(
+		httptest.NewRequest(http.MethodGet, "/oauth/authorize?"+suite.params().Encode(), nil),
+	)
+	suite.Require().NoError(err)
+	signed, err := suite.handler.signOAuthRequest(request)
+	suite.Require().NoError(err)
+
+	form := url.Values{"decision": {"allow"}, "oauth_request": {signed}, "csrf": {"forged"}}
+	post := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+	post.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	post.AddCookie(suite.session(time.Now()))
+	recorder := httptest.NewRecorder()
+
+	suite.handler.Consent(recorder, post)
+
+	suite.Equal(http.StatusForbidden, recorder.Code)
+	suite.repo.AssertNotCalled(suite.T(), "SaveOAuthConsent", mock.Anything, mock.Anything,
+		mock.Anything)
+}
+
+func (suite *OIDCTestSuite) TestSessionHandoff() {
+	login := suite.authorize(suite.params())
+	location, err := url.Parse(login.Header().Get("Location"))
+	suite.Require().NoError(err)
+	signed := location.Query().Get("oauth_request")
+	binding := login.Result().Cookies()[0]
+
+	var stored *UserToken
+	suite.repo.
+		On("CreateUserToken", mock.MatchedBy(func(token *UserToken) bool {
+			return token.Purpose == TokenPurposeOAuthSession && token.UserID == targetID
+		}), oauthSessionTTL).
+		Run(func(args mock.Arguments) { stored = args.Get(0).(*UserToken) }).
+		Return(nil).Once()
+
+	authTime := time.Now().Add(-time.Second).Truncate(time.Second)
+	ctx := context.WithValue(context.Background(), UserIDKey, targetID)
+	ctx = context.WithValue(ctx, AuthTimeKey, authTime)
+	body := strings.NewReader(`{"oauth_request":"` + signed + `"}`)
+	recorder := httptest.NewRecorder()
+	suite.handler.CreateOAuthSession(
+		recorder,
+		httptest.NewRequest(http.MethodPost, "/oauth/session", body).WithContext(ctx),
+	)
+
+	suite.Require().Equal(http.StatusOK, recorder.Code, recorder.Body.String())
+	var handoff struct {
+		RedirectTo string `json:"redirect_to"`
+	}
+	suite.Require().NoError(json.Unmarshal(recorder.Body.Bytes(), &handoff))
+	suite.True(strings.HasPrefix(handoff.RedirectTo, testIssuer+"/oauth/session?code="))
+
+	// Another browser, without the login cookie, cannot take the session.
+	suite.repo.
+		On("ConsumeUserToken", TokenPurposeOAuthSession, stored.TokenHash).
+		Return(&UserToken{UserID: targetID, Data: stored.Data}, nil).Twice()
+	recorder = httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, handoff.RedirectTo, nil)
+	suite.handler.StartOAuthSession(recorder, request)
+	suite.Equal(http.StatusForbidden, recorder.Code)
+	suite.Empty(recorder.Result().Cookies())
+
+	request = httptest.NewRequest(http.MethodGet, handoff.RedirectTo, nil)
+	request.AddCookie(binding)
+	recorder = httptest.NewRecorder()
+	suite.handler.StartOAuthSession(recorder, request)
+
+	suite.Equal(http.StatusFound, recorder.Code)
+	suite.True(strings.HasPrefix(
+		recorder.Header().Get("Location"),
+		testIssuer+"/oauth/authorize?oauth_request=",
+	))
+
+	var session *http.Cookie
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.Name == sessionCookieName {
+			session = cookie
+		}
+	}
+	suite.Require().NotNil(session)
+	user, sessionAuthTime, err := suite.handler.readSession(func() *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(session)
+		return r
+	}())
+	suite.Require().NoError(err)
+	suite.Equal(targetID, user.ID)
+	suite.Equal(authTime.Unix(), sessionAuthTime.Unix())
+}
+
+func (suite *OIDCTestSuite) TestRevokedSessionIsIgnored() {
+	revokedAt := time.Now().Add(time.Minute)
+	suite.user.TokensValidAfter = &revokedAt
+
+	recorder := suite.authorize(suite.params(), suite.session(time.Now()))
+
+	suite.Contains(recorder.Header().Get("Location"), "/login?oauth_request=")
+}
+
+func (suite *OIDCTestSuite) TestLogoutOnlyRedirectsToRegisteredURIs() {
+	recorder := httptest.NewRecorder()
+	suite.handler.Logout(recorder, httptest.NewRequest(http.MethodGet,
+		"/oauth/logout?client_id=app_test&state=s&post_logout_redirect_uri="+
+			url.QueryEscape(appRedirect), nil))
+
+	suite.Equal(appRedirect+"?state=s", recorder.Header().Get("Location"))
+	suite.Require().Len(recorder.Result().Cookies(), 1)
+	suite.Equal(-1, recorder.Result().Cookies()[0].MaxAge)
+
+	suite.repo.On("FindOAuthClient", "app_other").Return((*OAuthClient)(nil), sql.ErrNoRows)
+	recorder = httptest.NewRecorder()
+	suite.handler.Logout(recorder, httptest.NewRequest(http.MethodGet,
+		"/oauth/logout?client_id=app_other&post_logout_redirect_uri="+
+			url.QueryEscape(appRedirect), nil))
+
+	suite.Equal("https://sesamo.example.com/", recorder.Header().Get("Location"))
+}
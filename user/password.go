@@ -0,0 +1,255 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/diegodario88/sesamo/httphelper"
+	"github.com/diegodario88/sesamo/logging"
+	"github.com/diegodario88/sesamo/mail"
+	"github.com/diegodario88/sesamo/password"
+)
+
+type ForgotPasswordPayload struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type ResetPasswordPayload struct {
+	Token    string `json:"token"    validate:"required"`
+	Password string `json:"password" validate:"required"`
+}
+
+// ChangePasswordPayload changes the caller's password. CurrentPassword is
+// required unless the account has no password yet.
+type ChangePasswordPayload struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"     validate:"required"`
+}
+
+// ChangePassword sets the caller's password. Accounts with a password must
+// confirm the current one, and wrong guesses count towards the same lockout
+// as failed logins; SSO-only accounts, which have none, must have signed in
+// within REAUTH_WINDOW instead. Every other session is signed out and the
+// response carries a fresh token.
+func (svc *UserService) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var payload ChangePasswordPayload
+	if err := httphelper.ParseJSON(r, &payload); err != nil {
+		httphelper.WriteProblem(w, httphelper.BadRequest(err.Error()))
+		return
+	}
+
+	if err := httphelper.Validate.Struct(payload); err != nil {
+		httphelper.WriteProblem(w, httphelper.ValidationFailed(err))
+		return
+	}
+
+	user, err := svc.Repo.FindUserById(ctx, ctx.Value(UserIDKey).(string))
+	if err != nil {
+		writeLookupError(w, r, err, "user not found")
+		return
+	}
+
+	if user.HasPassword() {
+		ip := svc.clientIP(r)
+		var throttled *ThrottledError
+		_, err := svc.checkAccountThrottle(ctx, user.Email)
+		if errors.As(err, &throttled) {
+			httphelper.WriteTooManyRequests(
+				w,
+				"too many failed attempts, try again later",
+				throttled.RetryAfter,
+			)
+			return
+		}
+
+		if _, err := user.CheckPassword(payload.CurrentPassword); err != nil {
+			svc.failAccountLogin(ctx, user.Email, &user.ID, ip)
+			svc.failClientLogin(ctx, ip)
+			httphelper.WriteProblem(w, httphelper.NewProblem(
+				http.StatusForbidden,
+				"invalid_current_password",
+				"the current password is incorrect",
+			))
+			return
+		}
+	} else {
+		authTime, _ := ctx.Value(AuthTimeKey).(time.Time)
+		if time.Since(authTime) > svc.Config.ReauthWindow {
+			httphelper.WriteProblem(w, httphelper.NewProblem(
+				http.StatusForbidden,
+				"reauthentication_required",
+				"sign in again to set a password",
+			))
+			return
+		}
+	}
+
+	if err := svc.SetPassword(ctx, user, payload.NewPassword); err != nil {
+		writePasswordError(w, r, err, "newPassword")
+		return
+	}
+
+	token, err := svc.GenerateUserToken(ctx, user)
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	logging.FromContext(ctx).Info("Password changed")
+	httphelper.WriteJSON(w, http.StatusOK, map[string]string{"token": token})
+}
+
+// ForgotPassword mails a password reset link. It answers 202 whether or not
+// the email belongs to an account, so it cannot be used to probe which emails
+// are registered.
+func (svc *UserService) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var payload ForgotPasswordPayload
+	if err := httphelper.ParseJSON(r, &payload); err != nil {
+		httphelper.WriteProblem(w, httphelper.BadRequest(err.Error()))
+		return
+	}
+
+	if err := httphelper.Validate.Struct(payload); err != nil {
+		httphelper.WriteProblem(w, httphelper.ValidationFailed(err))
+		return
+	}
+
+	user, err := svc.Repo.FindUserByEmail(r.Context(), payload.Email)
+	if err == nil && user.Status != StatusDisabled {
+		svc.sendMail(r.Context(), "Sending password reset failed", func(ctx context.Context) error {
+			return svc.SendPasswordReset(ctx, user)
+		})
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// SendPasswordReset mails user a short-lived link to choose a new password.
+func (svc *UserService) SendPasswordReset(ctx context.Context, user *UserEntity) error {
+	secret, err := svc.issueToken(
+		ctx,
+		user.ID,
+		TokenPurposeResetPassword,
+		nil,
+		svc.Config.PasswordResetTTL,
+	)
+	if err != nil {
+		return fmt.Errorf("SendPasswordReset: %w", err)
+	}
+
+	err = svc.Mailer.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf(
+			"Hello %s,\n\n"+
+				"Open the link below to choose a new password. It expires in %s "+
+				"and works once.\n\n%s\n\n"+
+				"If you did not ask to reset your password, you can ignore this message; "+
+				"your password stays the same.\n",
+			user.FirstName,
+			svc.Config.PasswordResetTTL,
+			svc.link("reset-password", secret),
+		),
+	})
+	if err != nil {
+		return fmt.Errorf("SendPasswordReset: %w", err)
+	}
+
+	return nil
+}
+
+// ResetPassword redeems a reset link: it sets the new password and revokes
+// every token issued before, signing the user out everywhere.
+func (svc *UserService) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var payload ResetPasswordPayload
+	if err := httphelper.ParseJSON(r, &payload); err != nil {
+		httphelper.WriteProblem(w, httphelper.BadRequest(err.Error()))
+		return
+	}
+
+	if err := httphelper.Validate.Struct(payload); err != nil {
+		httphelper.WriteProblem(w, httphelper.ValidationFailed(err))
+		return
+	}
+
+	token, err := svc.redeemToken(ctx, TokenPurposeResetPassword, payload.Token)
+	if errors.Is(err, ErrInvalidToken) {
+		writeInvalidToken(w)
+		return
+	}
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	user, err := svc.Repo.FindUserById(ctx, token.UserID)
+	if err != nil {
+		writeLookupError(w, r, err, "user not found")
+		return
+	}
+
+	if err := svc.SetPassword(ctx, user, payload.Password); err != nil {
+		writePasswordError(w, r, err, "password")
+		return
+	}
+
+	if err := svc.Repo.RevokeUserTokens(ctx, user.ID); err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	logging.FromContext(ctx).Info("Password reset", "target_user_id", user.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// verifyDummy spends the time of a password verification on logins without a
+// hash to verify against, so they cannot be told apart from wrong passwords.
+func (svc *UserService) verifyDummy(ctx context.Context, plain string) {
+	dummy, err := password.DummyHash(svc.hashParams())
+	if err != nil {
+		logging.FromContext(ctx).Warn("Dummy password verification failed", "error", err)
+		return
+	}
+
+	password.Verify(plain, dummy)
+}
+
+func (svc *UserService) hashParams() password.Params {
+	if svc.Hashing == (password.Params{}) {
+		return password.DefaultParams
+	}
+	return svc.Hashing
+}
+
+// upgradePasswordHash rehashes plain, just verified against the stored hash,
+// when that hash uses outdated costs or the legacy bcrypt scheme. Failures are
+// logged and left for the next sign-in.
+func (svc *UserService) upgradePasswordHash(ctx context.Context, user *UserEntity, plain string) {
+	params := svc.hashParams()
+	if !user.PasswordNeedsRehash(params) {
+		return
+	}
+
+	logger := logging.FromContext(ctx)
+
+	newHash, err := user.HashPassword(plain, params)
+	if err != nil {
+		logger.Warn("Password rehash failed", "error", err)
+		return
+	}
+
+	if err := svc.Repo.RehashUserPassword(ctx, user.ID, *user.PasswordHash, newHash); err != nil {
+		logger.Warn("Password rehash failed", "error", err)
+		return
+	}
+
+	user.PasswordHash = &newHash
+	logger.Info("Password hash upgraded", "user_id", user.ID)
+}
@@ -0,0 +1,188 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diegodario88/sesamo/password"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+type PasswordTestSuite struct {
+	suite.Suite
+	repo   *MockUserRepository
+	mailer *recordingSender
+	svc    UserService
+}
+
+func TestPasswordTestSuite(t *testing.T) {
+	suite.Run(t, new(PasswordTestSuite))
+}
+
+func (suite *PasswordTestSuite) SetupTest() {
+	suite.repo = new(MockUserRepository)
+	suite.mailer = &recordingSender{}
+	suite.svc = mailingService(suite.repo, suite.mailer)
+}
+
+func (suite *PasswordTestSuite) forgot(email string) int {
+	recorder := httptest.NewRecorder()
+	body := strings.NewReader(`{"email":"` + email + `"}`)
+	suite.svc.ForgotPassword(recorder, httptest.NewRequest(http.MethodPost, "/", body))
+	return recorder.Code
+}
+
+func (suite *PasswordTestSuite) TestForgotPasswordDoesNotRevealUnknownEmails() {
+	suite.repo.
+		On("FindUserByEmail", "ghost@example.com").
+		Return((*UserEntity)(nil), sql.ErrNoRows)
+
+	suite.Equal(http.StatusAccepted, suite.forgot("ghost@example.com"))
+	suite.Empty(suite.mailer.sent)
+}
+
+func (suite *PasswordTestSuite) TestResetPasswordRevokesSessions() {
+	user := &UserEntity{ID: targetID, Email: "ana@example.com", Status: StatusActive}
+	suite.repo.On("FindUserByEmail", user.Email).Return(user, nil)
+	suite.repo.
+		On("CreateUserToken", mock.MatchedBy(func(token *UserToken) bool {
+			return token.Purpose == TokenPurposeResetPassword
+		}), 30*time.Minute).
+		Return(nil)
+
+	suite.Equal(http.StatusAccepted, suite.forgot(user.Email))
+	secret := suite.mailer.mailedToken(suite.T())
+
+	suite.repo.
+		On("ConsumeUserToken", TokenPurposeResetPassword, hashToken(secret)).
+		Return(&UserToken{UserID: targetID}, nil)
+	suite.repo.On("FindUserById", targetID).Return(user, nil)
+	suite.repo.
+		On("SetUserPassword", targetID, mock.MatchedBy(func(hash string) bool {
+			return strings.HasPrefix(hash, "$argon2id$")
+		})).
+		Return(time.Now(), nil)
+	suite.repo.On("RevokeUserTokens", targetID).Return(nil)
+
+	recorder := httptest.NewRecorder()
+	body := strings.NewReader(`{"token":"` + secret + `","password":"Correct-Horse-42"}`)
+	suite.svc.ResetPassword(recorder, httptest.NewRequest(http.MethodPost, "/", body))
+
+	suite.Equal(http.StatusNoContent, recorder.Code)
+	suite.repo.AssertExpectations(suite.T())
+}
+
+func (suite *PasswordTestSuite) TestResetTokenCannotVerifyEmail() {
+	secret, _, err := newToken([]byte(suite.svc.Config.JwtSecret), TokenPurposeResetPassword)
+	suite.Require().NoError(err)
+
+	recorder := httptest.NewRecorder()
+	body := strings.NewReader(`{"token":"` + secret + `"}`)
+	suite.svc.VerifyEmail(recorder, httptest.NewRequest(http.MethodPost, "/", body))
+
+	suite.Equal(http.StatusBadRequest, recorder.Code)
+}
+
+// changePassword sends body as a user who signed in at authTime.
+func (suite *PasswordTestSuite) changePassword(body string, authTime time.Time) int {
+	request := httptest.NewRequest(http.MethodPut, "/users/me/password", strings.NewReader(body))
+	ctx := context.WithValue(request.Context(), UserIDKey, targetID)
+	ctx = context.WithValue(ctx, AuthTimeKey, authTime)
+	recorder := httptest.NewRecorder()
+
+	suite.svc.ChangePassword(recorder, request.WithContext(ctx))
+
+	return recorder.Code
+}
+
+func (suite *PasswordTestSuite) TestChangePasswordRequiresCurrentPassword() {
+	user := &UserEntity{ID: targetID, Status: StatusActive}
+	hash, err := user.HashPassword("old password", password.DefaultParams)
+	suite.Require().NoError(err)
+	user.PasswordHash = &hash
+	suite.repo.On("FindUserById", targetID).Return(user, nil)
+
+	code := suite.changePassword(
+		`{"currentPassword":"wrong","newPassword":"Correct-Horse-42"}`,
+		time.Now(),
+	)
+
+	suite.Equal(http.StatusForbidden, code)
+	suite.repo.AssertNotCalled(suite.T(), "SetUserPassword", mock.Anything, mock.Anything)
+}
+
+func (suite *PasswordTestSuite) TestChangePasswordIssuesTokenAfterTheChange() {
+	user := &UserEntity{ID: targetID, Status: StatusActive}
+	hash, err := user.HashPassword("old password", password.DefaultParams)
+	suite.Require().NoError(err)
+	user.PasswordHash = &hash
+	suite.repo.On("FindUserById", targetID).Return(user, nil)
+	suite.repo.On("GetRoles", targetID).Return([]string{}, nil)
+	suite.repo.On("RequiresMFA", targetID).Return(false, nil)
+
+	// The database clock runs ahead of the service's, and stores microseconds.
+	changedAt := time.Now().Add(time.Second).Truncate(time.Microsecond)
+	suite.repo.
+		On("SetUserPassword", targetID, mock.AnythingOfType("string")).
+		Return(changedAt, nil)
+
+	body := `{"currentPassword":"old password","newPassword":"Correct-Horse-42"}`
+	request := httptest.NewRequest(http.MethodPut, "/users/me/password", strings.NewReader(body))
+	ctx := context.WithValue(request.Context(), UserIDKey, targetID)
+	recorder := httptest.NewRecorder()
+
+	suite.svc.ChangePassword(recorder, request.WithContext(ctx))
+	suite.Require().Equal(http.StatusOK, recorder.Code)
+
+	var response map[string]string
+	suite.Require().NoError(json.Unmarshal(recorder.Body.Bytes(), &response))
+	claims := jwt.MapClaims{}
+	_, _, err = jwt.NewParser().ParseUnverified(response["token"], claims)
+	suite.Require().NoError(err)
+	changed := &UserEntity{PasswordChangedAt: &changedAt}
+	suite.NoError(changed.CheckTokenIssuedAt(tokenIssuedAt(claims)))
+}
+
+func (suite *PasswordTestSuite) TestSSOUserMustHaveSignedInRecently() {
+	user := &UserEntity{ID: targetID, Status: StatusActive}
+	suite.repo.On("FindUserById", targetID).Return(user, nil)
+
+	code := suite.changePassword(`{"newPassword":"Correct-Horse-42"}`, time.Now().Add(-time.Hour))
+	suite.Equal(http.StatusForbidden, code)
+
+	suite.repo.
+		On("SetUserPassword", targetID, mock.AnythingOfType("string")).
+		Return(time.Now(), nil)
+	suite.repo.On("GetRoles", targetID).Return([]string{}, nil)
+	suite.repo.On("RequiresMFA", targetID).Return(false, nil)
+
+	code = suite.changePassword(`{"newPassword":"Correct-Horse-42"}`, time.Now())
+	suite.Equal(http.StatusOK, code)
+	suite.repo.AssertExpectations(suite.T())
+}
+
+func (suite *PasswordTestSuite) TestChangePasswordEnforcesPolicy() {
+	user := &UserEntity{ID: targetID, FirstName: "Ana", Email: "ana@example.com", Status: StatusActive}
+	suite.repo.On("FindUserById", targetID).Return(user, nil)
+
+	recorder := httptest.NewRecorder()
+	body := strings.NewReader(`{"newPassword":"ana12345"}`)
+	request := httptest.NewRequest(http.MethodPut, "/users/me/password", body)
+	ctx := context.WithValue(request.Context(), UserIDKey, targetID)
+	ctx = context.WithValue(ctx, AuthTimeKey, time.Now())
+
+	suite.svc.ChangePassword(recorder, request.WithContext(ctx))
+
+	suite.Equal(http.StatusUnprocessableEntity, recorder.Code)
+	suite.Contains(recorder.Body.String(), `"field":"newPassword"`)
+	suite.Contains(recorder.Body.String(), `"rule":"personal_info"`)
+	suite.repo.AssertNotCalled(suite.T(), "SetUserPassword", mock.Anything, mock.Anything)
+}
@@ -0,0 +1,68 @@
+package user
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/diegodario88/sesamo/httphelper"
+	"github.com/diegodario88/sesamo/password"
+)
+
+// PolicyError lists the password policy rules a password breaks.
+type PolicyError struct {
+	Violations []password.Violation
+}
+
+func (err *PolicyError) Error() string {
+	messages := make([]string, 0, len(err.Violations))
+	for _, violation := range err.Violations {
+		messages = append(messages, violation.Message)
+	}
+
+	return "password " + strings.Join(messages, "; ")
+}
+
+// Problem reports the violations as errors of the request field holding the
+// password.
+func (err *PolicyError) Problem(field string) *httphelper.Problem {
+	fields := make([]httphelper.FieldError, 0, len(err.Violations))
+	for _, violation := range err.Violations {
+		fields = append(fields, httphelper.FieldError{
+			Field:   field,
+			Rule:    violation.Rule,
+			Param:   violation.Param,
+			Message: violation.Message,
+		})
+	}
+
+	return httphelper.InvalidFields(fields...)
+}
+
+// checkPassword applies the password policy. A password may not contain the
+// email or names of the account it is for.
+func (svc *UserService) checkPassword(candidate string, owner *UserEntity) error {
+	policy := svc.Policy
+	if policy == nil {
+		policy = password.Default
+	}
+
+	violations := policy.Check(candidate, owner.Email, owner.FirstName, owner.LastName)
+	if len(violations) > 0 {
+		return &PolicyError{Violations: violations}
+	}
+
+	return nil
+}
+
+// writePasswordError answers a failed password update: policy violations are
+// a 422 on field, anything else an internal error.
+func writePasswordError(w http.ResponseWriter, r *http.Request, err error, field string) {
+	var policyErr *PolicyError
+	if errors.As(err, &policyErr) {
+		httphelper.WriteProblem(w, policyErr.Problem(field))
+		return
+	}
+
+	httphelper.WriteInternalError(w, r, err)
+}
@@ -1,9 +1,16 @@
 package user
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"slices"
+	"time"
 
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 )
 
 type UserRepository struct {
@@ -18,18 +25,23 @@ func NewUserRepository(db *sqlx.DB) *UserRepository {
 	return &newUserRepository
 }
 
-func (repo *UserRepository) InsertUser(user *UserEntity) (*UserEntity, error) {
+func (repo *UserRepository) InsertUser(ctx context.Context, user *UserEntity) (*UserEntity, error) {
 	var insertResult UserEntity
-	sqlQuery := `INSERT INTO users (first_name, last_name, email, password_hash) 
-                          values ($1, $2, $3, $4) returning *`
+	sqlQuery := `INSERT INTO users (first_name, last_name, email, password_hash, status,
+                          email_verified_at)
+                          values ($1, $2, $3, $4, COALESCE(NULLIF($5, ''), 'active'), $6)
+                          returning *`
 
-	err := repo.db.Get(
+	err := repo.db.GetContext(
+		ctx,
 		&insertResult,
 		sqlQuery,
 		user.FirstName,
 		user.LastName,
 		user.Email,
 		user.PasswordHash,
+		user.Status,
+		user.EmailVerifiedAt,
 	)
 
 	if err != nil {
@@ -39,19 +51,22 @@ func (repo *UserRepository) InsertUser(user *UserEntity) (*UserEntity, error) {
 	return &insertResult, nil
 }
 
-func (repo *UserRepository) CountUsers() (int, error) {
+func (repo *UserRepository) CountUsers(ctx context.Context) (int, error) {
 	var countResult int
 	sqlQuery := `SELECT COUNT(*) FROM users`
-	err := repo.db.QueryRow(sqlQuery).Scan(&countResult)
+	err := repo.db.QueryRowContext(ctx, sqlQuery).Scan(&countResult)
 
 	return countResult, err
 }
 
-func (repo *UserRepository) FindUserByEmail(email string) (*UserEntity, error) {
+func (repo *UserRepository) FindUserByEmail(
+	ctx context.Context,
+	email string,
+) (*UserEntity, error) {
 	var foundResult UserEntity
 	sqlQuery := `SELECT * FROM users u WHERE u.email = $1`
 
-	err := repo.db.Get(&foundResult, sqlQuery, email)
+	err := repo.db.GetContext(ctx, &foundResult, sqlQuery, email)
 
 	if err != nil {
 		return nil, fmt.Errorf("FindUserByEmail: %w", err)
@@ -60,11 +75,11 @@ func (repo *UserRepository) FindUserByEmail(email string) (*UserEntity, error) {
 	return &foundResult, nil
 }
 
-func (repo *UserRepository) FindUserById(id string) (*UserEntity, error) {
+func (repo *UserRepository) FindUserById(ctx context.Context, id string) (*UserEntity, error) {
 	var foundResult UserEntity
 	sqlQuery := `SELECT * FROM users u WHERE u.id = $1`
 
-	err := repo.db.Get(&foundResult, sqlQuery, id)
+	err := repo.db.GetContext(ctx, &foundResult, sqlQuery, id)
 
 	if err != nil {
 		return nil, fmt.Errorf("FindUserById: %w", err)
@@ -73,28 +88,24 @@ func (repo *UserRepository) FindUserById(id string) (*UserEntity, error) {
 	return &foundResult, nil
 }
 
-func (repo *UserRepository) FindAllUsers() ([]UserEntity, error) {
-	var foundResult []UserEntity
-	sqlQuery := `SELECT * FROM users`
-
-	err := repo.db.Select(&foundResult, sqlQuery)
-
+func (repo *UserRepository) FindAllUsers(ctx context.Context, query UserQuery) (*UserPage, error) {
+	page, err := repo.listUsers(ctx, &whereClause{}, query)
 	if err != nil {
-		return nil, fmt.Errorf("FindUserById: %w", err)
+		return nil, fmt.Errorf("FindAllUsers: %w", err)
 	}
 
-	return foundResult, nil
+	return page, nil
 }
 
-func (repo *UserRepository) GetRoles(userId string) ([]string, error) {
+func (repo *UserRepository) GetRoles(ctx context.Context, userId string) ([]string, error) {
 	query := `
 		SELECT r.name 
 		FROM roles r
-		JOIN user_roles ur ON r.id = ur.role_id
-		WHERE ur.user_id = $1
+		JOIN principal_roles ur ON r.id = ur.role_id
+		WHERE ur.principal_id = $1
 	`
 
-	rows, err := repo.db.Query(query, userId)
+	rows, err := repo.db.QueryContext(ctx, query, userId)
 	if err != nil {
 		return nil, err
 	}
@@ -112,23 +123,29 @@ func (repo *UserRepository) GetRoles(userId string) ([]string, error) {
 	return roles, nil
 }
 
-func (repo *UserRepository) HasAccess(userId string, permission string) (bool, error) {
+func (repo *UserRepository) HasAccess(
+	ctx context.Context,
+	userId string,
+	permission string,
+) (bool, error) {
 	var hasPermission bool
-	err := repo.db.QueryRow(`
+	err := repo.db.QueryRowContext(ctx, `
 		SELECT EXISTS (
 			SELECT 1
-			FROM users u
-			JOIN user_roles ur ON u.id = ur.user_id
+			FROM principal_roles ur
 			JOIN role_permissions rp ON ur.role_id = rp.role_id
 			JOIN permissions p ON rp.permission_id = p.id
-			WHERE u.id = $1 AND p.name = $2
+			WHERE ur.principal_id = $1 AND p.name = $2
 		)
 	`, userId, permission).Scan(&hasPermission)
 
 	return hasPermission, err
 }
 
-func (repo *UserRepository) GetUserOrganizations(userId string) ([]OrganizationEntity, error) {
+func (repo *UserRepository) GetUserOrganizations(
+	ctx context.Context,
+	userId string,
+) ([]OrganizationEntity, error) {
 	organizations := []OrganizationEntity{}
 
 	query := `
@@ -142,9 +159,9 @@ func (repo *UserRepository) GetUserOrganizations(userId string) ([]OrganizationE
         o.updated_at
     FROM
         organizations o
-        JOIN user_roles ur ON o.id = ur.organization_id
+        JOIN principal_roles ur ON o.id = ur.organization_id
     WHERE
-        ur.user_id = $1
+        ur.principal_id = $1
     UNION
     SELECT DISTINCT
         o.id,
@@ -161,17 +178,21 @@ func (repo *UserRepository) GetUserOrganizations(userId string) ([]OrganizationE
             SELECT
                 1
             FROM
-                user_roles ur
+                principal_roles ur
                 JOIN roles r ON ur.role_id = r.id
             WHERE
-                ur.user_id = $1
+                ur.principal_id = $1
                 AND r.scope = 'global');`
 
-	err := repo.db.Select(&organizations, query, userId)
+	err := repo.db.SelectContext(ctx, &organizations, query, userId)
 	return organizations, err
 }
 
-func (repo *UserRepository) GetUserBranches(userId string, orgId string) ([]BranchEntity, error) {
+func (repo *UserRepository) GetUserBranches(
+	ctx context.Context,
+	userId string,
+	orgId string,
+) ([]BranchEntity, error) {
 	branches := []BranchEntity{}
 
 	query := `
@@ -188,45 +209,53 @@ func (repo *UserRepository) GetUserBranches(userId string, orgId string) ([]Bran
 		FROM branches b
 		WHERE b.organization_id = $1 AND (
 			EXISTS (
-				SELECT 1 FROM user_roles ur 
-				WHERE ur.user_id = $2 AND ur.branch_id = b.id
+				SELECT 1 FROM principal_roles ur 
+				WHERE ur.principal_id = $2 AND ur.branch_id = b.id
 			) OR
 			EXISTS (
-				SELECT 1 FROM user_roles ur
+				SELECT 1 FROM principal_roles ur
 				JOIN roles r ON ur.role_id = r.id
-				WHERE ur.user_id = $2 AND ur.organization_id = $1 AND r.scope = 'organization'
+				WHERE ur.principal_id = $2 AND ur.organization_id = $1 AND r.scope = 'organization'
 			) OR
 			EXISTS (
-				SELECT 1 FROM user_roles ur
+				SELECT 1 FROM principal_roles ur
 				JOIN roles r ON ur.role_id = r.id
-				WHERE ur.user_id = $2 AND r.scope = 'global'
+				WHERE ur.principal_id = $2 AND r.scope = 'global'
 			)
 		);
 	`
-	err := repo.db.Select(&branches, query, orgId, userId)
+	err := repo.db.SelectContext(ctx, &branches, query, orgId, userId)
 	return branches, err
 }
 
-func (repo *UserRepository) FindOrganizationUsers(orgID string) ([]UserEntity, error) {
-	users := []UserEntity{}
-
-	query := `
-        SELECT DISTINCT u.* 
-        FROM users u
-        JOIN user_roles ur ON u.id = ur.user_id
-        WHERE ur.organization_id = $1 OR 
+func (repo *UserRepository) FindOrganizationUsers(
+	ctx context.Context,
+	orgID string,
+	query UserQuery,
+) (*UserPage, error) {
+	scope := &whereClause{}
+	scope.add(`(
             EXISTS (
-                SELECT 1 FROM user_roles ur2
-                JOIN roles r ON ur2.role_id = r.id
-                WHERE ur2.user_id = u.id AND r.scope = 'global'
+                SELECT 1 FROM user_roles ur
+                WHERE ur.user_id = u.id AND ur.organization_id = ?
+            ) OR
+            EXISTS (
+                SELECT 1 FROM user_roles ur
+                JOIN roles r ON ur.role_id = r.id
+                WHERE ur.user_id = u.id AND r.scope = 'global'
             )
-    `
+        )`, orgID)
+
+	page, err := repo.listUsers(ctx, scope, query)
+	if err != nil {
+		return nil, fmt.Errorf("FindOrganizationUsers: %w", err)
+	}
 
-	err := repo.db.Select(&users, query, orgID)
-	return users, err
+	return page, nil
 }
 
 func (repo *UserRepository) FindOrganizationUserByID(
+	ctx context.Context,
 	orgID string,
 	userID string,
 ) (*UserEntity, error) {
@@ -248,7 +277,7 @@ func (repo *UserRepository) FindOrganizationUserByID(
         )
     `
 
-	err := repo.db.Get(&user, query, userID, orgID)
+	err := repo.db.GetContext(ctx, &user, query, userID, orgID)
 	if err != nil {
 		return nil, err
 	}
@@ -256,34 +285,139 @@ func (repo *UserRepository) FindOrganizationUserByID(
 	return &user, nil
 }
 
-func (repo *UserRepository) FindBranchUsers(orgID string, branchID string) ([]UserEntity, error) {
-	users := []UserEntity{}
-
-	query := `
-        SELECT DISTINCT u.* 
-        FROM users u
-        WHERE 
+func (repo *UserRepository) FindBranchUsers(
+	ctx context.Context,
+	orgID string,
+	branchID string,
+	query UserQuery,
+) (*UserPage, error) {
+	scope := &whereClause{}
+	scope.add(`(
             EXISTS (
                 SELECT 1 FROM user_roles ur
-                WHERE ur.user_id = u.id AND ur.branch_id = $2
+                WHERE ur.user_id = u.id AND ur.branch_id = ?
             ) OR
             EXISTS (
                 SELECT 1 FROM user_roles ur
                 JOIN roles r ON ur.role_id = r.id
-                WHERE ur.user_id = u.id AND ur.organization_id = $1 AND r.scope = 'organization'
+                WHERE ur.user_id = u.id AND ur.organization_id = ? AND r.scope = 'organization'
             ) OR
             EXISTS (
                 SELECT 1 FROM user_roles ur
                 JOIN roles r ON ur.role_id = r.id
                 WHERE ur.user_id = u.id AND r.scope = 'global'
             )
-    `
+        )`, branchID, orgID)
+
+	page, err := repo.listUsers(ctx, scope, query)
+	if err != nil {
+		return nil, fmt.Errorf("FindBranchUsers: %w", err)
+	}
+
+	return page, nil
+}
+
+// listUsers runs a keyset-paginated listing of the users matching where and
+// the query's filters. It fetches one row more than the page size to learn
+// whether another page follows, and walks backwards for a prev cursor, then
+// restores the requested order.
+func (repo *UserRepository) listUsers(
+	ctx context.Context,
+	where *whereClause,
+	query UserQuery,
+) (*UserPage, error) {
+	field, descending, err := query.sortField()
+	if err != nil {
+		return nil, err
+	}
 
-	err := repo.db.Select(&users, query, orgID, branchID)
-	return users, err
+	after, err := decodeCursor(query.Cursor, query.Sort)
+	if err != nil {
+		return nil, err
+	}
+
+	query.UserFilter.apply(where)
+	page := &UserPage{Items: []UserEntity{}}
+
+	if query.WithTotal {
+		var total int
+		countQuery := repo.db.Rebind(`SELECT COUNT(*) FROM users u` + where.String())
+		if err := repo.db.GetContext(ctx, &total, countQuery, where.args...); err != nil {
+			return nil, err
+		}
+		page.Total = &total
+	}
+
+	backward := after != nil && after.Backward
+	ascending := descending == backward
+	if after != nil {
+		operator := "<"
+		if ascending {
+			operator = ">"
+		}
+		where.add(
+			fmt.Sprintf("(%s, u.id) %s (?%s, ?::ulid)", field.column, operator, field.cast),
+			after.Value,
+			after.ID,
+		)
+	}
+
+	direction := "DESC"
+	if ascending {
+		direction = "ASC"
+	}
+
+	limit := query.limit()
+	listQuery := repo.db.Rebind(fmt.Sprintf(
+		`SELECT u.* FROM users u%s ORDER BY %s %s, u.id %s LIMIT ?`,
+		where.String(),
+		field.column,
+		direction,
+		direction,
+	))
+
+	args := append(where.args, limit+1)
+	if err := repo.db.SelectContext(ctx, &page.Items, listQuery, args...); err != nil {
+		return nil, err
+	}
+
+	hasMore := len(page.Items) > limit
+	if hasMore {
+		page.Items = page.Items[:limit]
+	}
+
+	if backward {
+		slices.Reverse(page.Items)
+	}
+
+	if len(page.Items) == 0 {
+		return page, nil
+	}
+
+	cursorAt := func(user UserEntity, backward bool) string {
+		return encodeCursor(cursor{
+			Sort:     query.Sort,
+			Value:    field.value(user),
+			ID:       user.ID,
+			Backward: backward,
+		})
+	}
+
+	if hasMore || backward {
+		page.Next = cursorAt(page.Items[len(page.Items)-1], false)
+	}
+
+	if (hasMore && backward) || (after != nil && !backward) {
+		page.Prev = cursorAt(page.Items[0], true)
+	}
+
+	return page, nil
 }
 
-func (repo *UserRepository) GetOrganizationBranches(orgID string) ([]BranchEntity, error) {
+func (repo *UserRepository) GetOrganizationBranches(
+	ctx context.Context,
+	orgID string,
+) ([]BranchEntity, error) {
 	branches := []BranchEntity{}
 
 	query := `
@@ -302,6 +436,1369 @@ func (repo *UserRepository) GetOrganizationBranches(orgID string) ([]BranchEntit
 		ORDER BY name
 	`
 
-	err := repo.db.Select(&branches, query, orgID)
+	err := repo.db.SelectContext(ctx, &branches, query, orgID)
 	return branches, err
 }
+
+// SetUserPassword replaces the password hash and returns when it changed.
+// Tokens issued before the change stop being accepted, by the same rule as
+// RevokeUserTokens.
+func (repo *UserRepository) SetUserPassword(
+	ctx context.Context,
+	userID string,
+	passwordHash string,
+) (time.Time, error) {
+	sqlQuery := `UPDATE users SET password_hash = $2,
+                          password_changed_at = ` + revocationCutoff + `,
+                          updated_at = (now() at time zone 'utc')
+                          WHERE id = $1
+                          RETURNING password_changed_at`
+
+	var changedAt time.Time
+	err := repo.db.GetContext(ctx, &changedAt, sqlQuery, userID, passwordHash)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("SetUserPassword: %w", err)
+	}
+
+	return changedAt, nil
+}
+
+// RehashUserPassword stores a new hash of the same password. Unlike
+// SetUserPassword it keeps tokens valid, and it leaves the row alone when the
+// password changed since oldHash was read.
+func (repo *UserRepository) RehashUserPassword(
+	ctx context.Context,
+	userID string,
+	oldHash string,
+	newHash string,
+) error {
+	sqlQuery := `UPDATE users SET password_hash = $3
+                          WHERE id = $1 AND password_hash = $2`
+
+	if _, err := repo.db.ExecContext(ctx, sqlQuery, userID, oldHash, newHash); err != nil {
+		return fmt.Errorf("RehashUserPassword: %w", err)
+	}
+
+	return nil
+}
+
+// FindLoginFailures returns the failed logins counted under emailHash, or
+// sql.ErrNoRows when there are none.
+func (repo *UserRepository) FindLoginFailures(
+	ctx context.Context,
+	emailHash string,
+) (*LoginFailures, error) {
+	var found LoginFailures
+	sqlQuery := `SELECT failures, last_failed_at FROM login_failures WHERE email_hash = $1`
+
+	if err := repo.db.GetContext(ctx, &found, sqlQuery, emailHash); err != nil {
+		return nil, fmt.Errorf("FindLoginFailures: %w", err)
+	}
+
+	return &found, nil
+}
+
+// RecordFailedLogin counts a failed login under emailHash and returns how many
+// failed in a row, forgetting failures older than forgetAfter.
+func (repo *UserRepository) RecordFailedLogin(
+	ctx context.Context,
+	emailHash string,
+	forgetAfter time.Duration,
+) (int, error) {
+	sqlQuery := `INSERT INTO login_failures (email_hash, failures, last_failed_at)
+                          VALUES ($1, 1, (now() at time zone 'utc'))
+                          ON CONFLICT (email_hash) DO UPDATE SET failures = CASE
+                              WHEN login_failures.last_failed_at > (now() at time zone 'utc')
+                                   - make_interval(secs => $2) THEN login_failures.failures + 1
+                              ELSE 1
+                          END,
+                          last_failed_at = (now() at time zone 'utc')
+                          RETURNING failures`
+
+	var failures int
+	err := repo.db.GetContext(ctx, &failures, sqlQuery, emailHash, forgetAfter.Seconds())
+	if err != nil {
+		return 0, fmt.Errorf("RecordFailedLogin: %w", err)
+	}
+
+	return failures, nil
+}
+
+// ClearFailedLogins forgets the failed logins counted under emailHash, lifting
+// any lockout, and returns how many there were.
+func (repo *UserRepository) ClearFailedLogins(ctx context.Context, emailHash string) (int, error) {
+	sqlQuery := `DELETE FROM login_failures WHERE email_hash = $1 RETURNING failures`
+
+	var failures int
+	err := repo.db.GetContext(ctx, &failures, sqlQuery, emailHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("ClearFailedLogins: %w", err)
+	}
+
+	return failures, nil
+}
+
+// SetUserStatus moves a user to status. Leaving the active status also
+// revokes every token issued so far.
+func (repo *UserRepository) SetUserStatus(
+	ctx context.Context,
+	userID string,
+	status string,
+	reason *string,
+) (*UserEntity, error) {
+	var updateResult UserEntity
+	sqlQuery := `UPDATE users SET status = $2, status_reason = $3,
+                          status_changed_at = (now() at time zone 'utc'),
+                          tokens_valid_after = CASE WHEN $2 = 'active' THEN tokens_valid_after
+                              ELSE ` + revocationCutoff + ` END,
+                          updated_at = (now() at time zone 'utc')
+                          WHERE id = $1 returning *`
+
+	err := repo.db.GetContext(ctx, &updateResult, sqlQuery, userID, status, reason)
+	if err != nil {
+		return nil, fmt.Errorf("SetUserStatus: %w", err)
+	}
+
+	return &updateResult, nil
+}
+
+// revocationCutoff is the exact instant of a revocation; see revokedBefore
+// for how token issue times are compared with it.
+const revocationCutoff = `(now() at time zone 'utc')`
+
+// RevokeUserTokens invalidates every token issued to the user so far.
+func (repo *UserRepository) RevokeUserTokens(ctx context.Context, userID string) error {
+	sqlQuery := `UPDATE users SET tokens_valid_after = ` + revocationCutoff + `,
+                          updated_at = (now() at time zone 'utc')
+                          WHERE id = $1`
+
+	result, err := repo.db.ExecContext(ctx, sqlQuery, userID)
+	if err != nil {
+		return fmt.Errorf("RevokeUserTokens: %w", err)
+	}
+
+	return expectAffected("RevokeUserTokens", result)
+}
+
+// MarkEmailVerified records that the user proved to own their email and
+// activates the account when it was waiting for that.
+func (repo *UserRepository) MarkEmailVerified(
+	ctx context.Context,
+	userID string,
+) (*UserEntity, error) {
+	var updateResult UserEntity
+	sqlQuery := `UPDATE users SET email_verified_at = (now() at time zone 'utc'),
+                          status = CASE WHEN status = 'pending_verification' THEN 'active'
+                              ELSE status END,
+                          status_changed_at = CASE WHEN status = 'pending_verification'
+                              THEN (now() at time zone 'utc') ELSE status_changed_at END,
+                          updated_at = (now() at time zone 'utc')
+                          WHERE id = $1 returning *`
+
+	err := repo.db.GetContext(ctx, &updateResult, sqlQuery, userID)
+	if err != nil {
+		return nil, fmt.Errorf("MarkEmailVerified: %w", err)
+	}
+
+	return &updateResult, nil
+}
+
+// UpdateUserProfile changes the non-nil fields of a user's profile.
+func (repo *UserRepository) UpdateUserProfile(
+	ctx context.Context,
+	userID string,
+	firstName *string,
+	lastName *string,
+) (*UserEntity, error) {
+	var updateResult UserEntity
+	sqlQuery := `UPDATE users SET first_name = COALESCE($2, first_name),
+                          last_name = COALESCE($3, last_name),
+                          updated_at = (now() at time zone 'utc')
+                          WHERE id = $1 returning *`
+
+	err := repo.db.GetContext(ctx, &updateResult, sqlQuery, userID, firstName, lastName)
+	if err != nil {
+		return nil, fmt.Errorf("UpdateUserProfile: %w", err)
+	}
+
+	return &updateResult, nil
+}
+
+// UpdateUserEmail sets an email the user proved to own. It returns
+// ErrUserAlreadyExists when another user owns email.
+func (repo *UserRepository) UpdateUserEmail(
+	ctx context.Context,
+	userID string,
+	email string,
+) (*UserEntity, error) {
+	var updateResult UserEntity
+	sqlQuery := `UPDATE users SET email = $2, email_verified_at = (now() at time zone 'utc'),
+                          updated_at = (now() at time zone 'utc')
+                          WHERE id = $1 returning *`
+
+	err := repo.db.GetContext(ctx, &updateResult, sqlQuery, userID, email)
+	if isUniqueViolation(err) {
+		return nil, fmt.Errorf("UpdateUserEmail: %w", ErrUserAlreadyExists)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("UpdateUserEmail: %w", err)
+	}
+
+	return &updateResult, nil
+}
+
+// DeleteUser removes a user; role assignments and tokens cascade.
+func (repo *UserRepository) DeleteUser(ctx context.Context, userID string) error {
+	result, err := repo.db.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, userID)
+	if err != nil {
+		return fmt.Errorf("DeleteUser: %w", err)
+	}
+
+	return expectAffected("DeleteUser", result)
+}
+
+// FindManagedUser finds a user the manager may act on with permission, and
+// sql.ErrNoRows for users outside the manager's scope.
+func (repo *UserRepository) FindManagedUser(
+	ctx context.Context,
+	manager Manager,
+	userID string,
+) (*UserEntity, error) {
+	var user UserEntity
+	where := &whereClause{}
+	where.add("u.id = ?", userID)
+	UserFilter{ManagedBy: &manager}.apply(where)
+
+	sqlQuery := repo.db.Rebind(`SELECT u.* FROM users u` + where.String())
+	if err := repo.db.GetContext(ctx, &user, sqlQuery, where.args...); err != nil {
+		return nil, fmt.Errorf("FindManagedUser: %w", err)
+	}
+
+	return &user, nil
+}
+
+// CreateUserToken stores the hash of a single-use token, replacing any unused
+// token the user holds for the same purpose so only the latest link works.
+func (repo *UserRepository) CreateUserToken(
+	ctx context.Context,
+	token *UserToken,
+	ttl time.Duration,
+) error {
+	tx, err := repo.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("CreateUserToken: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(
+		ctx,
+		`DELETE FROM user_tokens WHERE user_id = $1 AND purpose = $2 AND used_at IS NULL`,
+		token.UserID,
+		token.Purpose,
+	)
+	if err != nil {
+		return fmt.Errorf("CreateUserToken: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO user_tokens (user_id, purpose, token_hash, data, expires_at)
+		VALUES ($1, $2, $3, $4, (now() at time zone 'utc') + make_interval(secs => $5))
+	`, token.UserID, token.Purpose, token.TokenHash, token.Data, ttl.Seconds())
+	if err != nil {
+		return fmt.Errorf("CreateUserToken: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("CreateUserToken: %w", err)
+	}
+
+	return nil
+}
+
+// ConsumeUserToken marks a token used and returns it. Unknown, expired and
+// already used tokens all yield ErrInvalidToken.
+func (repo *UserRepository) ConsumeUserToken(
+	ctx context.Context,
+	purpose string,
+	tokenHash string,
+) (*UserToken, error) {
+	var token UserToken
+	sqlQuery := `UPDATE user_tokens SET used_at = (now() at time zone 'utc')
+                          WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL
+                          AND expires_at > (now() at time zone 'utc') returning *`
+
+	err := repo.db.GetContext(ctx, &token, sqlQuery, tokenHash, purpose)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ConsumeUserToken: %w", err)
+	}
+
+	return &token, nil
+}
+
+// CreateWebAuthnSession stores the state of a WebAuthn ceremony for ttl,
+// dropping the sessions that expired unfinished.
+func (repo *UserRepository) CreateWebAuthnSession(
+	ctx context.Context,
+	session *WebAuthnSession,
+	ttl time.Duration,
+) error {
+	tx, err := repo.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("CreateWebAuthnSession: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(
+		ctx,
+		`DELETE FROM webauthn_sessions WHERE expires_at <= (now() at time zone 'utc')`,
+	)
+	if err != nil {
+		return fmt.Errorf("CreateWebAuthnSession: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO webauthn_sessions (user_id, purpose, token_hash, data, expires_at)
+		VALUES ($1, $2, $3, $4, (now() at time zone 'utc') + make_interval(secs => $5))
+	`, session.UserID, session.Purpose, session.TokenHash, session.Data, ttl.Seconds())
+	if err != nil {
+		return fmt.Errorf("CreateWebAuthnSession: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("CreateWebAuthnSession: %w", err)
+	}
+
+	return nil
+}
+
+// ConsumeWebAuthnSession removes and returns the unexpired session with
+// tokenHash, failing with ErrInvalidToken when there is none.
+func (repo *UserRepository) ConsumeWebAuthnSession(
+	ctx context.Context,
+	purpose string,
+	tokenHash string,
+) (*WebAuthnSession, error) {
+	var session WebAuthnSession
+	sqlQuery := `DELETE FROM webauthn_sessions
+                          WHERE token_hash = $1 AND purpose = $2
+                          AND expires_at > (now() at time zone 'utc') RETURNING *`
+
+	err := repo.db.GetContext(ctx, &session, sqlQuery, tokenHash, purpose)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ConsumeWebAuthnSession: %w", err)
+	}
+
+	return &session, nil
+}
+
+func (repo *UserRepository) InsertWebAuthnCredential(
+	ctx context.Context,
+	passkey *WebAuthnCredential,
+) (*WebAuthnCredential, error) {
+	var created WebAuthnCredential
+	sqlQuery := `INSERT INTO webauthn_credentials
+                          (user_id, name, credential_id, public_key, attestation_type,
+                           transports, aaguid, flags, sign_count)
+                          VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING *`
+
+	err := repo.db.GetContext(
+		ctx,
+		&created,
+		sqlQuery,
+		passkey.UserID,
+		passkey.Name,
+		passkey.CredentialID,
+		passkey.PublicKey,
+		passkey.AttestationType,
+		passkey.Transports,
+		passkey.AAGUID,
+		passkey.Flags,
+		passkey.SignCount,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("InsertWebAuthnCredential: %w", err)
+	}
+
+	return &created, nil
+}
+
+func (repo *UserRepository) FindWebAuthnCredentials(
+	ctx context.Context,
+	userID string,
+) ([]WebAuthnCredential, error) {
+	passkeys := []WebAuthnCredential{}
+	sqlQuery := `SELECT * FROM webauthn_credentials WHERE user_id = $1 ORDER BY id`
+
+	if err := repo.db.SelectContext(ctx, &passkeys, sqlQuery, userID); err != nil {
+		return nil, fmt.Errorf("FindWebAuthnCredentials: %w", err)
+	}
+
+	return passkeys, nil
+}
+
+// UpdateWebAuthnCredentialUse records a login with a passkey.
+func (repo *UserRepository) UpdateWebAuthnCredentialUse(
+	ctx context.Context,
+	id string,
+	signCount int64,
+	flags int16,
+) error {
+	sqlQuery := `UPDATE webauthn_credentials SET sign_count = $2, flags = $3,
+                          last_used_at = (now() at time zone 'utc')
+                          WHERE id = $1`
+
+	result, err := repo.db.ExecContext(ctx, sqlQuery, id, signCount, flags)
+	if err != nil {
+		return fmt.Errorf("UpdateWebAuthnCredentialUse: %w", err)
+	}
+
+	return expectAffected("UpdateWebAuthnCredentialUse", result)
+}
+
+func (repo *UserRepository) DeleteWebAuthnCredential(
+	ctx context.Context,
+	userID string,
+	id string,
+) error {
+	sqlQuery := `DELETE FROM webauthn_credentials WHERE id = $1 AND user_id = $2`
+
+	result, err := repo.db.ExecContext(ctx, sqlQuery, id, userID)
+	if err != nil {
+		return fmt.Errorf("DeleteWebAuthnCredential: %w", err)
+	}
+
+	return expectAffected("DeleteWebAuthnCredential", result)
+}
+
+// InsertPersonalAccessToken stores a personal access token expiring after ttl.
+func (repo *UserRepository) InsertPersonalAccessToken(
+	ctx context.Context,
+	token *PersonalAccessToken,
+	ttl time.Duration,
+) (*PersonalAccessToken, error) {
+	var created PersonalAccessToken
+	sqlQuery := `INSERT INTO personal_access_tokens
+                          (user_id, name, token_hash, scopes, organization_id, expires_at)
+                          VALUES ($1, $2, $3, $4, $5,
+                          (now() at time zone 'utc') + make_interval(secs => $6)) RETURNING *`
+
+	err := repo.db.GetContext(
+		ctx,
+		&created,
+		sqlQuery,
+		token.UserID,
+		token.Name,
+		token.TokenHash,
+		token.Scopes,
+		token.OrganizationID,
+		ttl.Seconds(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("InsertPersonalAccessToken: %w", err)
+	}
+
+	return &created, nil
+}
+
+func (repo *UserRepository) FindPersonalAccessTokens(
+	ctx context.Context,
+	userID string,
+) ([]PersonalAccessToken, error) {
+	tokens := []PersonalAccessToken{}
+	sqlQuery := `SELECT * FROM personal_access_tokens WHERE user_id = $1 ORDER BY id`
+
+	if err := repo.db.SelectContext(ctx, &tokens, sqlQuery, userID); err != nil {
+		return nil, fmt.Errorf("FindPersonalAccessTokens: %w", err)
+	}
+
+	return tokens, nil
+}
+
+// UsePersonalAccessToken records a request from ip made with the unexpired
+// token with tokenHash and returns it, failing with ErrInvalidToken when
+// there is none.
+func (repo *UserRepository) UsePersonalAccessToken(
+	ctx context.Context,
+	tokenHash string,
+	ip string,
+) (*PersonalAccessToken, error) {
+	var token PersonalAccessToken
+	sqlQuery := `UPDATE personal_access_tokens
+                          SET last_used_at = (now() at time zone 'utc'), last_used_ip = $2
+                          WHERE token_hash = $1 AND expires_at > (now() at time zone 'utc')
+                          RETURNING *`
+
+	err := repo.db.GetContext(ctx, &token, sqlQuery, tokenHash, ip)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, fmt.Errorf("UsePersonalAccessToken: %w", err)
+	}
+
+	return &token, nil
+}
+
+// FindPersonalAccessToken returns the unexpired token with tokenHash without
+// recording a use of it, failing with ErrInvalidToken when there is none.
+func (repo *UserRepository) FindPersonalAccessToken(
+	ctx context.Context,
+	tokenHash string,
+) (*PersonalAccessToken, error) {
+	var token PersonalAccessToken
+	sqlQuery := `SELECT * FROM personal_access_tokens
+                          WHERE token_hash = $1 AND expires_at > (now() at time zone 'utc')`
+
+	err := repo.db.GetContext(ctx, &token, sqlQuery, tokenHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, fmt.Errorf("FindPersonalAccessToken: %w", err)
+	}
+
+	return &token, nil
+}
+
+func (repo *UserRepository) DeletePersonalAccessToken(
+	ctx context.Context,
+	userID string,
+	id string,
+) error {
+	sqlQuery := `DELETE FROM personal_access_tokens WHERE id = $1 AND user_id = $2`
+
+	result, err := repo.db.ExecContext(ctx, sqlQuery, id, userID)
+	if err != nil {
+		return fmt.Errorf("DeletePersonalAccessToken: %w", err)
+	}
+
+	return expectAffected("DeletePersonalAccessToken", result)
+}
+
+func (repo *UserRepository) InsertServiceAccount(
+	ctx context.Context,
+	account *ServiceAccount,
+) (*ServiceAccount, error) {
+	var created ServiceAccount
+	sqlQuery := `INSERT INTO service_accounts
+                          (organization_id, name, client_id, secret_hash, public_key,
+                          can_introspect)
+                          VALUES ($1, $2, $3, $4, $5, $6) RETURNING *`
+
+	err := repo.db.GetContext(
+		ctx,
+		&created,
+		sqlQuery,
+		account.OrganizationID,
+		account.Name,
+		account.ClientID,
+		account.SecretHash,
+		account.PublicKey,
+		account.CanIntrospect,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("InsertServiceAccount: %w", err)
+	}
+
+	return &created, nil
+}
+
+func (repo *UserRepository) FindServiceAccountByClientID(
+	ctx context.Context,
+	clientID string,
+) (*ServiceAccount, error) {
+	var account ServiceAccount
+	sqlQuery := `SELECT * FROM service_accounts WHERE client_id = $1`
+
+	if err := repo.db.GetContext(ctx, &account, sqlQuery, clientID); err != nil {
+		return nil, fmt.Errorf("FindServiceAccountByClientID: %w", err)
+	}
+
+	return &account, nil
+}
+
+func (repo *UserRepository) FindOrganizationServiceAccounts(
+	ctx context.Context,
+	orgID string,
+) ([]ServiceAccount, error) {
+	accounts := []ServiceAccount{}
+	sqlQuery := `SELECT * FROM service_accounts WHERE organization_id = $1 ORDER BY id`
+
+	if err := repo.db.SelectContext(ctx, &accounts, sqlQuery, orgID); err != nil {
+		return nil, fmt.Errorf("FindOrganizationServiceAccounts: %w", err)
+	}
+
+	return accounts, nil
+}
+
+// SetServiceAccountSecret replaces the secret of a service account, which
+// then authenticates with it instead of its public key, and revokes the
+// tokens issued to it so far.
+func (repo *UserRepository) SetServiceAccountSecret(
+	ctx context.Context,
+	clientID string,
+	secretHash string,
+) error {
+	sqlQuery := `UPDATE service_accounts
+                          SET secret_hash = $2, public_key = NULL,
+                          tokens_valid_after = ` + revocationCutoff + `,
+                          updated_at = (now() at time zone 'utc')
+                          WHERE client_id = $1`
+
+	result, err := repo.db.ExecContext(ctx, sqlQuery, clientID, secretHash)
+	if err != nil {
+		return fmt.Errorf("SetServiceAccountSecret: %w", err)
+	}
+
+	return expectAffected("SetServiceAccountSecret", result)
+}
+
+// SetServiceAccountDisabled disables or enables a service account. Tokens
+// issued before it was disabled stay revoked once it is enabled again.
+func (repo *UserRepository) SetServiceAccountDisabled(
+	ctx context.Context,
+	clientID string,
+	disabled bool,
+) error {
+	sqlQuery := `UPDATE service_accounts
+                          SET disabled_at = CASE WHEN $2 THEN (now() at time zone 'utc') END,
+                          tokens_valid_after = CASE WHEN $2 THEN ` + revocationCutoff + `
+                              ELSE tokens_valid_after END,
+                          updated_at = (now() at time zone 'utc')
+                          WHERE client_id = $1`
+
+	result, err := repo.db.ExecContext(ctx, sqlQuery, clientID, disabled)
+	if err != nil {
+		return fmt.Errorf("SetServiceAccountDisabled: %w", err)
+	}
+
+	return expectAffected("SetServiceAccountDisabled", result)
+}
+
+func (repo *UserRepository) DeleteServiceAccount(ctx context.Context, clientID string) error {
+	sqlQuery := `DELETE FROM service_accounts WHERE client_id = $1`
+
+	result, err := repo.db.ExecContext(ctx, sqlQuery, clientID)
+	if err != nil {
+		return fmt.Errorf("DeleteServiceAccount: %w", err)
+	}
+
+	return expectAffected("DeleteServiceAccount", result)
+}
+
+// AssignServiceAccountRole grants a role within the organization that owns
+// the service account, or within one of its branches when branchID is set.
+func (repo *UserRepository) AssignServiceAccountRole(
+	ctx context.Context,
+	clientID string,
+	roleName string,
+	branchID string,
+) error {
+	account, err := repo.FindServiceAccountByClientID(ctx, clientID)
+	if err != nil {
+		return fmt.Errorf("AssignServiceAccountRole: %w", err)
+	}
+
+	var exists bool
+	err = repo.db.QueryRowContext(
+		ctx,
+		`SELECT EXISTS (SELECT 1 FROM roles r WHERE r.name = $1 AND r.scope = $2)`,
+		roleName,
+		roleScope(account.OrganizationID, branchID),
+	).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("AssignServiceAccountRole: %w", err)
+	}
+
+	if !exists {
+		return fmt.Errorf("AssignServiceAccountRole: %w", ErrRoleNotFound)
+	}
+
+	if branchID != "" {
+		err = repo.db.QueryRowContext(
+			ctx,
+			`SELECT EXISTS (SELECT 1 FROM branches b WHERE b.id = $1 AND b.organization_id = $2)`,
+			branchID,
+			account.OrganizationID,
+		).Scan(&exists)
+		if err != nil {
+			return fmt.Errorf("AssignServiceAccountRole: %w", err)
+		}
+
+		if !exists {
+			return fmt.Errorf("AssignServiceAccountRole: %w", ErrBranchNotFound)
+		}
+	}
+
+	query := `
+		INSERT INTO service_account_roles
+			(service_account_id, role_id, organization_id, branch_id)
+		SELECT $1, r.id, $3, $4
+		FROM roles r
+		WHERE r.name = $2 AND r.scope = $5
+		ON CONFLICT DO NOTHING
+	`
+
+	_, err = repo.db.ExecContext(
+		ctx,
+		query,
+		account.ID,
+		roleName,
+		account.OrganizationID,
+		nullable(branchID),
+		roleScope(account.OrganizationID, branchID),
+	)
+	if err != nil {
+		return fmt.Errorf("AssignServiceAccountRole: %w", err)
+	}
+
+	return nil
+}
+
+func (repo *UserRepository) RevokeServiceAccountRole(
+	ctx context.Context,
+	clientID string,
+	roleName string,
+	branchID string,
+) error {
+	query := `
+		DELETE FROM service_account_roles sar
+		USING roles r, service_accounts sa
+		WHERE sar.role_id = r.id
+			AND sar.service_account_id = sa.id
+			AND sa.client_id = $1
+			AND r.name = $2
+			AND sar.branch_id IS NOT DISTINCT FROM $3
+	`
+
+	result, err := repo.db.ExecContext(ctx, query, clientID, roleName, nullable(branchID))
+	if err != nil {
+		return fmt.Errorf("RevokeServiceAccountRole: %w", err)
+	}
+
+	return expectAffected("RevokeServiceAccountRole", result)
+}
+
+// UseClientAssertion records that the assertion jti of clientID, valid until
+// expiresAt, was redeemed, failing with ErrInvalidClient when it already was.
+func (repo *UserRepository) UseClientAssertion(
+	ctx context.Context,
+	clientID string,
+	jti string,
+	expiresAt time.Time,
+) error {
+	_, err := repo.db.ExecContext(
+		ctx,
+		`DELETE FROM client_assertions WHERE expires_at < (now() at time zone 'utc')`,
+	)
+	if err != nil {
+		return fmt.Errorf("UseClientAssertion: %w", err)
+	}
+
+	sqlQuery := `INSERT INTO client_assertions (client_id, jti, expires_at)
+                          VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`
+
+	result, err := repo.db.ExecContext(ctx, sqlQuery, clientID, jti, expiresAt.UTC())
+	if err != nil {
+		return fmt.Errorf("UseClientAssertion: %w", err)
+	}
+
+	if err := expectAffected("UseClientAssertion", result); errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("UseClientAssertion: %w", ErrInvalidClient)
+	} else if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (repo *UserRepository) InsertOAuthClient(
+	ctx context.Context,
+	client *OAuthClient,
+) (*OAuthClient, error) {
+	var created OAuthClient
+	sqlQuery := `INSERT INTO oauth_clients
+                          (client_id, name, secret_hash, redirect_uris, first_party,
+                          can_introspect)
+                          VALUES ($1, $2, $3, $4, $5, $6) RETURNING *`
+
+	err := repo.db.GetContext(
+		ctx,
+		&created,
+		sqlQuery,
+		client.ClientID,
+		client.Name,
+		client.SecretHash,
+		client.RedirectURIs,
+		client.FirstParty,
+		client.CanIntrospect,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("InsertOAuthClient: %w", err)
+	}
+
+	return &created, nil
+}
+
+func (repo *UserRepository) FindOAuthClient(
+	ctx context.Context,
+	clientID string,
+) (*OAuthClient, error) {
+	var client OAuthClient
+	sqlQuery := `SELECT * FROM oauth_clients WHERE client_id = $1`
+
+	if err := repo.db.GetContext(ctx, &client, sqlQuery, clientID); err != nil {
+		return nil, fmt.Errorf("FindOAuthClient: %w", err)
+	}
+
+	return &client, nil
+}
+
+func (repo *UserRepository) FindOAuthClients(ctx context.Context) ([]OAuthClient, error) {
+	clients := []OAuthClient{}
+	sqlQuery := `SELECT * FROM oauth_clients ORDER BY id`
+
+	if err := repo.db.SelectContext(ctx, &clients, sqlQuery); err != nil {
+		return nil, fmt.Errorf("FindOAuthClients: %w", err)
+	}
+
+	return clients, nil
+}
+
+// SetOAuthClientSecret replaces the secret of a client, turning public
+// clients into confidential ones.
+func (repo *UserRepository) SetOAuthClientSecret(
+	ctx context.Context,
+	clientID string,
+	secretHash string,
+) error {
+	sqlQuery := `UPDATE oauth_clients
+                          SET secret_hash = $2, updated_at = (now() at time zone 'utc')
+                          WHERE client_id = $1`
+
+	result, err := repo.db.ExecContext(ctx, sqlQuery, clientID, secretHash)
+	if err != nil {
+		return fmt.Errorf("SetOAuthClientSecret: %w", err)
+	}
+
+	return expectAffected("SetOAuthClientSecret", result)
+}
+
+func (repo *UserRepository) DeleteOAuthClient(ctx context.Context, clientID string) error {
+	sqlQuery := `DELETE FROM oauth_clients WHERE client_id = $1`
+
+	result, err := repo.db.ExecContext(ctx, sqlQuery, clientID)
+	if err != nil {
+		return fmt.Errorf("DeleteOAuthClient: %w", err)
+	}
+
+	return expectAffected("DeleteOAuthClient", result)
+}
+
+// FindOAuthConsent returns the scopes userID allowed clientID to ask for,
+// none when they never consented.
+func (repo *UserRepository) FindOAuthConsent(
+	ctx context.Context,
+	userID string,
+	clientID string,
+) ([]string, error) {
+	var scopes pq.StringArray
+	sqlQuery := `SELECT scopes FROM oauth_consents WHERE user_id = $1 AND client_id = $2`
+
+	err := repo.db.GetContext(ctx, &scopes, sqlQuery, userID, clientID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("FindOAuthConsent: %w", err)
+	}
+
+	return scopes, nil
+}
+
+// SaveOAuthConsent adds scopes to those userID allowed clientID to ask for.
+func (repo *UserRepository) SaveOAuthConsent(
+	ctx context.Context,
+	userID string,
+	clientID string,
+	scopes []string,
+) error {
+	sqlQuery := `INSERT INTO oauth_consents (user_id, client_id, scopes)
+                          VALUES ($1, $2, $3)
+                          ON CONFLICT (user_id, client_id) DO UPDATE
+                          SET scopes = ARRAY(
+                              SELECT DISTINCT unnest(oauth_consents.scopes || EXCLUDED.scopes)
+                              ORDER BY 1),
+                          updated_at = (now() at time zone 'utc')`
+
+	_, err := repo.db.ExecContext(ctx, sqlQuery, userID, clientID, pq.StringArray(scopes))
+	if err != nil {
+		return fmt.Errorf("SaveOAuthConsent: %w", err)
+	}
+
+	return nil
+}
+
+// RevokeToken refuses the token with tokenHash until expiresAt, forgetting
+// tokens that expired since they were revoked.
+func (repo *UserRepository) RevokeToken(
+	ctx context.Context,
+	tokenHash string,
+	expiresAt time.Time,
+) error {
+	_, err := repo.db.ExecContext(
+		ctx,
+		`DELETE FROM revoked_tokens WHERE expires_at < (now() at time zone 'utc')`,
+	)
+	if err != nil {
+		return fmt.Errorf("RevokeToken: %w", err)
+	}
+
+	sqlQuery := `INSERT INTO revoked_tokens (token_hash, expires_at)
+                          VALUES ($1, $2) ON CONFLICT DO NOTHING`
+
+	if _, err := repo.db.ExecContext(ctx, sqlQuery, tokenHash, expiresAt.UTC()); err != nil {
+		return fmt.Errorf("RevokeToken: %w", err)
+	}
+
+	return nil
+}
+
+func (repo *UserRepository) IsTokenRevoked(ctx context.Context, tokenHash string) (bool, error) {
+	var revoked bool
+	sqlQuery := `SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE token_hash = $1)`
+
+	if err := repo.db.GetContext(ctx, &revoked, sqlQuery, tokenHash); err != nil {
+		return false, fmt.Errorf("IsTokenRevoked: %w", err)
+	}
+
+	return revoked, nil
+}
+
+// SetTOTPSecret stores a sealed TOTP secret awaiting confirmation. Until
+// EnableTOTP is called the user signs in without codes.
+func (repo *UserRepository) SetTOTPSecret(
+	ctx context.Context,
+	userID string,
+	sealedSecret string,
+) error {
+	sqlQuery := `UPDATE users SET totp_secret = $2, totp_enabled_at = NULL, totp_last_step = NULL,
+                          updated_at = (now() at time zone 'utc')
+                          WHERE id = $1`
+
+	result, err := repo.db.ExecContext(ctx, sqlQuery, userID, sealedSecret)
+	if err != nil {
+		return fmt.Errorf("SetTOTPSecret: %w", err)
+	}
+
+	return expectAffected("SetTOTPSecret", result)
+}
+
+// EnableTOTP turns on the confirmed TOTP secret, recording step as used, and
+// replaces the recovery codes of the user with codeHashes.
+func (repo *UserRepository) EnableTOTP(
+	ctx context.Context,
+	userID string,
+	step int64,
+	codeHashes []string,
+) error {
+	tx, err := repo.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("EnableTOTP: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `UPDATE users SET totp_enabled_at = (now() at time zone 'utc'),
+                          totp_last_step = $2, updated_at = (now() at time zone 'utc')
+                          WHERE id = $1 AND totp_secret IS NOT NULL`, userID, step)
+	if err != nil {
+		return fmt.Errorf("EnableTOTP: %w", err)
+	}
+	if err := expectAffected("EnableTOTP", result); err != nil {
+		return err
+	}
+
+	if err := replaceRecoveryCodes(ctx, tx, userID, codeHashes); err != nil {
+		return fmt.Errorf("EnableTOTP: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("EnableTOTP: %w", err)
+	}
+
+	return nil
+}
+
+// ReplaceRecoveryCodes discards the recovery codes of the user, used or not,
+// in favour of codeHashes.
+func (repo *UserRepository) ReplaceRecoveryCodes(
+	ctx context.Context,
+	userID string,
+	codeHashes []string,
+) error {
+	tx, err := repo.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("ReplaceRecoveryCodes: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := replaceRecoveryCodes(ctx, tx, userID, codeHashes); err != nil {
+		return fmt.Errorf("ReplaceRecoveryCodes: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("ReplaceRecoveryCodes: %w", err)
+	}
+
+	return nil
+}
+
+func replaceRecoveryCodes(
+	ctx context.Context,
+	tx *sqlx.Tx,
+	userID string,
+	codeHashes []string,
+) error {
+	if _, err := tx.ExecContext(
+		ctx,
+		`DELETE FROM user_recovery_codes WHERE user_id = $1`,
+		userID,
+	); err != nil {
+		return err
+	}
+
+	for _, codeHash := range codeHashes {
+		if _, err := tx.ExecContext(
+			ctx,
+			`INSERT INTO user_recovery_codes (user_id, code_hash) VALUES ($1, $2)`,
+			userID,
+			codeHash,
+		); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DisableTOTP removes the TOTP secret and the recovery codes of the user.
+func (repo *UserRepository) DisableTOTP(ctx context.Context, userID string) error {
+	tx, err := repo.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("DisableTOTP: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `UPDATE users SET totp_secret = NULL,
+                          totp_enabled_at = NULL, totp_last_step = NULL,
+                          updated_at = (now() at time zone 'utc')
+                          WHERE id = $1`, userID)
+	if err != nil {
+		return fmt.Errorf("DisableTOTP: %w", err)
+	}
+	if err := expectAffected("DisableTOTP", result); err != nil {
+		return err
+	}
+
+	if err := replaceRecoveryCodes(ctx, tx, userID, nil); err != nil {
+		return fmt.Errorf("DisableTOTP: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("DisableTOTP: %w", err)
+	}
+
+	return nil
+}
+
+// AdvanceTOTPStep records step as the last TOTP step used by the user. It
+// fails with ErrInvalidMFACode when that step or a later one was already
+// used, so concurrent logins cannot both spend one code.
+func (repo *UserRepository) AdvanceTOTPStep(ctx context.Context, userID string, step int64) error {
+	sqlQuery := `UPDATE users SET totp_last_step = $2
+                          WHERE id = $1 AND (totp_last_step IS NULL OR totp_last_step < $2)`
+
+	result, err := repo.db.ExecContext(ctx, sqlQuery, userID, step)
+	if err != nil {
+		return fmt.Errorf("AdvanceTOTPStep: %w", err)
+	}
+
+	if err := expectAffected("AdvanceTOTPStep", result); errors.Is(err, sql.ErrNoRows) {
+		return ErrInvalidMFACode
+	} else if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UseRecoveryCode spends an unused recovery code of the user, failing with
+// ErrInvalidMFACode when there is none with codeHash.
+func (repo *UserRepository) UseRecoveryCode(
+	ctx context.Context,
+	userID string,
+	codeHash string,
+) error {
+	sqlQuery := `UPDATE user_recovery_codes SET used_at = (now() at time zone 'utc')
+                          WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`
+
+	result, err := repo.db.ExecContext(ctx, sqlQuery, userID, codeHash)
+	if err != nil {
+		return fmt.Errorf("UseRecoveryCode: %w", err)
+	}
+
+	if err := expectAffected("UseRecoveryCode", result); errors.Is(err, sql.ErrNoRows) {
+		return ErrInvalidMFACode
+	} else if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RequiresMFA reports whether a role of the user, or an organization the user
+// has a role in, requires multi-factor authentication.
+func (repo *UserRepository) RequiresMFA(ctx context.Context, userID string) (bool, error) {
+	sqlQuery := `SELECT EXISTS (
+                              SELECT 1
+                              FROM user_roles ur
+                              JOIN roles r ON r.id = ur.role_id
+                              LEFT JOIN organizations o ON o.id = ur.organization_id
+                              WHERE ur.user_id = $1
+                                AND (r.require_mfa OR COALESCE(o.require_mfa, FALSE))
+                          )`
+
+	var required bool
+	if err := repo.db.GetContext(ctx, &required, sqlQuery, userID); err != nil {
+		return false, fmt.Errorf("RequiresMFA: %w", err)
+	}
+
+	return required, nil
+}
+
+// SetRoleRequiresMFA sets whether holders of a role must use multi-factor
+// authentication.
+func (repo *UserRepository) SetRoleRequiresMFA(
+	ctx context.Context,
+	roleName string,
+	scope string,
+	required bool,
+) error {
+	sqlQuery := `UPDATE roles SET require_mfa = $3, updated_at = (now() at time zone 'utc')
+                          WHERE name = $1 AND scope = $2`
+
+	result, err := repo.db.ExecContext(ctx, sqlQuery, roleName, scope, required)
+	if err != nil {
+		return fmt.Errorf("SetRoleRequiresMFA: %w", err)
+	}
+
+	if err := expectAffected("SetRoleRequiresMFA", result); errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("SetRoleRequiresMFA: %w", ErrRoleNotFound)
+	} else if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (repo *UserRepository) AssignRole(
+	ctx context.Context,
+	userID string,
+	roleName string,
+	orgID string,
+	branchID string,
+) error {
+	query := `
+		INSERT INTO user_roles (user_id, role_id, organization_id, branch_id)
+		SELECT $1, r.id, $3, $4
+		FROM roles r
+		WHERE r.name = $2 AND r.scope = $5
+		ON CONFLICT DO NOTHING
+	`
+
+	var exists bool
+	err := repo.db.QueryRowContext(
+		ctx,
+		`SELECT EXISTS (SELECT 1 FROM roles r WHERE r.name = $1 AND r.scope = $2)`,
+		roleName,
+		roleScope(orgID, branchID),
+	).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("AssignRole: %w", err)
+	}
+
+	if !exists {
+		return fmt.Errorf("AssignRole: %w", ErrRoleNotFound)
+	}
+
+	_, err = repo.db.ExecContext(
+		ctx,
+		query,
+		userID,
+		roleName,
+		nullable(orgID),
+		nullable(branchID),
+		roleScope(orgID, branchID),
+	)
+	if err != nil {
+		return fmt.Errorf("AssignRole: %w", err)
+	}
+
+	return nil
+}
+
+func (repo *UserRepository) RevokeRole(
+	ctx context.Context,
+	userID string,
+	roleName string,
+	orgID string,
+	branchID string,
+) error {
+	query := `
+		DELETE FROM user_roles ur
+		USING roles r
+		WHERE ur.role_id = r.id
+			AND ur.user_id = $1
+			AND r.name = $2
+			AND ur.organization_id IS NOT DISTINCT FROM $3
+			AND ur.branch_id IS NOT DISTINCT FROM $4
+	`
+
+	result, err := repo.db.ExecContext(
+		ctx,
+		query,
+		userID,
+		roleName,
+		nullable(orgID),
+		nullable(branchID),
+	)
+	if err != nil {
+		return fmt.Errorf("RevokeRole: %w", err)
+	}
+
+	return expectAffected("RevokeRole", result)
+}
+
+func (repo *UserRepository) InsertOrganization(
+	ctx context.Context,
+	org *OrganizationEntity,
+	branches []BranchEntity,
+) (*OrganizationEntity, error) {
+	tx, err := repo.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("InsertOrganization: %w", err)
+	}
+	defer tx.Rollback()
+
+	var insertResult OrganizationEntity
+	orgQuery := `
+		INSERT INTO organizations
+			(id, external_company_id, external_head_office_id, name, description, require_mfa)
+		VALUES (COALESCE($1, gen_monotonic_ulid()), $2, $3, $4, $5, $6)
+		ON CONFLICT (id) DO UPDATE SET
+			external_company_id = EXCLUDED.external_company_id,
+			external_head_office_id = EXCLUDED.external_head_office_id,
+			name = EXCLUDED.name,
+			description = EXCLUDED.description,
+			require_mfa = EXCLUDED.require_mfa,
+			updated_at = (now() at time zone 'utc')
+		RETURNING *
+	`
+
+	err = tx.GetContext(
+		ctx,
+		&insertResult,
+		orgQuery,
+		nullable(org.ID),
+		org.ExternalCompanyId,
+		org.ExternalHeadOfficeId,
+		org.Name,
+		org.Description,
+		org.RequireMFA,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("InsertOrganization: %w", err)
+	}
+
+	branchQuery := `
+		INSERT INTO branches (external_office_id, cnpj, organization_id, name, description, is_warehouse)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (organization_id, cnpj) DO UPDATE SET
+			external_office_id = EXCLUDED.external_office_id,
+			name = EXCLUDED.name,
+			description = EXCLUDED.description,
+			is_warehouse = EXCLUDED.is_warehouse,
+			updated_at = (now() at time zone 'utc')
+	`
+
+	for _, branch := range branches {
+		_, err = tx.ExecContext(
+			ctx,
+			branchQuery,
+			branch.ExternalOfficeId,
+			branch.CNPJ,
+			insertResult.ID,
+			branch.Name,
+			branch.Description,
+			branch.IsWarehouse,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("InsertOrganization: branch %s: %w", branch.CNPJ, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("InsertOrganization: %w", err)
+	}
+
+	return &insertResult, nil
+}
+
+func roleScope(orgID string, branchID string) string {
+	switch {
+	case branchID != "":
+		return "branch"
+	case orgID != "":
+		return "organization"
+	default:
+		return "global"
+	}
+}
+
+func nullable(value string) *string {
+	if value == "" {
+		return nil
+	}
+
+	return &value
+}
+
+const uniqueViolation = "23505"
+
+// isUniqueViolation reports whether err is a PostgreSQL unique_violation.
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == uniqueViolation
+}
+
+func expectAffected(op string, result sql.Result) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if affected == 0 {
+		return fmt.Errorf("%s: %w", op, sql.ErrNoRows)
+	}
+
+	return nil
+}
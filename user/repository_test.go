@@ -1,12 +1,13 @@
 package user
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
+	"os"
 	"strings"
 	"testing"
+	"time"
 
-	"github.com/diegodario88/sesamo/config"
 	"github.com/diegodario88/sesamo/db"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
@@ -19,30 +20,568 @@ type MockUserRepository struct {
 	mock.Mock
 }
 
-func (m *MockUserRepository) FindUserByEmail(email string) (*UserEntity, error) {
+func (m *MockUserRepository) FindUserByEmail(
+	ctx context.Context,
+	email string,
+) (*UserEntity, error) {
 	args := m.Called(email)
 	return args.Get(0).(*UserEntity), args.Error(1)
 }
 
-func (m *MockUserRepository) InsertUser(user *UserEntity) (*UserEntity, error) {
+func (m *MockUserRepository) InsertUser(
+	ctx context.Context,
+	user *UserEntity,
+) (*UserEntity, error) {
 	args := m.Called(user)
 	return args.Get(0).(*UserEntity), args.Error(1)
 }
 
-func (m *MockUserRepository) CountUsers() (int, error) {
+func (m *MockUserRepository) CountUsers(ctx context.Context) (int, error) {
 	args := m.Called()
 	return args.Int(0), args.Error(1)
 }
 
+func (m *MockUserRepository) FindUserById(ctx context.Context, id string) (*UserEntity, error) {
+	args := m.Called(id)
+	return args.Get(0).(*UserEntity), args.Error(1)
+}
+
+func (m *MockUserRepository) FindAllUsers(
+	ctx context.Context,
+	query UserQuery,
+) (*UserPage, error) {
+	args := m.Called(query)
+	return args.Get(0).(*UserPage), args.Error(1)
+}
+
+func (m *MockUserRepository) HasAccess(
+	ctx context.Context,
+	userId string,
+	permission string,
+) (bool, error) {
+	args := m.Called(userId, permission)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockUserRepository) GetRoles(ctx context.Context, userId string) ([]string, error) {
+	args := m.Called(userId)
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *MockUserRepository) GetUserOrganizations(
+	ctx context.Context,
+	userId string,
+) ([]OrganizationEntity, error) {
+	args := m.Called(userId)
+	return args.Get(0).([]OrganizationEntity), args.Error(1)
+}
+
+func (m *MockUserRepository) GetUserBranches(
+	ctx context.Context,
+	userId string,
+	orgId string,
+) ([]BranchEntity, error) {
+	args := m.Called(userId, orgId)
+	return args.Get(0).([]BranchEntity), args.Error(1)
+}
+
+func (m *MockUserRepository) FindOrganizationUsers(
+	ctx context.Context,
+	orgID string,
+	query UserQuery,
+) (*UserPage, error) {
+	args := m.Called(orgID, query)
+	return args.Get(0).(*UserPage), args.Error(1)
+}
+
+func (m *MockUserRepository) FindOrganizationUserByID(
+	ctx context.Context,
+	orgID string,
+	userID string,
+) (*UserEntity, error) {
+	args := m.Called(orgID, userID)
+	return args.Get(0).(*UserEntity), args.Error(1)
+}
+
+func (m *MockUserRepository) FindBranchUsers(
+	ctx context.Context,
+	orgID string,
+	branchID string,
+	query UserQuery,
+) (*UserPage, error) {
+	args := m.Called(orgID, branchID, query)
+	return args.Get(0).(*UserPage), args.Error(1)
+}
+
+func (m *MockUserRepository) GetOrganizationBranches(
+	ctx context.Context,
+	orgID string,
+) ([]BranchEntity, error) {
+	args := m.Called(orgID)
+	return args.Get(0).([]BranchEntity), args.Error(1)
+}
+
+func (m *MockUserRepository) SetUserPassword(
+	ctx context.Context,
+	userID string,
+	passwordHash string,
+) (time.Time, error) {
+	args := m.Called(userID, passwordHash)
+	return args.Get(0).(time.Time), args.Error(1)
+}
+
+func (m *MockUserRepository) SetUserStatus(
+	ctx context.Context,
+	userID string,
+	status string,
+	reason *string,
+) (*UserEntity, error) {
+	args := m.Called(userID, status, reason)
+	return args.Get(0).(*UserEntity), args.Error(1)
+}
+
+func (m *MockUserRepository) RevokeUserTokens(ctx context.Context, userID string) error {
+	args := m.Called(userID)
+	return args.Error(0)
+}
+
+func (m *MockUserRepository) RehashUserPassword(
+	ctx context.Context,
+	userID string,
+	oldHash string,
+	newHash string,
+) error {
+	args := m.Called(userID, oldHash, newHash)
+	return args.Error(0)
+}
+
+func (m *MockUserRepository) FindLoginFailures(
+	ctx context.Context,
+	emailHash string,
+) (*LoginFailures, error) {
+	args := m.Called(emailHash)
+	return args.Get(0).(*LoginFailures), args.Error(1)
+}
+
+func (m *MockUserRepository) RecordFailedLogin(
+	ctx context.Context,
+	emailHash string,
+	forgetAfter time.Duration,
+) (int, error) {
+	args := m.Called(emailHash, forgetAfter)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockUserRepository) ClearFailedLogins(ctx context.Context, emailHash string) (int, error) {
+	args := m.Called(emailHash)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockUserRepository) SetTOTPSecret(
+	ctx context.Context,
+	userID string,
+	sealedSecret string,
+) error {
+	args := m.Called(userID, sealedSecret)
+	return args.Error(0)
+}
+
+func (m *MockUserRepository) EnableTOTP(
+	ctx context.Context,
+	userID string,
+	step int64,
+	codeHashes []string,
+) error {
+	args := m.Called(userID, step, codeHashes)
+	return args.Error(0)
+}
+
+func (m *MockUserRepository) ReplaceRecoveryCodes(
+	ctx context.Context,
+	userID string,
+	codeHashes []string,
+) error {
+	args := m.Called(userID, codeHashes)
+	return args.Error(0)
+}
+
+func (m *MockUserRepository) DisableTOTP(ctx context.Context, userID string) error {
+	args := m.Called(userID)
+	return args.Error(0)
+}
+
+func (m *MockUserRepository) AdvanceTOTPStep(
+	ctx context.Context,
+	userID string,
+	step int64,
+) error {
+	args := m.Called(userID, step)
+	return args.Error(0)
+}
+
+func (m *MockUserRepository) UseRecoveryCode(
+	ctx context.Context,
+	userID string,
+	codeHash string,
+) error {
+	args := m.Called(userID, codeHash)
+	return args.Error(0)
+}
+
+func (m *MockUserRepository) RequiresMFA(ctx context.Context, userID string) (bool, error) {
+	args := m.Called(userID)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockUserRepository) SetRoleRequiresMFA(
+	ctx context.Context,
+	roleName string,
+	scope string,
+	required bool,
+) error {
+	args := m.Called(roleName, scope, required)
+	return args.Error(0)
+}
+
+func (m *MockUserRepository) CreateWebAuthnSession(
+	ctx context.Context,
+	session *WebAuthnSession,
+	ttl time.Duration,
+) error {
+	args := m.Called(session, ttl)
+	return args.Error(0)
+}
+
+func (m *MockUserRepository) ConsumeWebAuthnSession(
+	ctx context.Context,
+	purpose string,
+	tokenHash string,
+) (*WebAuthnSession, error) {
+	args := m.Called(purpose, tokenHash)
+	return args.Get(0).(*WebAuthnSession), args.Error(1)
+}
+
+func (m *MockUserRepository) InsertWebAuthnCredential(
+	ctx context.Context,
+	passkey *WebAuthnCredential,
+) (*WebAuthnCredential, error) {
+	args := m.Called(passkey)
+	return args.Get(0).(*WebAuthnCredential), args.Error(1)
+}
+
+func (m *MockUserRepository) FindWebAuthnCredentials(
+	ctx context.Context,
+	userID string,
+) ([]WebAuthnCredential, error) {
+	args := m.Called(userID)
+	return args.Get(0).([]WebAuthnCredential), args.Error(1)
+}
+
+func (m *MockUserRepository) UpdateWebAuthnCredentialUse(
+	ctx context.Context,
+	id string,
+	signCount int64,
+	flags int16,
+) error {
+	args := m.Called(id, signCount, flags)
+	return args.Error(0)
+}
+
+func (m *MockUserRepository) DeleteWebAuthnCredential(
+	ctx context.Context,
+	userID string,
+	id string,
+) error {
+	args := m.Called(userID, id)
+	return args.Error(0)
+}
+
+func (m *MockUserRepository) InsertPersonalAccessToken(
+	ctx context.Context,
+	token *PersonalAccessToken,
+	ttl time.Duration,
+) (*PersonalAccessToken, error) {
+	args := m.Called(token, ttl)
+	return args.Get(0).(*PersonalAccessToken), args.Error(1)
+}
+
+func (m *MockUserRepository) FindPersonalAccessTokens(
+	ctx context.Context,
+	userID string,
+) ([]PersonalAccessToken, error) {
+	args := m.Called(userID)
+	return args.Get(0).([]PersonalAccessToken), args.Error(1)
+}
+
+func (m *MockUserRepository) UsePersonalAccessToken(
+	ctx context.Context,
+	tokenHash string,
+	ip string,
+) (*PersonalAccessToken, error) {
+	args := m.Called(tokenHash, ip)
+	return args.Get(0).(*PersonalAccessToken), args.Error(1)
+}
+
+func (m *MockUserRepository) FindPersonalAccessToken(
+	ctx context.Context,
+	tokenHash string,
+) (*PersonalAccessToken, error) {
+	args := m.Called(tokenHash)
+	return args.Get(0).(*PersonalAccessToken), args.Error(1)
+}
+
+func (m *MockUserRepository) DeletePersonalAccessToken(
+	ctx context.Context,
+	userID string,
+	id string,
+) error {
+	args := m.Called(userID, id)
+	return args.Error(0)
+}
+
+func (m *MockUserRepository) InsertServiceAccount(
+	ctx context.Context,
+	account *ServiceAccount,
+) (*ServiceAccount, error) {
+	args := m.Called(account)
+	return args.Get(0).(*ServiceAccount), args.Error(1)
+}
+
+func (m *MockUserRepository) FindServiceAccountByClientID(
+	ctx context.Context,
+	clientID string,
+) (*ServiceAccount, error) {
+	args := m.Called(clientID)
+	return args.Get(0).(*ServiceAccount), args.Error(1)
+}
+
+func (m *MockUserRepository) FindOrganizationServiceAccounts(
+	ctx context.Context,
+	orgID string,
+) ([]ServiceAccount, error) {
+	args := m.Called(orgID)
+	return args.Get(0).([]ServiceAccount), args.Error(1)
+}
+
+func (m *MockUserRepository) SetServiceAccountSecret(
+	ctx context.Context,
+	clientID string,
+	secretHash string,
+) error {
+	args := m.Called(clientID, secretHash)
+	return args.Error(0)
+}
+
+func (m *MockUserRepository) SetServiceAccountDisabled(
+	ctx context.Context,
+	clientID string,
+	disabled bool,
+) error {
+	args := m.Called(clientID, disabled)
+	return args.Error(0)
+}
+
+func (m *MockUserRepository) DeleteServiceAccount(ctx context.Context, clientID string) error {
+	args := m.Called(clientID)
+	return args.Error(0)
+}
+
+func (m *MockUserRepository) AssignServiceAccountRole(
+	ctx context.Context,
+	clientID string,
+	roleName string,
+	branchID string,
+) error {
+	args := m.Called(clientID, roleName, branchID)
+	return args.Error(0)
+}
+
+func (m *MockUserRepository) RevokeServiceAccountRole(
+	ctx context.Context,
+	clientID string,
+	roleName string,
+	branchID string,
+) error {
+	args := m.Called(clientID, roleName, branchID)
+	return args.Error(0)
+}
+
+func (m *MockUserRepository) UseClientAssertion(
+	ctx context.Context,
+	clientID string,
+	jti string,
+	expiresAt time.Time,
+) error {
+	args := m.Called(clientID, jti, expiresAt)
+	return args.Error(0)
+}
+
+func (m *MockUserRepository) InsertOAuthClient(
+	ctx context.Context,
+	client *OAuthClient,
+) (*OAuthClient, error) {
+	args := m.Called(client)
+	return args.Get(0).(*OAuthClient), args.Error(1)
+}
+
+func (m *MockUserRepository) FindOAuthClient(
+	ctx context.Context,
+	clientID string,
+) (*OAuthClient, error) {
+	args := m.Called(clientID)
+	return args.Get(0).(*OAuthClient), args.Error(1)
+}
+
+func (m *MockUserRepository) FindOAuthClients(ctx context.Context) ([]OAuthClient, error) {
+	args := m.Called()
+	return args.Get(0).([]OAuthClient), args.Error(1)
+}
+
+func (m *MockUserRepository) SetOAuthClientSecret(
+	ctx context.Context,
+	clientID string,
+	secretHash string,
+) error {
+	args := m.Called(clientID, secretHash)
+	return args.Error(0)
+}
+
+func (m *MockUserRepository) DeleteOAuthClient(ctx context.Context, clientID string) error {
+	args := m.Called(clientID)
+	return args.Error(0)
+}
+
+func (m *MockUserRepository) FindOAuthConsent(
+	ctx context.Context,
+	userID string,
+	clientID string,
+) ([]string, error) {
+	args := m.Called(userID, clientID)
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *MockUserRepository) SaveOAuthConsent(
+	ctx context.Context,
+	userID string,
+	clientID string,
+	scopes []string,
+) error {
+	args := m.Called(userID, clientID, scopes)
+	return args.Error(0)
+}
+
+func (m *MockUserRepository) RevokeToken(
+	ctx context.Context,
+	tokenHash string,
+	expiresAt time.Time,
+) error {
+	args := m.Called(tokenHash, expiresAt)
+	return args.Error(0)
+}
+
+func (m *MockUserRepository) IsTokenRevoked(ctx context.Context, tokenHash string) (bool, error) {
+	args := m.Called(tokenHash)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockUserRepository) UpdateUserProfile(
+	ctx context.Context,
+	userID string,
+	firstName *string,
+	lastName *string,
+) (*UserEntity, error) {
+	args := m.Called(userID, firstName, lastName)
+	return args.Get(0).(*UserEntity), args.Error(1)
+}
+
+func (m *MockUserRepository) UpdateUserEmail(
+	ctx context.Context,
+	userID string,
+	email string,
+) (*UserEntity, error) {
+	args := m.Called(userID, email)
+	return args.Get(0).(*UserEntity), args.Error(1)
+}
+
+func (m *MockUserRepository) MarkEmailVerified(
+	ctx context.Context,
+	userID string,
+) (*UserEntity, error) {
+	args := m.Called(userID)
+	return args.Get(0).(*UserEntity), args.Error(1)
+}
+
+func (m *MockUserRepository) DeleteUser(ctx context.Context, userID string) error {
+	args := m.Called(userID)
+	return args.Error(0)
+}
+
+func (m *MockUserRepository) FindManagedUser(
+	ctx context.Context,
+	manager Manager,
+	userID string,
+) (*UserEntity, error) {
+	args := m.Called(manager, userID)
+	return args.Get(0).(*UserEntity), args.Error(1)
+}
+
+func (m *MockUserRepository) CreateUserToken(
+	ctx context.Context,
+	token *UserToken,
+	ttl time.Duration,
+) error {
+	args := m.Called(token, ttl)
+	return args.Error(0)
+}
+
+func (m *MockUserRepository) ConsumeUserToken(
+	ctx context.Context,
+	purpose string,
+	tokenHash string,
+) (*UserToken, error) {
+	args := m.Called(purpose, tokenHash)
+	return args.Get(0).(*UserToken), args.Error(1)
+}
+
+func (m *MockUserRepository) AssignRole(
+	ctx context.Context,
+	userID string,
+	roleName string,
+	orgID string,
+	branchID string,
+) error {
+	args := m.Called(userID, roleName, orgID, branchID)
+	return args.Error(0)
+}
+
+func (m *MockUserRepository) RevokeRole(
+	ctx context.Context,
+	userID string,
+	roleName string,
+	orgID string,
+	branchID string,
+) error {
+	args := m.Called(userID, roleName, orgID, branchID)
+	return args.Error(0)
+}
+
+func (m *MockUserRepository) InsertOrganization(
+	ctx context.Context,
+	org *OrganizationEntity,
+	branches []BranchEntity,
+) (*OrganizationEntity, error) {
+	args := m.Called(org, branches)
+	return args.Get(0).(*OrganizationEntity), args.Error(1)
+}
+
 type RepositoryTestSuite struct {
 	suite.Suite
-	db *sqlx.DB
+	db             *sqlx.DB
+	testConnString string
 }
 
 func (repositoryTestSuite *RepositoryTestSuite) SetupTest() {
-	testConnString := config.Variables.TestDatabaseUrl
-	fmt.Println(testConnString)
-	repositoryTestSuite.db = sqlx.MustConnect("postgres", testConnString)
+	repositoryTestSuite.db = sqlx.MustConnect("postgres", repositoryTestSuite.testConnString)
 
 	goose.SetBaseFS(db.Migrations)
 
@@ -61,7 +600,12 @@ func (repositoryTestSuite *RepositoryTestSuite) SetupTest() {
 }
 
 func TestRepositoryTestSuite(t *testing.T) {
-	suite.Run(t, new(RepositoryTestSuite))
+	testConnString := os.Getenv("TEST_DATABASE_URL")
+	if testConnString == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	suite.Run(t, &RepositoryTestSuite{testConnString: testConnString})
 }
 
 func (repositoryTestSuite *RepositoryTestSuite) TestInsertUser() {
@@ -72,15 +616,16 @@ func (repositoryTestSuite *RepositoryTestSuite) TestInsertUser() {
 		PasswordHash: &passwordHash,
 	}
 
+	ctx := context.Background()
 	userRepository := NewUserRepository(repositoryTestSuite.db)
 
-	before, err := userRepository.CountUsers()
+	before, err := userRepository.CountUsers(ctx)
 	repositoryTestSuite.NoError(err)
 
-	actual, err := userRepository.InsertUser(&user)
+	actual, err := userRepository.InsertUser(ctx, &user)
 	repositoryTestSuite.NoError(err)
 
-	after, err := userRepository.CountUsers()
+	after, err := userRepository.CountUsers(ctx)
 	repositoryTestSuite.NoError(err)
 
 	repositoryTestSuite.Greater(actual.ID, 0)
@@ -97,20 +642,139 @@ func (repositoryTestSuite *RepositoryTestSuite) TestFindUserByEmail() {
 		PasswordHash: &passwordHash,
 	}
 
+	ctx := context.Background()
 	userRepository := NewUserRepository(repositoryTestSuite.db)
 
-	user, err := userRepository.InsertUser(&newUser)
+	user, err := userRepository.InsertUser(ctx, &newUser)
 	repositoryTestSuite.NoError(err)
 
 	arrange := []string{user.Email, strings.ToUpper(user.Email), "By-Email@TesT.coM"}
 
 	for _, email := range arrange {
-		actual, findErr := userRepository.FindUserByEmail(email)
+		actual, findErr := userRepository.FindUserByEmail(ctx, email)
 		repositoryTestSuite.NoError(findErr)
 		repositoryTestSuite.Equal(user.ID, actual.ID)
 	}
 
-	actual, err := userRepository.FindUserByEmail("non-existtent@test.com")
+	actual, err := userRepository.FindUserByEmail(ctx, "non-existtent@test.com")
 	repositoryTestSuite.ErrorIs(err, sql.ErrNoRows)
 	repositoryTestSuite.Nil(actual)
 }
+
+func (repositoryTestSuite *RepositoryTestSuite) TestFindAllUsersPaginates() {
+	ctx := context.Background()
+	userRepository := NewUserRepository(repositoryTestSuite.db)
+
+	for _, email := range []string{"page-a@test.com", "page-b@test.com", "page-c@test.com"} {
+		newUser := UserEntity{FirstName: "Page", LastName: "Test", Email: email}
+		_, err := userRepository.InsertUser(ctx, &newUser)
+		repositoryTestSuite.Require().NoError(err)
+	}
+
+	query := UserQuery{
+		UserFilter: UserFilter{NamePrefix: "page"},
+		Sort:       "email",
+		Limit:      2,
+		WithTotal:  true,
+	}
+
+	first, err := userRepository.FindAllUsers(ctx, query)
+	repositoryTestSuite.Require().NoError(err)
+	repositoryTestSuite.Equal(3, *first.Total)
+	repositoryTestSuite.Len(first.Items, 2)
+	repositoryTestSuite.Equal("page-a@test.com", first.Items[0].Email)
+	repositoryTestSuite.NotEmpty(first.Next)
+	repositoryTestSuite.Empty(first.Prev)
+
+	query.Cursor = first.Next
+	second, err := userRepository.FindAllUsers(ctx, query)
+	repositoryTestSuite.Require().NoError(err)
+	repositoryTestSuite.Len(second.Items, 1)
+	repositoryTestSuite.Equal("page-c@test.com", second.Items[0].Email)
+	repositoryTestSuite.Empty(second.Next)
+
+	query.Cursor = second.Prev
+	back, err := userRepository.FindAllUsers(ctx, query)
+	repositoryTestSuite.Require().NoError(err)
+	repositoryTestSuite.Equal(first.Items, back.Items)
+}
+
+func (repositoryTestSuite *RepositoryTestSuite) TestFindManagedUserRefusesBroaderTargets() {
+	ctx := context.Background()
+	userRepository := NewUserRepository(repositoryTestSuite.db)
+	orgID := "01JQEYB8V8AZW0TCJFM5848NQX"
+
+	insert := func(email string) string {
+		newUser := UserEntity{FirstName: "Managed", LastName: "Test", Email: email}
+		inserted, err := userRepository.InsertUser(ctx, &newUser)
+		repositoryTestSuite.Require().NoError(err)
+		return inserted.ID
+	}
+
+	managerID := insert("org-admin@test.com")
+	memberID := insert("org-member@test.com")
+	superAdminID := insert("super-admin@test.com")
+
+	repositoryTestSuite.Require().NoError(
+		userRepository.AssignRole(ctx, managerID, "org_admin", orgID, ""),
+	)
+	repositoryTestSuite.Require().NoError(
+		userRepository.AssignRole(ctx, memberID, "org_manager", orgID, ""),
+	)
+	repositoryTestSuite.Require().NoError(
+		userRepository.AssignRole(ctx, superAdminID, "super_admin", "", ""),
+	)
+	repositoryTestSuite.Require().NoError(
+		userRepository.AssignRole(ctx, superAdminID, "org_manager", orgID, ""),
+	)
+
+	for _, permission := range []string{"users:read", "users:update"} {
+		manager := Manager{UserID: managerID, Permission: permission}
+		member, err := userRepository.FindManagedUser(ctx, manager, memberID)
+		repositoryTestSuite.Require().NoError(err, permission)
+		repositoryTestSuite.Equal(memberID, member.ID)
+	}
+
+	manager := Manager{UserID: managerID, Permission: "users:update"}
+	_, err := userRepository.FindManagedUser(ctx, manager, superAdminID)
+	repositoryTestSuite.ErrorIs(err, sql.ErrNoRows)
+}
+
+func (repositoryTestSuite *RepositoryTestSuite) TestServiceAccountManagesUsersOfItsOrganization() {
+	ctx := context.Background()
+	userRepository := NewUserRepository(repositoryTestSuite.db)
+	orgID := "01JQEYB8V8AZW0TCJFM5848NQX"
+
+	newUser := UserEntity{FirstName: "Managed", LastName: "Test", Email: "sa-member@test.com"}
+	member, err := userRepository.InsertUser(ctx, &newUser)
+	repositoryTestSuite.Require().NoError(err)
+	repositoryTestSuite.Require().NoError(
+		userRepository.AssignRole(ctx, member.ID, "org_manager", orgID, ""),
+	)
+
+	secretHash := "test_secret"
+	account, err := userRepository.InsertServiceAccount(ctx, &ServiceAccount{
+		OrganizationID: orgID,
+		Name:           "Provisioning",
+		ClientID:       "sa_provisioning",
+		SecretHash:     &secretHash,
+	})
+	repositoryTestSuite.Require().NoError(err)
+	repositoryTestSuite.Require().NoError(
+		userRepository.AssignServiceAccountRole(ctx, account.ClientID, "org_admin", ""),
+	)
+
+	for _, permission := range []string{"users:read", "users:update"} {
+		manager := Manager{UserID: account.ID, Permission: permission}
+		found, err := userRepository.FindManagedUser(ctx, manager, member.ID)
+		repositoryTestSuite.Require().NoError(err, permission)
+		repositoryTestSuite.Equal(member.ID, found.ID)
+
+		page, err := userRepository.FindAllUsers(ctx, UserQuery{
+			UserFilter: UserFilter{Email: member.Email, ManagedBy: &manager},
+			Limit:      DefaultPageSize,
+		})
+		repositoryTestSuite.Require().NoError(err, permission)
+		repositoryTestSuite.Len(page.Items, 1, permission)
+	}
+}
@@ -6,6 +6,10 @@ import (
 	"github.com/gorilla/mux"
 )
 
+// ulidPattern matches a ULID in Crockford base32, so /users/{id} does not
+// shadow routes such as /users/me.
+const ulidPattern = "[0-9A-HJKMNP-TV-Za-hjkmnp-tv-z]{26}"
+
 type Handler struct {
 	UserService
 }
@@ -15,14 +19,94 @@ func NewHandler(userService UserService) *Handler {
 }
 
 func (h *Handler) RegisterRoutes(router *mux.Router) *Handler {
-	router.HandleFunc("/users/login", h.Login).Methods("POST")
-	router.HandleFunc("/users/register", h.Register).Methods("POST")
+	router.Handle("/users/login", h.hashing(h.Login)).Methods("POST")
+	router.HandleFunc("/users/login/mfa", h.LoginMFA).Methods("POST")
+	router.HandleFunc("/users/login/mfa/passkey/options", h.BeginPasskeyMFA).Methods("POST")
+	router.HandleFunc("/users/login/passkey/options", h.BeginPasskeyLogin).Methods("POST")
+	router.HandleFunc("/users/login/passkey/finish", h.FinishPasskeyLogin).Methods("POST")
+	router.Handle("/users/register", h.hashing(h.Register)).Methods("POST")
+	router.HandleFunc("/users/confirm-email", h.ConfirmEmail).Methods("POST")
+	router.HandleFunc("/users/verify-email", h.VerifyEmail).Methods("POST")
+	router.HandleFunc("/users/verify-email/resend", h.ResendVerification).Methods("POST")
+	router.HandleFunc("/users/password/forgot", h.ForgotPassword).Methods("POST")
+	router.Handle("/users/password/reset", h.hashing(h.ResetPassword)).Methods("POST")
+	router.HandleFunc("/.well-known/openid-configuration", h.OpenIDConfiguration).Methods("GET")
+	router.HandleFunc("/oauth/jwks", h.JWKS).Methods("GET")
+	router.HandleFunc("/oauth/authorize", h.Authorize).Methods("GET")
+	router.HandleFunc("/oauth/authorize/consent", h.Consent).Methods("POST")
+	router.HandleFunc("/oauth/token", h.Token).Methods("POST")
+	router.HandleFunc("/oauth/introspect", h.Introspect).Methods("POST")
+	router.HandleFunc("/oauth/revoke", h.Revoke).Methods("POST")
+	router.HandleFunc("/oauth/userinfo", h.Userinfo).Methods("GET", "POST")
+	router.HandleFunc("/oauth/session", h.StartOAuthSession).Methods("GET")
+	router.HandleFunc("/oauth/microsoft", h.MicrosoftLogin).Methods("GET")
+	router.HandleFunc("/oauth/microsoft/callback", h.MicrosoftCallback).Methods("GET")
+	router.HandleFunc("/oauth/logout", h.Logout).Methods("GET")
+	router.HandleFunc("/auth/verify", h.Verify)
 
 	protected := router.PathPrefix("/").Subrouter()
-	protected.Use(AuthMiddleware)
+	protected.Use(h.AuthMiddleware)
 
 	protected.HandleFunc("/users/me", h.GetCurrentUser).Methods("GET")
+	protected.Handle("/users/me/password", h.sessionOnly(h.hashing(h.ChangePassword))).
+		Methods("PUT")
+	protected.Handle("/users/token/refresh", h.sessionOnly(http.HandlerFunc(h.RefreshToken))).
+		Methods("POST")
+	protected.Handle("/users/me/mfa/totp", h.sessionOnly(http.HandlerFunc(h.EnrollTOTP))).
+		Methods("POST")
+	protected.Handle("/users/me/mfa/totp/verify", h.sessionOnly(http.HandlerFunc(h.ConfirmTOTP))).
+		Methods("POST")
+	protected.Handle("/users/me/mfa/totp", h.sessionOnly(http.HandlerFunc(h.DisableTOTP))).
+		Methods("DELETE")
+	protected.Handle("/users/me/mfa/recovery-codes", h.sessionOnly(
+		http.HandlerFunc(h.RegenerateRecoveryCodes))).Methods("POST")
+	protected.HandleFunc("/users/me/passkeys", h.GetPasskeys).Methods("GET")
+	protected.Handle("/users/me/passkeys/register/options", h.sessionOnly(
+		http.HandlerFunc(h.BeginPasskeyRegistration))).Methods("POST")
+	protected.Handle("/users/me/passkeys/register/finish", h.sessionOnly(
+		http.HandlerFunc(h.FinishPasskeyRegistration))).Methods("POST")
+	protected.Handle("/users/me/passkeys/{passkeyId:"+ulidPattern+"}", h.sessionOnly(
+		http.HandlerFunc(h.DeletePasskey))).Methods("DELETE")
+	protected.HandleFunc("/users/me/access-tokens", h.GetAccessTokens).Methods("GET")
+	protected.Handle("/users/me/access-tokens", h.sessionOnly(
+		http.HandlerFunc(h.CreateAccessToken))).Methods("POST")
+	protected.Handle("/users/me/access-tokens/{tokenId:"+ulidPattern+"}", h.sessionOnly(
+		http.HandlerFunc(h.RevokeAccessToken))).Methods("DELETE")
 	protected.HandleFunc("/users/organizations", h.FindUserOrganizations).Methods("GET")
+	protected.Handle("/oauth/session", h.sessionOnly(http.HandlerFunc(h.CreateOAuthSession))).
+		Methods("POST")
+
+	protected.Handle("/users", RBACMiddleware(h, "users:read")(
+		http.HandlerFunc(h.GetAllUsers))).Methods("GET")
+
+	userRoute := "/users/{id:" + ulidPattern + "}"
+
+	protected.Handle(userRoute, RBACMiddleware(h, "users:read")(
+		http.HandlerFunc(h.GetUserByID))).Methods("GET")
+
+	protected.Handle(userRoute, RBACMiddleware(h, "users:update")(
+		http.HandlerFunc(h.UpdateUser))).Methods("PATCH")
+
+	protected.Handle(userRoute, RBACMiddleware(h, "users:delete")(
+		http.HandlerFunc(h.DeleteUserByID))).Methods("DELETE")
+
+	protected.Handle(userRoute+"/email", RBACMiddleware(h, "users:update")(
+		http.HandlerFunc(h.ChangeUserEmail))).Methods("PUT")
+
+	protected.Handle(userRoute+"/status", RBACMiddleware(h, "users:update")(
+		http.HandlerFunc(h.ChangeUserStatus))).Methods("PUT")
+
+	protected.Handle(userRoute+"/disable", RBACMiddleware(h, "users:update")(
+		http.HandlerFunc(h.DisableUserByID))).Methods("POST")
+
+	protected.Handle(userRoute+"/enable", RBACMiddleware(h, "users:update")(
+		http.HandlerFunc(h.EnableUserByID))).Methods("POST")
+
+	protected.Handle(userRoute+"/lockout", RBACMiddleware(h, "users:update")(
+		http.HandlerFunc(h.ClearLockout))).Methods("DELETE")
+
+	protected.Handle(userRoute+"/mfa", RBACMiddleware(h, "users:update")(
+		http.HandlerFunc(h.ResetMFA))).Methods("DELETE")
 
 	orgRouter := protected.PathPrefix("/organizations/{orgId}").Subrouter()
 	orgRouter.Use(h.OrganizationAccessMiddleware)
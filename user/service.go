@@ -1,153 +1,453 @@
 package user
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"time"
 
+	"github.com/diegodario88/sesamo/audit"
 	"github.com/diegodario88/sesamo/config"
 	"github.com/diegodario88/sesamo/httphelper"
-	"github.com/go-playground/validator/v10"
+	"github.com/diegodario88/sesamo/logging"
+	"github.com/diegodario88/sesamo/mail"
+	"github.com/diegodario88/sesamo/metrics"
+	"github.com/diegodario88/sesamo/password"
+	"github.com/diegodario88/sesamo/throttle"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
 	"github.com/jmoiron/sqlx"
 )
 
 type IUserRepository interface {
-	FindUserByEmail(email string) (*UserEntity, error)
-	InsertUser(user *UserEntity) (*UserEntity, error)
-	CountUsers() (int, error)
-	FindUserById(id string) (*UserEntity, error)
-	FindAllUsers() ([]UserEntity, error)
-	HasAccess(userId string, permission string) (bool, error)
-	GetRoles(userId string) ([]string, error)
-	GetUserOrganizations(userId string) ([]OrganizationEntity, error)
-	GetUserBranches(userId string, orgId string) ([]BranchEntity, error)
-	FindOrganizationUsers(orgID string) ([]UserEntity, error)
-	FindOrganizationUserByID(orgID string, userID string) (*UserEntity, error)
-	FindBranchUsers(orgID string, branchID string) ([]UserEntity, error)
-	GetOrganizationBranches(orgID string) ([]BranchEntity, error)
+	FindUserByEmail(ctx context.Context, email string) (*UserEntity, error)
+	InsertUser(ctx context.Context, user *UserEntity) (*UserEntity, error)
+	CountUsers(ctx context.Context) (int, error)
+	FindUserById(ctx context.Context, id string) (*UserEntity, error)
+	FindAllUsers(ctx context.Context, query UserQuery) (*UserPage, error)
+	HasAccess(ctx context.Context, userId string, permission string) (bool, error)
+	GetRoles(ctx context.Context, userId string) ([]string, error)
+	GetUserOrganizations(ctx context.Context, userId string) ([]OrganizationEntity, error)
+	GetUserBranches(ctx context.Context, userId string, orgId string) ([]BranchEntity, error)
+	FindOrganizationUsers(ctx context.Context, orgID string, query UserQuery) (*UserPage, error)
+	FindOrganizationUserByID(ctx context.Context, orgID string, userID string) (*UserEntity, error)
+	FindBranchUsers(
+		ctx context.Context,
+		orgID string,
+		branchID string,
+		query UserQuery,
+	) (*UserPage, error)
+	GetOrganizationBranches(ctx context.Context, orgID string) ([]BranchEntity, error)
+	SetUserPassword(ctx context.Context, userID string, passwordHash string) (time.Time, error)
+	SetUserStatus(
+		ctx context.Context,
+		userID string,
+		status string,
+		reason *string,
+	) (*UserEntity, error)
+	RevokeUserTokens(ctx context.Context, userID string) error
+	RehashUserPassword(ctx context.Context, userID string, oldHash string, newHash string) error
+	FindLoginFailures(ctx context.Context, emailHash string) (*LoginFailures, error)
+	RecordFailedLogin(ctx context.Context, emailHash string, forgetAfter time.Duration) (int, error)
+	ClearFailedLogins(ctx context.Context, emailHash string) (int, error)
+	SetTOTPSecret(ctx context.Context, userID string, sealedSecret string) error
+	EnableTOTP(ctx context.Context, userID string, step int64, codeHashes []string) error
+	ReplaceRecoveryCodes(ctx context.Context, userID string, codeHashes []string) error
+	DisableTOTP(ctx context.Context, userID string) error
+	AdvanceTOTPStep(ctx context.Context, userID string, step int64) error
+	UseRecoveryCode(ctx context.Context, userID string, codeHash string) error
+	RequiresMFA(ctx context.Context, userID string) (bool, error)
+	SetRoleRequiresMFA(ctx context.Context, roleName string, scope string, required bool) error
+	CreateWebAuthnSession(ctx context.Context, session *WebAuthnSession, ttl time.Duration) error
+	ConsumeWebAuthnSession(
+		ctx context.Context,
+		purpose string,
+		tokenHash string,
+	) (*WebAuthnSession, error)
+	InsertWebAuthnCredential(
+		ctx context.Context,
+		passkey *WebAuthnCredential,
+	) (*WebAuthnCredential, error)
+	FindWebAuthnCredentials(ctx context.Context, userID string) ([]WebAuthnCredential, error)
+	UpdateWebAuthnCredentialUse(ctx context.Context, id string, signCount int64, flags int16) error
+	DeleteWebAuthnCredential(ctx context.Context, userID string, id string) error
+	InsertPersonalAccessToken(
+		ctx context.Context,
+		token *PersonalAccessToken,
+		ttl time.Duration,
+	) (*PersonalAccessToken, error)
+	FindPersonalAccessTokens(ctx context.Context, userID string) ([]PersonalAccessToken, error)
+	UsePersonalAccessToken(
+		ctx context.Context,
+		tokenHash string,
+		ip string,
+	) (*PersonalAccessToken, error)
+	FindPersonalAccessToken(ctx context.Context, tokenHash string) (*PersonalAccessToken, error)
+	DeletePersonalAccessToken(ctx context.Context, userID string, id string) error
+	InsertServiceAccount(ctx context.Context, account *ServiceAccount) (*ServiceAccount, error)
+	FindServiceAccountByClientID(ctx context.Context, clientID string) (*ServiceAccount, error)
+	FindOrganizationServiceAccounts(ctx context.Context, orgID string) ([]ServiceAccount, error)
+	SetServiceAccountSecret(ctx context.Context, clientID string, secretHash string) error
+	SetServiceAccountDisabled(ctx context.Context, clientID string, disabled bool) error
+	DeleteServiceAccount(ctx context.Context, clientID string) error
+	AssignServiceAccountRole(
+		ctx context.Context,
+		clientID string,
+		roleName string,
+		branchID string,
+	) error
+	RevokeServiceAccountRole(
+		ctx context.Context,
+		clientID string,
+		roleName string,
+		branchID string,
+	) error
+	UseClientAssertion(ctx context.Context, clientID string, jti string, expiresAt time.Time) error
+	InsertOAuthClient(ctx context.Context, client *OAuthClient) (*OAuthClient, error)
+	FindOAuthClient(ctx context.Context, clientID string) (*OAuthClient, error)
+	FindOAuthClients(ctx context.Context) ([]OAuthClient, error)
+	SetOAuthClientSecret(ctx context.Context, clientID string, secretHash string) error
+	DeleteOAuthClient(ctx context.Context, clientID string) error
+	FindOAuthConsent(ctx context.Context, userID string, clientID string) ([]string, error)
+	SaveOAuthConsent(ctx context.Context, userID string, clientID string, scopes []string) error
+	RevokeToken(ctx context.Context, tokenHash string, expiresAt time.Time) error
+	IsTokenRevoked(ctx context.Context, tokenHash string) (bool, error)
+	UpdateUserProfile(
+		ctx context.Context,
+		userID string,
+		firstName *string,
+		lastName *string,
+	) (*UserEntity, error)
+	UpdateUserEmail(ctx context.Context, userID string, email string) (*UserEntity, error)
+	MarkEmailVerified(ctx context.Context, userID string) (*UserEntity, error)
+	DeleteUser(ctx context.Context, userID string) error
+	FindManagedUser(ctx context.Context, manager Manager, userID string) (*UserEntity, error)
+	CreateUserToken(ctx context.Context, token *UserToken, ttl time.Duration) error
+	ConsumeUserToken(ctx context.Context, purpose string, tokenHash string) (*UserToken, error)
+	AssignRole(
+		ctx context.Context,
+		userID string,
+		roleName string,
+		orgID string,
+		branchID string,
+	) error
+	RevokeRole(
+		ctx context.Context,
+		userID string,
+		roleName string,
+		orgID string,
+		branchID string,
+	) error
+	InsertOrganization(
+		ctx context.Context,
+		org *OrganizationEntity,
+		branches []BranchEntity,
+	) (*OrganizationEntity, error)
 }
 
 type UserService struct {
-	Repo IUserRepository
+	Repo   IUserRepository
+	Config *config.Config
+	Mailer mail.Sender
+	Policy *password.Policy
+	// Hashing holds the argon2id costs of new password hashes; the zero value
+	// means password.DefaultParams.
+	Hashing  password.Params
+	HashGate *throttle.Gate
+	// Throttle slows down failed logins; nil disables it.
+	Throttle *LoginThrottle
+	Audit    audit.Recorder
+	WebAuthn *webauthn.WebAuthn
+	// SigningKey signs the ID tokens of OAuth clients.
+	SigningKey *SigningKey
+	// Microsoft federates sign-in to Entra ID; nil when it is not configured.
+	Microsoft MicrosoftSignIn
+	// ForwardAuthCache remembers the requests Verify allowed; nil disables it.
+	ForwardAuthCache *DecisionCache
 }
 
-func NewUserService(db *sqlx.DB) UserService {
+func NewUserService(db *sqlx.DB, cfg *config.Config) (UserService, error) {
+	policy, err := password.NewPolicy(cfg)
+	if err != nil {
+		return UserService{}, err
+	}
+
+	relyingParty, err := NewWebAuthn(cfg)
+	if err != nil {
+		return UserService{}, err
+	}
+
+	signingKey, err := NewSigningKey(cfg.OidcSigningKeyFile)
+	if err != nil {
+		return UserService{}, err
+	}
+
 	var newUserService = UserService{
-		Repo: NewUserRepository(db),
+		Repo:     NewUserRepository(db),
+		Config:   cfg,
+		Mailer:   mail.NewSender(cfg),
+		Policy:   policy,
+		Hashing:  password.ParamsFromConfig(cfg),
+		HashGate: throttle.NewGate(cfg.PasswordHashConcurrency, hashSlotWait),
+		Throttle: NewLoginThrottle(cfg),
+		WebAuthn: relyingParty,
+		Audit:    audit.NewStore(db),
+
+		SigningKey: signingKey,
+	}
+
+	if cfg.ForwardAuthCacheTTL > 0 {
+		newUserService.ForwardAuthCache = NewDecisionCache(cfg.ForwardAuthCacheTTL)
+	}
+
+	microsoft := NewMicrosoftFederation(MicrosoftAuthConfig{
+		ClientID:     cfg.MicrosoftClientId,
+		ClientSecret: cfg.MicrosoftClientSecret,
+		TenantID:     cfg.MicrosoftTenantId,
+		RedirectURL:  newUserService.issuer() + "/oauth/microsoft/callback",
+	})
+	// A nil *MicrosoftFederation in the interface would not compare to nil.
+	if microsoft != nil {
+		newUserService.Microsoft = microsoft
 	}
 
-	return newUserService
+	return newUserService, nil
 }
 
 func (svc *UserService) Login(w http.ResponseWriter, r *http.Request) {
-	log.Print("Starting login request ...")
+	ctx := r.Context()
+	logger := logging.FromContext(ctx)
+	logger.Debug("Starting login request")
 	var loginUserPayload LoginUserPayload
 	if err := httphelper.ParseJSON(r, &loginUserPayload); err != nil {
-		log.Print(err)
-		httphelper.WriteError(w, http.StatusBadRequest, err)
+		logger.Warn("Invalid login payload", "error", err)
+		metrics.LoginAttempts.WithLabelValues("password", metrics.OutcomeInvalidPayload).Inc()
+		httphelper.WriteProblem(w, httphelper.BadRequest(err.Error()))
 		return
 	}
 
 	if err := httphelper.Validate.Struct(loginUserPayload); err != nil {
-		errors := err.(validator.ValidationErrors)
-		httphelper.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		metrics.LoginAttempts.WithLabelValues("password", metrics.OutcomeInvalidPayload).Inc()
+		httphelper.WriteProblem(w, httphelper.ValidationFailed(err))
 		return
 	}
 
-	user, err := svc.authenticateUserByEmailPassword(loginUserPayload)
+	ip := svc.clientIP(r)
+	user, err := svc.authenticateUserByEmailPassword(ctx, loginUserPayload, ip)
 
 	if err != nil {
-		httphelper.WriteError(
-			w,
-			http.StatusBadRequest,
-			fmt.Errorf("not found, invalid email or password"),
-		)
+		logger.Info("Login failed", "reason", err, "ip", ip)
+		outcome := loginOutcome(err)
+		metrics.LoginAttempts.WithLabelValues("password", outcome).Inc()
+		var throttled *ThrottledError
+		if errors.As(err, &throttled) {
+			httphelper.WriteTooManyRequests(
+				w,
+				"too many failed logins, try again later",
+				throttled.RetryAfter,
+			)
+			return
+		}
+		if outcome == metrics.OutcomeInvalidCredentials {
+			svc.failClientLogin(ctx, ip)
+		}
+		if outcome == metrics.OutcomeError {
+			httphelper.WriteInternalError(w, r, err)
+			return
+		}
+		if inactive := accountInactive(err); inactive != nil {
+			httphelper.WriteProblem(w, inactive)
+			return
+		}
+		httphelper.WriteProblem(w, httphelper.NewProblem(
+			http.StatusUnauthorized,
+			"invalid_credentials",
+			"invalid email or password",
+		))
 		return
 	}
 
-	token, err := svc.GenerateUserToken(user)
+	methods, err := svc.mfaMethods(ctx, user)
+	if err != nil {
+		metrics.LoginAttempts.WithLabelValues("password", metrics.OutcomeError).Inc()
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	if len(methods) > 0 {
+		challenge, err := svc.generateMFAChallenge(user, time.Now())
+		if err != nil {
+			metrics.LoginAttempts.WithLabelValues("password", metrics.OutcomeError).Inc()
+			httphelper.WriteInternalError(w, r, err)
+			return
+		}
+
+		metrics.LoginAttempts.WithLabelValues("password", metrics.OutcomeMFARequired).Inc()
+		httphelper.WriteJSON(w, http.StatusOK, map[string]any{
+			"mfa_required": true,
+			"mfa_token":    challenge,
+			"mfa_methods":  methods,
+		})
+		return
+	}
+
+	token, err := svc.GenerateUserToken(ctx, user)
 
 	if err != nil {
-		httphelper.WriteError(w, http.StatusInternalServerError, err)
+		metrics.LoginAttempts.WithLabelValues("password", metrics.OutcomeError).Inc()
+		httphelper.WriteInternalError(w, r, err)
 		return
 	}
 
+	metrics.LoginAttempts.WithLabelValues("password", metrics.OutcomeSuccess).Inc()
 	httphelper.WriteJSON(w, http.StatusOK, map[string]string{"token": token})
 }
 
+// loginOutcome maps an authentication error to its metrics label.
+func loginOutcome(err error) string {
+	switch {
+	case errors.Is(err, ErrUserDisabled):
+		return metrics.OutcomeDisabled
+	case errors.Is(err, ErrUserLocked):
+		return metrics.OutcomeLocked
+	case errors.Is(err, ErrUserPendingVerification):
+		return metrics.OutcomeUnverified
+	case errors.As(err, new(*ThrottledError)):
+		return metrics.OutcomeThrottled
+	case errors.Is(err, ErrInvalidUserOrPassword),
+		errors.Is(err, ErrNoPasswordSet),
+		errors.Is(err, ErrInvalidMFACode),
+		errors.Is(err, ErrInvalidMFAChallenge),
+		errors.Is(err, sql.ErrNoRows):
+		return metrics.OutcomeInvalidCredentials
+	default:
+		return metrics.OutcomeError
+	}
+}
+
 func (svc *UserService) Register(w http.ResponseWriter, r *http.Request) {
-	log.Print("Starting register request ...")
+	ctx := r.Context()
+	logging.FromContext(ctx).Debug("Starting register request")
 	var registerUserPayload RegisterUserPayload
 	if err := httphelper.ParseJSON(r, &registerUserPayload); err != nil {
-		httphelper.WriteError(w, http.StatusBadRequest, err)
+		httphelper.WriteProblem(w, httphelper.BadRequest(err.Error()))
 		return
 	}
 
 	if err := httphelper.Validate.Struct(registerUserPayload); err != nil {
-		errors := err.(validator.ValidationErrors)
-		httphelper.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		httphelper.WriteProblem(w, httphelper.ValidationFailed(err))
 		return
 	}
 
-	user, err := svc.Repo.FindUserByEmail(registerUserPayload.Email)
+	insertedUser, err := svc.RegisterUser(ctx, registerUserPayload)
 
-	if err == nil {
-		httphelper.WriteError(
-			w,
-			http.StatusBadRequest,
-			fmt.Errorf("user with email %s already exists", registerUserPayload.Email),
-		)
+	// With enumeration protection on, taken and free emails get the same
+	// answer; the owner of a taken one is told by mail.
+	if svc.Config.EnumerationProtection && (err == nil || errors.Is(err, ErrUserAlreadyExists)) {
+		w.WriteHeader(http.StatusAccepted)
 		return
 	}
 
-	hashedPassword, err := user.HashPassword(registerUserPayload.Password)
+	if errors.Is(err, ErrUserAlreadyExists) {
+		writeUserExists(w, registerUserPayload.Email)
+		return
+	}
 
 	if err != nil {
-		httphelper.WriteError(w, http.StatusInternalServerError, err)
+		writePasswordError(w, r, err, "password")
 		return
 	}
 
+	httphelper.WriteJSON(w, http.StatusCreated, insertedUser)
+}
+
+// CreateUser creates an active account, as administrators do.
+func (svc *UserService) CreateUser(
+	ctx context.Context,
+	payload RegisterUserPayload,
+) (*UserEntity, error) {
+	return svc.createUser(ctx, payload, StatusActive)
+}
+
+// createUser checks and hashes the password before looking for an account
+// with the same email, so taken emails are not told apart by the password
+// policy or by response time.
+func (svc *UserService) createUser(
+	ctx context.Context,
+	payload RegisterUserPayload,
+	status string,
+) (*UserEntity, error) {
 	userToBeInserted := UserEntity{
-		FirstName:    registerUserPayload.FirstName,
-		LastName:     registerUserPayload.LastName,
-		Email:        registerUserPayload.Email,
-		PasswordHash: &hashedPassword,
+		FirstName: payload.FirstName,
+		LastName:  payload.LastName,
+		Email:     payload.Email,
+		Status:    status,
+	}
+
+	if err := svc.checkPassword(payload.Password, &userToBeInserted); err != nil {
+		return nil, err
 	}
 
-	insertedUser, err := svc.Repo.InsertUser(&userToBeInserted)
+	hashedPassword, err := userToBeInserted.HashPassword(payload.Password, svc.hashParams())
 
 	if err != nil {
-		httphelper.WriteError(w, http.StatusInternalServerError, err)
-		return
+		return nil, err
 	}
 
-	httphelper.WriteJSON(w, http.StatusCreated, insertedUser)
+	userToBeInserted.PasswordHash = &hashedPassword
+
+	if _, err := svc.Repo.FindUserByEmail(ctx, payload.Email); err == nil {
+		return nil, ErrUserAlreadyExists
+	}
+
+	return svc.Repo.InsertUser(ctx, &userToBeInserted)
+}
+
+// SetPassword replaces the password of user after checking it against the
+// password policy; violations are returned as a *PolicyError.
+func (svc *UserService) SetPassword(ctx context.Context, user *UserEntity, password string) error {
+	if err := svc.checkPassword(password, user); err != nil {
+		return err
+	}
+
+	hashedPassword, err := user.HashPassword(password, svc.hashParams())
+
+	if err != nil {
+		return err
+	}
+
+	changedAt, err := svc.Repo.SetUserPassword(ctx, user.ID, hashedPassword)
+	if err != nil {
+		return err
+	}
+
+	// Tokens issued to user from here on must not predate the change.
+	user.PasswordChangedAt = &changedAt
+	return nil
 }
 
 func (svc *UserService) GetAllUsers(w http.ResponseWriter, r *http.Request) {
-	users, err := svc.Repo.FindAllUsers()
+	query, err := ParseUserQuery(r.URL.Query())
 	if err != nil {
-		httphelper.WriteError(w, http.StatusInternalServerError, err)
+		httphelper.WriteProblem(w, httphelper.BadRequest(err.Error()))
 		return
 	}
 
-	httphelper.WriteJSON(w, http.StatusOK, users)
+	query.ManagedBy = &Manager{
+		UserID:     r.Context().Value(UserIDKey).(string),
+		Permission: "users:read",
+	}
+
+	page, err := svc.Repo.FindAllUsers(r.Context(), query)
+	writeUserPage(w, r, page, err)
 }
 
 func (svc *UserService) GetUserByID(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id, ok := vars["id"]
+	user, ok := svc.managedUser(w, r, "users:read")
 	if !ok {
-		httphelper.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid user ID"))
-		return
-	}
-
-	user, err := svc.Repo.FindUserById(id)
-	if err != nil {
-		httphelper.WriteError(w, http.StatusNotFound, fmt.Errorf("user not found"))
 		return
 	}
 
@@ -157,9 +457,9 @@ func (svc *UserService) GetUserByID(w http.ResponseWriter, r *http.Request) {
 func (svc *UserService) GetCurrentUser(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value(UserIDKey).(string)
 
-	user, err := svc.Repo.FindUserById(userID)
+	user, err := svc.Repo.FindUserById(r.Context(), userID)
 	if err != nil {
-		httphelper.WriteError(w, http.StatusNotFound, fmt.Errorf("user not found"))
+		writeLookupError(w, r, err, "user not found")
 		return
 	}
 
@@ -169,9 +469,9 @@ func (svc *UserService) GetCurrentUser(w http.ResponseWriter, r *http.Request) {
 func (svc *UserService) FindUserOrganizations(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value(UserIDKey).(string)
 
-	orgs, err := svc.Repo.GetUserOrganizations(userID)
+	orgs, err := svc.Repo.GetUserOrganizations(r.Context(), userID)
 	if err != nil {
-		httphelper.WriteError(w, http.StatusNotFound, fmt.Errorf("orgs not found"))
+		httphelper.WriteInternalError(w, r, err)
 		return
 	}
 
@@ -179,20 +479,33 @@ func (svc *UserService) FindUserOrganizations(w http.ResponseWriter, r *http.Req
 }
 
 func (svc *UserService) FindOrCreateFromMicrosoftAuth(
+	ctx context.Context,
 	msUserInfo *MicrosoftUserInfo,
 ) (*UserEntity, error) {
-	user, err := svc.Repo.FindUserByEmail(msUserInfo.Email)
+	user, err := svc.Repo.FindUserByEmail(ctx, msUserInfo.Email)
 	if err == nil {
+		// The identity provider vouches for the email.
+		if user.Status == StatusPendingVerification {
+			if user, err = svc.Repo.MarkEmailVerified(ctx, user.ID); err != nil {
+				return nil, err
+			}
+		}
+		if err := user.CheckActive(); err != nil {
+			return nil, err
+		}
 		return user, nil
 	}
 
+	verifiedAt := time.Now().UTC()
 	userToBeInserted := UserEntity{
-		FirstName: msUserInfo.GivenName,
-		LastName:  msUserInfo.FamilyName,
-		Email:     msUserInfo.Email,
+		FirstName:       msUserInfo.GivenName,
+		LastName:        msUserInfo.FamilyName,
+		Email:           msUserInfo.Email,
+		Status:          StatusActive,
+		EmailVerifiedAt: &verifiedAt,
 	}
 
-	insertedUser, err := svc.Repo.InsertUser(&userToBeInserted)
+	insertedUser, err := svc.Repo.InsertUser(ctx, &userToBeInserted)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create user from Microsoft auth: %w", err)
 	}
@@ -200,48 +513,131 @@ func (svc *UserService) FindOrCreateFromMicrosoftAuth(
 	return insertedUser, nil
 }
 
-func (svc *UserService) HasAccess(userID string, permission string) (bool, error) {
-	return svc.Repo.HasAccess(userID, permission)
+// HasAccess checks permission for userID. Requests made with a personal
+// access token are further limited to its scopes and organization.
+func (svc *UserService) HasAccess(
+	ctx context.Context,
+	userID string,
+	permission string,
+) (bool, error) {
+	if token, ok := ctx.Value(AccessTokenKey).(*PersonalAccessToken); ok {
+		orgID, _ := ctx.Value(OrganizationIDKey).(string)
+		if !token.allows(permission, orgID) {
+			return false, nil
+		}
+	}
+
+	return svc.Repo.HasAccess(ctx, userID, permission)
+}
+
+func (svc *UserService) FindUserBranches(
+	ctx context.Context,
+	userID string,
+	orgId string,
+) ([]BranchEntity, error) {
+	return svc.Repo.GetUserBranches(ctx, userID, orgId)
 }
 
-func (svc *UserService) FindUserBranches(userID string, orgId string) ([]BranchEntity, error) {
-	return svc.Repo.GetUserBranches(userID, orgId)
+// GenerateUserToken issues an access token for a user who just signed in.
+func (svc *UserService) GenerateUserToken(ctx context.Context, user *UserEntity) (string, error) {
+	return svc.generateToken(ctx, user, time.Now())
 }
 
-func (svc *UserService) GenerateUserToken(user *UserEntity) (string, error) {
-	expiration := time.Second * time.Duration(config.Variables.JwtExpirationInSeconds)
+// generateToken issues an access token. authTime is when the user last
+// proved their identity; refreshed tokens carry it over, so it tells how
+// recent a sign-in is.
+func (svc *UserService) generateToken(
+	ctx context.Context,
+	user *UserEntity,
+	authTime time.Time,
+) (string, error) {
+	if err := svc.checkCanSignIn(user); err != nil {
+		return "", err
+	}
 
-	roles, err := svc.Repo.GetRoles(user.ID)
+	expiration := time.Second * time.Duration(svc.Config.JwtExpirationInSeconds)
+
+	roles, err := svc.Repo.GetRoles(ctx, user.ID)
 	if err != nil {
 		return "", fmt.Errorf("failed to get user roles: %w", err)
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+	now := user.tokenIssueTime()
+	claims := jwt.MapClaims{
 		"userID":    user.ID,
 		"email":     user.Email,
 		"roles":     roles,
-		"expiresAt": time.Now().Add(expiration).Unix(),
-	})
+		"iat":       numericDate(now),
+		"auth_time": authTime.Unix(),
+		"exp":       now.Add(expiration).Unix(),
+		"expiresAt": now.Add(expiration).Unix(),
+	}
+
+	// A reduced token: it authenticates, but grants no role until the email
+	// is verified.
+	if user.Status == StatusPendingVerification {
+		claims["roles"] = []string{}
+		claims["email_verified"] = false
+	} else {
+		enrolling, err := svc.mfaEnrollmentRequired(ctx, user)
+		if err != nil {
+			return "", err
+		}
+
+		// Likewise until the user enrolls in MFA their roles require.
+		if enrolling {
+			claims["roles"] = []string{}
+			claims["mfa_enrollment_required"] = true
+		}
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 
-	tokenString, err := token.SignedString([]byte(config.Variables.JwtSecret))
+	tokenString, err := token.SignedString([]byte(svc.Config.JwtSecret))
 	if err != nil {
 		return "", err
 	}
 
+	metrics.TokensIssued.WithLabelValues("access").Inc()
+
 	return tokenString, nil
 }
 
+// mfaEnrollmentRequired is true for users holding a role that requires MFA
+// who enrolled in no second factor yet.
+func (svc *UserService) mfaEnrollmentRequired(ctx context.Context, user *UserEntity) (bool, error) {
+	if user.TOTPEnabled() {
+		return false, nil
+	}
+
+	required, err := svc.Repo.RequiresMFA(ctx, user.ID)
+	if err != nil {
+		return false, fmt.Errorf("failed to check MFA requirement: %w", err)
+	}
+	if !required {
+		return false, nil
+	}
+
+	passkeys, err := svc.Repo.FindWebAuthnCredentials(ctx, user.ID)
+	if err != nil {
+		return false, fmt.Errorf("failed to check MFA requirement: %w", err)
+	}
+
+	return len(passkeys) == 0, nil
+}
+
 func (svc *UserService) GetOrganizationUsers(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	orgID := vars["orgId"]
 
-	users, err := svc.Repo.FindOrganizationUsers(orgID)
+	query, err := ParseUserQuery(r.URL.Query())
 	if err != nil {
-		http.Error(w, "Error retrieving organization users", http.StatusInternalServerError)
+		httphelper.WriteProblem(w, httphelper.BadRequest(err.Error()))
 		return
 	}
 
-	httphelper.WriteJSON(w, http.StatusOK, users)
+	page, err := svc.Repo.FindOrganizationUsers(r.Context(), orgID, query)
+	writeUserPage(w, r, page, err)
 }
 
 func (svc *UserService) GetOrganizationUserByID(w http.ResponseWriter, r *http.Request) {
@@ -249,9 +645,9 @@ func (svc *UserService) GetOrganizationUserByID(w http.ResponseWriter, r *http.R
 	orgID := vars["orgId"]
 	userID := vars["id"]
 
-	user, err := svc.Repo.FindOrganizationUserByID(orgID, userID)
+	user, err := svc.Repo.FindOrganizationUserByID(r.Context(), orgID, userID)
 	if err != nil {
-		http.Error(w, "User not found or not in this organization", http.StatusNotFound)
+		writeLookupError(w, r, err, "user not found or not in this organization")
 		return
 	}
 
@@ -263,44 +659,138 @@ func (svc *UserService) GetBranchUsers(w http.ResponseWriter, r *http.Request) {
 	orgID := vars["orgId"]
 	branchID := vars["branchId"]
 
-	users, err := svc.Repo.FindBranchUsers(orgID, branchID)
+	query, err := ParseUserQuery(r.URL.Query())
 	if err != nil {
-		http.Error(w, "Error retrieving branch users", http.StatusInternalServerError)
+		httphelper.WriteProblem(w, httphelper.BadRequest(err.Error()))
 		return
 	}
 
-	httphelper.WriteJSON(w, http.StatusOK, users)
+	page, err := svc.Repo.FindBranchUsers(r.Context(), orgID, branchID, query)
+	writeUserPage(w, r, page, err)
 }
 
 func (svc *UserService) GetOrganizationBranches(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	orgID := vars["orgId"]
 
-	branches, err := svc.Repo.GetOrganizationBranches(orgID)
+	branches, err := svc.Repo.GetOrganizationBranches(r.Context(), orgID)
 	if err != nil {
-		httphelper.WriteError(
-			w,
-			http.StatusInternalServerError,
-			fmt.Errorf("error retrieving branches: %w", err),
-		)
+		httphelper.WriteInternalError(w, r, fmt.Errorf("error retrieving branches: %w", err))
 		return
 	}
 
 	httphelper.WriteJSON(w, http.StatusOK, branches)
 }
 
+// RefreshToken exchanges the caller's access token for a fresh one. The
+// account status is checked again, so inactive accounts cannot extend their
+// sessions.
+func (svc *UserService) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	user, err := svc.Repo.FindUserById(ctx, ctx.Value(UserIDKey).(string))
+	if err != nil {
+		writeLookupError(w, r, err, "user not found")
+		return
+	}
+
+	authTime, _ := ctx.Value(AuthTimeKey).(time.Time)
+	token, err := svc.generateToken(ctx, user, authTime)
+	if inactive := accountInactive(err); inactive != nil {
+		httphelper.WriteProblem(w, inactive)
+		return
+	}
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	httphelper.WriteJSON(w, http.StatusOK, map[string]string{"token": token})
+}
+
+// accountInactive describes why an account may not sign in, or returns nil
+// when err is not about the account status.
+func accountInactive(err error) *httphelper.Problem {
+	for _, inactive := range []struct {
+		err  error
+		code string
+	}{
+		{ErrUserDisabled, "account_disabled"},
+		{ErrUserLocked, "account_locked"},
+		{ErrUserPendingVerification, "account_pending_verification"},
+	} {
+		if errors.Is(err, inactive.err) {
+			return httphelper.NewProblem(http.StatusForbidden, inactive.code, inactive.err.Error())
+		}
+	}
+
+	return nil
+}
+
+// writeLookupError answers a failed single-row lookup: a missing row is a 404
+// with detail, anything else an internal error.
+func writeLookupError(w http.ResponseWriter, r *http.Request, err error, detail string) {
+	if errors.Is(err, sql.ErrNoRows) {
+		httphelper.WriteProblem(w, httphelper.NotFound(detail))
+		return
+	}
+
+	httphelper.WriteInternalError(w, r, err)
+}
+
+// authenticateUserByEmailPassword checks the credentials of a login from ip.
+// Only a client that must still wait is rejected before hashing anything:
+// every other answer, including a lockout of the account, comes after one
+// password hash, so neither it nor its timing tells whether the email is
+// registered.
 func (svc *UserService) authenticateUserByEmailPassword(
+	ctx context.Context,
 	loginUserPayload LoginUserPayload,
+	ip string,
 ) (*UserEntity, error) {
-	user, err := svc.Repo.FindUserByEmail(loginUserPayload.Email)
+	if err := svc.checkClientThrottle(ip); err != nil {
+		return nil, err
+	}
 
+	email := loginUserPayload.Email
+	failures, err := svc.checkAccountThrottle(ctx, email)
 	if err != nil {
+		svc.verifyDummy(ctx, loginUserPayload.Password)
+		return nil, err
+	}
+
+	user, err := svc.Repo.FindUserByEmail(ctx, email)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			svc.verifyDummy(ctx, loginUserPayload.Password)
+			svc.failAccountLogin(ctx, email, nil, ip)
+		}
 		return nil, err
 	}
 
 	if _, err := user.CheckPassword(loginUserPayload.Password); err != nil {
+		switch {
+		case errors.Is(err, ErrInvalidUserOrPassword):
+			svc.failAccountLogin(ctx, email, &user.ID, ip)
+		case errors.Is(err, ErrNoPasswordSet):
+			svc.verifyDummy(ctx, loginUserPayload.Password)
+			svc.failAccountLogin(ctx, email, &user.ID, ip)
+		}
+		return nil, err
+	}
+
+	if err := svc.checkCanSignIn(user); err != nil {
 		return nil, err
 	}
 
+	// With MFA on, failures are only forgotten once the code checks out too,
+	// or re-entering the password would reset the count of wrong codes.
+	if failures > 0 && !user.TOTPEnabled() {
+		svc.clearAccountLogins(ctx, email)
+	}
+
+	svc.upgradePasswordHash(ctx, user, loginUserPayload.Password)
+
 	return user, nil
 }
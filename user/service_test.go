@@ -1,11 +1,24 @@
 package user
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/diegodario88/sesamo/httphelper"
+	"github.com/diegodario88/sesamo/password"
+	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/bcrypt"
 )
 
+// testIP is the client address of logins in tests.
+const testIP = "192.0.2.1"
+
 type ServiceTestSuite struct {
 	suite.Suite
 	mockUserRepository *MockUserRepository
@@ -15,7 +28,7 @@ type ServiceTestSuite struct {
 func (serviceTestSuite *ServiceTestSuite) SetupTest() {
 	serviceTestSuite.mockUserRepository = new(MockUserRepository)
 	serviceTestSuite.userService = UserService{
-		Repository: serviceTestSuite.mockUserRepository,
+		Repo: serviceTestSuite.mockUserRepository,
 	}
 }
 
@@ -30,19 +43,159 @@ func (suite *ServiceTestSuite) TestAuthenticateUserByEmailPassword() {
 	}
 
 	correctUser := &UserEntity{
-		Email: loginUserPayload.Email,
+		Email:  loginUserPayload.Email,
+		Status: StatusActive,
 	}
 
-	encondedHash, errHash := correctUser.HashPassword(loginUserPayload.Password)
+	encondedHash, errHash := correctUser.HashPassword(
+		loginUserPayload.Password,
+		password.DefaultParams,
+	)
 	suite.NoError(errHash)
 
 	correctUser.PasswordHash = &encondedHash
 
 	suite.mockUserRepository.On("FindUserByEmail", loginUserPayload.Email).Return(correctUser, nil)
 
-	result, err := suite.userService.authenticateUserByEmailPassword(loginUserPayload)
+	result, err := suite.userService.authenticateUserByEmailPassword(
+		context.Background(),
+		loginUserPayload,
+		testIP,
+	)
 
 	suite.NoError(err)
 	suite.NotNil(result)
 	suite.mockUserRepository.AssertExpectations(suite.T())
 }
+
+func (suite *ServiceTestSuite) TestAuthenticateDisabledUser() {
+	loginUserPayload := LoginUserPayload{
+		Password: "password123",
+		Email:    "disabled@example.com",
+	}
+
+	disabledUser := &UserEntity{
+		Email:  loginUserPayload.Email,
+		Status: StatusDisabled,
+	}
+
+	encondedHash, errHash := disabledUser.HashPassword(
+		loginUserPayload.Password,
+		password.DefaultParams,
+	)
+	suite.NoError(errHash)
+
+	disabledUser.PasswordHash = &encondedHash
+
+	suite.mockUserRepository.On("FindUserByEmail", loginUserPayload.Email).Return(disabledUser, nil)
+
+	result, err := suite.userService.authenticateUserByEmailPassword(
+		context.Background(),
+		loginUserPayload,
+		testIP,
+	)
+
+	suite.ErrorIs(err, ErrUserDisabled)
+	suite.Nil(result)
+	suite.mockUserRepository.AssertExpectations(suite.T())
+}
+
+func (suite *ServiceTestSuite) TestLoginUnknownUserIsUnauthorized() {
+	suite.mockUserRepository.
+		On("FindUserByEmail", "ghost@example.com").
+		Return((*UserEntity)(nil), fmt.Errorf("FindUserByEmail: %w", sql.ErrNoRows))
+
+	body := strings.NewReader(`{"email":"ghost@example.com","password":"password123"}`)
+	recorder := httptest.NewRecorder()
+
+	suite.userService.Login(recorder, httptest.NewRequest(http.MethodPost, "/users/login", body))
+
+	suite.Equal(http.StatusUnauthorized, recorder.Code)
+	suite.Equal(httphelper.ProblemContentType, recorder.Header().Get("Content-Type"))
+	suite.Contains(recorder.Body.String(), `"code":"invalid_credentials"`)
+	suite.NotContains(recorder.Body.String(), "sql")
+}
+
+func (suite *ServiceTestSuite) TestRegisterInvalidPayloadIsUnprocessable() {
+	body := strings.NewReader(`{"firstName":"Ana","email":"nope","password":"secret"}`)
+	recorder := httptest.NewRecorder()
+
+	suite.userService.Register(recorder, httptest.NewRequest(http.MethodPost, "/users/register", body))
+
+	suite.Equal(http.StatusUnprocessableEntity, recorder.Code)
+	suite.Contains(recorder.Body.String(), `"field":"lastName"`)
+	suite.Contains(recorder.Body.String(), `"field":"email"`)
+}
+
+func (suite *ServiceTestSuite) TestLoginLockedUserIsForbidden() {
+	lockedUser := &UserEntity{Email: "locked@example.com", Status: StatusLocked}
+	encodedHash, err := lockedUser.HashPassword("password123", password.DefaultParams)
+	suite.Require().NoError(err)
+	lockedUser.PasswordHash = &encodedHash
+
+	suite.mockUserRepository.On("FindUserByEmail", lockedUser.Email).Return(lockedUser, nil)
+
+	body := strings.NewReader(`{"email":"locked@example.com","password":"password123"}`)
+	recorder := httptest.NewRecorder()
+
+	suite.userService.Login(recorder, httptest.NewRequest(http.MethodPost, "/users/login", body))
+
+	suite.Equal(http.StatusForbidden, recorder.Code)
+	suite.Contains(recorder.Body.String(), `"code":"account_locked"`)
+}
+
+func (suite *ServiceTestSuite) TestLoginUpgradesOutdatedHashes() {
+	weak := password.Params{Memory: 8 * 1024, Iterations: 1, Parallelism: 1}
+	argon2Hash, err := password.Hash("password123", weak)
+	suite.Require().NoError(err)
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	suite.Require().NoError(err)
+
+	for _, oldHash := range []string{argon2Hash, string(bcryptHash)} {
+		repo := new(MockUserRepository)
+		svc := UserService{Repo: repo}
+		user := &UserEntity{
+			ID:           targetID,
+			Email:        "legacy@example.com",
+			PasswordHash: &oldHash,
+			Status:       StatusActive,
+		}
+		repo.On("FindUserByEmail", user.Email).Return(user, nil)
+		repo.
+			On("RehashUserPassword", targetID, oldHash, mock.AnythingOfType("string")).
+			Return(nil)
+
+		result, err := svc.authenticateUserByEmailPassword(
+			context.Background(),
+			LoginUserPayload{Email: user.Email, Password: "password123"},
+			testIP,
+		)
+
+		suite.Require().NoError(err)
+		suite.False(result.PasswordNeedsRehash(password.DefaultParams))
+		repo.AssertExpectations(suite.T())
+	}
+}
+
+func (suite *ServiceTestSuite) TestLoginKeepsCurrentHashes() {
+	user := &UserEntity{Email: "current@example.com", Status: StatusActive}
+	hash, err := password.Hash("password123", password.DefaultParams)
+	suite.Require().NoError(err)
+	user.PasswordHash = &hash
+	suite.mockUserRepository.On("FindUserByEmail", user.Email).Return(user, nil)
+
+	_, err = suite.userService.authenticateUserByEmailPassword(
+		context.Background(),
+		LoginUserPayload{Email: user.Email, Password: "password123"},
+		testIP,
+	)
+
+	suite.Require().NoError(err)
+	suite.mockUserRepository.AssertNotCalled(
+		suite.T(),
+		"RehashUserPassword",
+		mock.Anything,
+		mock.Anything,
+		mock.Anything,
+	)
+}
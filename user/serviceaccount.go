@@ -0,0 +1,234 @@
+package user
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/diegodario88/sesamo/logging"
+	"github.com/diegodario88/sesamo/metrics"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Client IDs of service accounts start with serviceAccountPrefix and their
+// secrets with clientSecretPrefix, so either is recognizable when leaked.
+const (
+	serviceAccountPrefix = "sa_"
+	clientSecretPrefix   = "sesamo_cs_"
+	clientIDBytes        = 12
+)
+
+var ErrServiceAccountDisabled = errors.New("service account is disabled")
+var ErrBranchNotFound = errors.New("branch not found in the organization")
+var ErrInvalidPublicKey = errors.New("public key must be a PEM encoded RSA, ECDSA or Ed25519 key")
+
+// ServiceAccount is a machine principal owned by an organization. It
+// authenticates with a client secret, of which only the SHA-256 is stored,
+// or with JWTs signed by the private key of PublicKey.
+type ServiceAccount struct {
+	ID               string     `db:"id"                 json:"id"`
+	OrganizationID   string     `db:"organization_id"    json:"organization_id"`
+	Name             string     `db:"name"               json:"name"`
+	ClientID         string     `db:"client_id"          json:"client_id"`
+	SecretHash       *string    `db:"secret_hash"        json:"-"`
+	PublicKey        *string    `db:"public_key"         json:"public_key,omitempty"`
+	CanIntrospect    bool       `db:"can_introspect"     json:"can_introspect"`
+	DisabledAt       *time.Time `db:"disabled_at"        json:"disabled_at"`
+	TokensValidAfter *time.Time `db:"tokens_valid_after" json:"-"`
+	CreatedAt        time.Time  `db:"created_at"         json:"created_at"`
+	UpdatedAt        time.Time  `db:"updated_at"         json:"updated_at"`
+}
+
+// CreateServiceAccount registers a service account of orgID. Without a
+// public key it authenticates with the returned secret, which is not stored
+// and cannot be shown again. With canIntrospect it may call the
+// introspection endpoint, as resource servers do.
+func (svc *UserService) CreateServiceAccount(
+	ctx context.Context,
+	orgID string,
+	name string,
+	publicKey string,
+	canIntrospect bool,
+) (*ServiceAccount, string, error) {
+	raw, err := generateRandomBytes(clientIDBytes)
+	if err != nil {
+		return nil, "", fmt.Errorf("CreateServiceAccount: %w", err)
+	}
+
+	account := &ServiceAccount{
+		OrganizationID: orgID,
+		Name:           name,
+		ClientID:       serviceAccountPrefix + base64.RawURLEncoding.EncodeToString(raw),
+		CanIntrospect:  canIntrospect,
+	}
+
+	var secret string
+	if publicKey != "" {
+		if _, err := parseClientPublicKey(publicKey); err != nil {
+			return nil, "", err
+		}
+		account.PublicKey = &publicKey
+	} else {
+		var hash string
+		secret, hash, err = newClientSecret()
+		if err != nil {
+			return nil, "", fmt.Errorf("CreateServiceAccount: %w", err)
+		}
+		account.SecretHash = &hash
+	}
+
+	created, err := svc.Repo.InsertServiceAccount(ctx, account)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return created, secret, nil
+}
+
+// RotateServiceAccountSecret replaces the secret of the service account with
+// clientID and revokes the tokens issued to it so far.
+func (svc *UserService) RotateServiceAccountSecret(
+	ctx context.Context,
+	clientID string,
+) (string, error) {
+	secret, hash, err := newClientSecret()
+	if err != nil {
+		return "", fmt.Errorf("RotateServiceAccountSecret: %w", err)
+	}
+
+	if err := svc.Repo.SetServiceAccountSecret(ctx, clientID, hash); err != nil {
+		return "", err
+	}
+
+	return secret, nil
+}
+
+// generateServiceAccountToken signs an access token for account. Its roles
+// come from service_account_roles, so RBACMiddleware checks it like a user's.
+func (svc *UserService) generateServiceAccountToken(
+	ctx context.Context,
+	account *ServiceAccount,
+) (string, time.Duration, error) {
+	if account.DisabledAt != nil {
+		return "", 0, ErrServiceAccountDisabled
+	}
+
+	roles, err := svc.Repo.GetRoles(ctx, account.ID)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to get service account roles: %w", err)
+	}
+
+	expiration := time.Second * time.Duration(svc.Config.JwtExpirationInSeconds)
+	now := issueTime(account.TokensValidAfter)
+	claims := jwt.MapClaims{
+		"userID":    account.ID,
+		"client_id": account.ClientID,
+		"org_id":    account.OrganizationID,
+		"roles":     roles,
+		"iat":       numericDate(now),
+		"exp":       now.Add(expiration).Unix(),
+		"expiresAt": now.Add(expiration).Unix(),
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	tokenString, err := token.SignedString([]byte(svc.Config.JwtSecret))
+	if err != nil {
+		return "", 0, err
+	}
+
+	metrics.TokensIssued.WithLabelValues("client_credentials").Inc()
+
+	return tokenString, expiration, nil
+}
+
+// authenticateServiceAccount resolves the claims of a token issued to a
+// service account into the request context AuthMiddleware hands on.
+func (svc *UserService) authenticateServiceAccount(
+	ctx context.Context,
+	claims jwt.MapClaims,
+) (context.Context, error) {
+	clientID, _ := claims["client_id"].(string)
+	account, err := svc.Repo.FindServiceAccountByClientID(ctx, clientID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ctx, ErrInvalidToken
+	}
+	if err != nil {
+		return ctx, fmt.Errorf("authenticateServiceAccount: %w", err)
+	}
+
+	if account.DisabledAt != nil {
+		return ctx, ErrServiceAccountDisabled
+	}
+
+	issuedAt := tokenIssuedAt(claims)
+	if revokedBefore(issuedAt, account.TokensValidAfter) {
+		return ctx, ErrTokenRevoked
+	}
+
+	ctx = context.WithValue(ctx, UserIDKey, account.ID)
+	ctx = context.WithValue(ctx, UnverifiedKey, false)
+	ctx = context.WithValue(ctx, AuthTimeKey, time.Time{})
+	ctx = context.WithValue(ctx, MFAEnrollmentKey, false)
+	ctx = context.WithValue(ctx, ServiceAccountKey, account)
+	if roles, ok := claims["roles"].([]interface{}); ok {
+		roleStrings := make([]string, len(roles))
+		for i, role := range roles {
+			roleStrings[i], _ = role.(string)
+		}
+		ctx = context.WithValue(ctx, UserRolesKey, roleStrings)
+	}
+
+	return logging.SetUserID(ctx, account.ID), nil
+}
+
+func newClientSecret() (secret string, hash string, err error) {
+	raw, err := generateRandomBytes(tokenBytes)
+	if err != nil {
+		return "", "", err
+	}
+
+	secret = clientSecretPrefix + base64.RawURLEncoding.EncodeToString(raw)
+	return secret, hashToken(secret), nil
+}
+
+// parseClientPublicKey decodes the PEM encoded public key a client signs its
+// assertions with.
+func parseClientPublicKey(text string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(text))
+	if block == nil {
+		return nil, ErrInvalidPublicKey
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPublicKey, err)
+	}
+
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	default:
+		return nil, ErrInvalidPublicKey
+	}
+}
+
+// signingMethodsFor lists the JWT algorithms a key of this type verifies.
+func signingMethodsFor(key crypto.PublicKey) []string {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		return []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512"}
+	case *ecdsa.PublicKey:
+		return []string{"ES256", "ES384", "ES512"}
+	default:
+		return []string{"EdDSA"}
+	}
+}
@@ -0,0 +1,208 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/diegodario88/sesamo/audit"
+	"github.com/diegodario88/sesamo/config"
+	"github.com/diegodario88/sesamo/httphelper"
+	"github.com/diegodario88/sesamo/logging"
+	"github.com/diegodario88/sesamo/throttle"
+)
+
+// hashSlotWait is how long a request waits for a free password hashing slot
+// before it is rejected.
+const hashSlotWait = 250 * time.Millisecond
+
+// ThrottledError rejects a login attempt that came too soon after failed
+// ones, or during a lockout.
+type ThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (err *ThrottledError) Error() string {
+	return fmt.Sprintf("too many failed logins, retry in %s", err.RetryAfter)
+}
+
+// LoginThrottle delays and then locks out repeated failed logins, both per
+// email, counted in the database, and per client IP, counted in memory.
+type LoginThrottle struct {
+	Account    throttle.Policy
+	IPs        *throttle.Tracker
+	TrustProxy bool
+}
+
+func NewLoginThrottle(cfg *config.Config) *LoginThrottle {
+	return &LoginThrottle{
+		Account:    throttle.AccountPolicy(cfg),
+		IPs:        throttle.NewTracker(throttle.IPPolicy(cfg)),
+		TrustProxy: cfg.TrustProxyHeaders,
+	}
+}
+
+func (svc *UserService) clientIP(r *http.Request) string {
+	return httphelper.ClientIP(r, svc.Throttle != nil && svc.Throttle.TrustProxy)
+}
+
+// checkClientThrottle rejects attempts from an IP that must still wait.
+func (svc *UserService) checkClientThrottle(ip string) error {
+	if svc.Throttle == nil {
+		return nil
+	}
+
+	if wait := svc.Throttle.IPs.RetryAfter(ip, time.Now()); wait > 0 {
+		return &ThrottledError{RetryAfter: wait}
+	}
+
+	return nil
+}
+
+// failClientLogin counts a failed login from ip, auditing the attempt that
+// blocks it.
+func (svc *UserService) failClientLogin(ctx context.Context, ip string) {
+	if svc.Throttle == nil {
+		return
+	}
+
+	failures := svc.Throttle.IPs.Fail(ip, time.Now())
+	if failures == svc.Throttle.IPs.Policy().LockAfter {
+		svc.record(ctx, audit.Event{
+			Action:  audit.ActionLoginIPBlocked,
+			IP:      &ip,
+			Details: map[string]any{"failures": failures},
+		})
+	}
+}
+
+// LoginFailures counts the recent failed logins with one email.
+type LoginFailures struct {
+	Failures     int       `db:"failures"`
+	LastFailedAt time.Time `db:"last_failed_at"`
+}
+
+// loginKey is what failed logins with email are counted under. It is the
+// same whether or not email belongs to an account, so a lockout does not tell
+// which emails are registered.
+func loginKey(email string) string {
+	return hashToken(strings.ToLower(strings.TrimSpace(email)))
+}
+
+// checkAccountThrottle rejects attempts on the account email names that must
+// still wait, and returns its recent failed logins. Like failAccountLogin, it
+// lets the attempt through when the count cannot be read.
+func (svc *UserService) checkAccountThrottle(ctx context.Context, email string) (int, error) {
+	if svc.Throttle == nil {
+		return 0, nil
+	}
+
+	found, err := svc.Repo.FindLoginFailures(ctx, loginKey(email))
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		logging.FromContext(ctx).Warn("Reading failed logins failed", "error", err)
+		return 0, nil
+	}
+
+	wait := svc.Throttle.Account.RetryAfter(found.Failures, found.LastFailedAt, time.Now())
+	if wait > 0 {
+		return found.Failures, &ThrottledError{RetryAfter: wait}
+	}
+
+	return found.Failures, nil
+}
+
+// failAccountLogin counts a failed login with email from ip, auditing the
+// attempt that locks the account. userID is nil when email has no account.
+func (svc *UserService) failAccountLogin(
+	ctx context.Context,
+	email string,
+	userID *string,
+	ip string,
+) {
+	if svc.Throttle == nil {
+		return
+	}
+
+	policy := svc.Throttle.Account
+	failures, err := svc.Repo.RecordFailedLogin(ctx, loginKey(email), policy.LockFor)
+	if err != nil {
+		logging.FromContext(ctx).Warn("Recording failed login failed", "error", err)
+		return
+	}
+
+	if failures == policy.LockAfter {
+		svc.record(ctx, audit.Event{
+			Action: audit.ActionLoginLocked,
+			UserID: userID,
+			IP:     &ip,
+			Details: map[string]any{
+				"failures": failures,
+				"until":    time.Now().Add(policy.LockFor).UTC(),
+			},
+		})
+	}
+}
+
+// clearAccountLogins forgets the failed logins with email after a successful
+// sign-in.
+func (svc *UserService) clearAccountLogins(ctx context.Context, email string) {
+	if svc.Throttle == nil {
+		return
+	}
+
+	if _, err := svc.Repo.ClearFailedLogins(ctx, loginKey(email)); err != nil {
+		logging.FromContext(ctx).Warn("Clearing failed logins failed", "error", err)
+	}
+}
+
+// ClearLockout forgets the failed logins of a user, lifting their lockout.
+func (svc *UserService) ClearLockout(w http.ResponseWriter, r *http.Request) {
+	user, ok := svc.managedUser(w, r, "users:update")
+	if !ok {
+		return
+	}
+
+	failures, err := svc.Repo.ClearFailedLogins(r.Context(), loginKey(user.Email))
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	actorID := r.Context().Value(UserIDKey).(string)
+	svc.record(r.Context(), audit.Event{
+		Action:  audit.ActionLockoutCleared,
+		ActorID: &actorID,
+		UserID:  &user.ID,
+		Details: map[string]any{"failures": failures},
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// record writes event to the audit log. Failures are logged rather than
+// failing the request that caused the event.
+func (svc *UserService) record(ctx context.Context, event audit.Event) {
+	if svc.Audit == nil {
+		return
+	}
+
+	if err := svc.Audit.Record(ctx, event); err != nil {
+		logging.FromContext(ctx).Error("Audit event lost", "action", event.Action, "error", err)
+	}
+}
+
+// hashing bounds how many requests hash passwords at once.
+func (h *Handler) hashing(handler http.HandlerFunc) http.Handler {
+	if h.HashGate == nil {
+		return handler
+	}
+
+	return h.HashGate.Middleware(handler)
+}
@@ -0,0 +1,223 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diegodario88/sesamo/audit"
+	"github.com/diegodario88/sesamo/password"
+	"github.com/diegodario88/sesamo/throttle"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+// recordingAudit keeps the events it is asked to record.
+type recordingAudit struct {
+	events []audit.Event
+}
+
+func (recorder *recordingAudit) Record(ctx context.Context, event audit.Event) error {
+	recorder.events = append(recorder.events, event)
+	return nil
+}
+
+type ThrottleTestSuite struct {
+	suite.Suite
+	repo  *MockUserRepository
+	audit *recordingAudit
+	svc   UserService
+}
+
+func TestThrottleTestSuite(t *testing.T) {
+	suite.Run(t, new(ThrottleTestSuite))
+}
+
+func (suite *ThrottleTestSuite) SetupTest() {
+	suite.repo = new(MockUserRepository)
+	suite.audit = &recordingAudit{}
+	policy := throttle.Policy{
+		DelayAfter: 3,
+		LockAfter:  10,
+		MaxDelay:   time.Minute,
+		LockFor:    15 * time.Minute,
+	}
+	suite.svc = UserService{
+		Repo: suite.repo,
+		Throttle: &LoginThrottle{
+			Account: policy,
+			IPs:     throttle.NewTracker(throttle.Policy{LockAfter: 2, LockFor: time.Hour}),
+		},
+		Audit: suite.audit,
+	}
+}
+
+func (suite *ThrottleTestSuite) login(email string, secret string) *httptest.ResponseRecorder {
+	body := strings.NewReader(`{"email":"` + email + `","password":"` + secret + `"}`)
+	request := httptest.NewRequest(http.MethodPost, "/users/login", body)
+	request.RemoteAddr = testIP + ":40000"
+	recorder := httptest.NewRecorder()
+
+	suite.svc.Login(recorder, request)
+
+	return recorder
+}
+
+// userFailing returns an active user whose last failed login, one of
+// failures, was ago.
+func (suite *ThrottleTestSuite) userFailing(failures int, ago time.Duration) *UserEntity {
+	user := &UserEntity{ID: targetID, Email: "ana@example.com", Status: StatusActive}
+	hash, err := user.HashPassword("Correct-Horse-42", password.DefaultParams)
+	suite.Require().NoError(err)
+	user.PasswordHash = &hash
+	suite.failing(user.Email, failures, ago)
+	suite.repo.On("FindUserByEmail", user.Email).Return(user, nil)
+	return user
+}
+
+// failing counts failures with email, the last of them ago.
+func (suite *ThrottleTestSuite) failing(email string, failures int, ago time.Duration) {
+	found := &LoginFailures{Failures: failures, LastFailedAt: time.Now().Add(-ago)}
+	suite.repo.On("FindLoginFailures", loginKey(email)).Return(found, nil)
+}
+
+func (suite *ThrottleTestSuite) TestFailureThatLocksTheAccountIsAudited() {
+	user := suite.userFailing(9, 2*time.Minute)
+	suite.repo.On("RecordFailedLogin", loginKey(user.Email), 15*time.Minute).Return(10, nil)
+
+	recorder := suite.login(user.Email, "wrong")
+
+	suite.Equal(http.StatusUnauthorized, recorder.Code)
+	suite.Require().Len(suite.audit.events, 1)
+	suite.Equal(audit.ActionLoginLocked, suite.audit.events[0].Action)
+	suite.Equal(user.ID, *suite.audit.events[0].UserID)
+	suite.Equal(testIP, *suite.audit.events[0].IP)
+}
+
+func (suite *ThrottleTestSuite) TestLockedAccountIsRejected() {
+	user := suite.userFailing(10, time.Minute)
+
+	recorder := suite.login(user.Email, "Correct-Horse-42")
+
+	suite.Equal(http.StatusTooManyRequests, recorder.Code)
+	suite.Equal("840", recorder.Header().Get("Retry-After"))
+	suite.repo.AssertNotCalled(suite.T(), "FindUserByEmail", mock.Anything)
+	suite.repo.AssertNotCalled(suite.T(), "RecordFailedLogin", mock.Anything, mock.Anything)
+}
+
+func (suite *ThrottleTestSuite) TestUnknownEmailLocksLikeAnAccount() {
+	suite.failing("ghost@example.com", 9, 2*time.Minute)
+	suite.repo.
+		On("FindUserByEmail", "ghost@example.com").
+		Return((*UserEntity)(nil), sql.ErrNoRows)
+	suite.repo.
+		On("RecordFailedLogin", loginKey("ghost@example.com"), 15*time.Minute).
+		Return(10, nil)
+
+	suite.Equal(http.StatusUnauthorized, suite.login("ghost@example.com", "guess").Code)
+	suite.Require().Len(suite.audit.events, 1)
+	suite.Equal(audit.ActionLoginLocked, suite.audit.events[0].Action)
+	suite.Nil(suite.audit.events[0].UserID)
+
+	suite.repo.ExpectedCalls = nil
+	suite.failing("Ghost@Example.com", 10, time.Minute)
+	recorder := suite.login("Ghost@Example.com", "guess")
+
+	suite.Equal(http.StatusTooManyRequests, recorder.Code)
+	suite.Equal("840", recorder.Header().Get("Retry-After"))
+}
+
+func (suite *ThrottleTestSuite) TestSuccessClearsFailedLogins() {
+	user := suite.userFailing(3, 2*time.Second)
+	suite.svc.Config = mailingService(suite.repo, nil).Config
+	suite.repo.On("ClearFailedLogins", loginKey(user.Email)).Return(3, nil)
+	suite.repo.On("FindWebAuthnCredentials", user.ID).Return([]WebAuthnCredential{}, nil)
+	suite.repo.On("GetRoles", user.ID).Return([]string{}, nil)
+	suite.repo.On("RequiresMFA", user.ID).Return(false, nil)
+
+	recorder := suite.login(user.Email, "Correct-Horse-42")
+
+	suite.Equal(http.StatusOK, recorder.Code)
+	suite.repo.AssertExpectations(suite.T())
+}
+
+func (suite *ThrottleTestSuite) TestClientIPIsBlocked() {
+	suite.failing("ghost@example.com", 0, time.Hour)
+	suite.repo.
+		On("FindUserByEmail", "ghost@example.com").
+		Return((*UserEntity)(nil), sql.ErrNoRows).
+		Twice()
+	suite.repo.
+		On("RecordFailedLogin", loginKey("ghost@example.com"), 15*time.Minute).
+		Return(1, nil).
+		Twice()
+
+	suite.Equal(http.StatusUnauthorized, suite.login("ghost@example.com", "guess").Code)
+	suite.Equal(http.StatusUnauthorized, suite.login("ghost@example.com", "guess").Code)
+	recorder := suite.login("ghost@example.com", "guess")
+
+	suite.Equal(http.StatusTooManyRequests, recorder.Code)
+	suite.NotEmpty(recorder.Header().Get("Retry-After"))
+	suite.Require().Len(suite.audit.events, 1)
+	suite.Equal(audit.ActionLoginIPBlocked, suite.audit.events[0].Action)
+	suite.repo.AssertExpectations(suite.T())
+}
+
+func (suite *ThrottleTestSuite) TestAdminClearsLockout() {
+	suite.repo.
+		On("FindManagedUser", Manager{UserID: adminID, Permission: "users:update"}, targetID).
+		Return(&UserEntity{ID: targetID, Email: "ana@example.com"}, nil)
+	suite.repo.On("ClearFailedLogins", loginKey("ana@example.com")).Return(10, nil)
+
+	request := httptest.NewRequest(http.MethodDelete, "/users/"+targetID+"/lockout", nil)
+	request = request.WithContext(context.WithValue(request.Context(), UserIDKey, adminID))
+	recorder := httptest.NewRecorder()
+
+	suite.svc.ClearLockout(recorder, mux.SetURLVars(request, map[string]string{"id": targetID}))
+
+	suite.Equal(http.StatusNoContent, recorder.Code)
+	suite.Require().Len(suite.audit.events, 1)
+	suite.Equal(audit.ActionLockoutCleared, suite.audit.events[0].Action)
+	suite.Equal(adminID, *suite.audit.events[0].ActorID)
+	suite.Equal(10, suite.audit.events[0].Details["failures"])
+	suite.repo.AssertExpectations(suite.T())
+}
+
+func (suite *ThrottleTestSuite) changePassword(current string) *httptest.ResponseRecorder {
+	body := strings.NewReader(`{"currentPassword":"` + current + `","newPassword":"Another-Horse-43"}`)
+	request := httptest.NewRequest(http.MethodPut, "/users/me/password", body)
+	request.RemoteAddr = testIP + ":40000"
+	ctx := context.WithValue(request.Context(), UserIDKey, targetID)
+	recorder := httptest.NewRecorder()
+
+	suite.svc.ChangePassword(recorder, request.WithContext(ctx))
+
+	return recorder
+}
+
+func (suite *ThrottleTestSuite) TestWrongCurrentPasswordCountsAsFailedLogin() {
+	user := suite.userFailing(0, time.Hour)
+	suite.repo.On("FindUserById", user.ID).Return(user, nil)
+	suite.repo.On("RecordFailedLogin", loginKey(user.Email), 15*time.Minute).Return(1, nil)
+
+	recorder := suite.changePassword("wrong")
+
+	suite.Equal(http.StatusForbidden, recorder.Code)
+	suite.repo.AssertCalled(suite.T(), "RecordFailedLogin", loginKey(user.Email), 15*time.Minute)
+}
+
+func (suite *ThrottleTestSuite) TestLockedAccountCannotChangePassword() {
+	user := suite.userFailing(10, time.Minute)
+	suite.repo.On("FindUserById", user.ID).Return(user, nil)
+
+	recorder := suite.changePassword("Correct-Horse-42")
+
+	suite.Equal(http.StatusTooManyRequests, recorder.Code)
+	suite.repo.AssertNotCalled(suite.T(), "SetUserPassword", mock.Anything, mock.Anything)
+	suite.repo.AssertNotCalled(suite.T(), "RecordFailedLogin", mock.Anything, mock.Anything)
+}
@@ -0,0 +1,70 @@
+package user
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Purposes of the single-use tokens sent by email. A token only redeems for
+// the purpose it was issued with.
+const (
+	TokenPurposeEmailChange   = "email_change"
+	TokenPurposeVerifyEmail   = "verify_email"
+	TokenPurposeResetPassword = "reset_password"
+)
+
+const tokenBytes = 32
+
+var ErrInvalidToken = errors.New("invalid, expired or already used token")
+
+// UserToken is a single-use secret bound to a user. Only the SHA-256 of the
+// secret is stored, so a database leak does not reveal redeemable links.
+type UserToken struct {
+	ID        string     `db:"id"`
+	UserID    string     `db:"user_id"`
+	Purpose   string     `db:"purpose"`
+	TokenHash string     `db:"token_hash"`
+	Data      *string    `db:"data"`
+	ExpiresAt time.Time  `db:"expires_at"`
+	UsedAt    *time.Time `db:"used_at"`
+	CreatedAt time.Time  `db:"created_at"`
+}
+
+// newToken returns a random secret to hand to the user and the hash to store.
+// The secret is signed with key for purpose, so forged or repurposed tokens
+// are rejected by verifyToken without a database round trip.
+func newToken(key []byte, purpose string) (secret string, hash string, err error) {
+	raw, err := generateRandomBytes(tokenBytes)
+	if err != nil {
+		return "", "", err
+	}
+
+	nonce := base64.RawURLEncoding.EncodeToString(raw)
+	secret = nonce + "." + signToken(key, purpose, nonce)
+	return secret, hashToken(secret), nil
+}
+
+func verifyToken(key []byte, purpose string, secret string) bool {
+	nonce, signature, ok := strings.Cut(secret, ".")
+	if !ok {
+		return false
+	}
+
+	return hmac.Equal([]byte(signature), []byte(signToken(key, purpose, nonce)))
+}
+
+func signToken(key []byte, purpose string, nonce string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose + "." + nonce))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,28 @@
+package user
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type TokensTestSuite struct {
+	suite.Suite
+}
+
+func TestTokensTestSuite(t *testing.T) {
+	suite.Run(t, new(TokensTestSuite))
+}
+
+func (suite *TokensTestSuite) TestTokenIsBoundToKeyAndPurpose() {
+	key := []byte("0123456789abcdef")
+
+	secret, hash, err := newToken(key, TokenPurposeVerifyEmail)
+	suite.Require().NoError(err)
+
+	suite.Equal(hash, hashToken(secret))
+	suite.True(verifyToken(key, TokenPurposeVerifyEmail, secret))
+	suite.False(verifyToken(key, TokenPurposeEmailChange, secret))
+	suite.False(verifyToken([]byte("another key 1234"), TokenPurposeVerifyEmail, secret))
+	suite.False(verifyToken(key, TokenPurposeVerifyEmail, "unsigned"))
+}
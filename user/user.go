@@ -2,30 +2,45 @@ package user
 
 import (
 	"crypto/rand"
-	"encoding/base64"
 	"errors"
 	"fmt"
-	"strings"
 	"time"
 
-	"github.com/alexedwards/argon2id"
-	"golang.org/x/crypto/argon2"
+	"github.com/diegodario88/sesamo/password"
 )
 
-const saltLength uint32 = 16
-const iterations uint32 = 3
-const memory uint32 = 64 * 1024
-const parallelism uint8 = 2
-const keyLength uint32 = 32
+// Account statuses. Only active accounts can sign in or use their tokens.
+const (
+	StatusActive              = "active"
+	StatusDisabled            = "disabled"
+	StatusLocked              = "locked"
+	StatusPendingVerification = "pending_verification"
+)
+
+var AccountStatuses = []string{
+	StatusActive,
+	StatusDisabled,
+	StatusLocked,
+	StatusPendingVerification,
+}
 
 type UserEntity struct {
-	ID           string    `db:"id"            json:"id"`
-	FirstName    string    `db:"first_name"    json:"firstName"`
-	LastName     string    `db:"last_name"     json:"lastName"`
-	Email        string    `db:"email"         json:"email"`
-	PasswordHash *string   `db:"password_hash" json:"-"`
-	CreatedAt    time.Time `db:"created_at"    json:"created_at"`
-	UpdatedAt    time.Time `db:"updated_at"    json:"updated_at"`
+	ID                string     `db:"id"                  json:"id"`
+	FirstName         string     `db:"first_name"          json:"firstName"`
+	LastName          string     `db:"last_name"           json:"lastName"`
+	Email             string     `db:"email"               json:"email"`
+	PasswordHash      *string    `db:"password_hash"       json:"-"`
+	Status            string     `db:"status"              json:"status"`
+	StatusReason      *string    `db:"status_reason"       json:"status_reason,omitempty"`
+	StatusChangedAt   *time.Time `db:"status_changed_at"   json:"status_changed_at,omitempty"`
+	TokensValidAfter  *time.Time `db:"tokens_valid_after"  json:"-"`
+	EmailVerifiedAt   *time.Time `db:"email_verified_at"   json:"email_verified_at,omitempty"`
+	PasswordChangedAt *time.Time `db:"password_changed_at" json:"password_changed_at,omitempty"`
+	TOTPSecret        *string    `db:"totp_secret"         json:"-"`
+	TOTPEnabledAt     *time.Time `db:"totp_enabled_at"     json:"totp_enabled_at,omitempty"`
+	TOTPLastStep      *int64     `db:"totp_last_step"      json:"-"`
+	CreatedAt         time.Time  `db:"created_at"          json:"created_at"`
+	UpdatedAt         time.Time  `db:"updated_at"          json:"updated_at"`
 }
 
 type OrganizationEntity struct {
@@ -34,6 +49,7 @@ type OrganizationEntity struct {
 	ExternalHeadOfficeId int       `db:"external_head_office_id" json:"external_head_office_id"`
 	Name                 string    `db:"name"                    json:"name"`
 	Description          string    `db:"description"             json:"description"`
+	RequireMFA           bool      `db:"require_mfa"             json:"require_mfa"`
 	CreatedAt            time.Time `db:"created_at"              json:"created_at"`
 	UpdatedAt            time.Time `db:"updated_at"              json:"updated_at"`
 }
@@ -54,7 +70,7 @@ type RegisterUserPayload struct {
 	FirstName string `json:"firstName" validate:"required"`
 	LastName  string `json:"lastName"  validate:"required"`
 	Email     string `json:"email"     validate:"required,email"`
-	Password  string `json:"password"  validate:"required,min=3,max=130"`
+	Password  string `json:"password"  validate:"required"`
 }
 
 type LoginUserPayload struct {
@@ -64,38 +80,95 @@ type LoginUserPayload struct {
 
 var ErrNoPasswordSet = errors.New("no password set for user")
 var ErrInvalidUserOrPassword = errors.New("invalid user or password")
+var ErrUserAlreadyExists = errors.New("user already exists")
+var ErrUserDisabled = errors.New("user is disabled")
+var ErrUserLocked = errors.New("user is locked")
+var ErrUserPendingVerification = errors.New("user has not verified their email")
+var ErrTokenRevoked = errors.New("token has been revoked")
+var ErrUserNotFound = errors.New("user no longer exists")
+var ErrRoleNotFound = errors.New("role not found for the given scope")
+
+// CheckActive returns the error matching the account status when the user may
+// not sign in.
+func (user *UserEntity) CheckActive() error {
+	switch user.Status {
+	case StatusActive:
+		return nil
+	case StatusLocked:
+		return ErrUserLocked
+	case StatusPendingVerification:
+		return ErrUserPendingVerification
+	default:
+		return ErrUserDisabled
+	}
+}
 
-func (user *UserEntity) HashPassword(password string) (encondedHash string, err error) {
-	salt, err := generateRandomBytes(saltLength)
+// CheckTokenIssuedAt rejects tokens issued before the user's tokens were last
+// revoked or their password last changed.
+func (user *UserEntity) CheckTokenIssuedAt(issuedAt time.Time) error {
+	if revokedBefore(issuedAt, user.TokensValidAfter) {
+		return ErrTokenRevoked
+	}
 
-	if err != nil {
-		return "", err
+	if revokedBefore(issuedAt, user.PasswordChangedAt) {
+		return ErrTokenRevoked
+	}
+
+	return nil
+}
+
+// revokedBefore reports whether a token issued at issuedAt predates cutoff.
+// Both carry microseconds, so a token issued in the same second as a
+// revocation is judged by which came first.
+func revokedBefore(issuedAt time.Time, cutoff *time.Time) bool {
+	return cutoff != nil && issuedAt.Before(*cutoff)
+}
+
+// issueTime is the issue time of a new token for a subject with the given
+// revocation cutoffs. The database stamps the cutoffs, so when its clock runs
+// ahead of ours a token issued right after a revocation takes the cutoff
+// instead of now, rather than being born revoked.
+func issueTime(cutoffs ...*time.Time) time.Time {
+	now := time.Now()
+	for _, cutoff := range cutoffs {
+		if cutoff != nil && cutoff.After(now) {
+			now = *cutoff
+		}
 	}
 
-	hash := argon2.IDKey([]byte(password), salt, iterations, memory, parallelism, keyLength)
+	return now
+}
+
+// tokenIssueTime is the issue time of a new token for user.
+func (user *UserEntity) tokenIssueTime() time.Time {
+	return issueTime(user.TokensValidAfter, user.PasswordChangedAt)
+}
 
-	b64Salt := base64.RawStdEncoding.EncodeToString(salt)
-	b64Hash := base64.RawStdEncoding.EncodeToString(hash)
+// TOTPEnabled is true once the user confirmed their authenticator app, from
+// when on signing in takes a code as well.
+func (user *UserEntity) TOTPEnabled() bool {
+	return user.TOTPEnabledAt != nil && user.TOTPSecret != nil
+}
 
-	encodedHash := fmt.Sprintf(
-		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
-		argon2.Version,
-		memory,
-		iterations,
-		parallelism,
-		b64Salt,
-		b64Hash,
-	)
+// HasPassword is false for accounts that only sign in through an identity
+// provider.
+func (user *UserEntity) HasPassword() bool {
+	return user.PasswordHash != nil && *user.PasswordHash != ""
+}
 
-	return encodedHash, nil
+// HashPassword encodes plain with the argon2id costs in params.
+func (user *UserEntity) HashPassword(plain string, params password.Params) (string, error) {
+	return password.Hash(plain, params)
 }
 
-func (user *UserEntity) CheckPassword(password string) (bool, error) {
-	if user.PasswordHash == nil || !strings.HasPrefix(*user.PasswordHash, "$argon2id$") {
+// CheckPassword verifies plain against the stored argon2id or legacy bcrypt
+// hash.
+func (user *UserEntity) CheckPassword(plain string) (bool, error) {
+	if !user.HasPassword() || !password.Known(*user.PasswordHash) {
 		return false, ErrNoPasswordSet
 	}
 
-	match, err := argon2id.ComparePasswordAndHash(password, *user.PasswordHash)
+	match, err := password.Verify(plain, *user.PasswordHash)
 
 	if err != nil {
 		return false, fmt.Errorf("CheckPassword: %w", err)
@@ -108,6 +181,13 @@ func (user *UserEntity) CheckPassword(password string) (bool, error) {
 	return true, nil
 }
 
+// PasswordNeedsRehash is true when the stored hash was not created with
+// params, such as hashes from before the costs were raised or imported
+// bcrypt hashes.
+func (user *UserEntity) PasswordNeedsRehash(params password.Params) bool {
+	return user.HasPassword() && password.NeedsRehash(*user.PasswordHash, params)
+}
+
 func generateRandomBytes(n uint32) ([]byte, error) {
 	b := make([]byte, n)
 
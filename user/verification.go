@@ -0,0 +1,259 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/diegodario88/sesamo/httphelper"
+	"github.com/diegodario88/sesamo/logging"
+	"github.com/diegodario88/sesamo/mail"
+)
+
+// Values of EMAIL_VERIFICATION.
+const (
+	VerificationRequired = "required"
+	VerificationReduced  = "reduced"
+	VerificationOff      = "off"
+)
+
+type VerifyEmailPayload struct {
+	Token string `json:"token" validate:"required"`
+}
+
+type ResendVerificationPayload struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+// RegisterUser creates a self-registered account. Unless verification is off,
+// the account waits for its owner to redeem the link mailed to them. With
+// enumeration protection on, the owner of a taken email is told about the
+// attempt by mail.
+func (svc *UserService) RegisterUser(
+	ctx context.Context,
+	payload RegisterUserPayload,
+) (*UserEntity, error) {
+	status := StatusPendingVerification
+	if svc.Config.EmailVerification == VerificationOff {
+		status = StatusActive
+	}
+
+	user, err := svc.createUser(ctx, payload, status)
+	if errors.Is(err, ErrUserAlreadyExists) && svc.Config.EnumerationProtection {
+		svc.sendMail(ctx, "Sending registration notice failed", func(ctx context.Context) error {
+			return svc.SendRegistrationNotice(ctx, payload.Email)
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if status == StatusPendingVerification {
+		// The account exists either way; its owner can ask for another link.
+		svc.sendMail(ctx, "Sending verification email failed", func(ctx context.Context) error {
+			return svc.SendVerificationEmail(ctx, user)
+		})
+	}
+
+	return user, nil
+}
+
+// SendRegistrationNotice tells the owner of email that someone tried to
+// register it again.
+func (svc *UserService) SendRegistrationNotice(ctx context.Context, email string) error {
+	err := svc.Mailer.Send(ctx, mail.Message{
+		To:      email,
+		Subject: "You already have an account",
+		Body: fmt.Sprintf(
+			"Hello,\n\n"+
+				"Someone tried to create an account with this email address, "+
+				"which already has one. If it was you, sign in instead, or reset "+
+				"your password if you forgot it:\n\n%s\n\n"+
+				"If it was not you, you can ignore this message; your account is unchanged.\n",
+			strings.TrimRight(svc.Config.AppUrl, "/")+"/forgot-password",
+		),
+	})
+	if err != nil {
+		return fmt.Errorf("SendRegistrationNotice: %w", err)
+	}
+
+	return nil
+}
+
+// sendMail runs send, logging failures with message. With enumeration
+// protection on it runs in the background, so response times do not reveal
+// whether a mail was sent.
+func (svc *UserService) sendMail(
+	ctx context.Context,
+	message string,
+	send func(ctx context.Context) error,
+) {
+	run := func(ctx context.Context) {
+		if err := send(ctx); err != nil {
+			logging.FromContext(ctx).Error(message, "error", err)
+		}
+	}
+
+	if !svc.Config.EnumerationProtection {
+		run(ctx)
+		return
+	}
+
+	go run(context.WithoutCancel(ctx))
+}
+
+// SendVerificationEmail mails user a link proving they own their email.
+func (svc *UserService) SendVerificationEmail(ctx context.Context, user *UserEntity) error {
+	secret, err := svc.issueToken(
+		ctx,
+		user.ID,
+		TokenPurposeVerifyEmail,
+		nil,
+		svc.Config.EmailTokenTTL,
+	)
+	if err != nil {
+		return fmt.Errorf("SendVerificationEmail: %w", err)
+	}
+
+	err = svc.Mailer.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf(
+			"Hello %s,\n\n"+
+				"Open the link below to verify your email address and activate your account. "+
+				"It expires in %s.\n\n%s\n\n"+
+				"If you did not create an account, you can ignore this message.\n",
+			user.FirstName,
+			svc.Config.EmailTokenTTL,
+			svc.link("verify-email", secret),
+		),
+	})
+	if err != nil {
+		return fmt.Errorf("SendVerificationEmail: %w", err)
+	}
+
+	return nil
+}
+
+// VerifyEmail redeems a verification link and activates the account.
+func (svc *UserService) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var payload VerifyEmailPayload
+	if err := httphelper.ParseJSON(r, &payload); err != nil {
+		httphelper.WriteProblem(w, httphelper.BadRequest(err.Error()))
+		return
+	}
+
+	if err := httphelper.Validate.Struct(payload); err != nil {
+		httphelper.WriteProblem(w, httphelper.ValidationFailed(err))
+		return
+	}
+
+	token, err := svc.redeemToken(r.Context(), TokenPurposeVerifyEmail, payload.Token)
+	if errors.Is(err, ErrInvalidToken) {
+		writeInvalidToken(w)
+		return
+	}
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	user, err := svc.Repo.MarkEmailVerified(r.Context(), token.UserID)
+	if err != nil {
+		writeLookupError(w, r, err, "user not found")
+		return
+	}
+
+	httphelper.WriteJSON(w, http.StatusOK, user)
+}
+
+// ResendVerification mails a new link to a pending account. It answers 202
+// whether or not such an account exists, so it cannot be used to probe which
+// emails are registered.
+func (svc *UserService) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	var payload ResendVerificationPayload
+	if err := httphelper.ParseJSON(r, &payload); err != nil {
+		httphelper.WriteProblem(w, httphelper.BadRequest(err.Error()))
+		return
+	}
+
+	if err := httphelper.Validate.Struct(payload); err != nil {
+		httphelper.WriteProblem(w, httphelper.ValidationFailed(err))
+		return
+	}
+
+	user, err := svc.Repo.FindUserByEmail(r.Context(), payload.Email)
+	if err == nil && user.Status == StatusPendingVerification {
+		svc.sendMail(r.Context(), "Sending verification email failed", func(ctx context.Context) error {
+			return svc.SendVerificationEmail(ctx, user)
+		})
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// checkCanSignIn is CheckActive, except that unverified accounts may sign in
+// with a reduced token when EMAIL_VERIFICATION is reduced.
+func (svc *UserService) checkCanSignIn(user *UserEntity) error {
+	err := user.CheckActive()
+	if errors.Is(err, ErrUserPendingVerification) &&
+		svc.Config.EmailVerification == VerificationReduced {
+		return nil
+	}
+
+	return err
+}
+
+// issueToken stores a new single-use token for user, valid for ttl, and
+// returns the secret to mail them.
+func (svc *UserService) issueToken(
+	ctx context.Context,
+	userID string,
+	purpose string,
+	data *string,
+	ttl time.Duration,
+) (string, error) {
+	secret, hash, err := newToken([]byte(svc.Config.JwtSecret), purpose)
+	if err != nil {
+		return "", err
+	}
+
+	token := &UserToken{UserID: userID, Purpose: purpose, TokenHash: hash, Data: data}
+	if err := svc.Repo.CreateUserToken(ctx, token, ttl); err != nil {
+		return "", err
+	}
+
+	return secret, nil
+}
+
+// redeemToken consumes a token issued for purpose, returning ErrInvalidToken
+// for forged, unknown, expired and already used ones.
+func (svc *UserService) redeemToken(
+	ctx context.Context,
+	purpose string,
+	secret string,
+) (*UserToken, error) {
+	if !verifyToken([]byte(svc.Config.JwtSecret), purpose, secret) {
+		return nil, ErrInvalidToken
+	}
+
+	return svc.Repo.ConsumeUserToken(ctx, purpose, hashToken(secret))
+}
+
+// link builds a URL of the web app carrying a single-use token.
+func (svc *UserService) link(path string, token string) string {
+	base := strings.TrimRight(svc.Config.AppUrl, "/")
+	return base + "/" + path + "?token=" + url.QueryEscape(token)
+}
+
+func writeInvalidToken(w http.ResponseWriter) {
+	httphelper.WriteProblem(w, httphelper.NewProblem(
+		http.StatusBadRequest,
+		"invalid_token",
+		ErrInvalidToken.Error(),
+	))
+}
@@ -0,0 +1,232 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diegodario88/sesamo/config"
+	"github.com/diegodario88/sesamo/mail"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+type VerificationTestSuite struct {
+	suite.Suite
+	repo   *MockUserRepository
+	mailer *recordingSender
+	svc    UserService
+}
+
+func TestVerificationTestSuite(t *testing.T) {
+	suite.Run(t, new(VerificationTestSuite))
+}
+
+func (suite *VerificationTestSuite) SetupTest() {
+	suite.repo = new(MockUserRepository)
+	suite.mailer = &recordingSender{}
+	suite.svc = mailingService(suite.repo, suite.mailer)
+}
+
+// mailingService builds a service whose mail is recorded by mailer.
+func mailingService(repo *MockUserRepository, mailer *recordingSender) UserService {
+	return UserService{
+		Repo: repo,
+		Config: &config.Config{
+			AppUrl:                 "https://app.example.com",
+			JwtSecret:              "0123456789abcdef",
+			JwtExpirationInSeconds: 3600,
+			EmailVerification:      VerificationRequired,
+			EmailTokenTTL:          time.Hour,
+			PasswordResetTTL:       30 * time.Minute,
+			ReauthWindow:           5 * time.Minute,
+		},
+		Mailer: mailer,
+	}
+}
+
+// mailedToken extracts the token of the link in the last mail sent.
+func (sender *recordingSender) mailedToken(t *testing.T) string {
+	if len(sender.sent) == 0 {
+		t.Fatal("no mail sent")
+	}
+	body := sender.sent[len(sender.sent)-1].Body
+
+	for _, word := range strings.Fields(body) {
+		if parsed, err := url.Parse(word); err == nil && parsed.Query().Has("token") {
+			return parsed.Query().Get("token")
+		}
+	}
+
+	t.Fatalf("no link in mail: %s", body)
+	return ""
+}
+
+func (suite *VerificationTestSuite) TestRegisterCreatesPendingAccountAndVerifies() {
+	suite.repo.
+		On("FindUserByEmail", "ana@example.com").
+		Return((*UserEntity)(nil), sql.ErrNoRows)
+	suite.repo.
+		On("InsertUser", mock.MatchedBy(func(user *UserEntity) bool {
+			return user.Status == StatusPendingVerification
+		})).
+		Return(&UserEntity{
+			ID:     targetID,
+			Email:  "ana@example.com",
+			Status: StatusPendingVerification,
+		}, nil)
+
+	var stored *UserToken
+	suite.repo.
+		On("CreateUserToken", mock.AnythingOfType("*user.UserToken"), time.Hour).
+		Run(func(args mock.Arguments) { stored = args.Get(0).(*UserToken) }).
+		Return(nil)
+
+	body := strings.NewReader(
+		`{"firstName":"Ana","lastName":"Lima","email":"ana@example.com","password":"Correct-Horse-42"}`,
+	)
+	recorder := httptest.NewRecorder()
+	suite.svc.Register(recorder, httptest.NewRequest(http.MethodPost, "/users/register", body))
+
+	suite.Equal(http.StatusCreated, recorder.Code)
+	suite.Equal("ana@example.com", suite.mailer.sent[0].To)
+	suite.Equal(TokenPurposeVerifyEmail, stored.Purpose)
+
+	secret := suite.mailer.mailedToken(suite.T())
+	suite.repo.
+		On("ConsumeUserToken", TokenPurposeVerifyEmail, hashToken(secret)).
+		Return(&UserToken{UserID: targetID}, nil)
+	suite.repo.
+		On("MarkEmailVerified", targetID).
+		Return(&UserEntity{ID: targetID, Status: StatusActive}, nil)
+
+	recorder = httptest.NewRecorder()
+	body = strings.NewReader(`{"token":"` + secret + `"}`)
+	suite.svc.VerifyEmail(recorder, httptest.NewRequest(http.MethodPost, "/", body))
+
+	suite.Equal(http.StatusOK, recorder.Code)
+	suite.repo.AssertExpectations(suite.T())
+}
+
+func (suite *VerificationTestSuite) TestForgedTokenNeverReachesTheDatabase() {
+	recorder := httptest.NewRecorder()
+	body := strings.NewReader(`{"token":"forged.signature"}`)
+	suite.svc.VerifyEmail(recorder, httptest.NewRequest(http.MethodPost, "/", body))
+
+	suite.Equal(http.StatusBadRequest, recorder.Code)
+	suite.repo.AssertNotCalled(suite.T(), "ConsumeUserToken", mock.Anything, mock.Anything)
+}
+
+func (suite *VerificationTestSuite) TestPendingAccountSignIn() {
+	pending := &UserEntity{ID: targetID, Status: StatusPendingVerification}
+
+	_, err := suite.svc.GenerateUserToken(context.Background(), pending)
+	suite.ErrorIs(err, ErrUserPendingVerification)
+
+	suite.svc.Config.EmailVerification = VerificationReduced
+	suite.repo.On("GetRoles", targetID).Return([]string{"admin"}, nil)
+	suite.repo.On("RequiresMFA", targetID).Return(false, nil)
+
+	token, err := suite.svc.GenerateUserToken(context.Background(), pending)
+	suite.Require().NoError(err)
+	suite.NotEmpty(token)
+}
+
+func (suite *VerificationTestSuite) TestReducedTokenIsDeniedByRBAC() {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	request := httptest.NewRequest(http.MethodGet, "/users", nil)
+	ctx := context.WithValue(request.Context(), UserIDKey, targetID)
+	ctx = context.WithValue(ctx, UnverifiedKey, true)
+	recorder := httptest.NewRecorder()
+
+	RBACMiddleware(&suite.svc, "users:read")(next).ServeHTTP(recorder, request.WithContext(ctx))
+
+	suite.Equal(http.StatusForbidden, recorder.Code)
+	suite.Contains(recorder.Body.String(), `"code":"email_not_verified"`)
+	suite.repo.AssertNotCalled(suite.T(), "HasAccess", mock.Anything, mock.Anything)
+}
+
+// channelSender hands the messages it is asked to send to the test, which
+// may be waiting for mail sent in the background.
+type channelSender chan mail.Message
+
+func (sender channelSender) Send(ctx context.Context, msg mail.Message) error {
+	sender <- msg
+	return nil
+}
+
+func (suite *VerificationTestSuite) register(body string) int {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/users/register", strings.NewReader(body))
+	suite.svc.Register(recorder, request)
+	return recorder.Code
+}
+
+func (suite *VerificationTestSuite) TestEnumerationProtectionHidesTakenEmails() {
+	sender := make(channelSender, 1)
+	suite.svc.Mailer = sender
+	suite.svc.Config.EnumerationProtection = true
+	suite.repo.
+		On("FindUserByEmail", "ana@example.com").
+		Return(&UserEntity{ID: targetID, Email: "ana@example.com"}, nil)
+
+	code := suite.register(
+		`{"firstName":"Eve","lastName":"Doe","email":"ana@example.com","password":"Correct-Horse-42"}`,
+	)
+
+	suite.Equal(http.StatusAccepted, code)
+	select {
+	case msg := <-sender:
+		suite.Equal("ana@example.com", msg.To)
+		suite.Equal("You already have an account", msg.Subject)
+		suite.Contains(msg.Body, "https://app.example.com/forgot-password")
+	case <-time.After(time.Second):
+		suite.Fail("no registration notice sent")
+	}
+	suite.repo.AssertNotCalled(suite.T(), "InsertUser", mock.Anything)
+}
+
+func (suite *VerificationTestSuite) TestEnumerationProtectionAnswersNewEmailsAlike() {
+	sender := make(channelSender, 1)
+	suite.svc.Mailer = sender
+	suite.svc.Config.EnumerationProtection = true
+	suite.repo.
+		On("FindUserByEmail", "ana@example.com").
+		Return((*UserEntity)(nil), sql.ErrNoRows)
+	suite.repo.
+		On("InsertUser", mock.AnythingOfType("*user.UserEntity")).
+		Return(&UserEntity{ID: targetID, Email: "ana@example.com"}, nil)
+	suite.repo.
+		On("CreateUserToken", mock.AnythingOfType("*user.UserToken"), time.Hour).
+		Return(nil)
+
+	code := suite.register(
+		`{"firstName":"Ana","lastName":"Lima","email":"ana@example.com","password":"Correct-Horse-42"}`,
+	)
+
+	suite.Equal(http.StatusAccepted, code)
+	select {
+	case msg := <-sender:
+		suite.Equal("Verify your email address", msg.Subject)
+	case <-time.After(time.Second):
+		suite.Fail("no verification email sent")
+	}
+}
+
+func (suite *VerificationTestSuite) TestPasswordPolicyIsCheckedBeforeTakenEmails() {
+	suite.svc.Config.EnumerationProtection = true
+
+	code := suite.register(
+		`{"firstName":"Eve","lastName":"Doe","email":"ana@example.com","password":"short"}`,
+	)
+
+	suite.Equal(http.StatusUnprocessableEntity, code)
+	suite.repo.AssertNotCalled(suite.T(), "FindUserByEmail", mock.Anything)
+}
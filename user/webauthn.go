@@ -0,0 +1,749 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/diegodario88/sesamo/audit"
+	"github.com/diegodario88/sesamo/config"
+	"github.com/diegodario88/sesamo/httphelper"
+	"github.com/diegodario88/sesamo/logging"
+	"github.com/diegodario88/sesamo/metrics"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gorilla/mux"
+)
+
+// Purposes of WebAuthn ceremonies. A ceremony started for one purpose only
+// finishes for the same purpose.
+const (
+	ceremonyPurposeRegistration = "webauthn_registration"
+	ceremonyPurposeLogin        = "webauthn_login"
+	ceremonyPurposeMFA          = "webauthn_mfa"
+)
+
+// Second factors a user may complete a password login with.
+const (
+	MFAMethodTOTP    = "totp"
+	MFAMethodPasskey = "passkey"
+)
+
+var ErrInvalidCeremony = errors.New("invalid or expired passkey ceremony")
+var ErrPasskeyFailed = errors.New("passkey verification failed")
+
+var userHandlePattern = regexp.MustCompile("^" + ulidPattern + "$")
+
+// WebAuthnCredential is a passkey of a user: the public key the relying
+// party checks assertions with and the signature counter of its
+// authenticator.
+type WebAuthnCredential struct {
+	ID              string     `db:"id"               json:"id"`
+	UserID          string     `db:"user_id"          json:"-"`
+	Name            string     `db:"name"             json:"name"`
+	CredentialID    []byte     `db:"credential_id"    json:"-"`
+	PublicKey       []byte     `db:"public_key"       json:"-"`
+	AttestationType string     `db:"attestation_type" json:"-"`
+	Transports      string     `db:"transports"       json:"-"`
+	AAGUID          []byte     `db:"aaguid"           json:"-"`
+	Flags           int16      `db:"flags"            json:"-"`
+	SignCount       int64      `db:"sign_count"       json:"-"`
+	LastUsedAt      *time.Time `db:"last_used_at"     json:"last_used_at"`
+	CreatedAt       time.Time  `db:"created_at"       json:"created_at"`
+}
+
+// WebAuthnSession keeps the state of a ceremony between its options and
+// finish requests. UserID is nil for passkey logins, where the user is only
+// known once the authenticator answers.
+type WebAuthnSession struct {
+	ID        string    `db:"id"`
+	UserID    *string   `db:"user_id"`
+	Purpose   string    `db:"purpose"`
+	TokenHash string    `db:"token_hash"`
+	Data      string    `db:"data"`
+	ExpiresAt time.Time `db:"expires_at"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type PasskeyRegistrationPayload struct {
+	Session    string          `json:"session"    validate:"required"`
+	Name       string          `json:"name"       validate:"required,max=64"`
+	Credential json.RawMessage `json:"credential" validate:"required"`
+}
+
+type PasskeyLoginPayload struct {
+	Session    string          `json:"session"    validate:"required"`
+	Credential json.RawMessage `json:"credential" validate:"required"`
+}
+
+type PasskeyMFAOptionsPayload struct {
+	MFAToken string `json:"mfaToken" validate:"required"`
+}
+
+// NewWebAuthn configures the relying party passkeys are bound to, defaulting
+// to the host and origin of APP_URL.
+func NewWebAuthn(cfg *config.Config) (*webauthn.WebAuthn, error) {
+	appURL, err := url.Parse(cfg.AppUrl)
+	if err != nil {
+		return nil, fmt.Errorf("NewWebAuthn: %w", err)
+	}
+
+	rpID := cfg.WebauthnRPID
+	if rpID == "" {
+		rpID = appURL.Hostname()
+	}
+
+	origins := cfg.WebauthnOrigins
+	if len(origins) == 0 {
+		origins = []string{appURL.Scheme + "://" + appURL.Host}
+	}
+
+	timeout := webauthn.TimeoutConfig{
+		Enforce:    true,
+		Timeout:    cfg.WebauthnTimeout,
+		TimeoutUVD: cfg.WebauthnTimeout,
+	}
+	residentKey := true
+
+	relyingParty, err := webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: cfg.MfaIssuer,
+		RPOrigins:     origins,
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			RequireResidentKey: &residentKey,
+			ResidentKey:        protocol.ResidentKeyRequirementRequired,
+			UserVerification:   protocol.VerificationRequired,
+		},
+		Timeouts: webauthn.TimeoutsConfig{Login: timeout, Registration: timeout},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("NewWebAuthn: %w", err)
+	}
+
+	return relyingParty, nil
+}
+
+// passkeyUser adapts a user and their passkeys to webauthn.User. The user
+// handle is the user ID, which carries no personal data.
+type passkeyUser struct {
+	*UserEntity
+	passkeys []WebAuthnCredential
+}
+
+func (user *passkeyUser) WebAuthnID() []byte {
+	return []byte(user.ID)
+}
+
+func (user *passkeyUser) WebAuthnName() string {
+	return user.Email
+}
+
+func (user *passkeyUser) WebAuthnDisplayName() string {
+	if name := strings.TrimSpace(user.FirstName + " " + user.LastName); name != "" {
+		return name
+	}
+
+	return user.Email
+}
+
+func (user *passkeyUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, len(user.passkeys))
+	for i, passkey := range user.passkeys {
+		credentials[i] = passkey.credential()
+	}
+
+	return credentials
+}
+
+func (passkey *WebAuthnCredential) credential() webauthn.Credential {
+	var transports []protocol.AuthenticatorTransport
+	for _, transport := range strings.Split(passkey.Transports, ",") {
+		if transport != "" {
+			transports = append(transports, protocol.AuthenticatorTransport(transport))
+		}
+	}
+
+	return webauthn.Credential{
+		ID:              passkey.CredentialID,
+		PublicKey:       passkey.PublicKey,
+		AttestationType: passkey.AttestationType,
+		Transport:       transports,
+		Flags:           webauthn.NewCredentialFlags(protocol.AuthenticatorFlags(passkey.Flags)),
+		Authenticator: webauthn.Authenticator{
+			AAGUID:    passkey.AAGUID,
+			SignCount: uint32(passkey.SignCount),
+		},
+	}
+}
+
+func newWebAuthnCredential(
+	userID string,
+	name string,
+	credential *webauthn.Credential,
+) *WebAuthnCredential {
+	transports := make([]string, len(credential.Transport))
+	for i, transport := range credential.Transport {
+		transports[i] = string(transport)
+	}
+
+	return &WebAuthnCredential{
+		UserID:          userID,
+		Name:            name,
+		CredentialID:    credential.ID,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		Transports:      strings.Join(transports, ","),
+		AAGUID:          credential.Authenticator.AAGUID,
+		Flags:           int16(credential.Flags.ProtocolValue()),
+		SignCount:       int64(credential.Authenticator.SignCount),
+	}
+}
+
+// BeginPasskeyRegistration starts registering a passkey for the caller, who
+// must have signed in within REAUTH_WINDOW. The response carries the options
+// for navigator.credentials.create and the session to finish with.
+func (svc *UserService) BeginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	authTime, _ := ctx.Value(AuthTimeKey).(time.Time)
+	if time.Since(authTime) > svc.Config.ReauthWindow {
+		httphelper.WriteProblem(w, httphelper.NewProblem(
+			http.StatusForbidden,
+			"reauthentication_required",
+			"sign in again to add a passkey",
+		))
+		return
+	}
+
+	user, err := svc.Repo.FindUserById(ctx, ctx.Value(UserIDKey).(string))
+	if err != nil {
+		writeLookupError(w, r, err, "user not found")
+		return
+	}
+
+	passkeys, err := svc.Repo.FindWebAuthnCredentials(ctx, user.ID)
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	owner := &passkeyUser{user, passkeys}
+	options, session, err := svc.WebAuthn.BeginRegistration(
+		owner,
+		webauthn.WithExclusions(
+			webauthn.Credentials(owner.WebAuthnCredentials()).CredentialDescriptors(),
+		),
+	)
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	svc.writeCeremony(w, r, &user.ID, ceremonyPurposeRegistration, session, options)
+}
+
+// FinishPasskeyRegistration stores the passkey created by the caller's
+// authenticator. The response carries a fresh token, since the passkey may
+// satisfy an MFA requirement.
+func (svc *UserService) FinishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var payload PasskeyRegistrationPayload
+	if err := httphelper.ParseJSON(r, &payload); err != nil {
+		httphelper.WriteProblem(w, httphelper.BadRequest(err.Error()))
+		return
+	}
+
+	if err := httphelper.Validate.Struct(payload); err != nil {
+		httphelper.WriteProblem(w, httphelper.ValidationFailed(err))
+		return
+	}
+
+	user, err := svc.Repo.FindUserById(ctx, ctx.Value(UserIDKey).(string))
+	if err != nil {
+		writeLookupError(w, r, err, "user not found")
+		return
+	}
+
+	session, err := svc.consumeCeremony(ctx, ceremonyPurposeRegistration, payload.Session)
+	if err == nil && (session.UserID == nil || *session.UserID != user.ID) {
+		err = ErrInvalidCeremony
+	}
+	if err != nil {
+		writePasskeyError(w, r, err)
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(payload.Credential)
+	if err != nil {
+		writePasskeyError(w, r, fmt.Errorf("%w: %w", ErrPasskeyFailed, err))
+		return
+	}
+
+	created, err := svc.WebAuthn.CreateCredential(&passkeyUser{UserEntity: user}, session.data, parsed)
+	if err != nil {
+		writePasskeyError(w, r, fmt.Errorf("%w: %w", ErrPasskeyFailed, err))
+		return
+	}
+
+	passkey, err := svc.Repo.InsertWebAuthnCredential(
+		ctx,
+		newWebAuthnCredential(user.ID, payload.Name, created),
+	)
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	svc.record(ctx, audit.Event{
+		Action:  audit.ActionPasskeyAdded,
+		ActorID: &user.ID,
+		UserID:  &user.ID,
+		Details: map[string]any{"passkey_id": passkey.ID, "name": passkey.Name},
+	})
+
+	authTime, _ := ctx.Value(AuthTimeKey).(time.Time)
+	token, err := svc.generateToken(ctx, user, authTime)
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	httphelper.WriteJSON(w, http.StatusCreated, map[string]any{
+		"passkey": passkey,
+		"token":   token,
+	})
+}
+
+// GetPasskeys lists the passkeys of the caller.
+func (svc *UserService) GetPasskeys(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	passkeys, err := svc.Repo.FindWebAuthnCredentials(ctx, ctx.Value(UserIDKey).(string))
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	httphelper.WriteJSON(w, http.StatusOK, passkeys)
+}
+
+// DeletePasskey removes a passkey of the caller. The last second factor of a
+// user whose roles require MFA cannot be removed.
+func (svc *UserService) DeletePasskey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	passkeyID := mux.Vars(r)["passkeyId"]
+
+	user, err := svc.Repo.FindUserById(ctx, ctx.Value(UserIDKey).(string))
+	if err != nil {
+		writeLookupError(w, r, err, "user not found")
+		return
+	}
+
+	passkeys, err := svc.Repo.FindWebAuthnCredentials(ctx, user.ID)
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	if !user.TOTPEnabled() && len(passkeys) == 1 && passkeys[0].ID == passkeyID {
+		if !svc.canDropMFA(w, r, user) {
+			return
+		}
+	}
+
+	if err := svc.Repo.DeleteWebAuthnCredential(ctx, user.ID, passkeyID); err != nil {
+		writeLookupError(w, r, err, "passkey not found")
+		return
+	}
+
+	svc.record(ctx, audit.Event{
+		Action:  audit.ActionPasskeyRemoved,
+		ActorID: &user.ID,
+		UserID:  &user.ID,
+		Details: map[string]any{"passkey_id": passkeyID},
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// BeginPasskeyLogin starts a passwordless login. No user is named: the
+// authenticator offers the passkeys it holds for sesamo, so the options tell
+// nothing about which accounts exist.
+func (svc *UserService) BeginPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	options, session, err := svc.WebAuthn.BeginDiscoverableLogin(
+		webauthn.WithUserVerification(protocol.VerificationRequired),
+	)
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	svc.writeCeremony(w, r, nil, ceremonyPurposeLogin, session, options)
+}
+
+// FinishPasskeyLogin signs in the owner of the passkey that answered
+// BeginPasskeyLogin. A passkey proves both possession and, through user
+// verification, a PIN or biometric, so no second factor is asked for.
+func (svc *UserService) FinishPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.FromContext(ctx)
+
+	var payload PasskeyLoginPayload
+	if err := httphelper.ParseJSON(r, &payload); err != nil {
+		metrics.LoginAttempts.WithLabelValues("passkey", metrics.OutcomeInvalidPayload).Inc()
+		httphelper.WriteProblem(w, httphelper.BadRequest(err.Error()))
+		return
+	}
+
+	if err := httphelper.Validate.Struct(payload); err != nil {
+		metrics.LoginAttempts.WithLabelValues("passkey", metrics.OutcomeInvalidPayload).Inc()
+		httphelper.WriteProblem(w, httphelper.ValidationFailed(err))
+		return
+	}
+
+	ip := svc.clientIP(r)
+	user, err := svc.authenticatePasskey(ctx, payload, ip)
+	if err != nil {
+		logger.Info("Passkey login failed", "reason", err, "ip", ip)
+		metrics.LoginAttempts.WithLabelValues("passkey", loginOutcome(err)).Inc()
+		if errors.Is(err, ErrPasskeyFailed) || errors.Is(err, ErrInvalidCeremony) {
+			svc.failClientLogin(ctx, ip)
+		}
+		writePasskeyError(w, r, err)
+		return
+	}
+
+	token, err := svc.GenerateUserToken(ctx, user)
+	if err != nil {
+		metrics.LoginAttempts.WithLabelValues("passkey", metrics.OutcomeError).Inc()
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	metrics.LoginAttempts.WithLabelValues("passkey", metrics.OutcomeSuccess).Inc()
+	httphelper.WriteJSON(w, http.StatusOK, map[string]string{"token": token})
+}
+
+// BeginPasskeyMFA starts the passkey ceremony completing a password login,
+// for the user named by the MFA challenge token.
+func (svc *UserService) BeginPasskeyMFA(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var payload PasskeyMFAOptionsPayload
+	if err := httphelper.ParseJSON(r, &payload); err != nil {
+		httphelper.WriteProblem(w, httphelper.BadRequest(err.Error()))
+		return
+	}
+
+	if err := httphelper.Validate.Struct(payload); err != nil {
+		httphelper.WriteProblem(w, httphelper.ValidationFailed(err))
+		return
+	}
+
+	userID, _, _, err := svc.parseMFAChallenge(payload.MFAToken)
+	if err != nil {
+		writeInvalidMFAChallenge(w)
+		return
+	}
+
+	user, err := svc.Repo.FindUserById(ctx, userID)
+	if err != nil {
+		writeLookupError(w, r, err, "user not found")
+		return
+	}
+
+	passkeys, err := svc.Repo.FindWebAuthnCredentials(ctx, user.ID)
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	if len(passkeys) == 0 {
+		writeInvalidMFAChallenge(w)
+		return
+	}
+
+	options, session, err := svc.WebAuthn.BeginLogin(&passkeyUser{user, passkeys})
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	svc.writeCeremony(w, r, &user.ID, ceremonyPurposeMFA, session, options)
+}
+
+// authenticatePasskey checks the answer to a passwordless login from ip and
+// returns the owner of the passkey.
+func (svc *UserService) authenticatePasskey(
+	ctx context.Context,
+	payload PasskeyLoginPayload,
+	ip string,
+) (*UserEntity, error) {
+	if err := svc.checkClientThrottle(ip); err != nil {
+		return nil, err
+	}
+
+	session, err := svc.consumeCeremony(ctx, ceremonyPurposeLogin, payload.Session)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(payload.Credential)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrPasskeyFailed, err)
+	}
+
+	var owner *passkeyUser
+	findOwner := func(rawID, userHandle []byte) (webauthn.User, error) {
+		if !userHandlePattern.Match(userHandle) {
+			return nil, errors.New("malformed user handle")
+		}
+
+		user, err := svc.Repo.FindUserById(ctx, string(userHandle))
+		if err != nil {
+			return nil, err
+		}
+
+		passkeys, err := svc.Repo.FindWebAuthnCredentials(ctx, user.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		owner = &passkeyUser{user, passkeys}
+		return owner, nil
+	}
+
+	_, used, err := svc.WebAuthn.ValidatePasskeyLogin(findOwner, session.data, parsed)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrPasskeyFailed, err)
+	}
+
+	if err := svc.checkCanSignIn(owner.UserEntity); err != nil {
+		return nil, err
+	}
+
+	if err := svc.usePasskey(ctx, owner, used); err != nil {
+		return nil, err
+	}
+
+	svc.clearAccountLogins(ctx, owner.Email)
+
+	return owner.UserEntity, nil
+}
+
+// checkPasskey accepts the answer of a passkey of user to the ceremony
+// started by BeginPasskeyMFA.
+func (svc *UserService) checkPasskey(
+	ctx context.Context,
+	user *UserEntity,
+	sessionSecret string,
+	credential json.RawMessage,
+) error {
+	session, err := svc.consumeCeremony(ctx, ceremonyPurposeMFA, sessionSecret)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrPasskeyFailed, err)
+	}
+
+	if session.UserID == nil || *session.UserID != user.ID {
+		return fmt.Errorf("%w: %w", ErrPasskeyFailed, ErrInvalidCeremony)
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(credential)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrPasskeyFailed, err)
+	}
+
+	passkeys, err := svc.Repo.FindWebAuthnCredentials(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+
+	owner := &passkeyUser{user, passkeys}
+	used, err := svc.WebAuthn.ValidateLogin(owner, session.data, parsed)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrPasskeyFailed, err)
+	}
+
+	return svc.usePasskey(ctx, owner, used)
+}
+
+// usePasskey records the new signature counter of a passkey that signed in.
+// A counter that did not move forward hints at a cloned authenticator, so the
+// login is refused.
+func (svc *UserService) usePasskey(
+	ctx context.Context,
+	owner *passkeyUser,
+	used *webauthn.Credential,
+) error {
+	var passkey *WebAuthnCredential
+	for i := range owner.passkeys {
+		if string(owner.passkeys[i].CredentialID) == string(used.ID) {
+			passkey = &owner.passkeys[i]
+		}
+	}
+
+	if passkey == nil {
+		return fmt.Errorf("%w: unknown credential", ErrPasskeyFailed)
+	}
+
+	if used.Authenticator.CloneWarning {
+		svc.record(ctx, audit.Event{
+			Action:  audit.ActionPasskeyCloned,
+			UserID:  &owner.ID,
+			Details: map[string]any{"passkey_id": passkey.ID},
+		})
+		return fmt.Errorf("%w: signature counter went back", ErrPasskeyFailed)
+	}
+
+	return svc.Repo.UpdateWebAuthnCredentialUse(
+		ctx,
+		passkey.ID,
+		int64(used.Authenticator.SignCount),
+		int16(used.Flags.ProtocolValue()),
+	)
+}
+
+// mfaMethods lists the second factors user has set up.
+func (svc *UserService) mfaMethods(ctx context.Context, user *UserEntity) ([]string, error) {
+	var methods []string
+	if user.TOTPEnabled() {
+		methods = append(methods, MFAMethodTOTP)
+	}
+
+	passkeys, err := svc.Repo.FindWebAuthnCredentials(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(passkeys) > 0 {
+		methods = append(methods, MFAMethodPasskey)
+	}
+
+	return methods, nil
+}
+
+// canDropMFA answers for the request when user is about to lose their last
+// second factor while their roles require one.
+func (svc *UserService) canDropMFA(w http.ResponseWriter, r *http.Request, user *UserEntity) bool {
+	required, err := svc.Repo.RequiresMFA(r.Context(), user.ID)
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return false
+	}
+
+	if required {
+		httphelper.WriteProblem(w, httphelper.NewProblem(
+			http.StatusForbidden,
+			"mfa_required",
+			"your roles require multi-factor authentication",
+		))
+		return false
+	}
+
+	return true
+}
+
+// ceremony is a WebAuthn session read back for its finish request.
+type ceremony struct {
+	*WebAuthnSession
+	data webauthn.SessionData
+}
+
+// writeCeremony stores session and answers with the options for the browser
+// along with the secret naming the session, which the finish request sends
+// back.
+func (svc *UserService) writeCeremony(
+	w http.ResponseWriter,
+	r *http.Request,
+	userID *string,
+	purpose string,
+	session *webauthn.SessionData,
+	options any,
+) {
+	secret, hash, err := newToken([]byte(svc.Config.JwtSecret), purpose)
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	data, err := json.Marshal(session)
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	stored := &WebAuthnSession{UserID: userID, Purpose: purpose, TokenHash: hash, Data: string(data)}
+	err = svc.Repo.CreateWebAuthnSession(r.Context(), stored, svc.Config.WebauthnTimeout)
+	if err != nil {
+		httphelper.WriteInternalError(w, r, err)
+		return
+	}
+
+	httphelper.WriteJSON(w, http.StatusOK, map[string]any{
+		"session": secret,
+		"options": options,
+	})
+}
+
+// consumeCeremony reads back the session named by secret, which can only be
+// finished once.
+func (svc *UserService) consumeCeremony(
+	ctx context.Context,
+	purpose string,
+	secret string,
+) (*ceremony, error) {
+	if !verifyToken([]byte(svc.Config.JwtSecret), purpose, secret) {
+		return nil, ErrInvalidCeremony
+	}
+
+	stored, err := svc.Repo.ConsumeWebAuthnSession(ctx, purpose, hashToken(secret))
+	if errors.Is(err, ErrInvalidToken) {
+		return nil, ErrInvalidCeremony
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	found := &ceremony{WebAuthnSession: stored}
+	if err := json.Unmarshal([]byte(stored.Data), &found.data); err != nil {
+		return nil, fmt.Errorf("consumeCeremony: %w", err)
+	}
+
+	return found, nil
+}
+
+// writePasskeyError answers a failed passkey ceremony.
+func writePasskeyError(w http.ResponseWriter, r *http.Request, err error) {
+	var throttled *ThrottledError
+	switch {
+	case errors.As(err, &throttled):
+		httphelper.WriteTooManyRequests(
+			w,
+			"too many failed logins, try again later",
+			throttled.RetryAfter,
+		)
+	case errors.Is(err, ErrInvalidCeremony):
+		httphelper.WriteProblem(w, httphelper.NewProblem(
+			http.StatusBadRequest,
+			"invalid_passkey_session",
+			ErrInvalidCeremony.Error(),
+		))
+	case errors.Is(err, ErrPasskeyFailed):
+		httphelper.WriteProblem(w, httphelper.NewProblem(
+			http.StatusUnauthorized,
+			"invalid_passkey",
+			ErrPasskeyFailed.Error(),
+		))
+	case accountInactive(err) != nil:
+		httphelper.WriteProblem(w, accountInactive(err))
+	default:
+		httphelper.WriteInternalError(w, r, err)
+	}
+}
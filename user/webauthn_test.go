@@ -0,0 +1,425 @@
+package user
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diegodario88/sesamo/audit"
+	"github.com/diegodario88/sesamo/config"
+	"github.com/diegodario88/sesamo/password"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+const testOrigin = "https://app.sesamo.test"
+
+// softAuthenticator is a passkey held in memory, answering ceremonies the
+// way a platform authenticator does, with "none" attestation.
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	origin       string
+	counter      uint32
+}
+
+func newSoftAuthenticator(userID string) (*softAuthenticator, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	credentialID := make([]byte, 16)
+	if _, err := rand.Read(credentialID); err != nil {
+		return nil, err
+	}
+
+	return &softAuthenticator{
+		key:          key,
+		credentialID: credentialID,
+		userHandle:   []byte(userID),
+		origin:       testOrigin,
+	}, nil
+}
+
+func (a *softAuthenticator) clientData(kind string, challenge []byte) []byte {
+	data, _ := json.Marshal(map[string]string{
+		"type":      kind,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    a.origin,
+	})
+	return data
+}
+
+// authenticatorData flags user presence and verification, plus attested
+// credential data when attested is set.
+func (a *softAuthenticator) authenticatorData(rpID string, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	flags := byte(protocol.FlagUserPresent | protocol.FlagUserVerified)
+	if attested != nil {
+		flags |= byte(protocol.FlagAttestedCredentialData)
+	}
+
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.counter)
+	return append(data, attested...)
+}
+
+func (a *softAuthenticator) create(options protocol.PublicKeyCredentialCreationOptions) []byte {
+	ecdhKey, _ := a.key.PublicKey.ECDH()
+	point := ecdhKey.Bytes()
+	publicKey, _ := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  1,
+		XCoord: point[1:33],
+		YCoord: point[33:],
+	})
+
+	attested := make([]byte, 16)
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credentialID)))
+	attested = append(attested, a.credentialID...)
+	attested = append(attested, publicKey...)
+
+	attestationObject, _ := webauthncbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authenticatorData(options.RelyingParty.ID, attested),
+	})
+
+	response, _ := json.Marshal(map[string]any{
+		"id":    base64.RawURLEncoding.EncodeToString(a.credentialID),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"attestationObject": base64.RawURLEncoding.EncodeToString(attestationObject),
+			"clientDataJSON": base64.RawURLEncoding.EncodeToString(
+				a.clientData("webauthn.create", options.Challenge),
+			),
+		},
+	})
+	return response
+}
+
+func (a *softAuthenticator) get(options protocol.PublicKeyCredentialRequestOptions) []byte {
+	a.counter++
+	authenticatorData := a.authenticatorData(options.RelyingPartyID, nil)
+	clientData := a.clientData("webauthn.get", options.Challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authenticatorData, clientDataHash[:]...))
+	signature, _ := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+
+	response, _ := json.Marshal(map[string]any{
+		"id":    base64.RawURLEncoding.EncodeToString(a.credentialID),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"authenticatorData": base64.RawURLEncoding.EncodeToString(authenticatorData),
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+			"signature":         base64.RawURLEncoding.EncodeToString(signature),
+			"userHandle":        base64.RawURLEncoding.EncodeToString(a.userHandle),
+		},
+	})
+	return response
+}
+
+type WebAuthnTestSuite struct {
+	suite.Suite
+	repo          *MockUserRepository
+	audit         *recordingAudit
+	svc           UserService
+	user          *UserEntity
+	authenticator *softAuthenticator
+}
+
+func TestWebAuthnTestSuite(t *testing.T) {
+	suite.Run(t, new(WebAuthnTestSuite))
+}
+
+func (suite *WebAuthnTestSuite) SetupTest() {
+	cfg := &config.Config{
+		JwtSecret:              "0123456789abcdef",
+		JwtExpirationInSeconds: 3600,
+		AppUrl:                 testOrigin,
+		MfaIssuer:              "Sesamo",
+		MfaChallengeTTL:        5 * time.Minute,
+		ReauthWindow:           5 * time.Minute,
+		WebauthnTimeout:        5 * time.Minute,
+	}
+	relyingParty, err := NewWebAuthn(cfg)
+	suite.Require().NoError(err)
+
+	suite.repo = new(MockUserRepository)
+	suite.audit = &recordingAudit{}
+	suite.svc = UserService{Repo: suite.repo, Config: cfg, Audit: suite.audit, WebAuthn: relyingParty}
+	suite.user = &UserEntity{
+		ID:        targetID,
+		Email:     "ana@example.com",
+		FirstName: "Ana",
+		Status:    StatusActive,
+	}
+	suite.authenticator, err = newSoftAuthenticator(targetID)
+	suite.Require().NoError(err)
+}
+
+func (suite *WebAuthnTestSuite) post(
+	ctx context.Context,
+	handler http.HandlerFunc,
+	body string,
+) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	request.RemoteAddr = testIP + ":40000"
+	recorder := httptest.NewRecorder()
+
+	handler(recorder, request.WithContext(ctx))
+
+	return recorder
+}
+
+func (suite *WebAuthnTestSuite) signedIn() context.Context {
+	ctx := context.WithValue(context.Background(), UserIDKey, suite.user.ID)
+	return context.WithValue(ctx, AuthTimeKey, time.Now())
+}
+
+// begin calls an options endpoint, decodes its options into options and
+// makes the stored session available to the finish request.
+func (suite *WebAuthnTestSuite) begin(
+	ctx context.Context,
+	handler http.HandlerFunc,
+	body string,
+	options any,
+) string {
+	var stored *WebAuthnSession
+	suite.repo.
+		On("CreateWebAuthnSession", mock.Anything, 5*time.Minute).
+		Run(func(args mock.Arguments) { stored = args.Get(0).(*WebAuthnSession) }).
+		Return(nil).
+		Once()
+
+	recorder := suite.post(ctx, handler, body)
+	suite.Require().Equal(http.StatusOK, recorder.Code, recorder.Body.String())
+
+	var response struct {
+		Session string          `json:"session"`
+		Options json.RawMessage `json:"options"`
+	}
+	suite.Require().NoError(json.Unmarshal(recorder.Body.Bytes(), &response))
+	suite.Require().NoError(json.Unmarshal(response.Options, options))
+	suite.Equal(hashToken(response.Session), stored.TokenHash)
+
+	suite.repo.
+		On("ConsumeWebAuthnSession", stored.Purpose, stored.TokenHash).
+		Return(stored, nil).
+		Once()
+	return response.Session
+}
+
+// register runs the registration ceremony and returns the stored passkey.
+func (suite *WebAuthnTestSuite) register() *WebAuthnCredential {
+	suite.repo.On("FindUserById", suite.user.ID).Return(suite.user, nil).Twice()
+	suite.repo.On("FindWebAuthnCredentials", suite.user.ID).Return([]WebAuthnCredential{}, nil).Once()
+
+	var creation protocol.CredentialCreation
+	session := suite.begin(suite.signedIn(), suite.svc.BeginPasskeyRegistration, "", &creation)
+
+	passkey := &WebAuthnCredential{}
+	suite.repo.
+		On("InsertWebAuthnCredential", mock.Anything).
+		Run(func(args mock.Arguments) {
+			*passkey = *args.Get(0).(*WebAuthnCredential)
+			passkey.ID = "01JQ0000000000000000000009"
+		}).
+		Return(passkey, nil).
+		Once()
+	suite.repo.On("GetRoles", suite.user.ID).Return([]string{}, nil).Once()
+	suite.repo.On("RequiresMFA", suite.user.ID).Return(false, nil).Once()
+
+	body, _ := json.Marshal(map[string]any{
+		"session":    session,
+		"name":       "Laptop",
+		"credential": json.RawMessage(suite.authenticator.create(creation.Response)),
+	})
+	recorder := suite.post(suite.signedIn(), suite.svc.FinishPasskeyRegistration, string(body))
+	suite.Require().Equal(http.StatusCreated, recorder.Code, recorder.Body.String())
+	return passkey
+}
+
+func (suite *WebAuthnTestSuite) TestRegisterThenSignInWithoutPassword() {
+	passkey := suite.register()
+	suite.Equal(suite.authenticator.credentialID, passkey.CredentialID)
+	suite.Equal("Laptop", passkey.Name)
+
+	var assertion protocol.CredentialAssertion
+	session := suite.begin(context.Background(), suite.svc.BeginPasskeyLogin, "", &assertion)
+	suite.Empty(assertion.Response.AllowedCredentials)
+
+	suite.repo.On("FindUserById", suite.user.ID).Return(suite.user, nil).Once()
+	suite.repo.
+		On("FindWebAuthnCredentials", suite.user.ID).
+		Return([]WebAuthnCredential{*passkey}, nil)
+	suite.repo.
+		On("UpdateWebAuthnCredentialUse", passkey.ID, int64(1), passkey.Flags).
+		Return(nil).
+		Once()
+	suite.repo.On("GetRoles", suite.user.ID).Return([]string{}, nil).Once()
+	suite.repo.On("RequiresMFA", suite.user.ID).Return(false, nil).Once()
+
+	body, _ := json.Marshal(map[string]any{
+		"session":    session,
+		"credential": json.RawMessage(suite.authenticator.get(assertion.Response)),
+	})
+	recorder := suite.post(context.Background(), suite.svc.FinishPasskeyLogin, string(body))
+
+	suite.Equal(http.StatusOK, recorder.Code, recorder.Body.String())
+	suite.Contains(recorder.Body.String(), `"token"`)
+	suite.repo.AssertExpectations(suite.T())
+}
+
+func (suite *WebAuthnTestSuite) TestPasskeyCompletesPasswordLogin() {
+	passkey := suite.register()
+	hash, err := password.Hash("Correct-Horse-42", password.DefaultParams)
+	suite.Require().NoError(err)
+	suite.user.PasswordHash = &hash
+
+	suite.repo.On("FindUserByEmail", suite.user.Email).Return(suite.user, nil).Once()
+	suite.repo.
+		On("FindWebAuthnCredentials", suite.user.ID).
+		Return([]WebAuthnCredential{*passkey}, nil)
+	recorder := suite.post(
+		context.Background(),
+		suite.svc.Login,
+		`{"email":"ana@example.com","password":"Correct-Horse-42"}`,
+	)
+	suite.Require().Equal(http.StatusOK, recorder.Code)
+	var challenge struct {
+		MFAToken   string   `json:"mfa_token"`
+		MFAMethods []string `json:"mfa_methods"`
+	}
+	suite.Require().NoError(json.Unmarshal(recorder.Body.Bytes(), &challenge))
+	suite.Equal([]string{MFAMethodPasskey}, challenge.MFAMethods)
+
+	suite.repo.On("FindUserById", suite.user.ID).Return(suite.user, nil).Twice()
+	var assertion protocol.CredentialAssertion
+	session := suite.begin(
+		context.Background(),
+		suite.svc.BeginPasskeyMFA,
+		`{"mfaToken":"`+challenge.MFAToken+`"}`,
+		&assertion,
+	)
+	suite.Len(assertion.Response.AllowedCredentials, 1)
+
+	suite.repo.
+		On("UpdateWebAuthnCredentialUse", passkey.ID, int64(1), passkey.Flags).
+		Return(nil).
+		Once()
+	suite.repo.On("GetRoles", suite.user.ID).Return([]string{}, nil).Once()
+	suite.repo.On("RequiresMFA", suite.user.ID).Return(false, nil).Once()
+
+	body, _ := json.Marshal(map[string]any{
+		"mfaToken":   challenge.MFAToken,
+		"session":    session,
+		"credential": json.RawMessage(suite.authenticator.get(assertion.Response)),
+	})
+	recorder = suite.post(context.Background(), suite.svc.LoginMFA, string(body))
+
+	suite.Equal(http.StatusOK, recorder.Code, recorder.Body.String())
+	suite.Contains(recorder.Body.String(), `"token"`)
+}
+
+func (suite *WebAuthnTestSuite) TestAssertionForAnotherOriginIsRejected() {
+	passkey := suite.register()
+	suite.authenticator.origin = "https://evil.example"
+
+	var assertion protocol.CredentialAssertion
+	session := suite.begin(context.Background(), suite.svc.BeginPasskeyLogin, "", &assertion)
+	suite.repo.On("FindUserById", suite.user.ID).Return(suite.user, nil).Once()
+	suite.repo.
+		On("FindWebAuthnCredentials", suite.user.ID).
+		Return([]WebAuthnCredential{*passkey}, nil)
+
+	body, _ := json.Marshal(map[string]any{
+		"session":    session,
+		"credential": json.RawMessage(suite.authenticator.get(assertion.Response)),
+	})
+	recorder := suite.post(context.Background(), suite.svc.FinishPasskeyLogin, string(body))
+
+	suite.Equal(http.StatusUnauthorized, recorder.Code)
+	suite.Contains(recorder.Body.String(), "invalid_passkey")
+	suite.repo.AssertNotCalled(
+		suite.T(),
+		"UpdateWebAuthnCredentialUse",
+		mock.Anything,
+		mock.Anything,
+		mock.Anything,
+	)
+}
+
+func (suite *WebAuthnTestSuite) TestClonedPasskeyIsRejected() {
+	passkey := suite.register()
+	passkey.SignCount = 10
+
+	var assertion protocol.CredentialAssertion
+	session := suite.begin(context.Background(), suite.svc.BeginPasskeyLogin, "", &assertion)
+	suite.repo.On("FindUserById", suite.user.ID).Return(suite.user, nil).Once()
+	suite.repo.
+		On("FindWebAuthnCredentials", suite.user.ID).
+		Return([]WebAuthnCredential{*passkey}, nil)
+
+	body, _ := json.Marshal(map[string]any{
+		"session":    session,
+		"credential": json.RawMessage(suite.authenticator.get(assertion.Response)),
+	})
+	recorder := suite.post(context.Background(), suite.svc.FinishPasskeyLogin, string(body))
+
+	suite.Equal(http.StatusUnauthorized, recorder.Code)
+	suite.Require().NotEmpty(suite.audit.events)
+	suite.Equal(audit.ActionPasskeyCloned, suite.audit.events[len(suite.audit.events)-1].Action)
+}
+
+func (suite *WebAuthnTestSuite) TestRegistrationNeedsRecentSignIn() {
+	ctx := context.WithValue(context.Background(), UserIDKey, suite.user.ID)
+	ctx = context.WithValue(ctx, AuthTimeKey, time.Now().Add(-time.Hour))
+
+	recorder := suite.post(ctx, suite.svc.BeginPasskeyRegistration, "")
+
+	suite.Equal(http.StatusForbidden, recorder.Code)
+	suite.Contains(recorder.Body.String(), "reauthentication_required")
+}
+
+func (suite *WebAuthnTestSuite) TestLastSecondFactorCannotBeRemovedWhenRequired() {
+	passkey := WebAuthnCredential{ID: "01JQ0000000000000000000009", UserID: suite.user.ID}
+	suite.repo.On("FindUserById", suite.user.ID).Return(suite.user, nil).Once()
+	suite.repo.
+		On("FindWebAuthnCredentials", suite.user.ID).
+		Return([]WebAuthnCredential{passkey}, nil).
+		Once()
+	suite.repo.On("RequiresMFA", suite.user.ID).Return(true, nil).Once()
+
+	request := httptest.NewRequest(http.MethodDelete, "/users/me/passkeys/"+passkey.ID, nil)
+	request = mux.SetURLVars(
+		request.WithContext(suite.signedIn()),
+		map[string]string{"passkeyId": passkey.ID},
+	)
+	recorder := httptest.NewRecorder()
+	suite.svc.DeletePasskey(recorder, request)
+
+	suite.Equal(http.StatusForbidden, recorder.Code)
+	suite.repo.AssertNotCalled(suite.T(), "DeleteWebAuthnCredential", mock.Anything, mock.Anything)
+}